@@ -0,0 +1,19 @@
+// Package exercises bundles the web assets of the bookstore: the templates
+// in views/ and the stylesheets in css/, and the example books in seeds/.
+// They are built into the server binary, so it runs from any working
+// directory.
+package exercises
+
+import "embed"
+
+// Assets holds views/*.html and css/, with paths relative to the
+// repository root, e.g. "views/index.html".
+//
+//go:embed views/*.html css
+var Assets embed.FS
+
+// Seeds holds seeds/books.json, the books an empty database is seeded with
+// unless SEED_FILE names others.
+//
+//go:embed seeds/books.json
+var Seeds embed.FS
@@ -0,0 +1,5 @@
+// Package bookpb holds the gRPC BookService and its messages, generated from
+// book.proto. Run go generate after changing the proto file.
+package bookpb
+
+//go:generate protoc -I .. --go_out=.. --go_opt=paths=source_relative --go-grpc_out=.. --go-grpc_opt=paths=source_relative bookpb/book.proto
@@ -0,0 +1,577 @@
+// Package client talks to the books API of the server in cmd, for other
+// services and for tests. It covers the books themselves: listing, paging
+// through, searching, importing, and exporting them, and creating,
+// replacing, and deleting one.
+// Requests take a context, and requests that failed on the way or were
+// answered with 429 or a 5xx status are retried, so a restarting server
+// does not fail every call.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The errors an *Error matches with errors.Is, by status code.
+var (
+	// The book does not exist, or is in the recycle bin (404).
+	ErrNotFound = errors.New("client: book not found")
+	// A book with the ID exists already, or the book changed since the
+	// version that was sent (409, or 412 for If-Match).
+	ErrConflict = errors.New("client: conflict")
+	// The book was refused by validation (422); Error.Fields says why.
+	ErrInvalid = errors.New("client: validation failed")
+)
+
+// Error is an error answer of the server.
+type Error struct {
+	StatusCode int
+	// The "error" of the answer, e.g. "Book not found with ID dracula".
+	Message string
+	// The reason for each field that failed validation.
+	Fields map[string]string
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("client: %d %s", e.StatusCode, e.Message)
+	if len(e.Fields) > 0 {
+		var fields []string
+		for field, reason := range e.Fields {
+			fields = append(fields, field+" "+reason)
+		}
+		sort.Strings(fields)
+		msg += " (" + strings.Join(fields, ", ") + ")"
+	}
+	return msg
+}
+
+func (e *Error) Is(target error) bool {
+	switch e.StatusCode {
+	case http.StatusNotFound:
+		return target == ErrNotFound
+	case http.StatusConflict, http.StatusPreconditionFailed:
+		return target == ErrConflict
+	case http.StatusUnprocessableEntity:
+		return target == ErrInvalid
+	}
+	return false
+}
+
+// Book is a book as the API reads and writes it. The fields after AuthorID
+// are maintained by the server and not sent when writing, except Version.
+type Book struct {
+	ID          string   `json:"id"`
+	Title       string   `json:"title"`
+	Author      string   `json:"author"`
+	Edition     string   `json:"edition,omitempty"`
+	Pages       int      `json:"pages,omitempty"`
+	Year        int      `json:"year,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	Series      string   `json:"series,omitempty"`
+	SeriesIndex int      `json:"series_index,omitempty"`
+	Publisher   string   `json:"publisher,omitempty"`
+	// A BCP 47 language tag like en or pt-BR.
+	Language    string `json:"language,omitempty"`
+	Description string `json:"description,omitempty"`
+	Price       *Price `json:"price,omitempty"`
+	// The author in /api/authors, if the book is linked to one.
+	AuthorID string `json:"author_id,omitempty"`
+
+	// Counted up on every change. Update sends it, so the server refuses
+	// the change with ErrConflict if somebody else changed the book since.
+	Version   int       `json:"version,omitempty"`
+	CreatedAt time.Time `json:"created_at,omitempty"`
+	UpdatedAt time.Time `json:"updated_at,omitempty"`
+	// Whether the book is on the shelf, and when it is due back if not.
+	// Filled in from the answers of the server.
+	Available bool       `json:"available,omitempty"`
+	DueAt     *time.Time `json:"due_at,omitempty"`
+	Rating    *Rating    `json:"rating,omitempty"`
+	Copies    *Copies    `json:"copies,omitempty"`
+	// The price in the Currency of ListOptions, if the server has a rate
+	// for it.
+	DisplayPrice *Price `json:"display_price,omitempty"`
+}
+
+// The fields of a book clients write.
+type bookInput struct {
+	ID          string   `json:"id"`
+	Title       string   `json:"title"`
+	Author      string   `json:"author"`
+	Edition     string   `json:"edition,omitempty"`
+	Pages       int      `json:"pages,omitempty"`
+	Year        int      `json:"year,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	Series      string   `json:"series,omitempty"`
+	SeriesIndex int      `json:"series_index,omitempty"`
+	Publisher   string   `json:"publisher,omitempty"`
+	Language    string   `json:"language,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Price       *Price   `json:"price,omitempty"`
+	AuthorID    string   `json:"author_id,omitempty"`
+	Version     int      `json:"version,omitempty"`
+}
+
+func (b Book) input() bookInput {
+	return bookInput{b.ID, b.Title, b.Author, b.Edition, b.Pages, b.Year, b.Tags, b.Series, b.SeriesIndex, b.Publisher, b.Language, b.Description, b.Price, b.AuthorID, b.Version}
+}
+
+// Price is an amount like 12.99, kept as its decimal digits so it stays
+// exact, in an ISO 4217 currency like EUR.
+type Price struct {
+	Amount   json.Number `json:"amount"`
+	Currency string      `json:"currency"`
+}
+
+// Copies counts the copies of a book, and those of them available.
+type Copies struct {
+	Total     int `json:"total"`
+	Available int `json:"available"`
+}
+
+// Rating summarizes the reviews of a book.
+type Rating struct {
+	Average float64 `json:"average"`
+	Count   int     `json:"count"`
+}
+
+// ListOptions filter and sort the books of List and Books. Nil bounds and
+// empty fields are left out.
+type ListOptions struct {
+	// Page counts from 1. Size is the number of books per page, at most
+	// 100. With both 0, List returns all books at once.
+	Page, Size int
+	// One of id, title, author, edition, pages, year, created_at, and
+	// updated_at, prefixed with - to sort in descending order.
+	Sort               string
+	YearFrom, YearTo   *int
+	MinPages, MaxPages *int
+	// Only books carrying all of these tags.
+	Tags []string
+	// Only books of the publisher, and in the language or one of its
+	// regional variants, e.g. en for en-GB.
+	Publisher, Language string
+	// Adds the DisplayPrice of the books in this currency, e.g. USD.
+	Currency string
+	// The NextCursor of the page before, to list the page after it in the
+	// order books were added in. It cannot be combined with Page or Sort.
+	After string
+}
+
+func (o ListOptions) query() url.Values {
+	q := url.Values{}
+	if o.Page > 0 {
+		q.Set("page", strconv.Itoa(o.Page))
+	}
+	if o.Size > 0 {
+		q.Set("size", strconv.Itoa(o.Size))
+	}
+	if o.Sort != "" {
+		q.Set("sort", o.Sort)
+	}
+	if o.After != "" {
+		q.Set("after", o.After)
+	}
+	bounds := []struct {
+		param string
+		value *int
+	}{{"year_from", o.YearFrom}, {"year_to", o.YearTo}, {"min_pages", o.MinPages}, {"max_pages", o.MaxPages}}
+	for _, b := range bounds {
+		if b.value != nil {
+			q.Set(b.param, strconv.Itoa(*b.value))
+		}
+	}
+	for _, tag := range o.Tags {
+		q.Add("tag", tag)
+	}
+	if o.Publisher != "" {
+		q.Set("publisher", o.Publisher)
+	}
+	if o.Language != "" {
+		q.Set("language", o.Language)
+	}
+	if o.Currency != "" {
+		q.Set("currency", o.Currency)
+	}
+	return q
+}
+
+// Page is one page of List.
+type Page struct {
+	Books []Book
+	// The number of books matching the filters, on all pages together.
+	Total int
+	// The After of the next page, for pages in the order books were added
+	// in, i.e. with a Size and no Sort. It is empty on the last page.
+	NextCursor string
+}
+
+// SearchOptions tune Search.
+type SearchOptions struct {
+	// Whether to also find words with a typo or two.
+	Fuzzy bool
+	// The number of hits, at most 100; the server's default with 0.
+	Limit int
+}
+
+// SearchHit is a book found by Search.
+type SearchHit struct {
+	Book
+	// How well the book matches; higher is better. 0 if the search backend
+	// of the server does not score.
+	Score float64 `json:"score,omitempty"`
+	// The title and author with the matching words marked, by field, if
+	// the backend can tell.
+	Highlights map[string]string `json:"highlights,omitempty"`
+}
+
+// Client sends requests to one server. The zero value is not usable;
+// create one with New.
+type Client struct {
+	// BaseURL of the server, without a trailing slash, e.g.
+	// http://localhost:3030.
+	BaseURL string
+	// HTTPClient sends the requests. Its timeout bounds every attempt.
+	HTTPClient *http.Client
+	// Token is sent as a bearer token, for servers with JWT_SECRET set.
+	Token string
+	// Retries is how often a failed request is repeated, waiting Backoff
+	// before the first retry and twice as long before each further one,
+	// or as long as a Retry-After header asks.
+	Retries int
+	Backoff time.Duration
+}
+
+// New returns a client for the server at baseURL.
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+		Retries:    3,
+		Backoff:    200 * time.Millisecond,
+	}
+}
+
+// List returns the books matching opts.
+func (c *Client) List(ctx context.Context, opts ListOptions) (Page, error) {
+	var page Page
+	res, err := c.do(ctx, http.MethodGet, "/api/books?"+opts.query().Encode(), nil, nil, &page.Books)
+	if err != nil {
+		return Page{}, err
+	}
+	page.Total, _ = strconv.Atoi(res.Header.Get("X-Total-Count"))
+	page.NextCursor = res.Header.Get("X-Next-Cursor")
+	return page, nil
+}
+
+// Get returns the book with the ID.
+func (c *Client) Get(ctx context.Context, id string) (Book, error) {
+	var book Book
+	_, err := c.do(ctx, http.MethodGet, bookPath(id), nil, nil, &book)
+	return book, err
+}
+
+// Create adds a book and returns it as stored. It is sent with an
+// Idempotency-Key, so a retry after a lost answer does not fail with
+// ErrConflict or create the book twice.
+func (c *Client) Create(ctx context.Context, book Book) (Book, error) {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return Book{}, err
+	}
+	header := http.Header{"Idempotency-Key": {hex.EncodeToString(key)}}
+	var created Book
+	_, err := c.do(ctx, http.MethodPost, "/api/books", header, book.input(), &created)
+	return created, err
+}
+
+// Update replaces the book with book.ID by book; fields left empty are
+// cleared. With a Version, the update fails with ErrConflict if the book
+// changed since, so read, change, and update the book to keep somebody
+// else's change. Servers that require If-Match reject updates without a
+// Version. The updated book is returned.
+func (c *Client) Update(ctx context.Context, book Book) (Book, error) {
+	var updated Book
+	_, err := c.do(ctx, http.MethodPut, bookPath(book.ID), nil, book.input(), &updated)
+	return updated, err
+}
+
+// Delete moves the book with the ID to the recycle bin. It reads the book
+// first and deletes it only if nobody changes it in between, as servers
+// ask for with If-Match; otherwise it fails with ErrConflict.
+func (c *Client) Delete(ctx context.Context, id string) error {
+	res, err := c.do(ctx, http.MethodGet, bookPath(id), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	header := http.Header{"If-Match": {res.Header.Get("ETag")}}
+	_, err = c.do(ctx, http.MethodDelete, bookPath(id), header, nil, nil)
+	return err
+}
+
+// Search returns the books whose title or author match text, best first.
+func (c *Client) Search(ctx context.Context, text string, opts SearchOptions) ([]SearchHit, error) {
+	q := url.Values{"q": {text}}
+	if opts.Fuzzy {
+		q.Set("fuzzy", "true")
+	}
+	if opts.Limit > 0 {
+		q.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	var hits []SearchHit
+	_, err := c.do(ctx, http.MethodGet, "/api/books/search?"+q.Encode(), nil, nil, &hits)
+	return hits, err
+}
+
+// ImportReport tells what Import did with each row of the CSV.
+type ImportReport struct {
+	Created int         `json:"created"`
+	Failed  int         `json:"failed"`
+	Rows    []ImportRow `json:"rows"`
+}
+
+// ImportRow is one row of the CSV. Rows count the header as row 1.
+type ImportRow struct {
+	Row    int    `json:"row"`
+	ID     string `json:"id,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Import adds the books of a CSV file with the columns of a CSV export.
+// Rows are checked one by one; the report tells which were added. It is
+// not retried, as part of the books may have been added.
+func (c *Client) Import(ctx context.Context, name string, csv io.Reader) (ImportReport, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", filepath.Base(name))
+	if err != nil {
+		return ImportReport{}, err
+	}
+	if _, err := io.Copy(part, csv); err != nil {
+		return ImportReport{}, err
+	}
+	if err := form.Close(); err != nil {
+		return ImportReport{}, err
+	}
+	var report ImportReport
+	_, err = c.do(ctx, http.MethodPost, "/api/books/import", nil, rawBody{form.FormDataContentType(), body.Bytes()}, &report)
+	return report, err
+}
+
+// Export writes all books to w, in format: csv, bibtex, or ris.
+func (c *Client) Export(ctx context.Context, format string, w io.Writer) error {
+	q := url.Values{"format": {format}}
+	_, err := c.do(ctx, http.MethodGet, "/api/books/export?"+q.Encode(), http.Header{"Accept": {"*/*"}}, nil, w)
+	return err
+}
+
+// Books pages through all books matching opts, fetching a page whenever
+// the one before is used up:
+//
+//	books := c.Books(ctx, client.ListOptions{Sort: "title"})
+//	for books.Next() {
+//		fmt.Println(books.Book().Title)
+//	}
+//	if err := books.Err(); err != nil { ... }
+//
+// The pages have opts.Size books, or 100 without one. Without a Sort or a
+// Page to start at, they follow cursors through the books in the order
+// they were added in, so books added or deleted while paging never make
+// it skip or repeat one. Otherwise they start at opts.Page, and such
+// changes may shift the pages.
+func (c *Client) Books(ctx context.Context, opts ListOptions) *BookIterator {
+	if opts.Size <= 0 {
+		opts.Size = 100
+	}
+	cursor := opts.Sort == "" && opts.Page <= 1
+	if cursor {
+		opts.Page = 0
+	} else if opts.Page <= 0 {
+		opts.Page = 1
+	}
+	return &BookIterator{client: c, ctx: ctx, opts: opts, cursor: cursor}
+}
+
+// BookIterator is returned by Books.
+type BookIterator struct {
+	client *Client
+	ctx    context.Context
+	opts   ListOptions
+	cursor bool
+	page   []Book
+	book   Book
+	done   bool
+	err    error
+}
+
+// Next moves to the next book, and reports whether there is one. It
+// returns false at the end and on errors; Err tells which.
+func (it *BookIterator) Next() bool {
+	for len(it.page) == 0 {
+		if it.done || it.err != nil {
+			return false
+		}
+		page, err := it.client.List(it.ctx, it.opts)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.page = page.Books
+		if it.cursor {
+			it.done = page.NextCursor == ""
+			it.opts.After = page.NextCursor
+		} else {
+			it.done = len(page.Books) < it.opts.Size || it.opts.Page*it.opts.Size >= page.Total
+			it.opts.Page++
+		}
+	}
+	it.book, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+// Book returns the book Next moved to.
+func (it *BookIterator) Book() Book {
+	return it.book
+}
+
+// Err returns the error that stopped Next, if any.
+func (it *BookIterator) Err() error {
+	return it.err
+}
+
+func bookPath(id string) string {
+	return "/api/books/" + url.PathEscape(id)
+}
+
+// Errors worth another attempt: dropped connections, timeouts of a single
+// attempt, and 5xx or 429 answers.
+type retryableError struct {
+	err   error
+	after time.Duration
+}
+
+func (e retryableError) Error() string { return e.err.Error() }
+func (e retryableError) Unwrap() error { return e.err }
+
+// A request body that is not JSON.
+type rawBody struct {
+	contentType string
+	data        []byte
+}
+
+// Sends a request with body as JSON, unless it is a rawBody, retrying it
+// as configured. A JSON answer is decoded into out; if out is an
+// io.Writer, the answer is copied to it instead. A POST is only retried
+// with an Idempotency-Key, as it might have gone through before.
+func (c *Client) do(ctx context.Context, method, path string, header http.Header, body, out interface{}) (*http.Response, error) {
+	var raw rawBody
+	switch b := body.(type) {
+	case nil:
+	case rawBody:
+		raw = b
+	default:
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		raw = rawBody{"application/json", data}
+	}
+	retries := c.Retries
+	if method == http.MethodPost && header.Get("Idempotency-Key") == "" {
+		retries = 0
+	}
+	wait := c.Backoff
+	for attempt := 0; ; attempt++ {
+		res, err := c.send(ctx, method, path, header, raw, out)
+		var retry retryableError
+		if err == nil || !errors.As(err, &retry) {
+			return res, err
+		}
+		if attempt >= retries {
+			return nil, retry.err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(max(wait, retry.after)):
+		}
+		wait *= 2
+	}
+}
+
+func (c *Client) send(ctx context.Context, method, path string, header http.Header, body rawBody, out interface{}) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, bytes.NewReader(body.data))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if req.Header.Get("Accept") == "" {
+		req.Header.Set("Accept", "application/json")
+	}
+	if body.contentType != "" {
+		req.Header.Set("Content-Type", body.contentType)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, retryableError{err: err}
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 400 {
+		answer, _ := io.ReadAll(res.Body)
+		apiErr := &Error{StatusCode: res.StatusCode, Message: res.Status}
+		var failure struct {
+			Error  string            `json:"error"`
+			Fields map[string]string `json:"fields"`
+		}
+		if json.Unmarshal(answer, &failure) == nil && failure.Error != "" {
+			apiErr.Message, apiErr.Fields = failure.Error, failure.Fields
+		}
+		if res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests {
+			seconds, _ := strconv.Atoi(res.Header.Get("Retry-After"))
+			return nil, retryableError{err: apiErr, after: time.Duration(seconds) * time.Second}
+		}
+		return nil, apiErr
+	}
+	switch out := out.(type) {
+	case nil:
+	case io.Writer:
+		// Part of the answer may be written already, so this is not
+		// retried.
+		if _, err := io.Copy(out, res.Body); err != nil {
+			return nil, fmt.Errorf("client: %s %s: %w", method, path, err)
+		}
+	default:
+		answer, err := io.ReadAll(res.Body)
+		if err != nil {
+			return nil, retryableError{err: err}
+		}
+		if err := json.Unmarshal(answer, out); err != nil {
+			return nil, fmt.Errorf("client: %s %s: %w", method, path, err)
+		}
+	}
+	return res, nil
+}
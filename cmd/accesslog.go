@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// Every request is logged as one structured entry with its request ID, the
+// user it was made for, and how long it took, both in total and waiting
+// for Mongo (the upstream). Where the entries go and what they look like is
+// configured with the ACCESS_LOG_* variables:
+//
+//   - ACCESS_LOG_FORMAT: "json" (default) or "text", i.e. key=value pairs
+//   - ACCESS_LOG_LEVEL: "info" logs every request, "warn" only those that
+//     failed with 4xx or 5xx, "error" only those with 5xx
+//   - ACCESS_LOG_OUTPUT: "stdout" (default), "stderr", "syslog", or the
+//     path of a file, which is rotated once it grows beyond
+//     ACCESS_LOG_MAX_SIZE bytes, keeping ACCESS_LOG_MAX_FILES old files
+
+// How much time the Mongo commands of a request took, added up.
+type upstreamTiming struct {
+	calls atomic.Int64
+	nanos atomic.Int64
+}
+
+type upstreamTimingKey struct{}
+
+// Opens the destination of the access log.
+func openAccessLog(cfg Config) (io.Writer, error) {
+	switch cfg.AccessLogOutput {
+	case "", "stdout":
+		return os.Stdout, nil
+	case "stderr":
+		return os.Stderr, nil
+	case "syslog":
+		return openSyslog(cfg.ServiceName)
+	}
+	return openRotatingFile(cfg.AccessLogOutput, int64(cfg.AccessLogMaxSize), cfg.AccessLogMaxFiles)
+}
+
+// Builds the logger for the access log as configured.
+func newAccessLogger(cfg Config, out io.Writer) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.AccessLogLevel)); err != nil {
+		return nil, fmt.Errorf("invalid ACCESS_LOG_LEVEL %q", cfg.AccessLogLevel)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	switch cfg.AccessLogFormat {
+	case "json":
+		return slog.New(slog.NewJSONHandler(out, opts)), nil
+	case "text":
+		return slog.New(slog.NewTextHandler(out, opts)), nil
+	}
+	return nil, fmt.Errorf("invalid ACCESS_LOG_FORMAT %q, want json or text", cfg.AccessLogFormat)
+}
+
+// Logs every request once it is answered: at level INFO, WARN for 4xx, and
+// ERROR for 5xx. It must come before the middleware setting the request ID.
+func accessLog(logger *slog.Logger) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			timing := &upstreamTiming{}
+			req := c.Request()
+			c.SetRequest(req.WithContext(context.WithValue(req.Context(), upstreamTimingKey{}, timing)))
+
+			err := next(c)
+			if err != nil {
+				// Let echo answer now, so the entry has the status code;
+				// echo's error handler skips answers already sent.
+				c.Error(err)
+			}
+			res := c.Response()
+			level := slog.LevelInfo
+			switch {
+			case res.Status >= 500:
+				level = slog.LevelError
+			case res.Status >= 400:
+				level = slog.LevelWarn
+			}
+			user := callerSubject(c)
+			if user == "" {
+				user = currentSession(c).User
+			}
+			attrs := []slog.Attr{
+				slog.String("request_id", res.Header().Get(echo.HeaderXRequestID)),
+				slog.String("remote_ip", c.RealIP()),
+				slog.String("method", req.Method),
+				slog.String("uri", req.RequestURI),
+				slog.String("route", c.Path()),
+				slog.Int("status", res.Status),
+				slog.String("user", user),
+				slog.Float64("latency_ms", milliseconds(time.Since(start))),
+				slog.Float64("upstream_ms", milliseconds(time.Duration(timing.nanos.Load()))),
+				slog.Int64("upstream_calls", timing.calls.Load()),
+				slog.String("bytes_in", req.Header.Get(echo.HeaderContentLength)),
+				slog.Int64("bytes_out", res.Size),
+				slog.String("user_agent", req.UserAgent()),
+			}
+			if err != nil {
+				attrs = append(attrs, slog.String("error", err.Error()))
+			}
+			logger.LogAttrs(req.Context(), level, "request", attrs...)
+			return err
+		}
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// Adds the time of every Mongo command to the request it was sent for.
+func mongoTiming() *event.CommandMonitor {
+	record := func(ctx context.Context, took time.Duration) {
+		if timing, ok := ctx.Value(upstreamTimingKey{}).(*upstreamTiming); ok {
+			timing.calls.Add(1)
+			timing.nanos.Add(int64(took))
+		}
+	}
+	return &event.CommandMonitor{
+		Succeeded: func(ctx context.Context, evt *event.CommandSucceededEvent) {
+			record(ctx, evt.Duration)
+		},
+		Failed: func(ctx context.Context, evt *event.CommandFailedEvent) {
+			record(ctx, evt.Duration)
+		},
+	}
+}
+
+// Passes the events of a Mongo client on to each of the monitors, as the
+// client only takes one.
+func combineMonitors(monitors ...*event.CommandMonitor) *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, evt *event.CommandStartedEvent) {
+			for _, m := range monitors {
+				if m.Started != nil {
+					m.Started(ctx, evt)
+				}
+			}
+		},
+		Succeeded: func(ctx context.Context, evt *event.CommandSucceededEvent) {
+			for _, m := range monitors {
+				if m.Succeeded != nil {
+					m.Succeeded(ctx, evt)
+				}
+			}
+		},
+		Failed: func(ctx context.Context, evt *event.CommandFailedEvent) {
+			for _, m := range monitors {
+				if m.Failed != nil {
+					m.Failed(ctx, evt)
+				}
+			}
+		},
+	}
+}
+
+// A log file that is renamed to path.1 once it would grow beyond maxSize,
+// path.1 to path.2, and so on; the oldest beyond backups is removed.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	backups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, backups: backups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file, r.size = file, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	backup := func(n int) string { return r.path + "." + strconv.Itoa(n) }
+	if r.backups > 0 {
+		os.Remove(backup(r.backups))
+		for n := r.backups - 1; n >= 1; n-- {
+			os.Rename(backup(n), backup(n+1))
+		}
+		if err := os.Rename(r.path, backup(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		return err
+	}
+	return r.open()
+}
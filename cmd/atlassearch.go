@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"log"
+	"strings"
+	"sync/atomic"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The name of the text index created for textSearch. A collection can only
+// have one text index.
+const textIndexName = "books_text"
+
+// Searches with the $search stage of MongoDB Atlas, which needs a search
+// index on the books collection like
+//
+//	{"mappings": {"dynamic": false, "fields": {
+//	  "bookname":   [{"type": "string"}, {"type": "autocomplete"}],
+//	  "bookauthor": [{"type": "string"}, {"type": "autocomplete"}]}}}
+//
+// Every word searched for has to begin a word of the title or author, as
+// with the n-grams; in a fuzzy search it may be off by one letter, and
+// only one of the words has to match. The best matches come first, with
+// the words that matched highlighted. Outside of Atlas there is no
+// $search, and the searches go to the fallback instead.
+type atlasSearch struct {
+	coll     *mongo.Collection
+	index    string
+	fallback bookSearcher
+	// Set once Mongo refused a $search, so it is not tried again.
+	unavailable atomic.Bool
+}
+
+func (s *atlasSearch) Search(ctx context.Context, q searchQuery) ([]searchHit, error) {
+	if s.unavailable.Load() {
+		return s.fallback.Search(ctx, q)
+	}
+	hits, err := s.search(ctx, q)
+	if isSearchUnavailable(err) {
+		if !s.unavailable.Swap(true) {
+			log.Printf("Atlas Search is not available, searching without it from now on: %v", err)
+		}
+		return s.fallback.Search(ctx, q)
+	}
+	return hits, err
+}
+
+// Whether Mongo refused the $search stage, as any server outside of Atlas
+// does.
+func isSearchUnavailable(err error) bool {
+	var cmdErr mongo.CommandError
+	if !errors.As(err, &cmdErr) {
+		return false
+	}
+	// 40324 is "Unrecognized pipeline stage name"; newer servers know the
+	// stage, but only run it on Atlas.
+	return cmdErr.Code == 40324 || strings.Contains(cmdErr.Message, "$search")
+}
+
+func (s *atlasSearch) search(ctx context.Context, q searchQuery) ([]searchHit, error) {
+	words := searchWords(q.Text)
+	hits := []searchHit{}
+	if len(words) == 0 {
+		return hits, nil
+	}
+	var fuzzy bson.M
+	if q.Fuzzy {
+		fuzzy = bson.M{"maxEdits": 1, "prefixLength": 1}
+	}
+	var perWord bson.A
+	for _, word := range words {
+		should := bson.A{}
+		for _, path := range []string{"bookname", "bookauthor"} {
+			autocomplete := bson.M{"query": word, "path": path}
+			if fuzzy != nil {
+				autocomplete["fuzzy"] = fuzzy
+			}
+			should = append(should, bson.M{"autocomplete": autocomplete})
+		}
+		perWord = append(perWord, bson.M{"compound": bson.M{"should": should, "minimumShouldMatch": 1}})
+	}
+	// Whole words score higher than beginnings, and drive the highlights.
+	text := bson.M{"query": q.Text, "path": bson.A{"bookname", "bookauthor"}}
+	if fuzzy != nil {
+		text["fuzzy"] = fuzzy
+	}
+	compound := bson.M{"must": perWord, "should": bson.A{bson.M{"text": text}}}
+	if q.Fuzzy {
+		compound = bson.M{"should": append(bson.A{bson.M{"text": text}}, perWord...), "minimumShouldMatch": 1}
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$search", Value: bson.M{
+			"index":     s.index,
+			"compound":  compound,
+			"highlight": bson.M{"path": bson.A{"bookname", "bookauthor"}},
+		}}},
+		{{Key: "$match", Value: notDeleted(bson.M{})}},
+		{{Key: "$limit", Value: q.Limit}},
+		{{Key: "$set", Value: bson.M{
+			"score":      bson.M{"$meta": "searchScore"},
+			"highlights": bson.M{"$meta": "searchHighlights"},
+		}}},
+	}
+	cursor, err := s.coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var found []struct {
+		BookStore  `bson:",inline"`
+		Score      float64          `bson:"score"`
+		Highlights []atlasHighlight `bson:"highlights"`
+	}
+	if err := cursor.All(ctx, &found); err != nil {
+		return nil, err
+	}
+	for _, hit := range found {
+		hits = append(hits, searchHit{Book: hit.BookStore, Score: hit.Score, Highlights: atlasHighlights(hit.Highlights)})
+	}
+	return hits, nil
+}
+
+// A highlight as Atlas returns it: the passage of a field, split into the
+// words that matched ("hit") and the text between them.
+type atlasHighlight struct {
+	Path  string `bson:"path"`
+	Texts []struct {
+		Value string `bson:"value"`
+		Type  string `bson:"type"`
+	} `bson:"texts"`
+}
+
+// The highlights by JSON field, with the matches marked like
+// "<mark>Dracula</mark>".
+func atlasHighlights(highlights []atlasHighlight) map[string]string {
+	fields := map[string]string{"bookname": "title", "bookauthor": "author"}
+	marked := map[string]string{}
+	for _, highlight := range highlights {
+		field, ok := fields[highlight.Path]
+		if !ok || marked[field] != "" {
+			continue
+		}
+		var b strings.Builder
+		for _, text := range highlight.Texts {
+			value := template.HTMLEscapeString(text.Value)
+			if text.Type == "hit" {
+				value = "<mark>" + value + "</mark>"
+			}
+			b.WriteString(value)
+		}
+		marked[field] = b.String()
+	}
+	return marked
+}
+
+// Searches the text index of the books collection, the fallback for a
+// MongoDB outside of Atlas. The text index has no notion of misspellings,
+// so fuzzy searches go to the n-grams instead.
+type textSearch struct {
+	coll  *mongo.Collection
+	fuzzy bookSearcher
+}
+
+// Creates the text index over title and author, the title counting
+// double.
+func prepareTextIndex(ctx context.Context, coll *mongo.Collection) error {
+	_, err := coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "bookname", Value: "text"}, {Key: "bookauthor", Value: "text"}},
+		Options: options.Index().
+			SetName(textIndexName).
+			SetWeights(bson.M{"bookname": 2, "bookauthor": 1}),
+	})
+	return err
+}
+
+// Every word searched for has to appear in the title or the author, the
+// best matches first.
+func (s textSearch) Search(ctx context.Context, q searchQuery) ([]searchHit, error) {
+	if q.Fuzzy {
+		return s.fuzzy.Search(ctx, q)
+	}
+	words := searchWords(q.Text)
+	hits := []searchHit{}
+	if len(words) == 0 {
+		return hits, nil
+	}
+	// Quoting each word makes all of them required.
+	terms := `"` + strings.Join(words, `" "`) + `"`
+	score := bson.M{"$meta": "textScore"}
+	opts := options.Find().
+		SetProjection(bson.M{"score": score}).
+		SetSort(bson.D{{Key: "score", Value: score}, {Key: "_id", Value: 1}}).
+		SetLimit(int64(q.Limit))
+	cursor, err := s.coll.Find(ctx, notDeleted(bson.M{"$text": bson.M{"$search": terms}}), opts)
+	if err != nil {
+		return nil, err
+	}
+	var found []struct {
+		BookStore `bson:",inline"`
+		Score     float64 `bson:"score"`
+	}
+	if err := cursor.All(ctx, &found); err != nil {
+		return nil, err
+	}
+	for _, hit := range found {
+		hits = append(hits, searchHit{Book: hit.BookStore, Score: hit.Score})
+	}
+	return hits, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	echojwt "github.com/labstack/echo-jwt/v4"
+	"github.com/labstack/echo/v4"
+)
+
+// Roles a token can carry in its "role" claim. They are ordered: an editor
+// can do everything a reader can, and an admin everything an editor can.
+const (
+	RoleReader = "reader"
+	RoleEditor = "editor"
+	RoleAdmin  = "admin"
+)
+
+var roleRank = map[string]int{
+	RoleReader: 1,
+	RoleEditor: 2,
+	RoleAdmin:  3,
+}
+
+// The claims we expect inside every JWT. Besides the registered claims
+// (subject, expiry, ...) we only care about the role of the caller, and
+// the library the token belongs to, if it is limited to one; see
+// tenants.go.
+type bookClaims struct {
+	Role   string `json:"role"`
+	Tenant string `json:"tenant,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// Bundles the authentication and authorization middleware. Both become
+// no-ops when no secret is configured, so the API stays open by default.
+type accessControl struct {
+	secret []byte
+}
+
+func newAccessControl(secret string) accessControl {
+	return accessControl{secret: []byte(secret)}
+}
+
+func (a accessControl) enabled() bool {
+	return len(a.secret) > 0
+}
+
+// Verifies the bearer token of the request and stores the parsed token in the
+// context under the "user" key, where Require picks it up.
+func (a accessControl) Authenticate() echo.MiddlewareFunc {
+	if !a.enabled() {
+		return passThrough
+	}
+	return echojwt.WithConfig(echojwt.Config{
+		SigningKey: a.secret,
+		NewClaimsFunc: func(c echo.Context) jwt.Claims {
+			return new(bookClaims)
+		},
+		ErrorHandler: func(c echo.Context, err error) error {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Missing or invalid token"})
+		},
+	})
+}
+
+// Lets the user logged in to the session of a web page act with their
+// role: Require finds a token for them, like the one the API would get.
+func (a accessControl) SessionUser() echo.MiddlewareFunc {
+	if !a.enabled() {
+		return passThrough
+	}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if s := currentSession(c); s.User != "" {
+				claims := &bookClaims{Role: s.Role, RegisteredClaims: jwt.RegisteredClaims{Subject: s.User}}
+				c.Set("user", &jwt.Token{Claims: claims, Method: jwt.SigningMethodHS256, Valid: true})
+			}
+			return next(c)
+		}
+	}
+}
+
+// Signs a token for the given user and role that expires after ttl.
+func (a accessControl) Issue(subject, role string, ttl time.Duration) (string, time.Time, error) {
+	return a.IssueForTenant(subject, role, "", ttl)
+}
+
+// Like Issue, for a token that only opens the library of the tenant.
+func (a accessControl) IssueForTenant(subject, role, tenant string, ttl time.Duration) (string, time.Time, error) {
+	expires := now().Add(ttl)
+	claims := bookClaims{
+		Role:   role,
+		Tenant: tenant,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   subject,
+			IssuedAt:  jwt.NewNumericDate(now()),
+			ExpiresAt: jwt.NewNumericDate(expires),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(a.secret)
+	return token, expires, err
+}
+
+// Verifies a token outside of echo, as gRPC needs it, and returns its
+// claims.
+func (a accessControl) tokenClaims(token string) (*bookClaims, error) {
+	claims := new(bookClaims)
+	_, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+		return a.secret, nil
+	}, jwt.WithValidMethods([]string{"HS256"}))
+	return claims, err
+}
+
+// Rejects the request with 403 unless the caller holds at least the given
+// role. It must run after Authenticate.
+func (a accessControl) Require(role string) echo.MiddlewareFunc {
+	if !a.enabled() {
+		return passThrough
+	}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if _, ok := c.Get("user").(*jwt.Token); !ok {
+				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Missing or invalid token"})
+			}
+			if !a.Allows(c, role) {
+				return c.JSON(http.StatusForbidden, map[string]string{"error": "The " + role + " role is required"})
+			}
+			return next(c)
+		}
+	}
+}
+
+// Reports whether the caller holds at least the given role. Handlers that
+// serve several kinds of operations on one route, like GraphQL, use it to
+// check each operation on its own.
+func (a accessControl) Allows(c echo.Context, role string) bool {
+	if !a.enabled() {
+		return true
+	}
+	token, ok := c.Get("user").(*jwt.Token)
+	if !ok {
+		return false
+	}
+	claims, ok := token.Claims.(*bookClaims)
+	return ok && roleRank[claims.Role] >= roleRank[role]
+}
+
+// Returns the subject of the caller's token, or an empty string when
+// authentication is disabled.
+func callerSubject(c echo.Context) string {
+	token, ok := c.Get("user").(*jwt.Token)
+	if !ok {
+		return ""
+	}
+	subject, _ := token.Claims.GetSubject()
+	return subject
+}
+
+func passThrough(next echo.HandlerFunc) echo.HandlerFunc {
+	return next
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Authors live in their own collection. Books reference them through
+// AuthorID, but still carry the author's name in BookAuthor, so listing
+// books never needs a second query. Renaming an author updates that copy of
+// the name in all of their books.
+type Author struct {
+	MongoID   primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	ID        string             `json:"id"`
+	Name      string             `json:"name" validate:"required"`
+	Bio       string             `json:"bio"`
+	BirthYear flexInt            `json:"birth_year" validate:"min=-3000,notfuture"`
+	CreatedAt time.Time          `json:"created_at"`
+	UpdatedAt time.Time          `json:"updated_at"`
+}
+
+// Finds the author of the given name, creating it when there is none yet.
+func ensureAuthor(ctx context.Context, authors *mongo.Collection, name string) (Author, error) {
+	var author Author
+	err := authors.FindOne(ctx, bson.M{"name": name}).Decode(&author)
+	if err != mongo.ErrNoDocuments {
+		return author, err
+	}
+
+	author = Author{Name: name, CreatedAt: now()}
+	author.UpdatedAt = author.CreatedAt
+	if author.ID, err = freeAuthorID(ctx, authors, authorSlug(name)); err != nil {
+		return author, err
+	}
+	_, err = authors.InsertOne(ctx, author)
+	return author, err
+}
+
+// Derives a readable ID from a name, e.g. "José Eustasio Rivera" becomes
+// "jose-eustasio-rivera".
+func authorSlug(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range norm.NFD.String(strings.ToLower(name)) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+			// Accents were split off by NFD; drop them.
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		default:
+			dash = true
+		}
+	}
+	if b.Len() == 0 {
+		return "author"
+	}
+	return b.String()
+}
+
+// Returns id if no author uses it yet, and otherwise appends a number until
+// the ID is free.
+func freeAuthorID(ctx context.Context, authors *mongo.Collection, id string) (string, error) {
+	candidate := id
+	for n := 2; ; n++ {
+		count, err := authors.CountDocuments(ctx, bson.M{"id": candidate})
+		if err != nil || count == 0 {
+			return candidate, err
+		}
+		candidate = id + "-" + strconv.Itoa(n)
+	}
+}
+
+// When a book names its author by ID, the name is copied from the author.
+// An unknown ID is reported like any other invalid field.
+func fillAuthorName(ctx context.Context, authors *mongo.Collection, book *BookStore) error {
+	if book.AuthorID == "" {
+		return nil
+	}
+	var author Author
+	err := authors.FindOne(ctx, bson.M{"id": book.AuthorID}).Decode(&author)
+	if err == mongo.ErrNoDocuments {
+		return validationErrors{"author_id": "does not match an author"}
+	} else if err != nil {
+		return err
+	}
+	book.BookAuthor = author.Name
+	return nil
+}
+
+// When a book only names its author, it gets linked to the author of that
+// name, which is created if needed.
+func linkAuthor(ctx context.Context, authors *mongo.Collection, book *BookStore) error {
+	if book.AuthorID != "" || book.BookAuthor == "" {
+		return nil
+	}
+	author, err := ensureAuthor(ctx, authors, book.BookAuthor)
+	if err != nil {
+		return err
+	}
+	book.AuthorID = author.ID
+	return nil
+}
+
+// Links books stored before authors had a collection of their own to their
+// authors. It runs at startup and does nothing once every book is linked.
+func backfillAuthors(ctx context.Context, coll, authors *mongo.Collection) error {
+	unlinked := bson.M{"authorid": bson.M{"$exists": false}, "bookauthor": bson.M{"$nin": bson.A{nil, ""}}}
+	names, err := coll.Distinct(ctx, "bookauthor", unlinked)
+	if err != nil {
+		return err
+	}
+	for _, value := range names {
+		name, ok := value.(string)
+		if !ok {
+			continue
+		}
+		author, err := ensureAuthor(ctx, authors, name)
+		if err != nil {
+			return err
+		}
+		filter := bson.M{"authorid": bson.M{"$exists": false}, "bookauthor": name}
+		if _, err := coll.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"authorid": author.ID}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The authors collection, listed by name.
+func authorStore(authors *mongo.Collection) mongoStore[Author] {
+	return newMongoStore(authors, bson.D{{Key: "name", Value: 1}}, func(author Author) bson.M {
+		return bson.M{
+			"name":      author.Name,
+			"bio":       author.Bio,
+			"birthyear": author.BirthYear,
+			"updatedat": now(),
+		}
+	})
+}
+
+// Lists all authors by name.
+func findAuthors(ctx context.Context, authors *mongo.Collection) ([]Author, error) {
+	return authorStore(authors).List(ctx)
+}
+
+// Serves /api/authors. GET lists all authors by name. POST creates one;
+// the ID may be left out, in which case one is derived from the name. PUT
+// replaces name, bio, and birth year, and copies a new name into every
+// book of the author. Authors that still have books, including books in
+// the recycle bin, cannot be deleted.
+func authorResource(coll, authors *mongo.Collection) Resource[Author] {
+	return Resource[Author]{
+		Name:    "author",
+		Store:   authorStore(authors),
+		ID:      func(author *Author) *string { return &author.ID },
+		JSONAPI: authorResourceObject,
+		BeforeCreate: func(ctx context.Context, author *Author) error {
+			if author.ID == "" {
+				id, err := freeAuthorID(ctx, authors, authorSlug(author.Name))
+				if err != nil {
+					return err
+				}
+				author.ID = id
+			} else if count, err := authors.CountDocuments(ctx, bson.M{"id": author.ID}); err != nil {
+				return err
+			} else if count > 0 {
+				return errResourceExists
+			}
+			author.MongoID = primitive.NewObjectID()
+			author.CreatedAt = now()
+			author.UpdatedAt = author.CreatedAt
+			return nil
+		},
+		AfterReplace: func(ctx context.Context, author Author) error {
+			rename := bson.M{
+				"$set": bson.M{"bookauthor": author.Name, "authorkey": searchKey(author.Name), "updatedat": author.UpdatedAt},
+				"$inc": bson.M{"version": 1},
+			}
+			filter := bson.M{"authorid": author.ID, "bookauthor": bson.M{"$ne": author.Name}}
+			_, err := coll.UpdateMany(ctx, filter, rename)
+			return err
+		},
+		BeforeDelete: func(ctx context.Context, id string) error {
+			count, err := coll.CountDocuments(ctx, bson.M{"authorid": id})
+			if err != nil {
+				return err
+			}
+			if count > 0 {
+				return resourceConflict("Author with ID " + id + " still has books")
+			}
+			return nil
+		},
+	}
+}
+
+// Handles GET /api/authors/:id/books, listing the books of one author.
+func listAuthorBooks(coll *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		books := findBooks(c.Request().Context(), coll, bson.M{"authorid": c.Param("id")})
+		if books == nil {
+			books = []map[string]interface{}{}
+		}
+		return c.JSON(http.StatusOK, bookList(books))
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Result for one element of a batch request. Index is the position of the
+// element in the request array.
+type batchResult struct {
+	Index  int    `json:"index"`
+	ID     string `json:"id,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Handles POST /api/books/batch. The body is a JSON array of books. Invalid
+// entries and IDs that already exist are reported per item, the rest is
+// inserted with one InsertMany. When everything was created we answer 201,
+// otherwise 207 (Multi-Status) so clients know to look at the items. The
+// new books are announced like those of the repository.
+func batchCreateBooks(coll, authors *mongo.Collection, events directEvents) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var books []BookStore
+		if err := c.Bind(&books); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload, expected an array of books"})
+		}
+		if len(books) == 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "The batch is empty"})
+		}
+
+		ctx := c.Request().Context()
+		results := make([]batchResult, len(books))
+		var pending []BookStore
+		var positions []int
+		seen := map[string]bool{}
+		for i, book := range books {
+			results[i] = batchResult{Index: i, ID: book.ID, Status: bulkFailed}
+			// A book given with only an author_id gets its author's name
+			// before the check, as in createBook.
+			if err := fillAuthorName(ctx, authors, &book); err != nil {
+				if errs, ok := err.(validationErrors); ok {
+					results[i].Error = errs.Error()
+					continue
+				}
+				log.Printf("Error looking up the author of %s: %v", book.ID, err)
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to insert batch"})
+			}
+			if msg := validateBulkBook(book); msg != "" {
+				results[i].Error = msg
+				continue
+			}
+			if seen[book.ID] {
+				results[i].Status = bulkConflict
+				results[i].Error = "Duplicate ID within the batch"
+				continue
+			}
+			seen[book.ID] = true
+			// Never trust a client provided MongoID.
+			book.MongoID = primitive.NilObjectID
+			pending = append(pending, book)
+			positions = append(positions, i)
+		}
+
+		outcomes, err := insertBooksUnordered(ctx, coll, authors, pending, events)
+		if err != nil {
+			log.Printf("Error inserting batch: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to insert batch"})
+		}
+		for i, pos := range positions {
+			results[pos].Status = outcomes[i].Status
+			results[pos].Error = outcomes[i].Error
+		}
+
+		status := http.StatusCreated
+		for _, result := range results {
+			if result.Status != bulkCreated {
+				status = http.StatusMultiStatus
+				break
+			}
+		}
+		return c.JSON(status, results)
+	}
+}
+
+// Handles PATCH /api/books/batch. The body is a JSON array of merge
+// patches, each naming the book to change by "id" and, optionally, the
+// "version" it was edited in. All updates go to the database in a single
+// BulkWrite; the answer is 200 when every book was updated, and 207 with a
+// status (updated, not_found, conflict, failed) per item otherwise. The
+// updated books are announced like the updates of the repository.
+func batchUpdateBooks(coll, history, authors *mongo.Collection, events directEvents) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var patches []map[string]interface{}
+		if err := json.NewDecoder(c.Request().Body).Decode(&patches); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload, expected an array of updates"})
+		}
+		if len(patches) == 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "The batch is empty"})
+		}
+
+		results := make([]batchResult, len(patches))
+		changes := make([]bookChanges, len(patches))
+		expected := make([]*int, len(patches))
+		var ids []string
+		seen := map[string]bool{}
+		for i, patch := range patches {
+			id, _ := patch["id"].(string)
+			results[i] = batchResult{Index: i, ID: id, Status: bulkFailed}
+			if id == "" {
+				results[i].Error = "id is required"
+				continue
+			}
+			if seen[id] {
+				results[i].Status = bulkConflict
+				results[i].Error = "Duplicate ID within the batch"
+				continue
+			}
+			seen[id] = true
+			version, err := expectedVersionOf(c, patch)
+			if err != nil {
+				results[i].Error = "version must be a number"
+				continue
+			}
+			delete(patch, "id")
+			delete(patch, "version")
+			clearNulls(patch)
+			if errs := validateUpdate(patch); len(errs) > 0 {
+				results[i].Error = errs.Error()
+				continue
+			}
+			if changes[i] = changesFromPayload(patch); changes[i].empty() {
+				results[i].Error = "No valid fields provided for update"
+				continue
+			}
+			expected[i] = version
+			results[i].Status = bulkUpdated
+			ids = append(ids, id)
+		}
+
+		ctx := c.Request().Context()
+		current, err := booksByID(ctx, coll, ids)
+		if err != nil {
+			log.Printf("Error updating batch: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update batch"})
+		}
+
+		// Every write is pinned to the version read above, so a book
+		// changed in between is not overwritten, and its previous state is
+		// the revision to keep.
+		updatedAt := now()
+		var models []mongo.WriteModel
+		var positions []int
+		for i, result := range results {
+			if result.Status != bulkUpdated {
+				continue
+			}
+			book, ok := current[result.ID]
+			switch {
+			case !ok:
+				results[i].Status = bulkNotFound
+				results[i].Error = "Book not found with ID " + result.ID
+				continue
+			case expected[i] != nil && *expected[i] != book.Version:
+				results[i].Status = bulkConflict
+				results[i].Error = "Book with ID " + result.ID + " was modified by someone else"
+				continue
+			}
+			set, err := changeSet(ctx, authors, changes[i])
+			var errs validationErrors
+			if errors.As(err, &errs) {
+				results[i].Status = bulkFailed
+				results[i].Error = errs.Error()
+				continue
+			} else if err != nil {
+				log.Printf("Error updating batch: %v", err)
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update batch"})
+			}
+			set["updatedat"] = updatedAt
+			withSearchKeys(set)
+			models = append(models, mongo.NewUpdateOneModel().
+				SetFilter(withVersion(notDeleted(bson.M{"id": result.ID}), book.Version)).
+				SetUpdate(bson.M{"$set": set, "$inc": bson.M{"version": 1}}))
+			positions = append(positions, i)
+		}
+
+		if err := writeBatch(ctx, coll, models, positions, results, updatedAt); err != nil {
+			log.Printf("Error updating batch: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update batch"})
+		}
+
+		var revisions []interface{}
+		var updated []string
+		for _, pos := range positions {
+			if results[pos].Status == bulkUpdated {
+				previous := current[results[pos].ID]
+				revisions = append(revisions, bookRevision{BookID: previous.ID, Version: previous.Version, RecordedAt: updatedAt, Book: previous})
+				updated = append(updated, previous.ID)
+			}
+		}
+		if len(revisions) > 0 {
+			if _, err := history.InsertMany(ctx, revisions); err != nil {
+				// The updates went through, so we only log the lost revisions.
+				log.Printf("Error recording revisions of batch update: %v", err)
+			}
+		}
+		events.PublishStored(ctx, coll, bookUpdated, updated)
+		return c.JSON(batchStatus(results, bulkUpdated), results)
+	}
+}
+
+// Handles DELETE /api/books?ids=a,b,c, moving the listed books to the
+// recycle bin with a single BulkWrite. The answer is 200 when every book
+// was deleted, and 207 with a status (deleted, not_found) per ID otherwise.
+// The deleted books are announced like the deletions of the repository.
+func batchDeleteBooks(coll *mongo.Collection, events directEvents) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var ids []string
+		for _, id := range strings.Split(c.QueryParam("ids"), ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				ids = append(ids, id)
+			}
+		}
+		if len(ids) == 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Name the books to delete with ?ids="})
+		}
+
+		deletedAt := now()
+		results := make([]batchResult, len(ids))
+		var models []mongo.WriteModel
+		var positions []int
+		seen := map[string]bool{}
+		for i, id := range ids {
+			results[i] = batchResult{Index: i, ID: id, Status: bulkDeleted}
+			if seen[id] {
+				results[i].Status = bulkConflict
+				results[i].Error = "Duplicate ID within the batch"
+				continue
+			}
+			seen[id] = true
+			models = append(models, mongo.NewUpdateOneModel().
+				SetFilter(notDeleted(bson.M{"id": id})).
+				SetUpdate(bson.M{
+					"$set": bson.M{"deletedat": deletedAt, "updatedat": deletedAt},
+					"$inc": bson.M{"version": 1},
+				}))
+			positions = append(positions, i)
+		}
+
+		if err := writeBatch(c.Request().Context(), coll, models, positions, results, deletedAt); err != nil {
+			log.Printf("Error deleting batch: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete batch"})
+		}
+		for _, result := range results {
+			if result.Status == bulkDeleted {
+				events.Publish(bookEvent{Type: bookDeleted, Book: BookStore{ID: result.ID}})
+			}
+		}
+		return c.JSON(batchStatus(results, bulkDeleted), results)
+	}
+}
+
+// The books with the given IDs that are not deleted, by ID.
+func booksByID(ctx context.Context, coll *mongo.Collection, ids []string) (map[string]BookStore, error) {
+	books := map[string]BookStore{}
+	if len(ids) == 0 {
+		return books, nil
+	}
+	cursor, err := coll.Find(ctx, notDeleted(bson.M{"id": bson.M{"$in": ids}}))
+	if err != nil {
+		return nil, err
+	}
+	var found []BookStore
+	if err := cursor.All(ctx, &found); err != nil {
+		return nil, err
+	}
+	for _, book := range found {
+		books[book.ID] = book
+	}
+	return books, nil
+}
+
+// Runs the single-book writes of a batch in one unordered BulkWrite, each
+// stamping updatedat with stamp. positions maps the models to the results,
+// whose status is kept for the books written and changed otherwise. The
+// bulk result only counts the matches, so when some write matched no book,
+// the books are read again to tell which ones.
+func writeBatch(ctx context.Context, coll *mongo.Collection, models []mongo.WriteModel, positions []int, results []batchResult, stamp time.Time) error {
+	if len(models) == 0 {
+		return nil
+	}
+	failed := map[int]string{}
+	result, err := coll.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) {
+		for _, writeErr := range bulkErr.WriteErrors {
+			failed[writeErr.Index] = writeErr.Message
+		}
+	} else if err != nil {
+		return err
+	}
+
+	var written map[string]bool
+	if result == nil || int(result.MatchedCount)+len(failed) < len(models) {
+		var ids []string
+		for _, pos := range positions {
+			ids = append(ids, results[pos].ID)
+		}
+		cursor, err := coll.Find(ctx, bson.M{"id": bson.M{"$in": ids}, "updatedat": stamp})
+		if err != nil {
+			return err
+		}
+		var books []BookStore
+		if err := cursor.All(ctx, &books); err != nil {
+			return err
+		}
+		written = map[string]bool{}
+		for _, book := range books {
+			written[book.ID] = true
+		}
+	}
+
+	for i, pos := range positions {
+		if msg, ok := failed[i]; ok {
+			results[pos].Status = bulkFailed
+			results[pos].Error = msg
+		} else if written != nil && !written[results[pos].ID] {
+			if results[pos].Status == bulkDeleted {
+				results[pos].Status = bulkNotFound
+				results[pos].Error = "Book not found with ID " + results[pos].ID
+			} else {
+				results[pos].Status = bulkConflict
+				results[pos].Error = "Book with ID " + results[pos].ID + " was modified by someone else"
+			}
+		}
+	}
+	return nil
+}
+
+// 200 when every item ended in the wanted status, 207 (Multi-Status)
+// otherwise.
+func batchStatus(results []batchResult, want string) int {
+	for _, result := range results {
+		if result.Status != want {
+			return http.StatusMultiStatus
+		}
+	}
+	return http.StatusOK
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// The bench command puts load on a running server, to see what a change to
+// paging or caching does to it:
+//
+//	go run ./cmd bench --url http://localhost:3030 --duration 30s --concurrency 16 --writes 0.1
+//
+// Each worker sends one request after the other. Reads list a random page
+// of GET /api/books or fetch a single book; with --writes, that share of
+// the requests create, patch, and delete books of the benchmark's own,
+// with IDs starting with "bench-", which are deleted again at the end. The
+// latencies are reported per operation as percentiles. Ctrl-C stops early
+// and still reports.
+
+type benchConfig struct {
+	url         string
+	token       string
+	duration    time.Duration
+	requests    int
+	concurrency int
+	writes      float64
+	pageSize    int
+}
+
+// The outcome of one request.
+type benchSample struct {
+	op      string
+	latency time.Duration
+	status  int
+	err     error
+}
+
+func benchCommand(cfg Config, args []string) error {
+	flags := commandFlags("bench")
+	var bc benchConfig
+	flags.StringVar(&bc.url, "url", "http://localhost:3030", "address of the server")
+	flags.StringVar(&bc.token, "token", os.Getenv("BENCH_TOKEN"), "bearer token to send, for servers with JWT_SECRET; defaults to BENCH_TOKEN")
+	flags.DurationVar(&bc.duration, "duration", 30*time.Second, "how long to run")
+	flags.IntVar(&bc.requests, "requests", 0, "stop after this many requests instead; 0 runs for --duration")
+	flags.IntVar(&bc.concurrency, "concurrency", 8, "number of concurrent workers")
+	flags.Float64Var(&bc.writes, "writes", 0, "share of the requests that write, from 0 to 1")
+	flags.IntVar(&bc.pageSize, "size", 25, "page size of the listed pages")
+	flags.Parse(args)
+	if bc.concurrency < 1 || bc.writes < 0 || bc.writes > 1 || bc.pageSize < 1 || bc.pageSize > maxPageSize {
+		return fmt.Errorf("--concurrency must be at least 1, --writes from 0 to 1, and --size from 1 to %d", maxPageSize)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if bc.requests == 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, bc.duration)
+		defer cancel()
+	}
+
+	b := &bencher{benchConfig: bc, client: &http.Client{Timeout: 30 * time.Second}}
+	if err := b.discover(ctx); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Benchmarking %s with %d workers, %d books, %.0f%% writes\n", bc.url, bc.concurrency, len(b.ids), 100*bc.writes)
+
+	start := time.Now()
+	samples := b.run(ctx)
+	elapsed := time.Since(start)
+	b.cleanUp()
+	printBenchReport(os.Stdout, samples, elapsed)
+	return nil
+}
+
+type bencher struct {
+	benchConfig
+	client *http.Client
+	// The IDs of existing books, for the reads.
+	ids   []string
+	total int64
+	// Requests sent so far, for --requests.
+	mu   sync.Mutex
+	sent int
+	// The books the benchmark created and did not delete yet.
+	own map[string]bool
+}
+
+// Learns how many books there are, to list pages that exist, and the IDs
+// of the first of them.
+func (b *bencher) discover(ctx context.Context) error {
+	status, header, body, err := b.do(ctx, http.MethodGet, "/api/books?size="+strconv.Itoa(maxPageSize), nil)
+	if err != nil {
+		return fmt.Errorf("reaching %s: %w", b.url, err)
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("GET /api/books answered %d: %s", status, bytes.TrimSpace(body))
+	}
+	var books []struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(body, &books); err != nil {
+		return fmt.Errorf("reading the books: %w", err)
+	}
+	for _, book := range books {
+		b.ids = append(b.ids, book.ID)
+	}
+	b.total, _ = strconv.ParseInt(header.Get("X-Total-Count"), 10, 64)
+	b.own = map[string]bool{}
+	return nil
+}
+
+// Whether another request may go out.
+func (b *bencher) next(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if b.requests == 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.sent >= b.requests {
+		return false
+	}
+	b.sent++
+	return true
+}
+
+func (b *bencher) run(ctx context.Context) []benchSample {
+	results := make([][]benchSample, b.concurrency)
+	var wg sync.WaitGroup
+	for w := range b.concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Books this worker created, which it patches and deletes.
+			var mine []string
+			for n := 0; b.next(ctx); n++ {
+				var sample benchSample
+				if rand.Float64() < b.writes {
+					sample, mine = b.write(ctx, fmt.Sprintf("bench-%d-%d-%d", os.Getpid(), w, n), mine)
+				} else {
+					sample = b.read(ctx)
+				}
+				// A request cut off by the end of the run is not a sample.
+				if sample.err != nil && ctx.Err() != nil {
+					break
+				}
+				results[w] = append(results[w], sample)
+			}
+		}()
+	}
+	wg.Wait()
+	return slices.Concat(results...)
+}
+
+func (b *bencher) read(ctx context.Context) benchSample {
+	if len(b.ids) == 0 || rand.IntN(2) == 0 {
+		pages := max((b.total+int64(b.pageSize)-1)/int64(b.pageSize), 1)
+		path := fmt.Sprintf("/api/books?page=%d&size=%d", rand.Int64N(pages)+1, b.pageSize)
+		return b.sample(ctx, "list", http.MethodGet, path, nil)
+	}
+	return b.sample(ctx, "get", http.MethodGet, "/api/books/"+b.ids[rand.IntN(len(b.ids))], nil)
+}
+
+// Creates a book, or patches or deletes one created before, and returns
+// the books of the worker that are left.
+func (b *bencher) write(ctx context.Context, id string, mine []string) (benchSample, []string) {
+	if len(mine) > 0 {
+		switch rand.IntN(3) {
+		case 0:
+			target := mine[rand.IntN(len(mine))]
+			return b.sample(ctx, "patch", http.MethodPatch, "/api/books/"+target, map[string]interface{}{"pages": rand.IntN(1000) + 1}), mine
+		case 1:
+			target := mine[len(mine)-1]
+			sample := b.sample(ctx, "delete", http.MethodDelete, "/api/books/"+target, nil)
+			if sample.status == http.StatusOK {
+				b.forget(target)
+				mine = mine[:len(mine)-1]
+			}
+			return sample, mine
+		}
+	}
+	book := map[string]interface{}{"id": id, "title": "Benchmark " + id, "author": "Bench Mark", "pages": 100, "year": 2000}
+	sample := b.sample(ctx, "create", http.MethodPost, "/api/books", book)
+	if sample.status == http.StatusCreated {
+		b.mu.Lock()
+		b.own[id] = true
+		b.mu.Unlock()
+		mine = append(mine, id)
+	}
+	return sample, mine
+}
+
+func (b *bencher) forget(id string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.own, id)
+}
+
+// Deletes the books the benchmark left behind.
+func (b *bencher) cleanUp() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for id := range b.own {
+		if status, _, body, err := b.do(ctx, http.MethodDelete, "/api/books/"+id, nil); err != nil || status != http.StatusOK {
+			fmt.Fprintf(os.Stderr, "Could not delete %s: %d %s %v\n", id, status, bytes.TrimSpace(body), err)
+		}
+	}
+}
+
+func (b *bencher) sample(ctx context.Context, op, method, path string, body interface{}) benchSample {
+	start := time.Now()
+	status, _, _, err := b.do(ctx, method, path, body)
+	return benchSample{op: op, latency: time.Since(start), status: status, err: err}
+}
+
+func (b *bencher) do(ctx context.Context, method, path string, body interface{}) (int, http.Header, []byte, error) {
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		reader = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, b.url+path, reader)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if b.token != "" {
+		req.Header.Set("Authorization", "Bearer "+b.token)
+	}
+	res, err := b.client.Do(req)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer res.Body.Close()
+	raw, err := io.ReadAll(res.Body)
+	return res.StatusCode, res.Header, raw, err
+}
+
+// Prints the requests, failures, and latency percentiles of each
+// operation, and the status codes seen.
+func printBenchReport(w io.Writer, samples []benchSample, elapsed time.Duration) {
+	byOp := map[string][]benchSample{}
+	statuses := map[string]int{}
+	for _, s := range samples {
+		byOp[s.op] = append(byOp[s.op], s)
+		if s.err != nil {
+			statuses["error"]++
+		} else {
+			statuses[strconv.Itoa(s.status)]++
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "operation\trequests\tfailed\treq/s\tp50\tp90\tp95\tp99\tmax\t")
+	ops := []string{"list", "get", "create", "patch", "delete"}
+	for _, op := range append(ops, "all") {
+		group := byOp[op]
+		if op == "all" {
+			group = samples
+		}
+		if len(group) == 0 {
+			continue
+		}
+		latencies := make([]time.Duration, len(group))
+		failed := 0
+		for i, s := range group {
+			latencies[i] = s.latency
+			if s.err != nil || s.status >= 400 {
+				failed++
+			}
+		}
+		slices.Sort(latencies)
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f\t%s\t%s\t%s\t%s\t%s\t\n", op, len(group), failed,
+			float64(len(group))/elapsed.Seconds(),
+			percentile(latencies, 50), percentile(latencies, 90), percentile(latencies, 95), percentile(latencies, 99),
+			latencies[len(latencies)-1].Round(time.Microsecond))
+	}
+	tw.Flush()
+
+	codes := make([]string, 0, len(statuses))
+	for code := range statuses {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	fmt.Fprintf(w, "\nStatus codes in %s:", elapsed.Round(time.Millisecond))
+	for _, code := range codes {
+		fmt.Fprintf(w, " %s×%d", code, statuses[code])
+	}
+	fmt.Fprintln(w)
+}
+
+// The latency p percent of the sorted latencies are at most.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	i := (len(sorted)*p+99)/100 - 1
+	return sorted[max(i, 0)].Round(time.Microsecond)
+}
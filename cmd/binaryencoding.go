@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/bookpb"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Clients short on bandwidth can ask for a binary encoding in the Accept
+// header instead of JSON. application/x-msgpack is MessagePack with the
+// same field names as the JSON; any answer of respond can be sent in it.
+// application/x-protobuf is the Book message of bookpb/book.proto, for a
+// single book, or a ListBooksResponse, for a list, so the code generated
+// for the gRPC service decodes it as well.
+
+const (
+	msgpackMediaType  = "application/x-msgpack"
+	protobufMediaType = "application/x-protobuf"
+)
+
+func encodeMsgpack(w io.Writer, v interface{}) error {
+	enc := msgpack.NewEncoder(w)
+	enc.SetCustomStructTag("json")
+	enc.SetOmitEmpty(true)
+	return enc.Encode(v)
+}
+
+// Values that have a protobuf message.
+type protoEncodable interface {
+	ProtoMessage() proto.Message
+}
+
+func encodeProtobuf(w io.Writer, v interface{}) error {
+	raw, err := proto.Marshal(v.(protoEncodable).ProtoMessage())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(raw)
+	return err
+}
+
+// The book as the message the gRPC service sends, like toProtoBook. Fields
+// left out with ?fields= stay empty.
+func (b bookItem) protoBook() *bookpb.Book {
+	text := func(field string) string {
+		s, _ := b[field].(string)
+		return s
+	}
+	number := func(field string) int32 {
+		switch n := b[field].(type) {
+		case flexInt:
+			return int32(n)
+		case int:
+			return int32(n)
+		}
+		return 0
+	}
+	timestamp := func(field string) *timestamppb.Timestamp {
+		if t, ok := b[field].(time.Time); ok {
+			return timestamppb.New(t)
+		}
+		return nil
+	}
+	pb := &bookpb.Book{
+		Id:          text("id"),
+		Title:       text("title"),
+		Author:      text("author"),
+		AuthorId:    text("author_id"),
+		Edition:     text("edition"),
+		Pages:       number("pages"),
+		Year:        number("year"),
+		Series:      text("series"),
+		SeriesIndex: number("series_index"),
+		Version:     number("version"),
+		CreatedAt:   timestamp("created_at"),
+		UpdatedAt:   timestamp("updated_at"),
+	}
+	pb.Tags, _ = b["tags"].([]string)
+	pb.Available, _ = b["available"].(bool)
+	if rating, ok := b["rating"].(*bookRating); ok {
+		pb.RatingAverage = rating.Average
+		pb.RatingCount = int32(rating.Count)
+	}
+	return pb
+}
+
+func (b bookItem) ProtoMessage() proto.Message {
+	return b.protoBook()
+}
+
+func (l bookList) ProtoMessage() proto.Message {
+	list := &bookpb.ListBooksResponse{}
+	for _, book := range l {
+		list.Books = append(list.Books, bookItem(book).protoBook())
+	}
+	return list
+}
@@ -0,0 +1,414 @@
+// Bookctl manages the books of a running server from the command line,
+// through the client package:
+//
+//	bookctl [--url URL] [--api-key KEY] [--output table|json] <command> [flags]
+//
+//	bookctl list [--sort -year] [--tag horror] [--page 2 --size 10]
+//	bookctl get dracula
+//	bookctl create --id dracula --title Dracula --author "Bram Stoker" --pages 418 --year 1897
+//	bookctl create --file book.json       a book as JSON; - reads stdin
+//	bookctl update dracula --pages 420    changes only the given fields
+//	bookctl delete dracula [more IDs]
+//	bookctl import --file books.csv
+//	bookctl export [--format csv] [--out books.csv]
+//
+// The API key is a token as POST /api/login hands out, for servers with
+// JWT_SECRET set; BOOKCTL_URL and BOOKCTL_API_KEY set the defaults of
+// --url and --api-key. Books are printed as a table, or as JSON with
+// --output json, which is easier to pipe into other tools.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/CAPS-Cloud/exercises/client"
+)
+
+type command struct {
+	name    string
+	usage   string
+	summary string
+	run     func(ctx context.Context, c *client.Client, out printer, args []string) error
+}
+
+var commands = []command{
+	{"list", "[--sort title] [--tag t] [--page 1 --size 25]", "list the books, all of them without --page", listCommand},
+	{"get", "ID", "print one book", getCommand},
+	{"create", "--id ID --title T --author A | --file book.json", "add a book", createCommand},
+	{"update", "ID [--title T] [--pages N] ...", "change the given fields of a book", updateCommand},
+	{"delete", "ID...", "move books to the recycle bin", deleteCommand},
+	{"import", "--file books.csv", "add the books of a CSV file", importCommand},
+	{"export", "[--format csv] [--out books.csv]", "write all books to stdout or a file", exportCommand},
+}
+
+func main() {
+	flag.Usage = func() { printUsage(flag.CommandLine.Output()) }
+	baseURL := flag.String("url", envOr("BOOKCTL_URL", "http://localhost:3030"), "address of the server")
+	apiKey := flag.String("api-key", os.Getenv("BOOKCTL_API_KEY"), "token to authenticate with")
+	output := flag.String("output", "table", "how to print books: table or json")
+	flag.Parse()
+	if *output != "table" && *output != "json" {
+		fail(fmt.Errorf("--output must be table or json"))
+	}
+
+	name, args := flag.Arg(0), flag.Args()
+	if len(args) > 0 {
+		args = args[1:]
+	}
+	c := client.New(*baseURL)
+	c.Token = *apiKey
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	for _, cmd := range commands {
+		if cmd.name == name {
+			if err := cmd.run(ctx, c, printer{w: os.Stdout, json: *output == "json"}, args); err != nil {
+				fail(err)
+			}
+			return
+		}
+	}
+	if name != "" && name != "help" {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+	}
+	printUsage(os.Stderr)
+	if name != "help" {
+		os.Exit(2)
+	}
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "bookctl: %v\n", err)
+	os.Exit(1)
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: bookctl [--url URL] [--api-key KEY] [--output table|json] <command> [flags]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-7s %-50s %s\n", cmd.name, cmd.usage, cmd.summary)
+	}
+	fmt.Fprintf(w, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// A flag set for a command, printing the command's usage on errors and -h.
+func commandFlags(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: bookctl %s [flags]\n", name)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// Parses the flags of a command that takes IDs. The flag package stops at
+// the first argument, so the flags may also follow the ID.
+func parseWithIDs(flags *flag.FlagSet, args []string) ([]string, error) {
+	var ids []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		if flags.NArg() == 0 {
+			return ids, nil
+		}
+		ids = append(ids, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
+
+func listCommand(ctx context.Context, c *client.Client, out printer, args []string) error {
+	flags := commandFlags("list")
+	var opts client.ListOptions
+	flags.StringVar(&opts.Sort, "sort", "", "field to sort by, prefixed with - for descending order")
+	flags.Func("tag", "only books with this tag; may be repeated", func(tag string) error {
+		opts.Tags = append(opts.Tags, tag)
+		return nil
+	})
+	flags.IntVar(&opts.Page, "page", 0, "print only this page, counting from 1")
+	flags.IntVar(&opts.Size, "size", 0, "books per page, at most 100")
+	boundFlag(flags, "year-from", "only books published in or after this year", &opts.YearFrom)
+	boundFlag(flags, "year-to", "only books published in or before this year", &opts.YearTo)
+	flags.StringVar(&opts.Publisher, "publisher", "", "only books of this publisher")
+	flags.StringVar(&opts.Language, "language", "", "only books in this language, e.g. en")
+	flags.StringVar(&opts.Currency, "currency", "", "also show prices in this currency, e.g. USD")
+	flags.Parse(args)
+
+	if opts.Page > 0 {
+		page, err := c.List(ctx, opts)
+		if err != nil {
+			return err
+		}
+		return out.books(page.Books)
+	}
+	var books []client.Book
+	it := c.Books(ctx, opts)
+	for it.Next() {
+		books = append(books, it.Book())
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	return out.books(books)
+}
+
+// Defines a flag setting an optional bound of the list.
+func boundFlag(flags *flag.FlagSet, name, usage string, bound **int) {
+	flags.Func(name, usage, func(raw string) error {
+		var value int
+		if _, err := fmt.Sscan(raw, &value); err != nil {
+			return fmt.Errorf("must be a whole number")
+		}
+		*bound = &value
+		return nil
+	})
+}
+
+func getCommand(ctx context.Context, c *client.Client, out printer, args []string) error {
+	ids, err := parseWithIDs(commandFlags("get"), args)
+	if err != nil {
+		return err
+	}
+	if len(ids) != 1 {
+		return fmt.Errorf("get takes one book ID")
+	}
+	book, err := c.Get(ctx, ids[0])
+	if err != nil {
+		return err
+	}
+	return out.book(book)
+}
+
+// Defines the flags of the fields of a book.
+func bookFlags(flags *flag.FlagSet, book *client.Book) {
+	flags.StringVar(&book.Title, "title", "", "title")
+	flags.StringVar(&book.Author, "author", "", "name of the author")
+	flags.StringVar(&book.Edition, "edition", "", "ISBN of the edition")
+	flags.IntVar(&book.Pages, "pages", 0, "number of pages")
+	flags.IntVar(&book.Year, "year", 0, "year of publication")
+	flags.Func("tag", "a tag; may be repeated", func(tag string) error {
+		book.Tags = append(book.Tags, tag)
+		return nil
+	})
+	flags.StringVar(&book.Series, "series", "", "series the book belongs to")
+	flags.IntVar(&book.SeriesIndex, "series-index", 0, "position in the series, counting from 1")
+	flags.StringVar(&book.Publisher, "publisher", "", "publisher")
+	flags.StringVar(&book.Language, "language", "", "language as a BCP 47 tag, e.g. en or pt-BR")
+	flags.StringVar(&book.Description, "description", "", "short description")
+	flags.Func("price", `price with its currency, e.g. "12.99 EUR"`, func(raw string) error {
+		amount, currency, ok := strings.Cut(strings.TrimSpace(raw), " ")
+		if _, err := strconv.ParseFloat(amount, 64); !ok || err != nil {
+			return fmt.Errorf("must be an amount and a currency, e.g. 12.99 EUR")
+		}
+		book.Price = &client.Price{Amount: json.Number(amount), Currency: strings.TrimSpace(currency)}
+		return nil
+	})
+}
+
+func createCommand(ctx context.Context, c *client.Client, out printer, args []string) error {
+	flags := commandFlags("create")
+	var book client.Book
+	flags.StringVar(&book.ID, "id", "", "ID of the new book")
+	bookFlags(flags, &book)
+	file := flags.String("file", "", "read the book from a JSON file instead, or from stdin with -")
+	flags.Parse(args)
+
+	if *file != "" {
+		raw, err := readFile(*file)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(raw, &book); err != nil {
+			return fmt.Errorf("reading %s: %w", *file, err)
+		}
+	}
+	created, err := c.Create(ctx, book)
+	if err != nil {
+		return err
+	}
+	return out.book(created)
+}
+
+func readFile(name string) ([]byte, error) {
+	if name == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(name)
+}
+
+func updateCommand(ctx context.Context, c *client.Client, out printer, args []string) error {
+	flags := commandFlags("update")
+	var changes client.Book
+	bookFlags(flags, &changes)
+	ids, err := parseWithIDs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(ids) != 1 {
+		return fmt.Errorf("update takes one book ID")
+	}
+
+	// The update is sent with the version read here, so it fails instead
+	// of undoing a change made in between.
+	book, err := c.Get(ctx, ids[0])
+	if err != nil {
+		return err
+	}
+	set := 0
+	flags.Visit(func(f *flag.Flag) {
+		set++
+		switch f.Name {
+		case "title":
+			book.Title = changes.Title
+		case "author":
+			book.Author = changes.Author
+		case "edition":
+			book.Edition = changes.Edition
+		case "pages":
+			book.Pages = changes.Pages
+		case "year":
+			book.Year = changes.Year
+		case "tag":
+			book.Tags = changes.Tags
+		case "series":
+			book.Series = changes.Series
+		case "series-index":
+			book.SeriesIndex = changes.SeriesIndex
+		case "publisher":
+			book.Publisher = changes.Publisher
+		case "language":
+			book.Language = changes.Language
+		case "description":
+			book.Description = changes.Description
+		case "price":
+			book.Price = changes.Price
+		}
+	})
+	if set == 0 {
+		return fmt.Errorf("update needs at least one field to change")
+	}
+	updated, err := c.Update(ctx, book)
+	if err != nil {
+		return err
+	}
+	return out.book(updated)
+}
+
+func deleteCommand(ctx context.Context, c *client.Client, out printer, args []string) error {
+	ids, err := parseWithIDs(commandFlags("delete"), args)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return fmt.Errorf("delete takes at least one book ID")
+	}
+	for _, id := range ids {
+		if err := c.Delete(ctx, id); err != nil {
+			return fmt.Errorf("deleting %s: %w", id, err)
+		}
+		if !out.json {
+			fmt.Fprintf(out.w, "Deleted %s\n", id)
+		}
+	}
+	return nil
+}
+
+func importCommand(ctx context.Context, c *client.Client, out printer, args []string) error {
+	flags := commandFlags("import")
+	file := flags.String("file", "", "CSV file with the columns of an export, or - for stdin")
+	flags.Parse(args)
+	if *file == "" {
+		return fmt.Errorf("import needs --file")
+	}
+	in := os.Stdin
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	report, err := c.Import(ctx, *file, in)
+	if err != nil {
+		return err
+	}
+	if out.json {
+		return out.encode(report)
+	}
+	tw := tabwriter.NewWriter(out.w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ROW\tID\tSTATUS\tERROR")
+	for _, row := range report.Rows {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", row.Row, row.ID, row.Status, row.Error)
+	}
+	tw.Flush()
+	fmt.Fprintf(out.w, "\n%d created, %d failed\n", report.Created, report.Failed)
+	return nil
+}
+
+func exportCommand(ctx context.Context, c *client.Client, out printer, args []string) error {
+	flags := commandFlags("export")
+	format := flags.String("format", "csv", "csv, bibtex, or ris")
+	file := flags.String("out", "", "file to write to instead of stdout")
+	flags.Parse(args)
+
+	w := out.w
+	if *file != "" {
+		f, err := os.Create(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return c.Export(ctx, *format, w)
+}
+
+// Prints books as a table or as JSON.
+type printer struct {
+	w    io.Writer
+	json bool
+}
+
+func (p printer) encode(v interface{}) error {
+	enc := json.NewEncoder(p.w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func (p printer) book(book client.Book) error {
+	if p.json {
+		return p.encode(book)
+	}
+	return p.books([]client.Book{book})
+}
+
+func (p printer) books(books []client.Book) error {
+	if p.json {
+		if books == nil {
+			books = []client.Book{}
+		}
+		return p.encode(books)
+	}
+	tw := tabwriter.NewWriter(p.w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTITLE\tAUTHOR\tYEAR\tPAGES\tTAGS\tVERSION")
+	for _, b := range books {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%s\t%d\n", b.ID, b.Title, b.Author, b.Year, b.Pages, strings.Join(b.Tags, ","), b.Version)
+	}
+	return tw.Flush()
+}
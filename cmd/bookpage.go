@@ -0,0 +1,43 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// What the "book-page" template shows: the book, as the API returns it, and
+// its reviews, newest first.
+type bookDetails struct {
+	Book    map[string]interface{}
+	Reviews []Review
+}
+
+// Handles GET /books/:id, the page of a book with all of its fields, its
+// cover, and its reviews. Titles in the book tables link here. The page
+// loads the books like it from GET /books/:id/similar.
+func bookPage(books bookRepository, reviews *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		id := c.Param("id")
+		book, err := books.Get(ctx, id)
+		if err != nil {
+			return rowFailed(c, err, id, "fetch")
+		}
+		details := bookDetails{Book: bookToMap(book), Reviews: []Review{}}
+		opts := options.Find().SetSort(bson.D{{Key: "createdat", Value: -1}})
+		cursor, err := reviews.Find(ctx, bson.M{"bookid": id}, opts)
+		if err == nil {
+			err = cursor.All(ctx, &details.Reviews)
+		}
+		if err != nil {
+			log.Printf("Error listing reviews of book %s: %v", id, err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		return c.Render(http.StatusOK, "book-page", details)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// One page of the book table on /books, along with what its column headers
+// and the previous and next buttons need to link to other pages.
+type bookTablePage struct {
+	Books   []map[string]interface{}
+	Filters map[string]string
+	Page    int
+	Pages   int
+	Size    int
+	Total   int64
+	Sort    string
+}
+
+// The URL of the given page in the given order, keeping the filters.
+func (p bookTablePage) link(page int, sort string) string {
+	query := url.Values{}
+	for name, value := range p.Filters {
+		if value != "" && name != "size" && name != "sort" {
+			query.Set(name, value)
+		}
+	}
+	query.Set("page", strconv.Itoa(page))
+	query.Set("size", strconv.Itoa(p.Size))
+	if sort != "" {
+		query.Set("sort", sort)
+	}
+	return "/books?" + query.Encode()
+}
+
+// Columns the table only shows when their toggle above it is on, e.g.
+// ?show_publisher=1. The rows always carry them, hidden by the stylesheet
+// unless the table has the class show-<column>.
+var optionalBookColumns = []string{"publisher", "language", "price"}
+
+// The classes of the table that show the toggled columns.
+func (p bookTablePage) ColumnClasses() string {
+	var classes []string
+	for _, column := range optionalBookColumns {
+		if p.Filters["show_"+column] != "" {
+			classes = append(classes, "show-"+column)
+		}
+	}
+	return strings.Join(classes, " ")
+}
+
+// The numbers of rows to choose from above the table.
+func (p bookTablePage) SizeChoices() []int {
+	return []int{10, defaultPageSize, 50, maxPageSize}
+}
+
+func (p bookTablePage) HasPrev() bool {
+	return p.Page > 1
+}
+
+func (p bookTablePage) HasNext() bool {
+	return p.Page < p.Pages
+}
+
+func (p bookTablePage) PrevURL() string {
+	return p.link(p.Page-1, p.Sort)
+}
+
+func (p bookTablePage) NextURL() string {
+	return p.link(p.Page+1, p.Sort)
+}
+
+// The URL a column header links to: sorted by its field, ascending, or
+// descending when the table already is sorted ascending by it.
+func (p bookTablePage) SortURL(field string) string {
+	if p.Sort == field {
+		return p.link(1, "-"+field)
+	}
+	return p.link(1, field)
+}
+
+// An arrow telling whether the table is sorted by the field.
+func (p bookTablePage) SortMark(field string) string {
+	switch p.Sort {
+	case field:
+		return " ▲"
+	case "-" + field:
+		return " ▼"
+	}
+	return ""
+}
+
+// Handles GET /books. It takes the filters and the page, size, and sort
+// parameters of GET /api/books and shows defaultPageSize books unless told
+// otherwise, or the size chosen last in this session. Requests from the
+// table itself, for another page or order, only get the table back.
+func booksPage(books bookRepository, rates exchangeRates) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		query, errs := bookFilter(c)
+		if len(errs) > 0 {
+			// Ignore broken filters instead of failing the whole page.
+			query = bookQuery{}
+		}
+		// The table shows whole books.
+		query.Fields = nil
+		// The number of rows is remembered in the session, so it sticks
+		// when coming back to the page.
+		s := currentSession(c)
+		if c.QueryParam("size") != "" && query.Limit > 0 {
+			s.PageSize = int(query.Limit)
+			s.Changed()
+		} else if s.PageSize > 0 {
+			page := int64(1)
+			if query.Limit > 0 {
+				page = query.Offset/query.Limit + 1
+			}
+			query.Limit = int64(s.PageSize)
+			query.Offset = (page - 1) * query.Limit
+		}
+		if query.Limit == 0 {
+			query.Limit = defaultPageSize
+		}
+		found, err := books.List(ctx, query)
+		if err != nil {
+			log.Printf("Error listing books: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		total, err := books.Count(ctx, query)
+		if err != nil {
+			log.Printf("Error counting books: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+
+		page := bookTablePage{
+			Books:   []map[string]interface{}{},
+			Filters: bookFilterValues(c),
+			Page:    int(query.Offset/query.Limit) + 1,
+			Pages:   max(1, int((total+query.Limit-1)/query.Limit)),
+			Size:    int(query.Limit),
+			Total:   total,
+			Sort:    query.Sort,
+		}
+		for _, book := range found {
+			item := bookToMap(book)
+			if err := addDisplayPrice(ctx, rates, item, book, query.Currency); err != nil {
+				log.Printf("Error converting the price of book %s: %v", book.ID, err)
+			}
+			page.Books = append(page.Books, item)
+		}
+		if c.Request().Header.Get("HX-Target") == "book-results" {
+			return c.Render(http.StatusOK, "book-results", page)
+		}
+		return c.Render(http.StatusOK, "books-page", page)
+	}
+}
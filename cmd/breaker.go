@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// When Mongo is down, every request would otherwise wait for its own
+// timeout, holding a connection of the pool all along. The circuit breaker
+// notices instead: after BREAKER_THRESHOLD failures in a row it opens, and
+// the repository refuses right away with errCircuitOpen, answered with 503.
+// After BREAKER_COOLDOWN it lets a single request through to try again;
+// if that works, it closes, otherwise it stays open for another cooldown.
+// Its state is published in GET /metrics as mongo_breaker, and GET /readyz
+// answers 503 while it is open.
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+var errCircuitOpen = errors.New("the database is unavailable")
+
+var breakerRejected = expvar.NewInt("mongo_breaker_rejected")
+
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	// Whether the one request let through while half-open is still on
+	// its way.
+	probing bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	b := &circuitBreaker{threshold: threshold, cooldown: cooldown, state: breakerClosed}
+	expvar.Publish("mongo_breaker", expvar.Func(func() any { return b.Status() }))
+	return b
+}
+
+type breakerStatus struct {
+	State    string     `json:"state"`
+	Failures int        `json:"failures"`
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+}
+
+func (b *circuitBreaker) Status() breakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := breakerStatus{State: b.state, Failures: b.failures}
+	if b.state != breakerClosed {
+		openedAt := b.openedAt
+		status.OpenedAt = &openedAt
+	}
+	return status
+}
+
+// Runs op unless the breaker is open, and counts whether it failed.
+func (b *circuitBreaker) Do(ctx context.Context, op func() error) error {
+	if !b.allow() {
+		breakerRejected.Add(1)
+		return errCircuitOpen
+	}
+	err := op()
+	b.record(ctx, err)
+	return err
+}
+
+func (b *circuitBreaker) allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+func (b *circuitBreaker) record(ctx context.Context, err error) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	failed := isDatabaseFailure(ctx, err)
+	if b.state == breakerHalfOpen {
+		b.probing = false
+		if failed {
+			b.state, b.openedAt = breakerOpen, time.Now()
+			return
+		}
+		b.state, b.failures = breakerClosed, 0
+		return
+	}
+	if !failed {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.state, b.openedAt = breakerOpen, time.Now()
+	}
+}
+
+// Whether err says that Mongo failed, rather than that the request was
+// wrong or the caller went away.
+func isDatabaseFailure(ctx context.Context, err error) bool {
+	var errs validationErrors
+	switch {
+	case err == nil, errors.As(err, &errs):
+		return false
+	case err == errBookNotFound, err == errBookExists, err == errStaleVersion, err == errReadOnly:
+		return false
+	case errors.Is(err, mongo.ErrNoDocuments), mongo.IsDuplicateKeyError(err):
+		return false
+	case errors.Is(ctx.Err(), context.Canceled):
+		return false
+	}
+	return true
+}
+
+// Wraps a repository so its calls go through the circuit breaker.
+type breakerBooks struct {
+	bookRepository
+	breaker *circuitBreaker
+}
+
+func (r breakerBooks) List(ctx context.Context, q bookQuery) (books []BookStore, err error) {
+	err = r.breaker.Do(ctx, func() error {
+		books, err = r.bookRepository.List(ctx, q)
+		return err
+	})
+	return books, err
+}
+
+func (r breakerBooks) Get(ctx context.Context, id string) (book BookStore, err error) {
+	err = r.breaker.Do(ctx, func() error {
+		book, err = r.bookRepository.Get(ctx, id)
+		return err
+	})
+	return book, err
+}
+
+func (r breakerBooks) Create(ctx context.Context, book *BookStore) error {
+	return r.breaker.Do(ctx, func() error {
+		return r.bookRepository.Create(ctx, book)
+	})
+}
+
+func (r breakerBooks) Update(ctx context.Context, id string, changes bookChanges, version *int) (book BookStore, err error) {
+	err = r.breaker.Do(ctx, func() error {
+		book, err = r.bookRepository.Update(ctx, id, changes, version)
+		return err
+	})
+	return book, err
+}
+
+func (r breakerBooks) Delete(ctx context.Context, id string, version *int) error {
+	return r.breaker.Do(ctx, func() error {
+		return r.bookRepository.Delete(ctx, id, version)
+	})
+}
+
+func (r breakerBooks) Count(ctx context.Context, q bookQuery) (n int64, err error) {
+	err = r.breaker.Do(ctx, func() error {
+		n, err = r.bookRepository.Count(ctx, q)
+		return err
+	})
+	return n, err
+}
+
+// Handles GET /readyz, which load balancers ask whether to send requests
+// here: 200 when Mongo answers a ping, 503 when it does not or the breaker
+// is open.
+func readiness(client *mongo.Client, breaker *circuitBreaker) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx, cancel := context.WithTimeout(c.Request().Context(), 2*time.Second)
+		defer cancel()
+		err := breaker.Do(ctx, func() error { return client.Ping(ctx, nil) })
+		status := breaker.Status()
+		if err != nil {
+			return c.JSON(http.StatusServiceUnavailable, map[string]interface{}{"status": "unavailable", "error": err.Error(), "breaker": status})
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"status": "ready", "breaker": status})
+	}
+}
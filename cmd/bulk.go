@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Statuses reported for every item of a bulk operation.
+const (
+	bulkCreated  = "created"
+	bulkUpdated  = "updated"
+	bulkDeleted  = "deleted"
+	bulkNotFound = "not_found"
+	bulkConflict = "conflict"
+	bulkFailed   = "failed"
+)
+
+// What happened to a single book during a bulk insert.
+type insertOutcome struct {
+	Status string
+	Error  string
+}
+
+// Checks the fields of a book coming from a bulk request. It returns an
+// empty string when the book is fine, and a human readable reason otherwise.
+func validateBulkBook(book BookStore) string {
+	if errs := validateStruct(&book); len(errs) > 0 {
+		return errs.Error()
+	}
+	return ""
+}
+
+// Inserts many books at once. Books whose ID already exists are reported as
+// conflicts; the others go to the database in one unordered InsertMany, so
+// a single failing document does not stop the rest from being written. Each
+// book is linked to its author first, and the books created are announced
+// to events. The returned outcomes line up with the given books.
+func insertBooksUnordered(ctx context.Context, coll, authors *mongo.Collection, books []BookStore, events directEvents) ([]insertOutcome, error) {
+	outcomes := make([]insertOutcome, len(books))
+	if len(books) == 0 {
+		return outcomes, nil
+	}
+
+	ids := make([]string, 0, len(books))
+	for _, book := range books {
+		ids = append(ids, book.ID)
+	}
+	cursor, err := coll.Find(ctx, notDeleted(bson.M{"id": bson.M{"$in": ids}}))
+	if err != nil {
+		return nil, err
+	}
+	var existing []BookStore
+	if err := cursor.All(ctx, &existing); err != nil {
+		return nil, err
+	}
+	taken := map[string]bool{}
+	for _, book := range existing {
+		taken[book.ID] = true
+	}
+
+	var docs []interface{}
+	var positions []int
+	for i, book := range books {
+		if taken[book.ID] {
+			outcomes[i] = insertOutcome{Status: bulkConflict, Error: "Book with ID " + book.ID + " already exists"}
+			continue
+		}
+		if err := fillAuthorName(ctx, authors, &book); err != nil {
+			if errs, ok := err.(validationErrors); ok {
+				outcomes[i] = insertOutcome{Status: bulkFailed, Error: errs.Error()}
+				continue
+			}
+			return nil, err
+		}
+		if err := linkAuthor(ctx, authors, &book); err != nil {
+			return nil, err
+		}
+		book.BookEdition = normalizeEdition(book.BookEdition)
+		book.Language = normalizeLanguage(book.Language)
+		book.Tags = normalizeTags(book.Tags)
+		book.setSearchKeys()
+		book.CreatedAt = now()
+		book.UpdatedAt = book.CreatedAt
+		book.Version = 1
+		book.Rating = nil
+		book.Copies = nil
+		book.Checkout = nil
+		book.Cover = nil
+		docs = append(docs, book)
+		positions = append(positions, i)
+	}
+	if len(docs) == 0 {
+		return outcomes, nil
+	}
+	// New books replace deleted ones with the same ID for good.
+	var fresh []string
+	for _, pos := range positions {
+		fresh = append(fresh, books[pos].ID)
+	}
+	if err := purgeDeleted(ctx, coll, fresh); err != nil {
+		return nil, err
+	}
+
+	failed := map[int]string{}
+	conflicts := map[int]bool{}
+	_, err = coll.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) {
+		for _, writeErr := range bulkErr.WriteErrors {
+			failed[writeErr.Index] = writeErr.Message
+			if mongo.IsDuplicateKeyError(writeErr) {
+				// Created by someone else since the check above.
+				conflicts[writeErr.Index] = true
+			}
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	var created []string
+	for i, pos := range positions {
+		if conflicts[i] {
+			outcomes[pos] = insertOutcome{Status: bulkConflict, Error: "Book with ID " + books[pos].ID + " already exists"}
+		} else if msg, ok := failed[i]; ok {
+			outcomes[pos] = insertOutcome{Status: bulkFailed, Error: msg}
+		} else {
+			outcomes[pos] = insertOutcome{Status: bulkCreated}
+			created = append(created, books[pos].ID)
+		}
+	}
+	events.PublishStored(ctx, coll, bookCreated, created)
+	return outcomes, nil
+}
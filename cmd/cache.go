@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"expvar"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Counters shown at GET /metrics, next to the memory statistics Go
+// publishes itself.
+var (
+	cacheHits   = expvar.NewInt("cache_hits")
+	cacheMisses = expvar.NewInt("cache_misses")
+)
+
+// The headers of a cached response that are sent again with it. The rest,
+// like CORS or rate limit headers, are set anew by the middleware of each
+// request.
+var cachedHeaders = []string{echo.HeaderContentType, "ETag", echo.HeaderLastModified, "X-Total-Count", "X-Next-Cursor", "Link"}
+
+type cachedResponse struct {
+	Key     string      `json:"key"`
+	Header  http.Header `json:"header"`
+	Body    []byte      `json:"body"`
+	Expires time.Time   `json:"expires"`
+}
+
+// Where the cached answers live: in the memory of this process, or in
+// Redis, where all instances of the server share them.
+type cacheStore interface {
+	// Returns the answer stored under key, or nil, and the generation to
+	// pass to put along with a fresh answer.
+	get(ctx context.Context, key string) (*cachedResponse, uint64)
+	// Keeps the answer, unless the cache was purged since the generation
+	// was handed out; the answer may be outdated already then.
+	put(ctx context.Context, entry *cachedResponse, generation uint64)
+	// Forgets every answer.
+	purge(ctx context.Context)
+}
+
+// Keeps the answers of the busiest list endpoints, keyed by path, query,
+// and Accept header. Every change to the data empties the cache, and the
+// ttl bounds how stale an answer can get when a change goes unnoticed,
+// e.g. one made by another process without a change stream.
+type responseCache struct {
+	store cacheStore
+	ttl   time.Duration
+}
+
+// Picks the store named by cfg.CacheBackend. A size or ttl of 0 disables
+// the cache.
+func newResponseCache(cfg Config) *responseCache {
+	if cfg.ResponseCacheSize <= 0 || cfg.ResponseCacheTTL <= 0 {
+		return &responseCache{}
+	}
+	rc := &responseCache{ttl: cfg.ResponseCacheTTL}
+	switch cfg.CacheBackend {
+	case "redis":
+		rc.store = newRedisCache(cfg.RedisURL, cfg.ResponseCacheTTL)
+	default:
+		rc.store = newMemoryCache(cfg.ResponseCacheSize)
+	}
+	return rc
+}
+
+func (rc *responseCache) enabled() bool {
+	return rc.store != nil
+}
+
+// Forgets every answer.
+func (rc *responseCache) Purge() {
+	if rc.enabled() {
+		rc.store.purge(context.Background())
+	}
+}
+
+// Keeps up to size answers in memory. The least recently used answer goes
+// first when the cache is full.
+type memoryCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List
+	// Counts the purges, so an answer computed while the data changed is
+	// not stored afterwards.
+	generation uint64
+}
+
+func newMemoryCache(size int) *memoryCache {
+	return &memoryCache{size: size, entries: map[string]*list.Element{}, order: list.New()}
+}
+
+func (mc *memoryCache) get(ctx context.Context, key string) (*cachedResponse, uint64) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if el, ok := mc.entries[key]; ok {
+		entry := el.Value.(*cachedResponse)
+		if now().Before(entry.Expires) {
+			mc.order.MoveToFront(el)
+			return entry, mc.generation
+		}
+		mc.order.Remove(el)
+		delete(mc.entries, key)
+	}
+	return nil, mc.generation
+}
+
+func (mc *memoryCache) put(ctx context.Context, entry *cachedResponse, generation uint64) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if generation != mc.generation {
+		return
+	}
+	if el, ok := mc.entries[entry.Key]; ok {
+		mc.order.Remove(el)
+	}
+	mc.entries[entry.Key] = mc.order.PushFront(entry)
+	for mc.order.Len() > mc.size {
+		oldest := mc.order.Back()
+		mc.order.Remove(oldest)
+		delete(mc.entries, oldest.Value.(*cachedResponse).Key)
+	}
+}
+
+func (mc *memoryCache) purge(ctx context.Context) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.generation++
+	mc.entries = map[string]*list.Element{}
+	mc.order.Init()
+}
+
+// Tees the body of a response into a buffer.
+type recordingWriter struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// Answers from the cache, or lets the handler answer and keeps the answer
+// when it is a 200. Conditional requests are checked against the cached
+// ETag and Last-Modified, just like the handlers would.
+func (rc *responseCache) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			// The changes of tenants raise no book events that would purge
+			// their answers; see tenants.go.
+			if !rc.enabled() || tenantFrom(c.Request().Context()) != "" {
+				return next(c)
+			}
+			req := c.Request()
+			key := req.URL.Path + "?" + req.URL.Query().Encode() + "\n" + req.Header.Get(echo.HeaderAccept)
+
+			entry, generation := rc.store.get(req.Context(), key)
+			if entry != nil {
+				cacheHits.Add(1)
+				header := c.Response().Header()
+				for name, values := range entry.Header {
+					header[name] = values
+				}
+				header.Add(echo.HeaderVary, echo.HeaderAccept)
+				if notModifiedCached(req, entry.Header) {
+					return c.NoContent(http.StatusNotModified)
+				}
+				return c.Blob(http.StatusOK, entry.Header.Get(echo.HeaderContentType), entry.Body)
+			}
+			cacheMisses.Add(1)
+
+			res := c.Response()
+			w := &recordingWriter{ResponseWriter: res.Writer}
+			res.Writer = w
+			err := next(c)
+			res.Writer = w.ResponseWriter
+			if err != nil || res.Status != http.StatusOK {
+				return err
+			}
+			entry = &cachedResponse{Key: key, Header: http.Header{}, Body: w.body.Bytes(), Expires: now().Add(rc.ttl)}
+			for _, name := range cachedHeaders {
+				if values := res.Header().Values(name); len(values) > 0 {
+					entry.Header[http.CanonicalHeaderKey(name)] = values
+				}
+			}
+			rc.store.put(req.Context(), entry, generation)
+			return nil
+		}
+	}
+}
+
+// Whether the client already holds the cached answer. If-None-Match wins
+// over If-Modified-Since, as in notModifiedSince.
+func notModifiedCached(req *http.Request, header http.Header) bool {
+	if match := req.Header.Get("If-None-Match"); match != "" {
+		return header.Get("ETag") != "" && etagMatches(match, header.Get("ETag"), true)
+	}
+	modified, err := http.ParseTime(header.Get(echo.HeaderLastModified))
+	if err != nil {
+		return false
+	}
+	since, err := http.ParseTime(req.Header.Get(echo.HeaderIfModifiedSince))
+	return err == nil && !modified.After(since)
+}
+
+// Empties the cache after every request that may have changed something.
+// GraphQL is left out, since its queries are POSTed as well; its mutations
+// go through the repository and reach the cache as book events instead.
+func (rc *responseCache) PurgeOnWrites() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			err := next(c)
+			if !rc.enabled() {
+				return err
+			}
+			switch c.Request().Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+			default:
+				if c.Request().URL.Path != "/graphql" {
+					rc.Purge()
+				}
+			}
+			return err
+		}
+	}
+}
+
+// Empties the cache on every book event, which covers gRPC and GraphQL as
+// well as changes seen by the change stream.
+func (rc *responseCache) PurgeOnEvents(ctx context.Context, events *bookEvents) {
+	if !rc.enabled() {
+		return
+	}
+	ch, stop := events.Subscribe()
+	go func() {
+		defer stop()
+		for {
+			select {
+			case <-ch:
+				rc.Purge()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
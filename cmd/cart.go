@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The shopping cart of the storefront lives in the session, like the rest
+// of the state of a browser (see session.go), so filling it costs no
+// database writes until an order is placed; see orders.go. The cookie only
+// holds book IDs and quantities, and at most maxCartLines of them, so it
+// stays well below the size browsers accept.
+
+type cartItem struct {
+	BookID   string `json:"book_id"`
+	Quantity int    `json:"quantity,omitempty"`
+}
+
+const (
+	maxCartLines    = 50
+	maxCartQuantity = 99
+)
+
+// A line of the cart as answered, with the title, author, and price of the
+// book. Books deleted since they were added have none of them.
+type cartLine struct {
+	BookID   string     `json:"book_id"`
+	Title    string     `json:"title,omitempty"`
+	Author   string     `json:"author,omitempty"`
+	Price    *bookPrice `json:"price,omitempty"`
+	Quantity int        `json:"quantity"`
+}
+
+type cartContents struct {
+	Items []cartLine `json:"items"`
+	// The number of books in the cart, quantities included.
+	Count int `json:"count"`
+}
+
+// A line as sent to POST /api/cart/items. The quantity defaults to 1.
+var cartItemSchema = mustSchema(`{
+	"type": "object",
+	"properties": {
+		"book_id": {"type": "string", "minLength": 1},
+		"quantity": {"type": "integer", "minimum": 1, "maximum": ` + strconv.Itoa(maxCartQuantity) + `}
+	},
+	"required": ["book_id"],
+	"additionalProperties": false
+}`)
+
+func readCart(ctx context.Context, books bookRepository, items []cartItem) (cartContents, error) {
+	contents := cartContents{Items: []cartLine{}}
+	for _, item := range items {
+		line := cartLine{BookID: item.BookID, Quantity: item.Quantity}
+		book, err := books.Get(ctx, item.BookID)
+		if err != nil && err != errBookNotFound {
+			return cartContents{}, err
+		}
+		line.Title, line.Author, line.Price = book.BookName, book.BookAuthor, book.Price
+		contents.Items = append(contents.Items, line)
+		contents.Count += item.Quantity
+	}
+	return contents, nil
+}
+
+// Answers with the cart of the session.
+func respondCart(c echo.Context, books bookRepository) error {
+	contents, err := readCart(c.Request().Context(), books, currentSession(c).Cart)
+	if err != nil {
+		log.Printf("Error reading the cart: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to read the cart"})
+	}
+	return c.JSON(http.StatusOK, contents)
+}
+
+// Handles GET /api/cart.
+func getCart(books bookRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return respondCart(c, books)
+	}
+}
+
+// Handles POST /api/cart/items. Adding a book that is in the cart already
+// adds to its quantity.
+func addToCart(books bookRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var item cartItem
+		if err := c.Bind(&item); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+		}
+		if item.Quantity == 0 {
+			item.Quantity = 1
+		}
+		if _, err := books.Get(c.Request().Context(), item.BookID); err == errBookNotFound {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Book not found with ID " + item.BookID})
+		} else if err != nil {
+			log.Printf("Error fetching book with ID %s: %v", item.BookID, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to add to the cart"})
+		}
+
+		s := currentSession(c)
+		i := slices.IndexFunc(s.Cart, func(line cartItem) bool { return line.BookID == item.BookID })
+		switch {
+		case i >= 0 && s.Cart[i].Quantity+item.Quantity > maxCartQuantity:
+			return validationFailed(c, validationErrors{"quantity": "must not exceed " + strconv.Itoa(maxCartQuantity) + " per book"})
+		case i >= 0:
+			s.Cart[i].Quantity += item.Quantity
+		case len(s.Cart) >= maxCartLines:
+			return validationFailed(c, validationErrors{"book_id": "cannot be added, the cart holds at most " + strconv.Itoa(maxCartLines) + " books"})
+		default:
+			s.Cart = append(s.Cart, item)
+		}
+		s.Changed()
+		return respondCart(c, books)
+	}
+}
+
+// Handles DELETE /api/cart/items/:book, which takes the book out of the
+// cart, whatever its quantity.
+func removeFromCart(books bookRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		s := currentSession(c)
+		i := slices.IndexFunc(s.Cart, func(line cartItem) bool { return line.BookID == c.Param("book") })
+		if i < 0 {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Book " + c.Param("book") + " is not in the cart"})
+		}
+		s.Cart = slices.Delete(s.Cart, i, i+1)
+		s.Changed()
+		return respondCart(c, books)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"log"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// On a replica set, book events come from a change stream on the books
+// collection instead of from our own handlers. That way, changes made by
+// other processes, like a second server or somebody in the mongo shell,
+// reach the watchers as well.
+
+// The parts of a change event we look at.
+type bookChange struct {
+	OperationType     string     `bson:"operationType"`
+	FullDocument      *BookStore `bson:"fullDocument"`
+	UpdateDescription struct {
+		RemovedFields []string `bson:"removedFields"`
+	} `bson:"updateDescription"`
+}
+
+// Erasing a book for good only happens to books in the recycle bin, and
+// watchers have seen those go already. Delete events are left out, which
+// is just as well, since they don't carry the ID of the book.
+func openChangeStream(ctx context.Context, coll *mongo.Collection, resumeToken bson.Raw) (*mongo.ChangeStream, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"operationType": bson.M{"$in": bson.A{"insert", "update", "replace"}}}}},
+	}
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if resumeToken != nil {
+		opts.SetResumeAfter(resumeToken)
+	}
+	return coll.Watch(ctx, pipeline, opts)
+}
+
+// Turns a change event into a book event. Moving a book to the recycle bin
+// is an update, but watchers see it as a deletion, and restoring it as a
+// creation.
+func (ch bookChange) event() (bookEvent, bool) {
+	book := ch.FullDocument
+	if book == nil {
+		// The book was erased before the change could be looked up.
+		return bookEvent{}, false
+	}
+	switch {
+	case book.DeletedAt != nil:
+		return bookEvent{Type: bookDeleted, Book: BookStore{ID: book.ID}}, true
+	case ch.OperationType == "insert" || slices.Contains(ch.UpdateDescription.RemovedFields, "deletedat"):
+		return bookEvent{Type: bookCreated, Book: *book}, true
+	}
+	return bookEvent{Type: bookUpdated, Book: *book}, true
+}
+
+// Starts publishing the changes of the books collection. It returns false
+// when the server does not support change streams, e.g. a standalone
+// mongod, and the caller has to publish the events itself.
+func watchBookChanges(ctx context.Context, coll *mongo.Collection, events *bookEvents) bool {
+	stream, err := openChangeStream(ctx, coll, nil)
+	if err != nil {
+		log.Printf("Change streams are not available (%v), only changes made through this server are announced", err)
+		return false
+	}
+	go followBookChanges(ctx, coll, events, stream)
+	return true
+}
+
+// Publishes the changes of the stream. When the stream breaks, e.g. during
+// a failover, it is reopened where it stopped.
+func followBookChanges(ctx context.Context, coll *mongo.Collection, events *bookEvents, stream *mongo.ChangeStream) {
+	for {
+		for stream.Next(ctx) {
+			var change bookChange
+			if err := stream.Decode(&change); err != nil {
+				log.Printf("Error decoding book change: %v", err)
+				continue
+			}
+			if event, ok := change.event(); ok {
+				events.Publish(event)
+			}
+		}
+		resumeToken := stream.ResumeToken()
+		err := stream.Err()
+		stream.Close(context.Background())
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Error following book changes: %v", err)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(5 * time.Second):
+			}
+			if stream, err = openChangeStream(ctx, coll, resumeToken); err == nil {
+				break
+			}
+			log.Printf("Error reopening the change stream: %v", err)
+		}
+	}
+}
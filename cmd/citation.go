@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Citations of books in the formats reference managers import: BibTeX for
+// LaTeX users, and RIS for Zotero, EndNote, Mendeley, and friends.
+
+type citationFormat struct {
+	contentType string
+	extension   string
+	format      func(book BookStore, key string) string
+}
+
+var citationFormats = map[string]citationFormat{
+	"bibtex": {"application/x-bibtex; charset=utf-8", "bib", bibtexEntry},
+	"ris":    {"application/x-research-info-systems; charset=utf-8", "ris", risEntry},
+}
+
+// Reference managers want "Last, First" when a name has several parts.
+func citationName(name string) string {
+	name = strings.TrimSpace(name)
+	if idx := strings.LastIndex(name, " "); idx > 0 {
+		return name[idx+1:] + ", " + name[:idx]
+	}
+	return name
+}
+
+// Builds a citation key like "shelley1818frankenstein" from the author's
+// last name, the year, and the first word of the title.
+func citationKey(book BookStore) string {
+	var parts []string
+	if fields := strings.Fields(book.BookAuthor); len(fields) > 0 {
+		parts = append(parts, fields[len(fields)-1])
+	}
+	parts = append(parts, book.BookYear.String())
+	if fields := strings.Fields(book.BookName); len(fields) > 0 {
+		parts = append(parts, fields[0])
+		// Skip articles, "thevortex1924" is not what anyone searches for.
+		if len(fields) > 1 && map[string]bool{"the": true, "a": true, "an": true}[strings.ToLower(fields[0])] {
+			parts[len(parts)-1] = fields[1]
+		}
+	}
+	key := authorSlug(strings.Join(parts, " "))
+	key = strings.ReplaceAll(key, "-", "")
+	if key == "author" || key == "" {
+		key = authorSlug(book.ID)
+	}
+	return key
+}
+
+// Characters BibTeX treats specially are escaped so titles like
+// "Tom & Jerry" survive LaTeX.
+var bibtexEscaper = strings.NewReplacer(
+	`\`, `\textbackslash{}`, "{", `\{`, "}", `\}`, "&", `\&`, "%", `\%`,
+	"$", `\$`, "#", `\#`, "_", `\_`, "~", `\textasciitilde{}`, "^", `\textasciicircum{}`,
+)
+
+func bibtexEntry(book BookStore, key string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "@book{%s,\n", key)
+	field := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(&b, "  %s = {%s},\n", name, bibtexEscaper.Replace(value))
+		}
+	}
+	field("title", book.BookName)
+	field("author", citationName(book.BookAuthor))
+	field("year", book.BookYear.String())
+	if looksLikeISBN(book.BookEdition) {
+		field("isbn", book.BookEdition)
+	} else {
+		field("edition", book.BookEdition)
+	}
+	field("pagetotal", book.BookPages.String())
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// RIS is line based: a two letter tag, two spaces, a dash, and the value.
+// The spec asks for CRLF line endings.
+func risEntry(book BookStore, _ string) string {
+	var b strings.Builder
+	field := func(tag, value string) {
+		if value = strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) {
+				return ' '
+			}
+			return r
+		}, value); value != "" {
+			fmt.Fprintf(&b, "%s  - %s\r\n", tag, value)
+		}
+	}
+	field("TY", "BOOK")
+	field("ID", book.ID)
+	field("TI", book.BookName)
+	field("AU", citationName(book.BookAuthor))
+	field("PY", book.BookYear.String())
+	if looksLikeISBN(book.BookEdition) {
+		field("SN", book.BookEdition)
+	} else {
+		field("ET", book.BookEdition)
+	}
+	b.WriteString("ER  - \r\n")
+	return b.String()
+}
+
+// Handles GET /api/books/:id/citation?format=bibtex or ?format=ris.
+// BibTeX is the default.
+func bookCitation(coll *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		name := c.QueryParam("format")
+		if name == "" {
+			name = "bibtex"
+		}
+		format, ok := citationFormats[name]
+		if !ok {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Unsupported citation format " + name})
+		}
+
+		idParam := c.Param("id")
+		book, err := findBook(c.Request().Context(), coll, idParam)
+		if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Book not found with ID " + idParam})
+		} else if err != nil {
+			log.Printf("Error fetching book with ID %s: %v", idParam, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch book"})
+		}
+		return c.Blob(http.StatusOK, format.contentType, []byte(format.format(book, citationKey(book))))
+	}
+}
+
+// Writes the citations of a whole collection, e.g. for a .bib file. Keys
+// must be unique within a file, so repeated keys get a letter appended, as
+// in "poe1843black" and "poe1843blacka".
+type citationWriter struct {
+	w      io.Writer
+	format citationFormat
+	keys   map[string]int
+}
+
+func (cw *citationWriter) Write(book BookStore) error {
+	key := citationKey(book)
+	if n := cw.keys[key]; n > 0 {
+		cw.keys[key]++
+		key += string(rune('a' + (n-1)%26))
+	} else {
+		cw.keys[key] = 1
+	}
+	_, err := io.WriteString(cw.w, cw.format.format(book, key)+"\n")
+	return err
+}
+
+func (cw *citationWriter) Flush() error {
+	return nil
+}
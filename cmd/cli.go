@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// The binary runs one of several commands, named by its first argument:
+//
+//	app serve [--dev] [--seed=false]     run the web server (the default)
+//	app migrate [status]                 apply or list the migrations
+//	app seed [--file books.json]         insert the seed books; see seeds.go
+//	app export [--format csv] [--out f]  write all books to stdout or a file
+//	app import --file books.csv          insert books from a CSV file
+//	app bench [--url URL] [--writes 0.1] load a running server; see bench.go
+//	app token --subject ci [--tenant t]  print a bearer token; see tenants.go
+//
+// All of them are configured by the same environment variables. Without a
+// command, or when the first argument is a flag, it serves, so
+// `go run ./cmd --dev` keeps working.
+
+type command struct {
+	name    string
+	usage   string
+	summary string
+	run     func(cfg Config, args []string) error
+}
+
+var commands = []command{
+	{"serve", "[--dev] [--seed=false]", "run the web server", serveCommand},
+	{"migrate", "[status]", "apply the pending migrations, or list them all", migrateCommand},
+	{"seed", "[--file books.json]", "insert the seed books missing from the database", seedCommand},
+	{"export", "[--format csv] [--out books.csv]", "write all books to stdout or a file", exportCommand},
+	{"import", "--file books.csv", "insert the books of a CSV file and print a report", importCommand},
+	{"bench", "[--url URL] [--duration 30s]", "put load on a running server and report latencies", benchCommand},
+	{"token", "--subject ci [--tenant acme]", "print a bearer token signed with JWT_SECRET", tokenCommand},
+}
+
+func main() {
+	cfg := loadConfig()
+
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	for _, cmd := range commands {
+		if cmd.name == name {
+			if err := cmd.run(cfg, args); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+	if name != "help" {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+	}
+	printUsage(os.Stderr)
+	if name != "help" {
+		os.Exit(2)
+	}
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s <command> [flags]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-8s %-35s %s\n", cmd.name, cmd.usage, cmd.summary)
+	}
+}
+
+// A flag set for a command, printing the command's usage on errors and -h.
+func commandFlags(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s [flags]\n", os.Args[0], name)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+func serveCommand(cfg Config, args []string) error {
+	flags := commandFlags("serve")
+	dev := flags.Bool("dev", cfg.Dev, "load templates and CSS from views/ and css/ on disk and reload templates on every request")
+	seed := flags.Bool("seed", cfg.SeedOnStart, "insert the seed books missing from the database")
+	flags.Parse(args)
+	cfg.Dev, cfg.SeedOnStart = *dev, *seed
+	runServer(cfg)
+	return nil
+}
+
+// Connects to Mongo for a command other than serve, which has no tracing
+// or timing of its own. The caller disconnects.
+func connectForCommand(ctx context.Context, cfg Config) (*mongo.Client, error) {
+	opts, err := mongoClientOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	client, err := mongo.Connect(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(context.Background())
+		return nil, fmt.Errorf("connecting to MongoDB: %w", err)
+	}
+	return client, nil
+}
+
+// Commands that insert books compute their search keys, which must match
+// the ones the server computes.
+func useSearchConfig(cfg Config) error {
+	if cfg.SearchNGramMin < 1 || cfg.SearchNGramMax < cfg.SearchNGramMin {
+		return fmt.Errorf("SEARCH_NGRAM_MIN must be at least 1 and at most SEARCH_NGRAM_MAX")
+	}
+	ngramRange.Min, ngramRange.Max = cfg.SearchNGramMin, cfg.SearchNGramMax
+	return nil
+}
+
+func migrateCommand(cfg Config, args []string) error {
+	flags := commandFlags("migrate")
+	flags.Parse(args)
+	ctx := context.Background()
+	client, err := connectForCommand(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+
+	db := client.Database(databaseName)
+	if flags.Arg(0) == "status" {
+		return printMigrationStatus(ctx, db)
+	}
+	applied, err := migrate(ctx, db)
+	if err != nil {
+		return err
+	}
+	log.Printf("Applied %d migrations", applied)
+	return nil
+}
+
+// Inserts the seed books, skipping those whose ID exists. Each book is
+// printed with what happened to it.
+func seedCommand(cfg Config, args []string) error {
+	flags := commandFlags("seed")
+	file := flags.String("file", cfg.SeedFile, "JSON or YAML file with an array of books; the built-in example books when empty")
+	flags.Parse(args)
+	if err := useSearchConfig(cfg); err != nil {
+		return err
+	}
+	books, err := loadSeeds(*file)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	client, err := connectForCommand(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+	coll, err := prepareDatabase(client, databaseName, "information")
+	if err != nil {
+		return err
+	}
+	authors, err := prepareDatabase(client, databaseName, "authors")
+	if err != nil {
+		return err
+	}
+
+	// Servers without a change stream do not learn about books written by
+	// commands.
+	outcomes, err := insertBooksUnordered(ctx, coll, authors, books, directEvents{})
+	if err != nil {
+		return err
+	}
+	created := 0
+	for i, outcome := range outcomes {
+		if outcome.Status == bulkCreated {
+			created++
+			fmt.Printf("%s: %s\n", books[i].ID, outcome.Status)
+		} else {
+			fmt.Printf("%s: %s: %s\n", books[i].ID, outcome.Status, outcome.Error)
+		}
+	}
+	log.Printf("Seeded %d of %d books", created, len(books))
+	return nil
+}
+
+func exportCommand(cfg Config, args []string) error {
+	flags := commandFlags("export")
+	names := make([]string, 0, len(exportFormats))
+	for name := range exportFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	name := flags.String("format", "csv", "one of "+strings.Join(names, ", "))
+	outPath := flags.String("out", "", "file to write to; stdout when empty")
+	flags.Parse(args)
+	format, ok := exportFormats[*name]
+	if !ok {
+		return fmt.Errorf("unsupported export format %s", *name)
+	}
+
+	ctx := context.Background()
+	client, err := connectForCommand(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+
+	var out io.Writer = os.Stdout
+	if *outPath != "" {
+		f, err := os.Create(*outPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	cursor, err := client.Database(databaseName).Collection("information").Find(ctx, notDeleted(bson.M{}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	return writeExport(ctx, cursor, format, out, func() {})
+}
+
+func importCommand(cfg Config, args []string) error {
+	flags := commandFlags("import")
+	file := flags.String("file", "", "CSV file with the columns of GET /api/books/export")
+	flags.Parse(args)
+	if *file == "" {
+		flags.Usage()
+		return fmt.Errorf("import needs --file")
+	}
+	if err := useSearchConfig(cfg); err != nil {
+		return err
+	}
+	f, err := os.Open(*file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	books, report, err := parseBookCSV(f)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	client, err := connectForCommand(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+	coll, err := prepareDatabase(client, databaseName, "information")
+	if err != nil {
+		return err
+	}
+	authors, err := prepareDatabase(client, databaseName, "authors")
+	if err != nil {
+		return err
+	}
+	if err := insertImportedBooks(ctx, coll, authors, books, report, directEvents{}); err != nil {
+		return err
+	}
+	report.count()
+	out := json.NewEncoder(os.Stdout)
+	out.SetIndent("", "  ")
+	return out.Encode(report)
+}
+
+// Signs a token without a user account, e.g. for scripts, or as the API
+// key of a library.
+func tokenCommand(cfg Config, args []string) error {
+	flags := commandFlags("token")
+	subject := flags.String("subject", "", "who the token is for")
+	role := flags.String("role", RoleReader, "reader, editor, or admin")
+	tenant := flags.String("tenant", "", "the only library the token opens; see TENANTS")
+	ttl := flags.Duration("ttl", cfg.TokenTTL, "how long the token is valid")
+	flags.Parse(args)
+	if *subject == "" {
+		flags.Usage()
+		return fmt.Errorf("token needs --subject")
+	}
+	if cfg.JWTSecret == "" {
+		return fmt.Errorf("token needs JWT_SECRET")
+	}
+	if _, ok := roleRank[*role]; !ok {
+		return fmt.Errorf("unknown role %s", *role)
+	}
+	if *tenant != "" && !slices.Contains(cfg.Tenants, *tenant) {
+		return fmt.Errorf("unknown tenant %s, see TENANTS", *tenant)
+	}
+	token, expires, err := newAccessControl(cfg.JWTSecret).IssueForTenant(*subject, *role, *tenant, *ttl)
+	if err != nil {
+		return err
+	}
+	fmt.Println(token)
+	fmt.Fprintf(os.Stderr, "Valid until %s\n", expires.Format(time.RFC3339))
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/client"
+)
+
+// The client package against the book endpoints on the in-memory
+// repository, as another service would use it.
+
+func TestClientBooks(t *testing.T) {
+	server, _ := newContractServerIfMatch(t, "", true)
+	c := client.New(server.URL)
+	ctx := context.Background()
+
+	created, err := c.Create(ctx, client.Book{ID: "carmilla", Title: "Carmilla", Author: "Sheridan Le Fanu", Pages: 108, Year: 1872, Tags: []string{"Horror"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Version != 1 || created.CreatedAt.IsZero() || created.Tags[0] != "horror" {
+		t.Errorf("created book is %+v, want version 1, a creation time, and normalized tags", created)
+	}
+	if _, err := c.Create(ctx, client.Book{ID: "carmilla", Title: "Carmilla", Author: "Sheridan Le Fanu", Pages: 108, Year: 1872}); !errors.Is(err, client.ErrConflict) {
+		t.Errorf("creating it again failed with %v, want ErrConflict", err)
+	}
+	var apiErr *client.Error
+	if _, err := c.Create(ctx, client.Book{ID: "untitled", Author: "Nobody", Pages: 1}); !errors.As(err, &apiErr) || apiErr.Fields["title"] == "" {
+		t.Errorf("creating a book without title failed with %v, want a validation error for the title", err)
+	}
+
+	got, err := c.Get(ctx, "carmilla")
+	if err != nil || got.Title != "Carmilla" || got.Pages != 108 || !got.Available {
+		t.Errorf("got %+v, %v", got, err)
+	}
+
+	got.Title = "Carmilla: A Vampyre Tale"
+	updated, err := c.Update(ctx, got)
+	if err != nil || updated.Version != 2 || updated.Title != got.Title {
+		t.Errorf("updated book is %+v, %v, want the new title in version 2", updated, err)
+	}
+	if _, err := c.Update(ctx, got); !errors.Is(err, client.ErrConflict) {
+		t.Errorf("updating version 1 again failed with %v, want ErrConflict", err)
+	}
+	got.Version = 0
+	if _, err := c.Update(ctx, got); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusPreconditionRequired {
+		t.Errorf("updating without a version failed with %v, want 428", err)
+	}
+
+	page, err := c.List(ctx, client.ListOptions{Sort: "-year", Tags: []string{"horror"}})
+	if err != nil || page.Total != 1 || len(page.Books) != 1 || page.Books[0].ID != "carmilla" {
+		t.Errorf("listed %+v, %v, want carmilla alone", page, err)
+	}
+
+	if err := c.Delete(ctx, "carmilla"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ctx, "carmilla"); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("getting the deleted book failed with %v, want ErrNotFound", err)
+	}
+}
+
+func TestClientIteratesPages(t *testing.T) {
+	server, books := newContractServer(t, "")
+	for i := range 6 {
+		if err := books.Create(context.Background(), contractBook(fmt.Sprintf("book-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := client.New(server.URL)
+
+	var ids []string
+	it := c.Books(context.Background(), client.ListOptions{Size: 3, Sort: "id"})
+	for it.Next() {
+		ids = append(ids, it.Book().ID)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"book-0", "book-1", "book-2", "book-3", "book-4", "book-5", "dracula"}
+	if fmt.Sprint(ids) != fmt.Sprint(want) {
+		t.Errorf("iterated %v, want %v", ids, want)
+	}
+
+	// Without a sort, it follows cursors in the order books were added in.
+	ids = nil
+	it = c.Books(context.Background(), client.ListOptions{Size: 3})
+	for it.Next() {
+		ids = append(ids, it.Book().ID)
+	}
+	want = []string{"dracula", "book-0", "book-1", "book-2", "book-3", "book-4", "book-5"}
+	if err := it.Err(); err != nil || fmt.Sprint(ids) != fmt.Sprint(want) {
+		t.Errorf("iterated %v, %v, want %v", ids, err, want)
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	var attempts atomic.Int32
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"dracula","title":"Dracula","author":"Bram Stoker","version":1}`)
+	}))
+	defer flaky.Close()
+	c := client.New(flaky.URL)
+	c.Backoff = time.Millisecond
+
+	book, err := c.Get(context.Background(), "dracula")
+	if err != nil || book.Title != "Dracula" || attempts.Load() != 3 {
+		t.Errorf("got %+v, %v after %d attempts, want Dracula after 3", book, err, attempts.Load())
+	}
+
+	attempts.Store(-10)
+	var apiErr *client.Error
+	if _, err := c.Get(context.Background(), "dracula"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got %v, want the 503 after giving up", err)
+	}
+}
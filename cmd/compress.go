@@ -0,0 +1,190 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/labstack/echo/v4"
+)
+
+// Compresses responses with brotli or gzip, depending on what the client
+// accepts. Echo ships a gzip middleware, but it cannot look at the content
+// type of a response, so we wrap the response writer ourselves: the body is
+// buffered until it reaches cfg.CompressMinSize bytes, and only responses
+// whose Content-Type is listed in cfg.CompressTypes are compressed at all.
+// Small or unlisted responses (e.g., images) are passed through untouched.
+func compression(cfg Config) echo.MiddlewareFunc {
+	if len(cfg.CompressTypes) == 0 {
+		return passThrough
+	}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			encoding := negotiateEncoding(c.Request().Header.Get(echo.HeaderAcceptEncoding))
+			// WebSocket connections are taken over by the handler and
+			// never get an HTTP body to compress.
+			if encoding == "" || c.IsWebSocket() {
+				return next(c)
+			}
+			c.Response().Header().Add(echo.HeaderVary, echo.HeaderAcceptEncoding)
+
+			res := c.Response()
+			cw := &compressWriter{
+				ResponseWriter: res.Writer,
+				encoding:       encoding,
+				minSize:        cfg.CompressMinSize,
+				types:          cfg.CompressTypes,
+				status:         http.StatusOK,
+			}
+			res.Writer = cw
+			// The writer is put back before the error handler runs, so an
+			// error answer of a handler that wrote nothing goes out as is.
+			defer func() {
+				res.Writer = cw.ResponseWriter
+				cw.Close()
+			}()
+			return next(c)
+		}
+	}
+}
+
+// Picks the best encoding from an Accept-Encoding header. Brotli usually
+// wins on text, so it is preferred when the client supports both.
+func negotiateEncoding(header string) string {
+	var accepted []string
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.ReplaceAll(params, " ", "") == "q=0" {
+			continue
+		}
+		accepted = append(accepted, strings.ToLower(strings.TrimSpace(name)))
+	}
+	for _, encoding := range []string{"br", "gzip"} {
+		if slices.Contains(accepted, encoding) {
+			return encoding
+		}
+	}
+	return ""
+}
+
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+	types    []string
+
+	status      int
+	wroteHeader bool
+	buf         []byte
+	decided     bool
+	enc         io.WriteCloser
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	// Hold the status back until we know whether the body gets compressed,
+	// because that changes the headers we have to send.
+	w.status = code
+	w.wroteHeader = true
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if w.decided {
+		if w.enc != nil {
+			return w.enc.Write(p)
+		}
+		return w.ResponseWriter.Write(p)
+	}
+	if !w.compressible() {
+		w.passThrough()
+		return w.ResponseWriter.Write(p)
+	}
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= w.minSize {
+		if err := w.startCompression(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Streaming responses cannot wait for the buffer to fill up, so a flush
+// forces the decision and pushes everything written so far to the client.
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		if w.compressible() {
+			w.startCompression()
+		} else {
+			w.passThrough()
+		}
+	}
+	if flusher, ok := w.enc.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Lets http.ResponseController reach the underlying writer, e.g., to hijack
+// the connection.
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Finishes the response. Bodies that never reached the minimum size are
+// sent as they are. A response nothing was written to is left uncommitted,
+// for the error handler to answer.
+func (w *compressWriter) Close() error {
+	if !w.decided {
+		if !w.wroteHeader && len(w.buf) == 0 {
+			return nil
+		}
+		w.passThrough()
+		if len(w.buf) > 0 {
+			if _, err := w.ResponseWriter.Write(w.buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if w.enc != nil {
+		return w.enc.Close()
+	}
+	return nil
+}
+
+func (w *compressWriter) compressible() bool {
+	header := w.Header()
+	if header.Get(echo.HeaderContentEncoding) != "" {
+		return false
+	}
+	if w.status == http.StatusNoContent || w.status == http.StatusNotModified || w.status < http.StatusOK {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get(echo.HeaderContentType))
+	return err == nil && slices.Contains(w.types, mediaType)
+}
+
+func (w *compressWriter) passThrough() {
+	w.decided = true
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+func (w *compressWriter) startCompression() error {
+	w.decided = true
+	header := w.Header()
+	header.Set(echo.HeaderContentEncoding, w.encoding)
+	header.Del(echo.HeaderContentLength)
+	w.ResponseWriter.WriteHeader(w.status)
+
+	if w.encoding == "br" {
+		w.enc = brotli.NewWriter(w.ResponseWriter)
+	} else {
+		w.enc = gzip.NewWriter(w.ResponseWriter)
+	}
+	_, err := w.enc.Write(w.buf)
+	w.buf = nil
+	return err
+}
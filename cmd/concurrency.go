@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Context key under which requireIfMatch stores the version of the book the
+// client's ETag refers to.
+const expectedVersionKey = "expectedVersion"
+
+// Works out which version of a book the client based its change on. It can
+// come from the "version" field of the body or, indirectly, from the ETag in
+// If-Match. ok is false when the client did not say.
+func expectedVersion(c echo.Context, payload map[string]interface{}) (version int, ok bool, err error) {
+	if raw, found := payload["version"]; found {
+		switch v := raw.(type) {
+		case float64:
+			return int(v), true, nil
+		case string:
+			version, err := strconv.Atoi(v)
+			return version, err == nil, err
+		default:
+			return 0, false, strconv.ErrSyntax
+		}
+	}
+	version, ok = c.Get(expectedVersionKey).(int)
+	return version, ok, nil
+}
+
+// Narrows a filter down to one version of a document, so the write only
+// happens if nobody changed the book in the meantime. Books stored before
+// versioning existed have no version field and count as version 0.
+func withVersion(filter bson.M, version int) bson.M {
+	if version == 0 {
+		filter["version"] = bson.M{"$in": bson.A{0, nil}}
+	} else {
+		filter["version"] = version
+	}
+	return filter
+}
+
+// Reports whether a JSON body carries a "version" field, leaving the body
+// intact for the handler to bind later.
+func bodyHasVersion(c echo.Context) bool {
+	req := c.Request()
+	if req.Body == nil {
+		return false
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	var payload map[string]interface{}
+	if json.Unmarshal(body, &payload) != nil {
+		return false
+	}
+	_, ok := payload["version"]
+	return ok
+}
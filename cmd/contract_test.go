@@ -0,0 +1,817 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/bookpb"
+	"github.com/CAPS-Cloud/exercises/openlibrary"
+	"github.com/labstack/echo/v4"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+// The status codes and shapes of the answers of the /api/books endpoints,
+// for valid, malformed, missing, and duplicate payloads. The endpoints run
+// on the in-memory repository, so these tests need no MongoDB. That limits
+// them to the routes of registerBookRoutes, each of which TestBookContract
+// checks to have a case. The rest of /api works on the collections
+// directly and is left to the integration tests.
+
+// Serves the book endpoints like newServer does with the default
+// configuration, on books, with a book "dracula" in version 1.
+func newContractServer(t *testing.T, secret string) (*httptest.Server, *memoryBooks) {
+	t.Helper()
+	return newContractServerIfMatch(t, secret, loadConfig().RequireIfMatch)
+}
+
+// Like newContractServer, with If-Match required if required is set, as
+// with REQUIRE_IF_MATCH=true.
+func newContractServerIfMatch(t *testing.T, secret string, required bool) (*httptest.Server, *memoryBooks) {
+	t.Helper()
+	cfg := loadConfig()
+	cfg.MaxBodySize = "1K"
+	books := newMemoryBooks()
+	if err := books.Create(context.Background(), contractBook("dracula")); err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	e.Use(bodyLimit(cfg))
+	cache := newResponseCache(cfg)
+	e.Use(cache.PurgeOnWrites())
+	access := newAccessControl(secret)
+	api := e.Group("/api", requireJSON(), access.Authenticate())
+	registerBookRoutes(api, books, openlibrary.New(time.Second, time.Minute), fixedRates{"EUR": 1, "USD": 1.1}, access, cache, passThrough, requireIfMatch(books, required))
+
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+	return server, books
+}
+
+func contractBook(id string) *BookStore {
+	return &BookStore{
+		ID:          id,
+		BookName:    "Dracula",
+		BookAuthor:  "Bram Stoker",
+		BookEdition: "9783649646099",
+		BookPages:   418,
+		BookYear:    1897,
+	}
+}
+
+// The shapes answers come in.
+const (
+	shapeNone       = "none"
+	shapeBook       = "book"
+	shapeList       = "list"
+	shapeError      = "error"
+	shapeValidation = "validation"
+)
+
+type contractCase struct {
+	name        string
+	method      string
+	path        string
+	contentType string
+	header      map[string]string
+	body        string
+	status      int
+	shape       string
+}
+
+func (tc contractCase) run(t *testing.T, server *httptest.Server) (*http.Response, interface{}) {
+	t.Helper()
+	req, err := http.NewRequest(tc.method, server.URL+tc.path, strings.NewReader(tc.body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tc.body != "" {
+		contentType := tc.contentType
+		if contentType == "" {
+			contentType = echo.MIMEApplicationJSON
+		}
+		req.Header.Set(echo.HeaderContentType, contentType)
+	}
+	for name, value := range tc.header {
+		req.Header.Set(name, value)
+	}
+	if host := tc.header["Host"]; host != "" {
+		req.Host = host
+	}
+	res, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != tc.status {
+		t.Errorf("%s %s answered %d, want %d", tc.method, tc.path, res.StatusCode, tc.status)
+	}
+	var answer interface{}
+	if tc.shape == shapeNone {
+		return res, nil
+	}
+	if err := json.NewDecoder(res.Body).Decode(&answer); err != nil {
+		t.Fatalf("%s %s answered no JSON: %v", tc.method, tc.path, err)
+	}
+	checkShape(t, tc.shape, answer)
+	return res, answer
+}
+
+func checkShape(t *testing.T, shape string, answer interface{}) {
+	t.Helper()
+	switch shape {
+	case shapeList:
+		if _, ok := answer.([]interface{}); !ok {
+			t.Errorf("answer is %v, want a list of books", answer)
+		}
+	case shapeBook:
+		book, ok := answer.(map[string]interface{})
+		if !ok {
+			t.Fatalf("answer is %v, want a book", answer)
+		}
+		for _, field := range []string{"id", "title", "author", "edition", "pages", "year", "version"} {
+			if _, ok := book[field]; !ok {
+				t.Errorf("book %v has no %s", book, field)
+			}
+		}
+		// Stored fields stay on the server.
+		for _, field := range []string{"mongo_id", "_id", "bookname", "checkout", "deleted_at"} {
+			if _, ok := book[field]; ok {
+				t.Errorf("book %v shows the stored %s", book, field)
+			}
+		}
+	case shapeError, shapeValidation:
+		object, ok := answer.(map[string]interface{})
+		if !ok {
+			t.Fatalf("answer is %v, want an error", answer)
+		}
+		if msg, ok := object["error"].(string); !ok || msg == "" {
+			t.Errorf("answer %v has no error message", object)
+		}
+		if _, ok := object["fields"].(map[string]interface{}); shape == shapeValidation && !ok {
+			t.Errorf("answer %v has no fields", object)
+		}
+	}
+}
+
+const (
+	validBook   = `{"id": "carmilla", "title": "Carmilla", "author": "Sheridan Le Fanu", "pages": 108, "year": 1872}`
+	draculaBook = `{"id": "dracula", "title": "Dracula", "author": "Bram Stoker", "pages": 418, "year": 1897}`
+	malformed   = `{"id": "dracula", "title": `
+)
+
+func TestBookContract(t *testing.T) {
+	future := strconv.Itoa(time.Now().Year() + 10)
+	cases := []contractCase{
+		{name: "list", method: http.MethodGet, path: "/api/books", status: http.StatusOK, shape: shapeList},
+		{name: "list a page", method: http.MethodGet, path: "/api/books?page=1&size=10&sort=-year", status: http.StatusOK, shape: shapeList},
+		{name: "list some fields", method: http.MethodGet, path: "/api/books?fields=id,title", status: http.StatusOK, shape: shapeList},
+		{name: "list filtered", method: http.MethodGet, path: "/api/books?year_from=1800&year_to=1900&min_pages=100", status: http.StatusOK, shape: shapeList},
+		{name: "list with a malformed filter", method: http.MethodGet, path: "/api/books?year_from=soon", status: http.StatusUnprocessableEntity, shape: shapeValidation},
+		{name: "list with a bad page", method: http.MethodGet, path: "/api/books?page=0", status: http.StatusUnprocessableEntity, shape: shapeValidation},
+		{name: "list with a huge page", method: http.MethodGet, path: "/api/books?size=1000", status: http.StatusUnprocessableEntity, shape: shapeValidation},
+		{name: "list with an unknown sort", method: http.MethodGet, path: "/api/books?sort=weight", status: http.StatusUnprocessableEntity, shape: shapeValidation},
+		{name: "list with an unknown field", method: http.MethodGet, path: "/api/books?fields=weight", status: http.StatusUnprocessableEntity, shape: shapeValidation},
+		{name: "list as an image", method: http.MethodGet, path: "/api/books", header: map[string]string{"Accept": "image/png"}, status: http.StatusNotAcceptable, shape: shapeError},
+		{name: "head of the list", method: http.MethodHead, path: "/api/books", status: http.StatusOK, shape: shapeNone},
+
+		{name: "get", method: http.MethodGet, path: "/api/books/dracula", status: http.StatusOK, shape: shapeBook},
+		{name: "get as XML", method: http.MethodGet, path: "/api/books/dracula", header: map[string]string{"Accept": "application/xml"}, status: http.StatusOK, shape: shapeNone},
+		{name: "get missing", method: http.MethodGet, path: "/api/books/nosferatu", status: http.StatusNotFound, shape: shapeError},
+		{name: "head", method: http.MethodHead, path: "/api/books/dracula", status: http.StatusOK, shape: shapeNone},
+
+		{name: "create", method: http.MethodPost, path: "/api/books", body: validBook, status: http.StatusCreated, shape: shapeBook},
+		{name: "create with pages as text", method: http.MethodPost, path: "/api/books", body: strings.Replace(validBook, "108", `"108"`, 1), status: http.StatusCreated, shape: shapeBook},
+		{name: "create duplicate", method: http.MethodPost, path: "/api/books", body: draculaBook, status: http.StatusConflict, shape: shapeError},
+		{name: "create malformed", method: http.MethodPost, path: "/api/books", body: malformed, status: http.StatusBadRequest, shape: shapeError},
+		{name: "create without fields", method: http.MethodPost, path: "/api/books", body: `{"id": "carmilla"}`, status: http.StatusUnprocessableEntity, shape: shapeValidation},
+		{name: "create without a body", method: http.MethodPost, path: "/api/books", status: http.StatusBadRequest, shape: shapeError},
+		{name: "create with a wrong type", method: http.MethodPost, path: "/api/books", body: strings.Replace(validBook, "108", `"many"`, 1), status: http.StatusUnprocessableEntity, shape: shapeValidation},
+		{name: "create with an unknown field", method: http.MethodPost, path: "/api/books", body: strings.Replace(validBook, `"pages"`, `"weight": 300, "pages"`, 1), status: http.StatusUnprocessableEntity, shape: shapeValidation},
+		{name: "create with a number as title", method: http.MethodPost, path: "/api/books", body: strings.Replace(validBook, `"Carmilla"`, "7", 1), status: http.StatusUnprocessableEntity, shape: shapeValidation},
+		{name: "create from the future", method: http.MethodPost, path: "/api/books", body: strings.Replace(validBook, "1872", future, 1), status: http.StatusUnprocessableEntity, shape: shapeValidation},
+		{name: "create with a bad ISBN", method: http.MethodPost, path: "/api/books", body: strings.Replace(validBook, `"pages"`, `"edition": "978-0-00-000000-1", "pages"`, 1), status: http.StatusUnprocessableEntity, shape: shapeValidation},
+		{name: "create from a form", method: http.MethodPost, path: "/api/books", contentType: echo.MIMEApplicationForm, body: "id=carmilla", status: http.StatusUnsupportedMediaType, shape: shapeError},
+		{name: "create too large", method: http.MethodPost, path: "/api/books", body: strings.Replace(validBook, "Carmilla", strings.Repeat("C", 2048), 1), status: http.StatusRequestEntityTooLarge, shape: shapeError},
+
+		{name: "replace", method: http.MethodPut, path: "/api/books/dracula", body: draculaBook, status: http.StatusOK, shape: shapeBook},
+		{name: "replace without the ID", method: http.MethodPut, path: "/api/books/dracula", body: strings.Replace(draculaBook, `"id": "dracula", `, "", 1), status: http.StatusOK, shape: shapeBook},
+		{name: "replace in the current version", method: http.MethodPut, path: "/api/books/dracula", body: strings.Replace(draculaBook, "}", `, "version": 1}`, 1), status: http.StatusOK, shape: shapeBook},
+		{name: "replace in a stale version", method: http.MethodPut, path: "/api/books/dracula", body: strings.Replace(draculaBook, "}", `, "version": 7}`, 1), status: http.StatusConflict, shape: shapeError},
+		{name: "replace missing", method: http.MethodPut, path: "/api/books/carmilla", body: validBook, status: http.StatusNotFound, shape: shapeError},
+		{name: "replace missing with upsert", method: http.MethodPut, path: "/api/books/carmilla?upsert=true", body: validBook, status: http.StatusCreated, shape: shapeBook},
+		{name: "replace with another ID", method: http.MethodPut, path: "/api/books/dracula", body: validBook, status: http.StatusUnprocessableEntity, shape: shapeValidation},
+		{name: "replace malformed", method: http.MethodPut, path: "/api/books/dracula", body: malformed, status: http.StatusBadRequest, shape: shapeError},
+		{name: "replace incomplete", method: http.MethodPut, path: "/api/books/dracula", body: `{"title": "Dracula"}`, status: http.StatusUnprocessableEntity, shape: shapeValidation},
+		{name: "replace with a bad version", method: http.MethodPut, path: "/api/books/dracula", body: strings.Replace(draculaBook, "}", `, "version": "new"}`, 1), status: http.StatusUnprocessableEntity, shape: shapeValidation},
+		{name: "replace with a stale ETag", method: http.MethodPut, path: "/api/books/dracula", header: map[string]string{"If-Match": `"stale"`}, body: draculaBook, status: http.StatusPreconditionFailed, shape: shapeError},
+		{name: "replace missing with an ETag", method: http.MethodPut, path: "/api/books/carmilla", header: map[string]string{"If-Match": `"stale"`}, body: validBook, status: http.StatusNotFound, shape: shapeError},
+
+		{name: "patch", method: http.MethodPatch, path: "/api/books/dracula", body: `{"pages": 420}`, status: http.StatusOK, shape: shapeBook},
+		{name: "merge patch", method: http.MethodPatch, path: "/api/books/dracula", contentType: mergePatchType, body: `{"tags": ["horror"]}`, status: http.StatusOK, shape: shapeBook},
+		{name: "JSON patch", method: http.MethodPatch, path: "/api/books/dracula", contentType: jsonPatchType, body: `[{"op": "replace", "path": "/title", "value": "Dracula's Guest"}]`, status: http.StatusOK, shape: shapeBook},
+		{name: "JSON patch with a failed test", method: http.MethodPatch, path: "/api/books/dracula", contentType: jsonPatchType, body: `[{"op": "test", "path": "/title", "value": "Carmilla"}]`, status: http.StatusConflict, shape: shapeError},
+		{name: "JSON patch malformed", method: http.MethodPatch, path: "/api/books/dracula", contentType: jsonPatchType, body: `{"op": "replace"}`, status: http.StatusBadRequest, shape: shapeError},
+		{name: "patch missing", method: http.MethodPatch, path: "/api/books/nosferatu", body: `{"pages": 420}`, status: http.StatusNotFound, shape: shapeError},
+		{name: "patch in a stale version", method: http.MethodPatch, path: "/api/books/dracula", body: `{"pages": 420, "version": 7}`, status: http.StatusConflict, shape: shapeError},
+		{name: "patch malformed", method: http.MethodPatch, path: "/api/books/dracula", body: malformed, status: http.StatusBadRequest, shape: shapeError},
+		{name: "patch nothing", method: http.MethodPatch, path: "/api/books/dracula", body: `{}`, status: http.StatusBadRequest, shape: shapeError},
+		{name: "patch invalid", method: http.MethodPatch, path: "/api/books/dracula", body: `{"pages": -1}`, status: http.StatusUnprocessableEntity, shape: shapeValidation},
+		{name: "patch a required field away", method: http.MethodPatch, path: "/api/books/dracula", contentType: mergePatchType, body: `{"title": null}`, status: http.StatusUnprocessableEntity, shape: shapeValidation},
+		{name: "patch with a wrong type", method: http.MethodPatch, path: "/api/books/dracula", body: `{"year": "long ago"}`, status: http.StatusUnprocessableEntity, shape: shapeValidation},
+		{name: "patch an unknown field", method: http.MethodPatch, path: "/api/books/dracula", body: `{"titel": "Dracula's Guest"}`, status: http.StatusUnprocessableEntity, shape: shapeValidation},
+		{name: "patch as XML", method: http.MethodPatch, path: "/api/books/dracula", contentType: echo.MIMEApplicationXML, body: "<book/>", status: http.StatusUnsupportedMediaType, shape: shapeError},
+
+		{name: "delete", method: http.MethodDelete, path: "/api/books/dracula", status: http.StatusOK, shape: shapeNone},
+		{name: "delete missing", method: http.MethodDelete, path: "/api/books/nosferatu", status: http.StatusNotFound, shape: shapeError},
+		{name: "delete with a stale ETag", method: http.MethodDelete, path: "/api/books/dracula", header: map[string]string{"If-Match": `"stale"`}, status: http.StatusPreconditionFailed, shape: shapeError},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server, _ := newContractServer(t, "")
+			tc.run(t, server)
+		})
+	}
+
+	// A route added to registerBookRoutes needs cases above.
+	e := echo.New()
+	routes := registerBookRoutes(e.Group("/api"), newMemoryBooks(), nil, fixedRates{}, newAccessControl(""), newResponseCache(loadConfig()), passThrough, passThrough)
+	covered := map[string]bool{}
+	for _, tc := range cases {
+		c := e.NewContext(nil, nil)
+		path, _, _ := strings.Cut(tc.path, "?")
+		e.Router().Find(tc.method, path, c)
+		covered[tc.method+" "+c.Path()] = true
+	}
+	for key := range routeKeys(routes) {
+		if !covered[key] {
+			t.Errorf("%s has no contract case", key)
+		}
+	}
+}
+
+// Each write shows up in the next read, and the version counts the writes.
+func TestBookLifecycle(t *testing.T) {
+	server, _ := newContractServer(t, "")
+	steps := []contractCase{
+		{method: http.MethodPost, path: "/api/books", body: validBook, status: http.StatusCreated, shape: shapeBook},
+		{method: http.MethodPost, path: "/api/books", body: validBook, status: http.StatusConflict, shape: shapeError},
+		{method: http.MethodPatch, path: "/api/books/carmilla", body: `{"pages": 110, "version": 1}`, status: http.StatusOK, shape: shapeBook},
+		{method: http.MethodPatch, path: "/api/books/carmilla", body: `{"pages": 112, "version": 1}`, status: http.StatusConflict, shape: shapeError},
+		{method: http.MethodDelete, path: "/api/books/carmilla", status: http.StatusOK, shape: shapeNone},
+		{method: http.MethodGet, path: "/api/books/carmilla", status: http.StatusNotFound, shape: shapeError},
+		{method: http.MethodDelete, path: "/api/books/carmilla", status: http.StatusNotFound, shape: shapeError},
+		// A deleted book's ID can be taken by a new book.
+		{method: http.MethodPost, path: "/api/books", body: validBook, status: http.StatusCreated, shape: shapeBook},
+	}
+	for _, step := range steps {
+		step.run(t, server)
+	}
+
+	res, answer := contractCase{method: http.MethodGet, path: "/api/books?sort=id", status: http.StatusOK, shape: shapeList}.run(t, server)
+	if total := res.Header.Get("X-Total-Count"); total != "2" {
+		t.Errorf("X-Total-Count is %q, want 2", total)
+	}
+	if list := answer.([]interface{}); len(list) != 2 || list[0].(map[string]interface{})["id"] != "carmilla" {
+		t.Errorf("listed %v, want carmilla and dracula", list)
+	}
+
+	// The ETag of GET is good for If-Match until the book changes.
+	res, _ = contractCase{method: http.MethodGet, path: "/api/books/dracula", status: http.StatusOK, shape: shapeBook}.run(t, server)
+	etag := map[string]string{"If-Match": res.Header.Get("ETag")}
+	contractCase{method: http.MethodPut, path: "/api/books/dracula", header: etag, body: draculaBook, status: http.StatusOK, shape: shapeBook}.run(t, server)
+	contractCase{method: http.MethodPut, path: "/api/books/dracula", header: etag, body: draculaBook, status: http.StatusPreconditionFailed, shape: shapeError}.run(t, server)
+}
+
+// With REQUIRE_IF_MATCH=true, writes need If-Match or a version, except
+// an upsert creating a book.
+func TestBookContractIfMatchRequired(t *testing.T) {
+	cases := []contractCase{
+		{name: "replace without a precondition", method: http.MethodPut, path: "/api/books/dracula", body: draculaBook, status: http.StatusPreconditionRequired, shape: shapeError},
+		{name: "replace in the current version", method: http.MethodPut, path: "/api/books/dracula", body: strings.Replace(draculaBook, "}", `, "version": 1}`, 1), status: http.StatusOK, shape: shapeBook},
+		{name: "patch without a precondition", method: http.MethodPatch, path: "/api/books/dracula", body: `{"pages": 420}`, status: http.StatusPreconditionRequired, shape: shapeError},
+		{name: "patch in the current version", method: http.MethodPatch, path: "/api/books/dracula", body: `{"pages": 420, "version": 1}`, status: http.StatusOK, shape: shapeBook},
+		{name: "delete without a precondition", method: http.MethodDelete, path: "/api/books/dracula", status: http.StatusPreconditionRequired, shape: shapeError},
+		{name: "upsert a missing book", method: http.MethodPut, path: "/api/books/carmilla?upsert=true", body: validBook, status: http.StatusCreated, shape: shapeBook},
+		{name: "upsert an existing book without a precondition", method: http.MethodPut, path: "/api/books/dracula?upsert=true", body: draculaBook, status: http.StatusPreconditionRequired, shape: shapeError},
+		{name: "upsert an existing book in the current version", method: http.MethodPut, path: "/api/books/dracula?upsert=true", body: strings.Replace(draculaBook, "}", `, "version": 1}`, 1), status: http.StatusOK, shape: shapeBook},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server, _ := newContractServerIfMatch(t, "", true)
+			tc.run(t, server)
+		})
+	}
+}
+
+// With a JWT secret, readers may only read, editors also write, and only
+// admins delete.
+func TestBookContractRoles(t *testing.T) {
+	const secret = "contract-test-secret"
+	access := newAccessControl(secret)
+	token := func(role string) map[string]string {
+		signed, _, err := access.Issue("tester", role, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return map[string]string{echo.HeaderAuthorization: "Bearer " + signed}
+	}
+	reader, editor, admin := token(RoleReader), token(RoleEditor), token(RoleAdmin)
+
+	cases := []contractCase{
+		{name: "list without a token", method: http.MethodGet, path: "/api/books", status: http.StatusUnauthorized, shape: shapeError},
+		{name: "list with a bad token", method: http.MethodGet, path: "/api/books", header: map[string]string{echo.HeaderAuthorization: "Bearer nonsense"}, status: http.StatusUnauthorized, shape: shapeError},
+		{name: "list as reader", method: http.MethodGet, path: "/api/books", header: reader, status: http.StatusOK, shape: shapeList},
+		{name: "create as reader", method: http.MethodPost, path: "/api/books", header: reader, body: validBook, status: http.StatusForbidden, shape: shapeError},
+		{name: "create as editor", method: http.MethodPost, path: "/api/books", header: editor, body: validBook, status: http.StatusCreated, shape: shapeBook},
+		{name: "replace as editor", method: http.MethodPut, path: "/api/books/dracula", header: editor, body: draculaBook, status: http.StatusOK, shape: shapeBook},
+		{name: "delete as editor", method: http.MethodDelete, path: "/api/books/dracula", header: editor, status: http.StatusForbidden, shape: shapeError},
+		{name: "delete as admin", method: http.MethodDelete, path: "/api/books/dracula", header: admin, status: http.StatusOK, shape: shapeNone},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server, _ := newContractServer(t, secret)
+			tc.run(t, server)
+		})
+	}
+}
+
+// Books come as JSON:API documents to clients asking for them.
+func TestBookContractJSONAPI(t *testing.T) {
+	server, books := newContractServer(t, "")
+	books.books[0].AuthorID = "bram-stoker"
+
+	get := func(path string) map[string]interface{} {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		req.Header.Set(echo.HeaderAccept, jsonAPIMediaType)
+		res, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if contentType := res.Header.Get(echo.HeaderContentType); contentType != jsonAPIMediaType {
+			t.Errorf("GET %s answered %s, want %s", path, contentType, jsonAPIMediaType)
+		}
+		var doc map[string]interface{}
+		if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+			t.Fatal(err)
+		}
+		return doc
+	}
+
+	book := get("/api/books/dracula")["data"].(map[string]interface{})
+	attributes := book["attributes"].(map[string]interface{})
+	if book["type"] != "books" || book["id"] != "dracula" || attributes["title"] != "Dracula" || attributes["author_name"] != "Bram Stoker" {
+		t.Errorf("book is %v, want dracula with its title and author_name", book)
+	}
+	author := book["relationships"].(map[string]interface{})["author"].(map[string]interface{})
+	if data := author["data"].(map[string]interface{}); data["type"] != "authors" || data["id"] != "bram-stoker" {
+		t.Errorf("author relationship is %v, want bram-stoker", author)
+	}
+
+	list := get("/api/books?fields[books]=title,author")["data"].([]interface{})
+	if len(list) != 1 {
+		t.Fatalf("listed %v, want dracula", list)
+	}
+	book = list[0].(map[string]interface{})
+	attributes = book["attributes"].(map[string]interface{})
+	if _, ok := book["relationships"]; book["id"] != "dracula" || len(attributes) != 1 || attributes["title"] != "Dracula" || !ok {
+		t.Errorf("sparse book is %v, want the ID, the title, and the author relationship", book)
+	}
+
+	// Plain JSON stays the default.
+	contractCase{method: http.MethodGet, path: "/api/books/dracula", status: http.StatusOK, shape: shapeBook}.run(t, server)
+}
+
+// A book answered as CSV, in the columns of the export, reads back the same
+// with the parser of the imports.
+func TestBookContractCSVRoundTrip(t *testing.T) {
+	server, books := newContractServer(t, "")
+	price, err := parsePrice("12.99", "EUR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	book := &BookStore{
+		ID:          "carmilla",
+		BookName:    "Carmilla",
+		BookAuthor:  "Sheridan Le Fanu",
+		BookPages:   108,
+		BookYear:    1872,
+		Tags:        []string{"gothic", "vampires"},
+		Series:      "In a Glass Darkly",
+		SeriesIndex: 5,
+		Publisher:   "R. Bentley & Son",
+		Language:    "en-GB",
+		Description: "Laura tells of \"Carmilla\",\nher strange guest.",
+		Price:       &price,
+	}
+	if err := books.Create(context.Background(), book); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/api/books/carmilla", nil)
+	req.Header.Set(echo.HeaderAccept, "text/csv")
+	res, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	parsed, report, err := parseBookCSV(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Rows) != 1 || report.Rows[0].Error != "" {
+		t.Fatalf("read back rows %v, want carmilla", report.Rows)
+	}
+	// The repository sets these, and imports start over at version 1.
+	want := *book
+	want.MongoID, want.CreatedAt, want.UpdatedAt, want.Version = [12]byte{}, time.Time{}, time.Time{}, 0
+	if got := parsed[0]; !reflect.DeepEqual(got, want) {
+		t.Errorf("read back %+v, want %+v", got, want)
+	}
+}
+
+// Books come in MessagePack and protobuf to clients asking for them.
+func TestBookContractBinaryEncodings(t *testing.T) {
+	server, _ := newContractServer(t, "")
+	get := func(path, accept string) []byte {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		req.Header.Set(echo.HeaderAccept, accept)
+		res, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if contentType := res.Header.Get(echo.HeaderContentType); res.StatusCode != http.StatusOK || contentType != accept {
+			t.Fatalf("GET %s answered %d %s, want 200 %s", path, res.StatusCode, contentType, accept)
+		}
+		raw, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+
+	var book map[string]interface{}
+	if err := msgpack.Unmarshal(get("/api/books/dracula", msgpackMediaType), &book); err != nil {
+		t.Fatal(err)
+	}
+	if book["title"] != "Dracula" || fmt.Sprint(book["year"]) != "1897" {
+		t.Errorf("MessagePack book is %v, want Dracula of 1897", book)
+	}
+
+	var pb bookpb.Book
+	if err := proto.Unmarshal(get("/api/books/dracula", protobufMediaType), &pb); err != nil {
+		t.Fatal(err)
+	}
+	if pb.Id != "dracula" || pb.Pages != 418 || pb.Version != 1 || pb.CreatedAt == nil {
+		t.Errorf("protobuf book is %v, want dracula with 418 pages in version 1", &pb)
+	}
+	var list bookpb.ListBooksResponse
+	if err := proto.Unmarshal(get("/api/books?fields=id,title", protobufMediaType), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Books) != 1 || list.Books[0].Title != "Dracula" || list.Books[0].Pages != 0 {
+		t.Errorf("protobuf list is %v, want dracula with only ID and title", &list)
+	}
+}
+
+// Payloads that do not fit the schema of their route are answered with
+// what is wrong with each field before anything is bound.
+func TestBookContractSchema(t *testing.T) {
+	server, _ := newContractServer(t, "")
+	body := `{"id": "carmilla", "titel": "Carmilla", "author": ["Sheridan Le Fanu"], "pages": "108", "tags": ["horror", 1]}`
+	_, answer := contractCase{method: http.MethodPost, path: "/api/books", body: body, status: http.StatusUnprocessableEntity, shape: shapeValidation}.run(t, server)
+	want := map[string]interface{}{
+		"titel":   "is not a known field",
+		"title":   "is required",
+		"author":  "must be a string",
+		"tags[1]": "must be a string",
+	}
+	if fields := answer.(map[string]interface{})["fields"]; fmt.Sprint(fields) != fmt.Sprint(want) {
+		t.Errorf("fields are %v, want %v", fields, want)
+	}
+}
+
+// A book may name its author by author_id alone. The in-memory repository
+// knows no authors, so the ID is refused, but only after the schema let
+// the book through.
+func TestBookContractAuthorID(t *testing.T) {
+	for _, body := range []string{`{"id": "x1", "title": "T", "author_id": "a1"}`, `{"title": "T", "author_id": "a1"}`} {
+		var doc map[string]interface{}
+		if err := json.Unmarshal([]byte(body), &doc); err != nil {
+			t.Fatal(err)
+		}
+		errs := validationErrors{}
+		bookSchema.check(doc, "", errs)
+		if len(errs) > 0 {
+			t.Errorf("the schema refuses %s: %v", body, errs)
+		}
+	}
+
+	server, _ := newContractServer(t, "")
+	cases := []struct {
+		contractCase
+		fields string
+	}{
+		{contractCase{method: http.MethodPost, path: "/api/books", body: `{"id": "x1", "title": "T", "author_id": "a1"}`}, "map[author_id:does not match an author]"},
+		{contractCase{method: http.MethodPut, path: "/api/books/dracula", body: `{"title": "T", "author_id": "a1"}`}, "map[author_id:does not match an author]"},
+		{contractCase{method: http.MethodPost, path: "/api/books", body: `{"id": "x1", "title": "T"}`}, "map[author:is required]"},
+	}
+	for _, tc := range cases {
+		tc.status, tc.shape = http.StatusUnprocessableEntity, shapeValidation
+		_, answer := tc.run(t, server)
+		if fields := answer.(map[string]interface{})["fields"]; fmt.Sprint(fields) != tc.fields {
+			t.Errorf("%s %s answered fields %v, want %s", tc.method, tc.path, fields, tc.fields)
+		}
+	}
+}
+
+// Books can be filtered by publisher and language, and languages must be
+// BCP 47 tags.
+func TestBookContractPublisherAndLanguage(t *testing.T) {
+	server, _ := newContractServer(t, "")
+	_, answer := contractCase{method: http.MethodPost, path: "/api/books", body: `{"id": "carmilla", "title": "Carmilla", "author": "Sheridan Le Fanu", "publisher": "Penguin", "language": "en-gb", "description": "A vampire novella."}`, status: http.StatusCreated, shape: shapeBook}.run(t, server)
+	if book := answer.(map[string]interface{}); book["language"] != "en-GB" || book["publisher"] != "Penguin" || book["description"] != "A vampire novella." {
+		t.Errorf("created %v, want the publisher, description, and language en-GB", book)
+	}
+	contractCase{method: http.MethodPost, path: "/api/books", body: `{"id": "lilith", "title": "Lilith", "author": "George MacDonald", "language": "elvish"}`, status: http.StatusUnprocessableEntity, shape: shapeValidation}.run(t, server)
+	contractCase{method: http.MethodPatch, path: "/api/books/dracula", body: `{"language": "xx-123456789"}`, status: http.StatusUnprocessableEntity, shape: shapeValidation}.run(t, server)
+	contractCase{method: http.MethodPatch, path: "/api/books/dracula", body: `{"language": "de", "publisher": "Insel"}`, status: http.StatusOK, shape: shapeBook}.run(t, server)
+
+	for path, want := range map[string]string{
+		"/api/books?language=en":                 "[carmilla]",
+		"/api/books?language=EN-gb":              "[carmilla]",
+		"/api/books?language=de":                 "[dracula]",
+		"/api/books?language=fr":                 "[]",
+		"/api/books?publisher=penguin":           "[carmilla]",
+		"/api/books?publisher=Insel&language=en": "[]",
+	} {
+		_, answer := contractCase{method: http.MethodGet, path: path + "&fields=id", status: http.StatusOK, shape: shapeList}.run(t, server)
+		var ids []string
+		for _, book := range answer.([]interface{}) {
+			ids = append(ids, book.(map[string]interface{})["id"].(string))
+		}
+		if fmt.Sprint(ids) != want {
+			t.Errorf("%s lists %v, want %s", path, ids, want)
+		}
+	}
+	contractCase{method: http.MethodGet, path: "/api/books?language=english", status: http.StatusUnprocessableEntity, shape: shapeValidation}.run(t, server)
+}
+
+// Prices keep their decimals exactly, and are converted for display only.
+func TestBookContractPrices(t *testing.T) {
+	server, _ := newContractServer(t, "")
+	_, answer := contractCase{method: http.MethodPost, path: "/api/books", body: `{"id": "carmilla", "title": "Carmilla", "author": "Sheridan Le Fanu", "price": {"amount": "12.90", "currency": "eur"}}`, status: http.StatusCreated, shape: shapeBook}.run(t, server)
+	if price := answer.(map[string]interface{})["price"]; fmt.Sprint(price) != "map[amount:12.9 currency:EUR]" {
+		t.Errorf("created a book priced %v, want 12.90 EUR", price)
+	}
+	for _, body := range []string{
+		`{"price": {"amount": 12.999, "currency": "EUR"}}`,
+		`{"price": {"amount": 12, "currency": "XYZ"}}`,
+		`{"price": {"amount": -1, "currency": "EUR"}}`,
+		`{"price": {"amount": "1e3", "currency": "EUR"}}`,
+		`{"price": {"currency": "EUR"}}`,
+	} {
+		contractCase{method: http.MethodPatch, path: "/api/books/dracula", body: body, status: http.StatusUnprocessableEntity, shape: shapeValidation}.run(t, server)
+	}
+	contractCase{method: http.MethodPatch, path: "/api/books/dracula", body: `{"price": {"amount": 1500, "currency": "JPY"}}`, status: http.StatusOK, shape: shapeBook}.run(t, server)
+
+	// The test server knows EUR and USD, at 1.1 dollars to the euro.
+	_, answer = contractCase{method: http.MethodGet, path: "/api/books/carmilla?currency=usd", status: http.StatusOK, shape: shapeBook}.run(t, server)
+	if price := answer.(map[string]interface{})["display_price"]; fmt.Sprint(price) != "map[amount:14.19 currency:USD]" {
+		t.Errorf("carmilla is shown at %v, want 14.19 USD", price)
+	}
+	_, answer = contractCase{method: http.MethodGet, path: "/api/books/dracula?currency=USD", status: http.StatusOK, shape: shapeBook}.run(t, server)
+	if price, ok := answer.(map[string]interface{})["display_price"]; ok {
+		t.Errorf("dracula is shown at %v, want no display price without a rate for JPY", price)
+	}
+	_, answer = contractCase{method: http.MethodGet, path: "/api/books?currency=USD&fields=id,display_price&sort=id", status: http.StatusOK, shape: shapeList}.run(t, server)
+	if book := answer.([]interface{})[0].(map[string]interface{}); book["display_price"] == nil {
+		t.Errorf("listed %v, want the display price", book)
+	}
+	contractCase{method: http.MethodGet, path: "/api/books?currency=dollars", status: http.StatusUnprocessableEntity, shape: shapeValidation}.run(t, server)
+
+	_, answer = contractCase{method: http.MethodPatch, path: "/api/books/carmilla", body: `{"price": null}`, status: http.StatusOK, shape: shapeBook}.run(t, server)
+	if price, ok := answer.(map[string]interface{})["price"]; ok {
+		t.Errorf("cleared price is %v", price)
+	}
+}
+
+// Fields are named in camelCase for older clients when the server is told
+// to.
+func TestBookContractFieldNaming(t *testing.T) {
+	server, _ := newContractServer(t, "")
+	if err := setJSONFieldNaming(camelCaseFields); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { setJSONFieldNaming(snakeCaseFields) })
+	_, answer := contractCase{method: http.MethodGet, path: "/api/books?sort=id", status: http.StatusOK, shape: shapeList}.run(t, server)
+	book := answer.([]interface{})[0].(map[string]interface{})
+	if _, ok := book["createdAt"]; !ok || book["created_at"] != nil {
+		t.Errorf("listed %v, want createdAt instead of created_at", book)
+	}
+	_, answer = contractCase{method: http.MethodPatch, path: "/api/books/dracula", body: `{"series_index": "first"}`, status: http.StatusUnprocessableEntity, shape: shapeValidation}.run(t, server)
+	if fields := answer.(map[string]interface{})["fields"].(map[string]interface{}); fields["seriesIndex"] == nil {
+		t.Errorf("fields are %v, want seriesIndex", fields)
+	}
+	// The history has no route in the contract server; its answers are
+	// named the same way.
+	revised := contractBook("dracula")
+	revised.CreatedAt = now()
+	raw, err := json.Marshal([]revisionItem{{Version: 1, RecordedAt: now(), Book: bookToMap(*revised)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var revisions []map[string]interface{}
+	if err := json.Unmarshal(raw, &revisions); err != nil {
+		t.Fatal(err)
+	}
+	if book, _ := revisions[0]["book"].(map[string]interface{}); revisions[0]["recordedAt"] == nil || book["createdAt"] == nil {
+		t.Errorf("listed revision %s, want recordedAt and a book with createdAt", raw)
+	}
+	if err := setJSONFieldNaming("kebab-case"); err == nil {
+		t.Error("kebab-case was accepted as JSON_FIELD_NAMING")
+	}
+}
+
+// Cursors page through the books in the order they were added in, and a
+// book added while paging neither shifts the pages nor is missed.
+func TestBookContractCursorPages(t *testing.T) {
+	server, books := newContractServer(t, "")
+	for _, id := range []string{"book-1", "book-2", "book-3"} {
+		if err := books.Create(context.Background(), contractBook(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var ids []string
+	path := "/api/books?size=2&fields=id"
+	for page := 0; path != ""; page++ {
+		res, answer := contractCase{method: http.MethodGet, path: path, status: http.StatusOK, shape: shapeList}.run(t, server)
+		for _, book := range answer.([]interface{}) {
+			ids = append(ids, book.(map[string]interface{})["id"].(string))
+		}
+		if total := res.Header.Get("X-Total-Count"); page == 1 && total != "5" {
+			t.Errorf("X-Total-Count of the second page is %q, want 5", total)
+		}
+		if page == 0 {
+			if err := books.Create(context.Background(), contractBook("book-4")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		path = ""
+		if cursor := res.Header.Get("X-Next-Cursor"); cursor != "" {
+			path = "/api/books?size=2&fields=id&after=" + cursor
+		}
+		if page > 0 && path != "" && !strings.Contains(res.Header.Get("Link"), `after=`+res.Header.Get("X-Next-Cursor")) {
+			t.Errorf("Link is %q, want the next cursor", res.Header.Get("Link"))
+		}
+	}
+	want := []string{"dracula", "book-1", "book-2", "book-3", "book-4"}
+	if fmt.Sprint(ids) != fmt.Sprint(want) {
+		t.Errorf("paged through %v, want %v", ids, want)
+	}
+
+	for _, path := range []string{"/api/books?after=nope", "/api/books?after=AAAAAAAAAAAAAAAA&page=2", "/api/books?after=AAAAAAAAAAAAAAAA&sort=title"} {
+		contractCase{method: http.MethodGet, path: path, status: http.StatusUnprocessableEntity, shape: shapeError}.run(t, server)
+	}
+}
+
+// Every tenant sees only its own books, however the request names it.
+func TestBookContractTenants(t *testing.T) {
+	const secret = "contract-test-secret"
+	cfg := loadConfig()
+	cfg.TenantSources = []string{"subdomain", "path", "token"}
+	cfg.TenantDomain = "books.test"
+	cfg.Tenants = []string{"acme", "beta"}
+	tenants, err := newTenancy(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	books := newTenantBooks(newMemoryBooks(), func(string) bookRepository { return newMemoryBooks() })
+	if err := books.Create(context.Background(), contractBook("dracula")); err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	cache := newResponseCache(cfg)
+	access := newAccessControl(secret)
+	open := map[string]bool{}
+	library := openlibrary.New(time.Second, time.Minute)
+	for _, prefix := range []string{"/api", "/t/:tenant/api"} {
+		api := e.Group(prefix, requireJSON(), access.Authenticate(), tenants.Resolve(open))
+		for key := range routeKeys(registerBookRoutes(api, books, library, fixedRates{}, access, cache, passThrough, requireIfMatch(books, false))) {
+			open[key] = true
+		}
+		api.GET("/ping", func(c echo.Context) error { return c.NoContent(http.StatusNoContent) })
+	}
+	// Like /graphql and the forms of the web pages.
+	e.GET("/default/ping", func(c echo.Context) error { return c.NoContent(http.StatusNoContent) }, access.Authenticate(), tenants.DefaultOnly())
+	// Like a deployment without the token source.
+	e.GET("/single/ping", func(c echo.Context) error { return c.NoContent(http.StatusNoContent) }, access.Authenticate(), tenancy{}.Resolve(open))
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+
+	token := func(tenant string) map[string]string {
+		signed, _, err := access.IssueForTenant("tester", RoleAdmin, tenant, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return map[string]string{echo.HeaderAuthorization: "Bearer " + signed}
+	}
+	admin, acme := token(""), token("acme")
+	withHost := func(header map[string]string, host string) map[string]string {
+		return map[string]string{echo.HeaderAuthorization: header[echo.HeaderAuthorization], "Host": host}
+	}
+
+	contractCase{method: http.MethodPost, path: "/t/acme/api/books", header: admin, body: validBook, status: http.StatusCreated, shape: shapeBook}.run(t, server)
+	cases := []struct {
+		contractCase
+		ids string
+	}{
+		{contractCase{method: http.MethodGet, path: "/api/books", header: admin}, "[dracula]"},
+		{contractCase{method: http.MethodGet, path: "/t/acme/api/books", header: admin}, "[carmilla]"},
+		{contractCase{method: http.MethodGet, path: "/api/books", header: withHost(admin, "acme.books.test")}, "[carmilla]"},
+		{contractCase{method: http.MethodGet, path: "/api/books", header: acme}, "[carmilla]"},
+		{contractCase{method: http.MethodGet, path: "/t/beta/api/books", header: admin}, "[]"},
+	}
+	for _, tc := range cases {
+		tc.status, tc.shape = http.StatusOK, shapeList
+		_, answer := tc.run(t, server)
+		var ids []string
+		for _, book := range answer.([]interface{}) {
+			ids = append(ids, book.(map[string]interface{})["id"].(string))
+		}
+		if fmt.Sprint(ids) != tc.ids {
+			t.Errorf("%s %v lists %v, want %s", tc.path, tc.header, ids, tc.ids)
+		}
+	}
+
+	for _, tc := range []contractCase{
+		{name: "book of another library", method: http.MethodGet, path: "/t/beta/api/books/carmilla", header: admin, status: http.StatusNotFound},
+		{name: "unknown library", method: http.MethodGet, path: "/t/nope/api/books", header: admin, status: http.StatusNotFound},
+		{name: "unknown subdomain", method: http.MethodGet, path: "/api/books", header: withHost(admin, "nope.books.test"), status: http.StatusNotFound},
+		{name: "token of another library", method: http.MethodGet, path: "/t/beta/api/books", header: acme, status: http.StatusForbidden},
+		{name: "route not open to libraries", method: http.MethodGet, path: "/t/acme/api/ping", header: admin, status: http.StatusNotFound},
+		{name: "route of the default library", method: http.MethodGet, path: "/api/ping", header: admin, status: http.StatusNoContent},
+		{name: "default-only route with a library's token", method: http.MethodGet, path: "/default/ping", header: acme, status: http.StatusNotFound},
+		{name: "default-only route on a library's subdomain", method: http.MethodGet, path: "/default/ping", header: withHost(admin, "acme.books.test"), status: http.StatusNotFound},
+		{name: "default-only route", method: http.MethodGet, path: "/default/ping", header: admin, status: http.StatusNoContent},
+		{name: "library's token without the token source", method: http.MethodGet, path: "/single/ping", header: acme, status: http.StatusForbidden},
+		{name: "no library without the token source", method: http.MethodGet, path: "/single/ping", header: admin, status: http.StatusNoContent},
+	} {
+		tc.shape = shapeError
+		if tc.status == http.StatusNoContent {
+			tc.shape = shapeNone
+		}
+		tc.run(t, server)
+	}
+}
+
+// GET /graphql runs queries, but not mutations, which links and caches
+// could otherwise trigger.
+func TestGraphQLMutationsNeedPost(t *testing.T) {
+	books := newMemoryBooks()
+	if err := books.Create(context.Background(), contractBook("dracula")); err != nil {
+		t.Fatal(err)
+	}
+	schema, err := newGraphQLSchema(books, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := echo.New()
+	e.Match([]string{http.MethodGet, http.MethodPost}, "/graphql", graphqlHandler(schema, newAccessControl("")))
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+
+	query := func(q string) string { return "/graphql?query=" + url.QueryEscape(q) }
+	for _, tc := range []contractCase{
+		{name: "query", method: http.MethodGet, path: query(`{ book(id: "dracula") { title } }`), status: http.StatusOK},
+		{name: "mutation", method: http.MethodGet, path: query(`mutation { deleteBook(id: "dracula") }`), status: http.StatusMethodNotAllowed, shape: shapeError},
+		{name: "mutation next to a query", method: http.MethodGet, path: query(`query q { books { id } } mutation m { deleteBook(id: "dracula") }`) + "&operationName=q", status: http.StatusMethodNotAllowed, shape: shapeError},
+	} {
+		t.Run(tc.name, func(t *testing.T) { tc.run(t, server) })
+	}
+	if _, err := books.Get(context.Background(), "dracula"); err != nil {
+		t.Errorf("book after GET mutations: %v", err)
+	}
+	contractCase{method: http.MethodPost, path: "/graphql", body: `{"query": "mutation { deleteBook(id: \"dracula\") }"}`, status: http.StatusOK}.run(t, server)
+	if _, err := books.Get(context.Background(), "dracula"); err != errBookNotFound {
+		t.Errorf("book after a POSTed deleteBook: %v, want it deleted", err)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A library or a shop usually has several copies of a book. Each copy is
+// kept in the copies collection, known by the barcode on its label, with
+// its condition, where it stands, and whether it is there. Like the rating
+// with the reviews, every book carries the number of its copies and of
+// those available, recomputed whenever a copy changes, so listings show
+// the stock without touching the copies.
+//
+// Lending still works on the whole book; see loans.go. A copy's available
+// flag only tracks the stock, e.g. a copy sent off for repair.
+type Copy struct {
+	MongoID   primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	Barcode   string             `json:"barcode"`
+	BookID    string             `bson:"bookid" json:"book_id"`
+	Condition string             `json:"condition"`
+	Location  string             `json:"location,omitempty"`
+	Available bool               `json:"available"`
+	AddedAt   time.Time          `json:"added_at"`
+	UpdatedAt time.Time          `json:"updated_at"`
+}
+
+// The conditions a copy can be in, from best to worst.
+var copyConditions = []interface{}{"new", "good", "fair", "poor", "damaged"}
+
+// The stock summary stored with every book that has copies.
+type bookCopies struct {
+	Total     int `json:"total"`
+	Available int `json:"available"`
+}
+
+// The body of POST /api/books/:id/copies. A new copy is in good condition
+// and available unless told otherwise.
+type copyPayload struct {
+	Barcode   string `json:"barcode"`
+	Condition string `json:"condition"`
+	Location  string `json:"location"`
+	Available *bool  `json:"available"`
+}
+
+// The body of PATCH /api/books/:id/copies/:barcode. Only the fields that
+// are set change.
+type copyChanges struct {
+	Condition *string `json:"condition"`
+	Location  *string `json:"location"`
+	Available *bool   `json:"available"`
+}
+
+// A copy as sent to POST /api/books/:id/copies.
+var copySchema = mustSchema(`{
+	"type": "object",
+	"properties": {
+		"barcode": {"type": "string", "pattern": "^[A-Za-z0-9-]+$", "maxLength": 64},
+		"condition": {"enum": ` + string(mustJSON(copyConditions)) + `},
+		"location": {"type": "string"},
+		"available": {"type": "boolean"}
+	},
+	"required": ["barcode"],
+	"additionalProperties": false
+}`)
+
+// A change of a copy as sent to PATCH /api/books/:id/copies/:barcode; the
+// barcode stays.
+var copyPatchSchema = mustSchema(`{
+	"type": "object",
+	"properties": {
+		"condition": {"enum": ` + string(mustJSON(copyConditions)) + `},
+		"location": {"type": "string"},
+		"available": {"type": "boolean"}
+	},
+	"additionalProperties": false
+}`)
+
+// Recomputes the stock summary of a book from its copies. The handlers run
+// it in one transaction with the change of the copy (see transactions.go):
+// of two changes at once, the later one then conflicts on the book and is
+// tried again, instead of storing a summary that misses the other copy.
+func refreshCopies(ctx context.Context, coll, copies *mongo.Collection, bookID string) error {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"bookid": bookID}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":       nil,
+			"total":     bson.M{"$sum": 1},
+			"available": bson.M{"$sum": bson.M{"$cond": bson.A{"$available", 1, 0}}},
+		}}},
+	}
+	cursor, err := copies.Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	var summary []bookCopies
+	if err := cursor.All(ctx, &summary); err != nil {
+		return err
+	}
+
+	update := bson.M{"$unset": bson.M{"copies": ""}}
+	if len(summary) > 0 {
+		update = bson.M{"$set": bson.M{"copies": summary[0]}}
+	}
+	_, err = coll.UpdateOne(ctx, bson.M{"id": bookID}, update)
+	return err
+}
+
+// Handles GET /api/books/:id/copies, ordered by barcode.
+func listCopies(copies *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		opts := options.Find().SetSort(bson.D{{Key: "barcode", Value: 1}})
+		cursor, err := copies.Find(ctx, bson.M{"bookid": c.Param("id")}, opts)
+		if err != nil {
+			log.Printf("Error listing copies of book %s: %v", c.Param("id"), err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to list copies"})
+		}
+		ret := []Copy{}
+		if err := cursor.All(ctx, &ret); err != nil {
+			log.Printf("Error listing copies of book %s: %v", c.Param("id"), err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to list copies"})
+		}
+		return c.JSON(http.StatusOK, ret)
+	}
+}
+
+// Handles POST /api/books/:id/copies. Barcodes are unique across all
+// books; a taken one answers 409.
+func addCopy(coll, copies *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		idParam := c.Param("id")
+		var payload copyPayload
+		if err := c.Bind(&payload); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+		}
+
+		if _, err := findBook(ctx, coll, idParam); err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Book not found with ID " + idParam})
+		} else if err != nil {
+			log.Printf("Error fetching book with ID %s: %v", idParam, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to add copy"})
+		}
+
+		cp := Copy{
+			MongoID:   primitive.NewObjectID(),
+			Barcode:   payload.Barcode,
+			BookID:    idParam,
+			Condition: payload.Condition,
+			Location:  payload.Location,
+			Available: payload.Available == nil || *payload.Available,
+			AddedAt:   now(),
+		}
+		cp.UpdatedAt = cp.AddedAt
+		if cp.Condition == "" {
+			cp.Condition = "good"
+		}
+		err := inTransaction(ctx, coll.Database().Client(), func(ctx context.Context) error {
+			if _, err := copies.InsertOne(ctx, cp); err != nil {
+				return err
+			}
+			return refreshCopies(ctx, coll, copies, idParam)
+		})
+		if mongo.IsDuplicateKeyError(err) {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Copy with barcode " + cp.Barcode + " already exists"})
+		} else if err != nil {
+			log.Printf("Error inserting copy %s: %v", cp.Barcode, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to add copy"})
+		}
+		return c.JSON(http.StatusCreated, cp)
+	}
+}
+
+// Handles PATCH /api/books/:id/copies/:barcode, e.g. {"available": false}
+// when a copy goes missing.
+func updateCopy(coll, copies *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		idParam := c.Param("id")
+		var changes copyChanges
+		if err := c.Bind(&changes); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+		}
+
+		set := bson.M{"updatedat": now()}
+		if changes.Condition != nil {
+			set["condition"] = *changes.Condition
+		}
+		if changes.Location != nil {
+			set["location"] = *changes.Location
+		}
+		if changes.Available != nil {
+			set["available"] = *changes.Available
+		}
+		var cp Copy
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+		err := inTransaction(ctx, coll.Database().Client(), func(ctx context.Context) error {
+			err := copies.FindOneAndUpdate(ctx, bson.M{"barcode": c.Param("barcode"), "bookid": idParam}, bson.M{"$set": set}, opts).Decode(&cp)
+			if err != nil {
+				return err
+			}
+			return refreshCopies(ctx, coll, copies, idParam)
+		})
+		if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Copy not found with barcode " + c.Param("barcode")})
+		} else if err != nil {
+			log.Printf("Error updating copy %s: %v", c.Param("barcode"), err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update copy"})
+		}
+		return c.JSON(http.StatusOK, cp)
+	}
+}
+
+// Handles DELETE /api/books/:id/copies/:barcode, for a copy that was sold
+// or written off.
+func removeCopy(coll, copies *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		idParam := c.Param("id")
+		err := inTransaction(ctx, coll.Database().Client(), func(ctx context.Context) error {
+			result, err := copies.DeleteOne(ctx, bson.M{"barcode": c.Param("barcode"), "bookid": idParam})
+			if err != nil {
+				return err
+			}
+			if result.DeletedCount == 0 {
+				return mongo.ErrNoDocuments
+			}
+			return refreshCopies(ctx, coll, copies, idParam)
+		})
+		if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Copy not found with barcode " + c.Param("barcode")})
+		} else if err != nil {
+			log.Printf("Error deleting copy %s: %v", c.Param("barcode"), err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to remove copy"})
+		}
+		return c.NoContent(http.StatusOK)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	// Registered for image.Decode, so GIF covers are accepted as well.
+	_ "image/gif"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/image/draw"
+)
+
+// Cover images are stored in GridFS, in the "covers" bucket, since they can
+// easily outgrow the 16 MB limit of a regular document. Next to the
+// original we keep a small thumbnail for tables and lists, created once at
+// upload time. The book only references both files.
+type bookCover struct {
+	FileID      primitive.ObjectID `bson:"fileid"`
+	ThumbID     primitive.ObjectID `bson:"thumbid"`
+	ContentType string             `bson:"contenttype"`
+	ThumbType   string             `bson:"thumbtype"`
+	UploadedAt  time.Time          `bson:"uploadedat"`
+}
+
+const (
+	// Uploads above this size are refused.
+	maxCoverSize = 5 << 20
+	// Thumbnails fit into a box of this many pixels.
+	thumbnailSize = 200
+)
+
+var coverTypes = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"gif":  "image/gif",
+}
+
+func coverBucket(coll *mongo.Collection) (*gridfs.Bucket, error) {
+	return gridfs.NewBucket(coll.Database(), options.GridFSBucket().SetName("covers"))
+}
+
+// Scales an image down so it fits into a size x size box, keeping its
+// aspect ratio. Small images are left as they are.
+func thumbnail(src image.Image) image.Image {
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= thumbnailSize && h <= thumbnailSize {
+		return src
+	}
+	if w > h {
+		w, h = thumbnailSize, max(1, h*thumbnailSize/w)
+	} else {
+		w, h = max(1, w*thumbnailSize/h), thumbnailSize
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+	return dst
+}
+
+// Handles POST /api/books/:id/cover, a multipart upload with the image in
+// the "cover" field. A new cover replaces the old one.
+func uploadCover(coll *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		idParam := c.Param("id")
+		book, err := findBook(ctx, coll, idParam)
+		if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Book not found with ID " + idParam})
+		} else if err != nil {
+			log.Printf("Error fetching book with ID %s: %v", idParam, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to store cover"})
+		}
+
+		header, err := c.FormFile("cover")
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Upload the image in the cover field"})
+		}
+		if header.Size > maxCoverSize {
+			return c.JSON(http.StatusRequestEntityTooLarge, map[string]string{"error": "Covers may be at most 5 MB"})
+		}
+		file, err := header.Open()
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Failed to read the upload"})
+		}
+		defer file.Close()
+		data, err := io.ReadAll(io.LimitReader(file, maxCoverSize+1))
+		if err != nil || len(data) > maxCoverSize {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Failed to read the upload"})
+		}
+
+		// Decoding tells us whether the upload really is an image, whatever
+		// the client claims its type is.
+		img, format, err := image.Decode(bytes.NewReader(data))
+		contentType, ok := coverTypes[format]
+		if err != nil || !ok {
+			return c.JSON(http.StatusUnsupportedMediaType, map[string]string{"error": "Covers must be JPEG, PNG, or GIF images"})
+		}
+		// PNGs keep their transparency, everything else becomes a JPEG.
+		cover := bookCover{ContentType: contentType, ThumbType: "image/jpeg", UploadedAt: now()}
+		var thumb bytes.Buffer
+		if format == "png" {
+			cover.ThumbType = "image/png"
+			err = png.Encode(&thumb, thumbnail(img))
+		} else {
+			err = jpeg.Encode(&thumb, thumbnail(img), &jpeg.Options{Quality: 85})
+		}
+		if err != nil {
+			log.Printf("Error creating thumbnail for book %s: %v", idParam, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to store cover"})
+		}
+
+		bucket, err := coverBucket(coll)
+		if err != nil {
+			log.Printf("Error opening the covers bucket: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to store cover"})
+		}
+		upload := func(name, kind, mediaType string, content []byte) (primitive.ObjectID, error) {
+			opts := options.GridFSUpload().SetMetadata(bson.M{"bookid": idParam, "kind": kind, "contenttype": mediaType})
+			return bucket.UploadFromStream(name, bytes.NewReader(content), opts)
+		}
+		if cover.FileID, err = upload(idParam, "cover", contentType, data); err == nil {
+			cover.ThumbID, err = upload(idParam+"-thumb", "thumbnail", cover.ThumbType, thumb.Bytes())
+		}
+		if err != nil {
+			log.Printf("Error uploading cover of book %s: %v", idParam, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to store cover"})
+		}
+
+		if _, err := coll.UpdateOne(ctx, bson.M{"id": idParam}, bson.M{"$set": bson.M{"cover": cover}}); err != nil {
+			log.Printf("Error saving cover of book %s: %v", idParam, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to store cover"})
+		}
+		if book.Cover != nil {
+			deleteCoverFiles(bucket, *book.Cover)
+		}
+		return c.JSON(http.StatusCreated, map[string]string{
+			"cover":     coverURL(idParam, ""),
+			"thumbnail": coverURL(idParam, "thumb"),
+		})
+	}
+}
+
+func deleteCoverFiles(bucket *gridfs.Bucket, cover bookCover) {
+	for _, id := range []primitive.ObjectID{cover.FileID, cover.ThumbID} {
+		if err := bucket.Delete(id); err != nil && err != gridfs.ErrFileNotFound {
+			log.Printf("Error deleting cover file %s: %v", id.Hex(), err)
+		}
+	}
+}
+
+func coverURL(id, size string) string {
+	url := "/api/books/" + id + "/cover"
+	if size != "" {
+		url += "?size=" + size
+	}
+	return url
+}
+
+// Handles GET /api/books/:id/cover, or ?size=thumb for the thumbnail. A
+// stored file never changes (a new upload gets new files), so clients may
+// cache covers for a day and revalidate them with the file ID as ETag.
+func getCover(coll *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		idParam := c.Param("id")
+		book, err := findBook(c.Request().Context(), coll, idParam)
+		if err == mongo.ErrNoDocuments || (err == nil && book.Cover == nil) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "No cover for book " + idParam})
+		} else if err != nil {
+			log.Printf("Error fetching book with ID %s: %v", idParam, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch cover"})
+		}
+
+		fileID, contentType := book.Cover.FileID, book.Cover.ContentType
+		if c.QueryParam("size") == "thumb" {
+			fileID, contentType = book.Cover.ThumbID, book.Cover.ThumbType
+		}
+
+		etag := `"` + fileID.Hex() + `"`
+		header := c.Response().Header()
+		header.Set(echo.HeaderCacheControl, "public, max-age=86400")
+		header.Set("ETag", etag)
+		if etagMatches(c.Request().Header.Get("If-None-Match"), etag, true) || notModifiedSince(c, book.Cover.UploadedAt) {
+			return c.NoContent(http.StatusNotModified)
+		}
+
+		bucket, err := coverBucket(coll)
+		if err != nil {
+			log.Printf("Error opening the covers bucket: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch cover"})
+		}
+		stream, err := bucket.OpenDownloadStream(fileID)
+		if err != nil {
+			log.Printf("Error opening cover of book %s: %v", idParam, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch cover"})
+		}
+		defer stream.Close()
+		header.Set(echo.HeaderContentLength, strconv.FormatInt(stream.GetFile().Length, 10))
+		return c.Stream(http.StatusOK, contentType, stream)
+	}
+}
+
+// Handles DELETE /api/books/:id/cover.
+func deleteCover(coll *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		idParam := c.Param("id")
+		var book BookStore
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.Before)
+		filter := notDeleted(bson.M{"id": idParam, "cover": bson.M{"$ne": nil}})
+		err := coll.FindOneAndUpdate(ctx, filter, bson.M{"$unset": bson.M{"cover": ""}}, opts).Decode(&book)
+		if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "No cover for book " + idParam})
+		} else if err != nil {
+			log.Printf("Error removing cover of book %s: %v", idParam, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete cover"})
+		}
+		if bucket, err := coverBucket(coll); err == nil {
+			deleteCoverFiles(bucket, *book.Cover)
+		}
+		return c.NoContent(http.StatusOK)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// Protects the forms of the web pages against cross-site request forgery.
+// Every page gets a token in the _csrf cookie, and POST, PUT, and DELETE
+// requests have to send it back: HTMX in the X-CSRF-Token header, plain
+// forms in the _csrf field (see the script in index.html). The API, also
+// that of the tenants, and GraphQL are exempt, since they authenticate
+// with bearer tokens, which a foreign site cannot make the browser send.
+func csrfProtection() echo.MiddlewareFunc {
+	return middleware.CSRFWithConfig(middleware.CSRFConfig{
+		Skipper: func(c echo.Context) bool {
+			return isAPIPath(c.Request().URL.Path)
+		},
+		TokenLookup:    "header:" + echo.HeaderXCSRFToken + ",form:_csrf",
+		CookiePath:     "/",
+		CookieHTTPOnly: true,
+		CookieSameSite: http.SameSiteLaxMode,
+	})
+}
+
+// The CSRF token of the request, for the templates.
+func csrfToken(c echo.Context) string {
+	token, _ := c.Get("csrf").(string)
+	return token
+}
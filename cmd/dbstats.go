@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// GET /api/admin/dbstats reports how much room the books take in Mongo, and
+// which operations on them were slow, for capacity planning. Sizes are in
+// bytes. Slow operations come from two places: those still running, from
+// $currentOp, and those that finished, from the profiler. The profiler
+// only records them once it is switched on, e.g. with
+// db.setProfilingLevel(1, {slowms: 100}) in the mongo shell.
+
+// How slow an operation has to be to be listed, in milliseconds, and how
+// many are listed, unless told otherwise with ?slow_ms= and ?limit=.
+const (
+	defaultSlowMillis     = 100
+	defaultSlowOperations = 10
+	maxSlowOperations     = 100
+)
+
+// The storage figures of the books collection.
+type storageStats struct {
+	Count          int64            `bson:"count" json:"count"`
+	Size           int64            `bson:"size" json:"size"`
+	StorageSize    int64            `bson:"storageSize" json:"storage_size"`
+	AverageSize    float64          `bson:"avgObjSize" json:"average_document_size"`
+	TotalIndexSize int64            `bson:"totalIndexSize" json:"total_index_size"`
+	IndexSizes     map[string]int64 `bson:"indexSizes" json:"index_sizes"`
+}
+
+// An operation on the books that took at least the threshold.
+type slowOperation struct {
+	Op           string    `bson:"op" json:"op"`
+	Namespace    string    `bson:"ns" json:"ns"`
+	Millis       int64     `bson:"millis" json:"millis"`
+	At           time.Time `bson:"ts,omitempty" json:"at,omitempty"`
+	PlanSummary  string    `bson:"planSummary,omitempty" json:"plan_summary,omitempty"`
+	KeysExamined int64     `bson:"keysExamined" json:"keys_examined,omitempty"`
+	DocsExamined int64     `bson:"docsExamined" json:"docs_examined,omitempty"`
+	Returned     int64     `bson:"nreturned" json:"returned,omitempty"`
+	Command      bson.M    `bson:"command,omitempty" json:"command,omitempty"`
+}
+
+type dbStats struct {
+	Collection string       `json:"collection"`
+	Storage    storageStats `json:"storage"`
+	// The level of the profiler: 0 is off, 1 records slow operations, 2
+	// all of them. Nil when Mongo would not tell.
+	ProfilingLevel *int            `json:"profiling_level"`
+	Running        []slowOperation `json:"running_operations"`
+	Recent         []slowOperation `json:"recent_slow_operations"`
+}
+
+// Reads the storage figures with $collStats, which unlike the collStats
+// command works on every current version of Mongo.
+func readStorageStats(ctx context.Context, coll *mongo.Collection) (storageStats, error) {
+	var stats storageStats
+	cursor, err := coll.Aggregate(ctx, mongo.Pipeline{{{Key: "$collStats", Value: bson.M{"storageStats": bson.M{}}}}})
+	if err != nil {
+		return stats, err
+	}
+	var found []struct {
+		StorageStats storageStats `bson:"storageStats"`
+	}
+	if err := cursor.All(ctx, &found); err != nil {
+		return stats, err
+	}
+	if len(found) > 0 {
+		stats = found[0].StorageStats
+	}
+	return stats, nil
+}
+
+// Lists the operations on the collection that have been running for at
+// least slow, longest first.
+func runningOperations(ctx context.Context, coll *mongo.Collection, slow time.Duration, limit int) ([]slowOperation, error) {
+	ns := coll.Database().Name() + "." + coll.Name()
+	pipeline := mongo.Pipeline{
+		{{Key: "$currentOp", Value: bson.M{}}},
+		{{Key: "$match", Value: bson.M{"ns": ns, "microsecs_running": bson.M{"$gte": slow.Microseconds()}}}},
+		{{Key: "$sort", Value: bson.M{"microsecs_running": -1}}},
+		{{Key: "$limit", Value: limit}},
+		{{Key: "$set", Value: bson.M{"millis": bson.M{"$toLong": bson.M{"$divide": bson.A{"$microsecs_running", 1000}}}}}},
+	}
+	cursor, err := coll.Database().Client().Database("admin").Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	ops := []slowOperation{}
+	err = cursor.All(ctx, &ops)
+	return ops, err
+}
+
+// Lists the most recent operations on the collection the profiler recorded
+// as taking at least slow, newest first.
+func profiledOperations(ctx context.Context, coll *mongo.Collection, slow time.Duration, limit int) ([]slowOperation, error) {
+	ns := coll.Database().Name() + "." + coll.Name()
+	opts := options.Find().SetSort(bson.D{{Key: "ts", Value: -1}}).SetLimit(int64(limit))
+	cursor, err := coll.Database().Collection("system.profile").Find(ctx, bson.M{"ns": ns, "millis": bson.M{"$gte": slow.Milliseconds()}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	ops := []slowOperation{}
+	err = cursor.All(ctx, &ops)
+	return ops, err
+}
+
+// Handles GET /api/admin/dbstats. Only the storage figures are required;
+// the slow operations are left empty where Mongo does not let us read
+// them, e.g. without the privileges for $currentOp.
+func getDBStats(coll *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		errs := validationErrors{}
+		slow, limit := defaultSlowMillis, defaultSlowOperations
+		if raw := c.QueryParam("slow_ms"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 0 {
+				errs["slow_ms"] = "must be a whole number of at least 0"
+			}
+			slow = n
+		}
+		if raw := c.QueryParam("limit"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 1 || n > maxSlowOperations {
+				errs["limit"] = "must be a whole number from 1 to " + strconv.Itoa(maxSlowOperations)
+			}
+			limit = n
+		}
+		if len(errs) > 0 {
+			return validationFailed(c, errs)
+		}
+		threshold := time.Duration(slow) * time.Millisecond
+
+		stats := dbStats{Collection: coll.Name(), Running: []slowOperation{}, Recent: []slowOperation{}}
+		var err error
+		if stats.Storage, err = readStorageStats(ctx, coll); err != nil {
+			log.Printf("Error reading collection statistics: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to read database statistics"})
+		}
+		var profile struct {
+			Was int `bson:"was"`
+		}
+		if err := coll.Database().RunCommand(ctx, bson.D{{Key: "profile", Value: -1}}).Decode(&profile); err != nil {
+			log.Printf("Error reading the profiling level: %v", err)
+		} else {
+			stats.ProfilingLevel = &profile.Was
+		}
+		if ops, err := runningOperations(ctx, coll, threshold, limit); err != nil {
+			log.Printf("Error listing running operations: %v", err)
+		} else {
+			stats.Running = ops
+		}
+		if ops, err := profiledOperations(ctx, coll, threshold, limit); err != nil {
+			log.Printf("Error listing profiled operations: %v", err)
+		} else {
+			stats.Recent = ops
+		}
+		return c.JSON(http.StatusOK, stats)
+	}
+}
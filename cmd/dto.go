@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// The API speaks in types of its own rather than in BookStore, the document
+// stored in Mongo: a book sent by a client is decoded into a bookRequest,
+// and a book is answered as the bookItem built by bookToMap. Stored fields
+// the API does not own, like the Mongo _id, the checkout, or the search
+// grams, can neither be set by clients nor leak into answers, whatever the
+// json tags of BookStore say.
+//
+// Fields are named in snake_case, e.g. created_at. Older clients that
+// expect camelCase, e.g. createdAt, get it with JSON_FIELD_NAMING=camelCase.
+// The switch covers books, their revisions, authors, webhooks, and the
+// fields of validation errors, in JSON answers only; requests always use
+// snake_case.
+
+// A book as sent with POST and PUT /api/books.
+type bookRequest struct {
+	ID          string     `json:"id"`
+	Title       string     `json:"title"`
+	Author      string     `json:"author"`
+	AuthorID    string     `json:"author_id"`
+	Edition     string     `json:"edition"`
+	Pages       flexInt    `json:"pages"`
+	Year        flexInt    `json:"year"`
+	Tags        []string   `json:"tags"`
+	Series      string     `json:"series"`
+	SeriesIndex flexInt    `json:"series_index"`
+	Publisher   string     `json:"publisher"`
+	Language    string     `json:"language"`
+	Description string     `json:"description"`
+	Price       *bookPrice `json:"price"`
+}
+
+func (r bookRequest) book() BookStore {
+	return BookStore{
+		ID:          r.ID,
+		BookName:    r.Title,
+		BookAuthor:  r.Author,
+		AuthorID:    r.AuthorID,
+		BookEdition: r.Edition,
+		BookPages:   r.Pages,
+		BookYear:    r.Year,
+		Tags:        r.Tags,
+		Series:      r.Series,
+		SeriesIndex: r.SeriesIndex,
+		Publisher:   r.Publisher,
+		Language:    r.Language,
+		Description: r.Description,
+		Price:       r.Price,
+	}
+}
+
+const (
+	snakeCaseFields = "snake_case"
+	camelCaseFields = "camelCase"
+)
+
+// How the fields of JSON answers are named, set from JSON_FIELD_NAMING when
+// the server starts.
+var jsonFieldNaming = snakeCaseFields
+
+func setJSONFieldNaming(naming string) error {
+	switch naming {
+	case snakeCaseFields, camelCaseFields:
+		jsonFieldNaming = naming
+		return nil
+	}
+	return fmt.Errorf("invalid JSON_FIELD_NAMING %q, want snake_case or camelCase", naming)
+}
+
+// The name of a field in JSON answers, e.g. series_index or seriesIndex.
+func fieldName(name string) string {
+	if jsonFieldNaming != camelCaseFields {
+		return name
+	}
+	words := strings.Split(name, "_")
+	for i, word := range words[1:] {
+		if word != "" {
+			words[i+1] = strings.ToUpper(word[:1]) + word[1:]
+		}
+	}
+	return strings.Join(words, "")
+}
+
+// Marshals v with its fields named by fieldName. Every key of the objects
+// in v must be a field name, not data like a tag or a year.
+func marshalNamed(v interface{}) ([]byte, error) {
+	raw, err := json.Marshal(v)
+	if err != nil || jsonFieldNaming == snakeCaseFields {
+		return raw, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return json.Marshal(renameFields(doc))
+}
+
+func renameFields(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		renamed := make(map[string]interface{}, len(v))
+		for name, value := range v {
+			renamed[fieldName(name)] = renameFields(value)
+		}
+		return renamed
+	case []interface{}:
+		for i, value := range v {
+			v[i] = renameFields(value)
+		}
+	}
+	return v
+}
+
+func (b bookItem) MarshalJSON() ([]byte, error) {
+	return marshalNamed(map[string]interface{}(b))
+}
+
+func (l bookList) MarshalJSON() ([]byte, error) {
+	return marshalNamed([]map[string]interface{}(l))
+}
+
+func (r revisionItem) MarshalJSON() ([]byte, error) {
+	type fields revisionItem
+	return marshalNamed(fields(r))
+}
+
+func (a Author) MarshalJSON() ([]byte, error) {
+	type stored Author
+	return marshalNamed(stored(a))
+}
+
+func (w Webhook) MarshalJSON() ([]byte, error) {
+	type stored Webhook
+	return marshalNamed(stored(w))
+}
+
+func (v validationErrors) MarshalJSON() ([]byte, error) {
+	return marshalNamed(map[string]string(v))
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"slices"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Books entered twice, e.g. once by hand and once by an import, can be
+// found by their title and author, and merged into one.
+
+// A group of books that look like the same book, as listed by GET
+// /api/books/duplicates.
+type duplicateGroup struct {
+	Key struct {
+		Title  string `bson:"title" json:"title"`
+		Author string `bson:"author" json:"author"`
+	} `bson:"_id" json:"key"`
+	Count int               `bson:"count" json:"count"`
+	Books []duplicateVolume `bson:"books" json:"books"`
+}
+
+type duplicateVolume struct {
+	ID      string  `bson:"id" json:"id"`
+	Title   string  `bson:"bookname" json:"title"`
+	Author  string  `bson:"bookauthor" json:"author"`
+	Edition string  `bson:"bookedition" json:"edition"`
+	Year    flexInt `bson:"bookyear" json:"year"`
+}
+
+// The body of POST /api/books/merge.
+type mergePayload struct {
+	// The book that is kept.
+	Target string `json:"target"`
+	// The book that is merged into the target and goes to the recycle bin.
+	Source string `json:"source"`
+}
+
+// Groups the books by title and author, ignoring case and surrounding
+// spaces, and returns the groups with more than one book, biggest first.
+func findDuplicates(ctx context.Context, coll *mongo.Collection) ([]duplicateGroup, error) {
+	normalized := func(field string) bson.M {
+		return bson.M{"$toLower": bson.M{"$trim": bson.M{"input": bson.M{"$ifNull": bson.A{field, ""}}}}}
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: notDeleted(bson.M{})}},
+		{{Key: "$sort", Value: bson.D{{Key: "createdat", Value: 1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   bson.M{"title": normalized("$bookname"), "author": normalized("$bookauthor")},
+			"count": bson.M{"$sum": 1},
+			"books": bson.M{"$push": bson.M{
+				"id":          "$id",
+				"bookname":    "$bookname",
+				"bookauthor":  "$bookauthor",
+				"bookedition": "$bookedition",
+				"bookyear":    "$bookyear",
+			}},
+		}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "_id.title", Value: 1}, {Key: "_id.author", Value: 1}}}},
+	}
+	cursor, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	groups := []duplicateGroup{}
+	err = cursor.All(ctx, &groups)
+	return groups, err
+}
+
+// Handles GET /api/books/duplicates. Within a group, the oldest book comes
+// first.
+func listDuplicates(coll *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		groups, err := findDuplicates(c.Request().Context(), coll)
+		if err != nil {
+			log.Printf("Error finding duplicate books: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to find duplicates"})
+		}
+		return c.JSON(http.StatusOK, groups)
+	}
+}
+
+// Handles POST /api/books/merge. The target keeps its fields and takes
+// those it lacks, as well as its tags and cover, from the source. Reviews,
+// loans, and reading lists of the source move to the target. The target's
+// previous state is kept in its history, and the source goes to the
+// recycle bin, where it remembers the book it was merged into, so the
+// history of both stays available. A source that is checked out has to be
+// returned first.
+func mergeBooks(coll, history, reviews, loans, copies, users *mongo.Collection, events directEvents) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		var payload mergePayload
+		if err := c.Bind(&payload); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+		}
+		errs := validationErrors{}
+		if payload.Target == "" {
+			errs["target"] = "is required"
+		}
+		if payload.Source == "" {
+			errs["source"] = "is required"
+		} else if payload.Source == payload.Target {
+			errs["source"] = "must differ from the target"
+		}
+		if len(errs) > 0 {
+			return validationFailed(c, errs)
+		}
+
+		target, err := findBook(ctx, coll, payload.Target)
+		if err == nil {
+			var source BookStore
+			if source, err = findBook(ctx, coll, payload.Source); err == nil {
+				return mergeInto(c, coll, history, reviews, loans, copies, users, events, target, source)
+			}
+		}
+		if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Book not found with ID " + payload.Target + " or " + payload.Source})
+		}
+		log.Printf("Error fetching books to merge: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to merge books"})
+	}
+}
+
+func mergeInto(c echo.Context, coll, history, reviews, loans, copies, users *mongo.Collection, events directEvents, target, source BookStore) error {
+	ctx := c.Request().Context()
+	if source.Checkout != nil {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Book with ID " + source.ID + " is checked out, return it before merging"})
+	}
+	failed := func(err error) error {
+		log.Printf("Error merging book %s into %s: %v", source.ID, target.ID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to merge books"})
+	}
+
+	// All writes of the merge happen in one transaction where Mongo
+	// offers them; see transactions.go.
+	err := inTransaction(ctx, coll.Database().Client(), func(ctx context.Context) error {
+		return mergeWrites(ctx, coll, history, reviews, loans, copies, users, target, source)
+	})
+	if err == errStaleVersion {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Book with ID " + target.ID + " or " + source.ID + " was modified by someone else"})
+	} else if err != nil {
+		return failed(err)
+	}
+
+	events.Publish(bookEvent{Type: bookDeleted, Book: BookStore{ID: source.ID}})
+	merged, err := findBook(ctx, coll, target.ID)
+	if err != nil {
+		return failed(err)
+	}
+	events.Publish(bookEvent{Type: bookUpdated, Book: merged})
+	return c.JSON(http.StatusOK, bookToMap(merged))
+}
+
+// Moves the source to the recycle bin and everything of it to the target.
+// Either book having changed since it was read fails with errStaleVersion.
+func mergeWrites(ctx context.Context, coll, history, reviews, loans, copies, users *mongo.Collection, target, source BookStore) error {
+	// The source goes first, pinned to the version we read, so it cannot
+	// change between reading and merging it.
+	deletedAt := now()
+	result, err := coll.UpdateOne(ctx, withVersion(notDeleted(bson.M{"id": source.ID}), source.Version), bson.M{
+		"$set": bson.M{"deletedat": deletedAt, "updatedat": deletedAt, "mergedinto": target.ID},
+		"$inc": bson.M{"version": 1},
+	})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errStaleVersion
+	}
+
+	set := mergedFields(target, source)
+	if target.Cover == nil && source.Cover != nil {
+		set["cover"] = source.Cover
+	}
+	filter := withVersion(notDeleted(bson.M{"id": target.ID}), target.Version)
+	if _, err := updateWithHistory(ctx, coll, history, filter, set); err != nil {
+		// Without a transaction, take the source out of the recycle bin
+		// again, so nothing changed.
+		if !inTransactionContext(ctx) {
+			undo := bson.M{
+				"$unset": bson.M{"deletedat": "", "mergedinto": ""},
+				"$set":   bson.M{"updatedat": now()},
+				"$inc":   bson.M{"version": 1},
+			}
+			if _, undoErr := coll.UpdateOne(ctx, bson.M{"id": source.ID, "deletedat": deletedAt}, undo); undoErr != nil {
+				log.Printf("Error restoring book %s after a failed merge: %v", source.ID, undoErr)
+			}
+		}
+		if err == mongo.ErrNoDocuments {
+			return errStaleVersion
+		}
+		return err
+	}
+	if set["cover"] != nil {
+		if _, err := coll.UpdateOne(ctx, bson.M{"id": source.ID, "deletedat": deletedAt}, bson.M{"$unset": bson.M{"cover": ""}}); err != nil {
+			return err
+		}
+	}
+
+	if _, err := reviews.UpdateMany(ctx, bson.M{"bookid": source.ID}, bson.M{"$set": bson.M{"bookid": target.ID}}); err != nil {
+		return err
+	}
+	if err := refreshRating(ctx, coll, reviews, target.ID); err != nil {
+		return err
+	}
+	if _, err := loans.UpdateMany(ctx, bson.M{"bookid": source.ID}, bson.M{"$set": bson.M{"bookid": target.ID}}); err != nil {
+		return err
+	}
+	if _, err := copies.UpdateMany(ctx, bson.M{"bookid": source.ID}, bson.M{"$set": bson.M{"bookid": target.ID}}); err != nil {
+		return err
+	}
+	if err := refreshCopies(ctx, coll, copies, target.ID); err != nil {
+		return err
+	}
+	// Lists holding the source hold the target instead, once.
+	opts := options.Update().SetArrayFilters(options.ArrayFilters{Filters: bson.A{bson.M{"list.books": source.ID}}})
+	if _, err := users.UpdateMany(ctx, bson.M{"lists.books": source.ID}, bson.M{"$addToSet": bson.M{"lists.$[list].books": target.ID}}, opts); err != nil {
+		return err
+	}
+	_, err = users.UpdateMany(ctx, bson.M{"lists.books": source.ID}, bson.M{"$pull": bson.M{"lists.$[].books": source.ID}})
+	return err
+}
+
+// The fields the target takes from the source: those it has no value for,
+// and the tags of both.
+func mergedFields(target, source BookStore) bson.M {
+	set := bson.M{"tags": normalizeTags(append(slices.Clone(target.Tags), source.Tags...))}
+	if target.BookEdition == "" && source.BookEdition != "" {
+		set["bookedition"] = source.BookEdition
+	}
+	if target.BookPages == 0 && source.BookPages != 0 {
+		set["bookpages"] = source.BookPages
+	}
+	if target.BookYear == 0 && source.BookYear != 0 {
+		set["bookyear"] = source.BookYear
+	}
+	if target.Series == "" && source.Series != "" {
+		set["series"] = source.Series
+		set["seriesindex"] = source.SeriesIndex
+	}
+	if target.Publisher == "" && source.Publisher != "" {
+		set["publisher"] = source.Publisher
+	}
+	if target.Language == "" && source.Language != "" {
+		set["language"] = source.Language
+	}
+	if target.Description == "" && source.Description != "" {
+		set["description"] = source.Description
+	}
+	if target.Price == nil && source.Price != nil {
+		set["price"] = source.Price
+	}
+	if target.AuthorID == "" && source.AuthorID != "" {
+		set["authorid"] = source.AuthorID
+		set["bookauthor"] = source.BookAuthor
+	}
+	return set
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// A response encoder knows how to write values in one media type. Handlers
+// never pick an encoder themselves; they call respond, which looks at the
+// Accept header and chooses from the registry below.
+type responseEncoder struct {
+	mediaType string
+	// Reports whether the encoder can represent the value at all, e.g., CSV
+	// only works for tabular data.
+	supports func(v interface{}) bool
+	encode   func(w io.Writer, v interface{}) error
+}
+
+// Values that can be written as a CSV table, header row included.
+type csvEncodable interface {
+	CSVRecords() [][]string
+}
+
+// The registry of response formats. The first entry is the default, used
+// when the client does not care (no Accept header or */*).
+var responseEncoders = []responseEncoder{
+	{
+		mediaType: echo.MIMEApplicationJSON,
+		supports:  func(v interface{}) bool { return true },
+		encode: func(w io.Writer, v interface{}) error {
+			return json.NewEncoder(w).Encode(v)
+		},
+	},
+	{
+		mediaType: jsonAPIMediaType,
+		supports: func(v interface{}) bool {
+			_, ok := v.(jsonAPIEncodable)
+			return ok
+		},
+		encode: func(w io.Writer, v interface{}) error {
+			return json.NewEncoder(w).Encode(v.(jsonAPIEncodable).JSONAPIDocument())
+		},
+	},
+	{
+		mediaType: echo.MIMEApplicationXML,
+		supports:  func(v interface{}) bool { return true },
+		encode: func(w io.Writer, v interface{}) error {
+			if _, err := io.WriteString(w, xml.Header); err != nil {
+				return err
+			}
+			return xml.NewEncoder(w).Encode(v)
+		},
+	},
+	{
+		mediaType: "text/csv",
+		supports: func(v interface{}) bool {
+			_, ok := v.(csvEncodable)
+			return ok
+		},
+		encode: func(w io.Writer, v interface{}) error {
+			cw := csv.NewWriter(w)
+			cw.WriteAll(v.(csvEncodable).CSVRecords())
+			return cw.Error()
+		},
+	},
+	// The binary encodings; see binaryencoding.go.
+	{
+		mediaType: msgpackMediaType,
+		supports:  func(v interface{}) bool { return true },
+		encode:    encodeMsgpack,
+	},
+	{
+		mediaType: protobufMediaType,
+		supports: func(v interface{}) bool {
+			_, ok := v.(protoEncodable)
+			return ok
+		},
+		encode: encodeProtobuf,
+	},
+}
+
+// Writes v in the format the client asked for. Clients that only accept
+// formats we cannot produce get a 406. Every representation carries a strong
+// ETag, and GET requests whose If-None-Match already names it get a 304
+// without a body.
+func respond(c echo.Context, status int, v interface{}) error {
+	enc, ok := negotiateEncoder(c.Request().Header.Get(echo.HeaderAccept), v)
+	if !ok {
+		var offered []string
+		for _, enc := range responseEncoders {
+			if enc.supports(v) {
+				offered = append(offered, enc.mediaType)
+			}
+		}
+		return c.JSON(http.StatusNotAcceptable, map[string]string{
+			"error": "Not acceptable, available formats: " + strings.Join(offered, ", "),
+		})
+	}
+
+	var body bytes.Buffer
+	if err := enc.encode(&body, v); err != nil {
+		return err
+	}
+	etag := etagFor(body.Bytes())
+
+	header := c.Response().Header()
+	header.Add(echo.HeaderVary, echo.HeaderAccept)
+	header.Set("ETag", etag)
+	method := c.Request().Method
+	if status == http.StatusOK && (method == http.MethodGet || method == http.MethodHead) &&
+		etagMatches(c.Request().Header.Get("If-None-Match"), etag, true) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	// JSON:API forbids parameters on its media type, and binary ones have
+	// no charset.
+	contentType := enc.mediaType + "; charset=UTF-8"
+	if enc.mediaType == jsonAPIMediaType || enc.mediaType == msgpackMediaType || enc.mediaType == protobufMediaType {
+		contentType = enc.mediaType
+	}
+	return c.Blob(status, contentType, body.Bytes())
+}
+
+// Picks the registered encoder that best matches an Accept header, honouring
+// q-values and wildcards like text/* or */*.
+func negotiateEncoder(accept string, v interface{}) (responseEncoder, bool) {
+	if strings.TrimSpace(accept) == "" {
+		accept = "*/*"
+	}
+
+	type candidate struct {
+		mediaType string
+		q         float64
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if raw, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(raw, 64); err == nil {
+				q = parsed
+			}
+		}
+		if q > 0 {
+			candidates = append(candidates, candidate{mediaType, q})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+
+	for _, cand := range candidates {
+		for _, enc := range responseEncoders {
+			if enc.supports(v) && mediaTypeMatches(cand.mediaType, enc.mediaType) {
+				return enc, true
+			}
+		}
+	}
+	return responseEncoder{}, false
+}
+
+func mediaTypeMatches(pattern, mediaType string) bool {
+	if pattern == "*/*" || pattern == mediaType {
+		return true
+	}
+	prefix, ok := strings.CutSuffix(pattern, "/*")
+	return ok && strings.HasPrefix(mediaType, prefix+"/")
+}
+
+// A single book as returned by GET /api/books/:id.
+type bookItem map[string]interface{}
+
+func (b bookItem) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start = xml.StartElement{Name: xml.Name{Local: "book"}}
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, column := range csvColumns {
+		value := b.column(column)
+		if err := e.EncodeElement(value, xml.StartElement{Name: xml.Name{Local: column}}); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+func (b bookItem) csvRecord() []string {
+	record := make([]string, len(csvColumns))
+	for i, column := range csvColumns {
+		record[i] = b.column(column)
+	}
+	return record
+}
+
+// The value of a column as text, with tags separated by commas as in the
+// book form. Fields left out with ?fields= stay empty.
+func (b bookItem) column(name string) string {
+	switch value := b[name].(type) {
+	case nil:
+		return ""
+	case []string:
+		return strings.Join(value, ",")
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+func (b bookItem) CSVRecords() [][]string {
+	return [][]string{csvColumns, b.csvRecord()}
+}
+
+// The listing returned by GET /api/books. It is still the familiar array of
+// objects in JSON, but also knows how to show up as XML and CSV.
+type bookList []map[string]interface{}
+
+func (l bookList) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start = xml.StartElement{Name: xml.Name{Local: "books"}}
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, book := range l {
+		if err := bookItem(book).MarshalXML(e, start); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+func (l bookList) CSVRecords() [][]string {
+	records := [][]string{csvColumns}
+	for _, book := range l {
+		records = append(records, bookItem(book).csvRecord())
+	}
+	return records
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/labstack/echo/v4"
+)
+
+// With SENTRY_DSN set, panics and failed requests are reported to Sentry
+// instead of only ending up in the log. Every request gets its own hub,
+// which knows the request, its route and ID, and the user, so events
+// arrive with that context. Handlers answering 500 after an error call
+// reportError with it; any other 5xx answer is reported by the middleware,
+// with the error echo got, or just the route and status.
+
+// The key in the echo context marking that the error of a request has been
+// reported, so it is not reported twice.
+const errorReportedKey = "errorReported"
+
+// Connects the Sentry client. Events still queued are sent by flushErrors.
+func setupErrorTracking(cfg Config) error {
+	return sentry.Init(sentry.ClientOptions{
+		Dsn:         cfg.SentryDSN,
+		Environment: cfg.SentryEnvironment,
+	})
+}
+
+// Waits up to two seconds for the queued events to be sent.
+func flushErrors() {
+	sentry.Flush(2 * time.Second)
+}
+
+// Reports panics and 5xx answers other than 503. A panic is answered with
+// 500, like any other error. It must come after the middleware setting the
+// request ID.
+func errorTracking() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+			req := c.Request()
+			hub := sentry.CurrentHub().Clone()
+			hub.Scope().SetRequest(req)
+			hub.Scope().SetTag("request_id", c.Response().Header().Get(echo.HeaderXRequestID))
+			c.SetRequest(req.WithContext(sentry.SetHubOnContext(req.Context(), hub)))
+
+			defer func() {
+				if r := recover(); r != nil {
+					hub.Scope().SetTag("route", c.Path())
+					hub.RecoverWithContext(c.Request().Context(), r)
+					c.Set(errorReportedKey, true)
+					err = echo.NewHTTPError(http.StatusInternalServerError, "Internal Server Error")
+				}
+			}()
+			err = next(c)
+
+			status := c.Response().Status
+			var httpErr *echo.HTTPError
+			if errors.As(err, &httpErr) {
+				status = httpErr.Code
+			} else if err != nil {
+				status = http.StatusInternalServerError
+			}
+			// 503 is how read-only and maintenance mode refuse requests,
+			// on purpose.
+			if status < 500 || status == http.StatusServiceUnavailable || c.Get(errorReportedKey) != nil {
+				return err
+			}
+			setErrorScope(c, hub)
+			if err != nil {
+				hub.CaptureException(err)
+			} else {
+				hub.CaptureMessage(fmt.Sprintf("%s %s answered %d", req.Method, c.Path(), status))
+			}
+			return err
+		}
+	}
+}
+
+// Adds what is only known once the request was routed and authenticated.
+func setErrorScope(c echo.Context, hub *sentry.Hub) {
+	hub.Scope().SetTag("route", c.Path())
+	user := callerSubject(c)
+	if user == "" {
+		user = currentSession(c).User
+	}
+	if user != "" {
+		hub.Scope().SetUser(sentry.User{Username: user})
+	}
+}
+
+// Reports an error a handler is about to answer with 500. Without Sentry
+// it does nothing; the handler logs the error either way.
+func reportError(c echo.Context, err error) {
+	hub := sentry.GetHubFromContext(c.Request().Context())
+	if hub == nil {
+		return
+	}
+	setErrorScope(c, hub)
+	hub.CaptureException(err)
+	c.Set(errorReportedKey, true)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Kinds of book events.
+const (
+	bookCreated = "created"
+	bookUpdated = "updated"
+	bookDeleted = "deleted"
+)
+
+// Something that happened to a book. For deletions, only the ID of the book
+// is known. Seq numbers the events of this process, starting at 1.
+type bookEvent struct {
+	Seq  uint64
+	Type string
+	Book BookStore
+}
+
+// The number of recent events kept for subscribers that reconnect.
+const eventBacklog = 256
+
+// Passes book events on to everybody watching, e.g. gRPC Watch streams.
+// A subscriber that does not keep up misses events rather than holding up
+// the writes that publish them.
+type bookEvents struct {
+	mu     sync.Mutex
+	subs   map[chan bookEvent]struct{}
+	seq    uint64
+	recent []bookEvent
+}
+
+func newBookEvents() *bookEvents {
+	return &bookEvents{subs: map[chan bookEvent]struct{}{}}
+}
+
+// Returns a channel receiving all events from now on, and a function to
+// stop receiving them.
+func (e *bookEvents) Subscribe() (<-chan bookEvent, func()) {
+	_, ch, stop := e.SubscribeAfter(0)
+	return ch, stop
+}
+
+// Like Subscribe, but also returns the events after seq that are still in
+// the backlog, so a subscriber coming back misses nothing in between. A seq
+// of 0 returns no old events.
+func (e *bookEvents) SubscribeAfter(seq uint64) ([]bookEvent, <-chan bookEvent, func()) {
+	ch := make(chan bookEvent, 64)
+	e.mu.Lock()
+	var missed []bookEvent
+	if seq > 0 {
+		for _, event := range e.recent {
+			if event.Seq > seq {
+				missed = append(missed, event)
+			}
+		}
+	}
+	e.subs[ch] = struct{}{}
+	e.mu.Unlock()
+	return missed, ch, func() {
+		e.mu.Lock()
+		delete(e.subs, ch)
+		e.mu.Unlock()
+	}
+}
+
+func (e *bookEvents) Publish(event bookEvent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.seq++
+	event.Seq = e.seq
+	e.recent = append(e.recent, event)
+	if len(e.recent) > eventBacklog {
+		e.recent = e.recent[len(e.recent)-eventBacklog:]
+	}
+	for ch := range e.subs {
+		select {
+		case ch <- event:
+		default:
+			log.Printf("Dropping %s event of book %s for a slow watcher", event.Type, event.Book.ID)
+		}
+	}
+}
+
+// Publishes the events of writes that go around the repository, like the
+// batch endpoints, imports, merges, reverts, and restores. With a change
+// stream, which announces them already, events is nil.
+type directEvents struct {
+	events *bookEvents
+}
+
+func (d directEvents) Publish(event bookEvent) {
+	if d.events != nil {
+		d.events.Publish(event)
+	}
+}
+
+// Publishes an event of kind for each of the books with the IDs, as they
+// are stored now.
+func (d directEvents) PublishStored(ctx context.Context, coll *mongo.Collection, kind string, ids []string) {
+	if d.events == nil || len(ids) == 0 {
+		return
+	}
+	books, err := booksByID(ctx, coll, ids)
+	if err != nil {
+		log.Printf("Error announcing %d %s books: %v", len(ids), kind, err)
+		return
+	}
+	for _, id := range ids {
+		if book, ok := books[id]; ok {
+			d.events.Publish(bookEvent{Type: kind, Book: book})
+		}
+	}
+}
+
+// Wraps a repository so every successful write is published as an event.
+type publishingBooks struct {
+	bookRepository
+	events *bookEvents
+}
+
+func (r publishingBooks) Create(ctx context.Context, book *BookStore) error {
+	if err := r.bookRepository.Create(ctx, book); err != nil {
+		return err
+	}
+	r.events.Publish(bookEvent{Type: bookCreated, Book: *book})
+	return nil
+}
+
+func (r publishingBooks) Update(ctx context.Context, id string, changes bookChanges, version *int) (BookStore, error) {
+	book, err := r.bookRepository.Update(ctx, id, changes, version)
+	if err == nil {
+		r.events.Publish(bookEvent{Type: bookUpdated, Book: book})
+	}
+	return book, err
+}
+
+func (r publishingBooks) Delete(ctx context.Context, id string, version *int) error {
+	if err := r.bookRepository.Delete(ctx, id, version); err != nil {
+		return err
+	}
+	r.events.Publish(bookEvent{Type: bookDeleted, Book: BookStore{ID: id}})
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Header row of the CSV export. The column names match the JSON keys of the
+// API so the file can be imported again later. Only the version is not
+// read back: imported books start over at version 1.
+var csvColumns = []string{
+	"id", "title", "author", "author_id", "edition", "pages", "year", "tags",
+	"series", "series_index", "publisher", "language", "description", "price", "version",
+}
+
+// The CSV row of a book, with the values of its API answer.
+func bookCSVRecord(book BookStore) []string {
+	return bookToMap(book).csvRecord()
+}
+
+// Writes the books of an export one by one.
+type bookWriter interface {
+	Write(book BookStore) error
+	Flush() error
+}
+
+type csvBookWriter struct {
+	*csv.Writer
+}
+
+func (w csvBookWriter) Write(book BookStore) error {
+	return w.Writer.Write(bookCSVRecord(book))
+}
+
+func (w csvBookWriter) Flush() error {
+	w.Writer.Flush()
+	return w.Error()
+}
+
+// The formats of GET /api/books/export: CSV, and the citation formats.
+type exportFormat struct {
+	contentType string
+	filename    string
+	newWriter   func(w io.Writer) (bookWriter, error)
+}
+
+var exportFormats = map[string]exportFormat{
+	"csv": {"text/csv; charset=utf-8", "books.csv", func(w io.Writer) (bookWriter, error) {
+		cw := csv.NewWriter(w)
+		return csvBookWriter{cw}, cw.Write(csvColumns)
+	}},
+}
+
+func init() {
+	for name, format := range citationFormats {
+		exportFormats[name] = exportFormat{format.contentType, "books." + format.extension, func(w io.Writer) (bookWriter, error) {
+			return &citationWriter{w: w, format: format, keys: map[string]int{}}, nil
+		}}
+	}
+}
+
+// Handles GET /api/books/export?format=csv (also bibtex or ris). Instead of
+// loading the whole collection like findAllBooks does, we walk the Mongo
+// cursor and write one book at a time, flushing every few books so even a
+// huge collection never has to fit in memory.
+func exportBooks(coll *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		name := c.QueryParam("format")
+		if name == "" {
+			name = "csv"
+		}
+		format, ok := exportFormats[name]
+		if !ok {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Unsupported export format " + name})
+		}
+
+		ctx := c.Request().Context()
+		cursor, err := coll.Find(ctx, notDeleted(bson.M{}))
+		if err != nil {
+			log.Printf("Error exporting books: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to export books"})
+		}
+		defer cursor.Close(ctx)
+
+		res := c.Response()
+		withoutWriteTimeout(c)
+		res.Header().Set(echo.HeaderContentType, format.contentType)
+		res.Header().Set(echo.HeaderContentDisposition, `attachment; filename="`+format.filename+`"`)
+		res.WriteHeader(http.StatusOK)
+
+		err = writeExport(ctx, cursor, format, res, res.Flush)
+		var cursorErr exportCursorError
+		if errors.As(err, &cursorErr) {
+			// The status line is already out, so a cursor failure can
+			// only be logged at this point.
+			log.Printf("Error while streaming the export: %v", err)
+			return nil
+		}
+		return err
+	}
+}
+
+// A failure of the cursor an export reads from, as opposed to one writing
+// the export.
+type exportCursorError struct{ error }
+
+func (e exportCursorError) Unwrap() error { return e.error }
+
+// Writes the books of the cursor to out in the format, calling flush every
+// hundred books. Also used by the export command; see cli.go.
+func writeExport(ctx context.Context, cursor *mongo.Cursor, format exportFormat, out io.Writer, flush func()) error {
+	w, err := format.newWriter(out)
+	if err != nil {
+		return err
+	}
+	for rows := 1; cursor.Next(ctx); rows++ {
+		var book BookStore
+		if err := cursor.Decode(&book); err != nil {
+			return err
+		}
+		if err := w.Write(book); err != nil {
+			return err
+		}
+		if rows%100 == 0 {
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			flush()
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := cursor.Err(); err != nil {
+		return exportCursorError{err}
+	}
+	return nil
+}
+
+// Handles GET /api/books/stream, which lists the books as newline delimited
+// JSON, one book per line. It takes the filters, paging, sort, and fields of
+// GET /api/books, but walks the cursor like the export does, so the listing
+// never has to fit in memory.
+func streamBooks(coll *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		q, errs := bookFilter(c)
+		if len(errs) > 0 {
+			return validationFailed(c, errs)
+		}
+		opts := options.Find()
+		if q.Sort != "" || q.Offset > 0 || q.Limit > 0 {
+			opts.SetSort(q.sort()).SetSkip(q.Offset).SetLimit(q.Limit)
+		}
+		if projection := q.projection(); projection != nil {
+			opts.SetProjection(projection)
+		}
+
+		ctx := c.Request().Context()
+		cursor, err := coll.Find(ctx, notDeleted(q.filter()), opts)
+		if err != nil {
+			log.Printf("Error streaming books: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to list books"})
+		}
+		defer cursor.Close(ctx)
+
+		res := c.Response()
+		withoutWriteTimeout(c)
+		res.Header().Set(echo.HeaderContentType, "application/x-ndjson")
+		res.WriteHeader(http.StatusOK)
+
+		enc := json.NewEncoder(res)
+		for rows := 1; cursor.Next(ctx); rows++ {
+			var book BookStore
+			if err := cursor.Decode(&book); err != nil {
+				return err
+			}
+			if err := enc.Encode(bookItem(q.project(bookToMap(book)))); err != nil {
+				return err
+			}
+			if rows%100 == 0 {
+				res.Flush()
+			}
+		}
+		if err := cursor.Err(); err != nil {
+			log.Printf("Error while streaming books: %v", err)
+		}
+		return nil
+	}
+}
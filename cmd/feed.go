@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/xml"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Handles GET /feed.xml, an Atom feed of the most recently added books for
+// feed readers. The feed only changes when books do, so its Updated date is
+// the newest change among its entries, which keeps the ETag stable between
+// polls. Readers may cache it for a few minutes and then revalidate.
+func recentBooksFeed(coll *mongo.Collection, size int) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		opts := options.Find().SetSort(bson.D{{Key: "createdat", Value: -1}}).SetLimit(int64(size))
+		var books []BookStore
+		cursor, err := coll.Find(ctx, notDeleted(bson.M{"createdat": bson.M{"$exists": true}}), opts)
+		if err == nil {
+			err = cursor.All(ctx, &books)
+		}
+		if err != nil {
+			log.Printf("Error listing recent books: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+
+		feed := atomFeed{
+			ID:     absoluteURL(c, "/feed.xml"),
+			Title:  "Recently added books",
+			Author: &atomPerson{Name: "Cloud Computing Exercise Website"},
+			Links: []atomLink{
+				{Rel: "self", Href: absoluteURL(c, "/feed.xml"), Type: "application/atom+xml"},
+				{Rel: "alternate", Href: absoluteURL(c, "/"), Type: "text/html"},
+			},
+			Updated: time.Unix(0, 0).UTC(),
+		}
+		for _, book := range books {
+			entry := bookEntry(c, book)
+			entry.Published = &book.CreatedAt
+			feed.Entries = append(feed.Entries, entry)
+			if entry.Updated.After(feed.Updated) {
+				feed.Updated = entry.Updated
+			}
+		}
+
+		body, err := xml.MarshalIndent(feed, "", "  ")
+		if err != nil {
+			return err
+		}
+		body = append([]byte(xml.Header), body...)
+		etag := etagFor(body)
+		header := c.Response().Header()
+		header.Set(echo.HeaderCacheControl, "public, max-age=300")
+		header.Set("ETag", etag)
+		if etagMatches(c.Request().Header.Get("If-None-Match"), etag, true) || notModifiedSince(c, feed.Updated) {
+			return c.NoContent(http.StatusNotModified)
+		}
+		return c.Blob(http.StatusOK, "application/atom+xml; charset=UTF-8", body)
+	}
+}
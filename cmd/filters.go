@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The range filters understood by /api/books and /books. Each query
+// parameter sets one bound of the book query.
+var rangeParams = []struct {
+	param string
+	bound func(q *bookQuery) **int
+}{
+	{"year_from", func(q *bookQuery) **int { return &q.YearFrom }},
+	{"year_to", func(q *bookQuery) **int { return &q.YearTo }},
+	{"min_pages", func(q *bookQuery) **int { return &q.MinPages }},
+	{"max_pages", func(q *bookQuery) **int { return &q.MaxPages }},
+}
+
+// Turns the filter parameters of a request into a book query, e.g.
+// ?year_from=1800&year_to=1900 selects the books of the 19th century.
+// ?tag= may be repeated to find books carrying all of the given tags.
+// ?publisher= and ?language= select the books of a publisher or in a
+// language. ?currency= adds the prices in that currency; see price.go.
+// Unknown parameters are ignored, malformed numbers, language tags, and
+// currency codes are reported as validation errors.
+func bookFilter(c echo.Context) (bookQuery, validationErrors) {
+	var q bookQuery
+	errs := validationErrors{}
+	for _, rp := range rangeParams {
+		raw := c.QueryParam(rp.param)
+		if raw == "" {
+			continue
+		}
+		value, err := strconv.Atoi(raw)
+		if err != nil {
+			errs[rp.param] = "must be a whole number"
+			continue
+		}
+		*rp.bound(&q) = &value
+	}
+	q.Tags = normalizeTags(c.QueryParams()["tag"])
+	q.Publisher = strings.TrimSpace(c.QueryParam("publisher"))
+	if raw := strings.TrimSpace(c.QueryParam("language")); raw != "" {
+		if msg := validationRules["bcp47"](raw, ""); msg != "" {
+			errs["language"] = msg
+		} else {
+			q.Language = normalizeLanguage(raw)
+		}
+	}
+	bookPaging(c, &q, errs)
+	bookFields(c, &q, errs)
+	var msg string
+	if q.Currency, msg = displayCurrency(c); msg != "" {
+		errs["currency"] = msg
+	}
+	return q, errs
+}
+
+// Reads ?fields=id,title,author into the query, so only those fields are
+// read from the database and returned. JSON:API clients send the sparse
+// fieldset ?fields[books]= instead; see jsonapi.go.
+func bookFields(c echo.Context, q *bookQuery, errs validationErrors) {
+	raw := c.QueryParam("fields")
+	if sparse := c.QueryParam("fields[books]"); raw == "" && sparse != "" {
+		raw = jsonAPIBookFieldset(sparse)
+	}
+	if raw == "" {
+		return
+	}
+	for _, field := range strings.Split(raw, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if _, ok := projectionFields[field]; !ok {
+			errs["fields"] = "unknown field " + field
+			return
+		}
+		q.Fields = append(q.Fields, field)
+	}
+}
+
+// Books are listed in pages of defaultPageSize, and at most maxPageSize,
+// books once ?page or ?size is given.
+const (
+	defaultPageSize = 25
+	maxPageSize     = 100
+)
+
+// Reads ?page (counting from 1), ?size, and ?sort into the query, e.g.
+// ?page=2&size=10&sort=-year lists the 11th to 20th book, newest first.
+// Without page and size, all books are listed. ?after=<cursor> lists the
+// page of books added after the cursor instead; see bookCursor.
+func bookPaging(c echo.Context, q *bookQuery, errs validationErrors) {
+	page, size := 1, defaultPageSize
+	paged := false
+	if raw := c.QueryParam("page"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			errs["page"] = "must be a whole number of at least 1"
+		}
+		page, paged = n, true
+	}
+	if raw := c.QueryParam("size"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxPageSize {
+			errs["size"] = "must be a whole number from 1 to " + strconv.Itoa(maxPageSize)
+		}
+		size, paged = n, true
+	}
+	if paged && errs["page"] == "" && errs["size"] == "" {
+		q.Offset = int64((page - 1) * size)
+		q.Limit = int64(size)
+	}
+	if sort := c.QueryParam("sort"); sort != "" {
+		if _, ok := sortFields[strings.TrimPrefix(sort, "-")]; !ok {
+			errs["sort"] = "must be one of id, title, author, edition, pages, year, created_at, updated_at, optionally prefixed with -"
+		} else {
+			q.Sort = sort
+		}
+	}
+	if raw := c.QueryParam("after"); raw != "" {
+		after, err := parseBookCursor(raw)
+		switch {
+		case err != nil:
+			errs["after"] = "is not a valid cursor"
+		case c.QueryParam("page") != "":
+			errs["after"] = "cannot be combined with page"
+		case c.QueryParam("sort") != "":
+			errs["after"] = "cannot be combined with sort, cursors follow the order books were added in"
+		case errs["size"] == "":
+			q.After = &after
+			q.Offset, q.Limit = 0, int64(size)
+		}
+	}
+}
+
+// Offset pagination skips or repeats books when others are added or
+// deleted between two pages. A cursor names the last book of a page
+// instead, and the next page starts after it, in the order the books were
+// added in, which is the order of their indexed _id. The cursor is opaque
+// to clients: the _id, base64url encoded.
+func bookCursor(book BookStore) string {
+	return base64.RawURLEncoding.EncodeToString(book.MongoID[:])
+}
+
+func parseBookCursor(raw string) (primitive.ObjectID, error) {
+	var id primitive.ObjectID
+	b, err := base64.RawURLEncoding.DecodeString(raw)
+	if err == nil && len(b) != len(id) {
+		err = base64.CorruptInputError(len(b))
+	}
+	copy(id[:], b)
+	return id, err
+}
+
+// Tells clients paging through the books how many there are in total, in
+// X-Total-Count, and where the other pages are, in a Link header (RFC
+// 8288) with first, prev, next, and last. Without paging, all books are
+// on the single page, and only the count is sent. Pages of a cursor have
+// their links set by setCursorHeaders.
+func setPaginationHeaders(c echo.Context, q bookQuery, total int64) {
+	header := c.Response().Header()
+	header.Set("X-Total-Count", strconv.FormatInt(total, 10))
+	if q.Limit <= 0 || q.After != nil {
+		return
+	}
+	page := q.Offset/q.Limit + 1
+	last := max((total+q.Limit-1)/q.Limit, 1)
+
+	link := func(page int64, rel string) string {
+		query := c.Request().URL.Query()
+		query.Set("page", strconv.FormatInt(page, 10))
+		query.Set("size", strconv.FormatInt(q.Limit, 10))
+		return "<" + c.Request().URL.Path + "?" + query.Encode() + `>; rel="` + rel + `"`
+	}
+	links := []string{link(1, "first")}
+	if page > 1 {
+		links = append(links, link(min(page-1, last), "prev"))
+	}
+	if page < last {
+		links = append(links, link(page+1, "next"))
+	}
+	links = append(links, link(last, "last"))
+	header.Set("Link", strings.Join(links, ", "))
+}
+
+// Sends the cursor of the next page in X-Next-Cursor when a page in the
+// order books were added in is full, so there may be more. A page of a
+// cursor also links to the next one, e.g.
+// </api/books?after=ZmM...&size=25>; rel="next". The last page has no
+// cursor.
+func setCursorHeaders(c echo.Context, q bookQuery, page []BookStore) {
+	if q.Limit <= 0 || q.Sort != "" || int64(len(page)) < q.Limit {
+		return
+	}
+	cursor := bookCursor(page[len(page)-1])
+	header := c.Response().Header()
+	header.Set("X-Next-Cursor", cursor)
+	if q.After == nil {
+		return
+	}
+	query := c.Request().URL.Query()
+	query.Set("after", cursor)
+	query.Set("size", strconv.FormatInt(q.Limit, 10))
+	header.Set("Link", "<"+c.Request().URL.Path+"?"+query.Encode()+`>; rel="next"`)
+}
+
+// The current values of the filters, used to fill the form above the book
+// table.
+func bookFilterValues(c echo.Context) map[string]string {
+	values := map[string]string{}
+	for _, rp := range rangeParams {
+		values[rp.param] = c.QueryParam(rp.param)
+	}
+	values["tag"] = c.QueryParam("tag")
+	values["publisher"] = c.QueryParam("publisher")
+	values["language"] = c.QueryParam("language")
+	values["currency"] = c.QueryParam("currency")
+	for _, column := range optionalBookColumns {
+		values["show_"+column] = c.QueryParam("show_" + column)
+	}
+	values["size"] = c.QueryParam("size")
+	values["sort"] = c.QueryParam("sort")
+	return values
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Flash messages tell the user what just happened, e.g. that a book was
+// created. They are kept in the session until the next page shows them, so
+// they survive a redirect, and HTMX responses carry them along to be
+// swapped into the message area of the page.
+type flash struct {
+	Kind string `json:"kind"`
+	Text string `json:"text"`
+}
+
+// Kinds of flash messages; each has its own style.
+const (
+	flashCreated = "created"
+	flashUpdated = "updated"
+	flashDeleted = "deleted"
+	flashError   = "error"
+)
+
+// Queues a message for the next page the user sees.
+func addFlash(c echo.Context, kind, text string) {
+	s := currentSession(c)
+	s.Flashes = append(s.Flashes, flash{Kind: kind, Text: text})
+	s.Changed()
+}
+
+// Returns the pending messages and forgets them.
+func takeFlashes(c echo.Context) []flash {
+	s := currentSession(c)
+	messages := s.Flashes
+	if len(messages) > 0 {
+		s.Flashes = nil
+		s.Changed()
+	}
+	return messages
+}
+
+// Renders the template followed by the "flash-messages" partial with the
+// pending messages, which HTMX swaps into the message area out of band.
+// Without a template name, only the messages are sent.
+func renderWithFlashes(c echo.Context, code int, name string, data interface{}) error {
+	var buf bytes.Buffer
+	renderer := c.Echo().Renderer
+	if name != "" {
+		if err := renderer.Render(&buf, name, data, c); err != nil {
+			return err
+		}
+	}
+	if err := renderer.Render(&buf, "flash-messages", takeFlashes(c), c); err != nil {
+		return err
+	}
+	return c.HTMLBlob(code, buf.Bytes())
+}
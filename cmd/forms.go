@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The fields of the create form.
+var bookFormFields = []string{"id", "title", "author", "edition", "pages", "year", "tags", "series", "series_index"}
+
+// What the "create-form" template shows: the values entered so far and
+// the problems found with them, both keyed by field name.
+type bookForm struct {
+	Values map[string]string
+	Errors validationErrors
+}
+
+// Handles GET /create, the page with the form for a new book. Books created
+// with it are listed below the form.
+func createBookPage(c echo.Context) error {
+	return c.Render(http.StatusOK, "create-page", bookForm{Values: map[string]string{}, Errors: validationErrors{}})
+}
+
+// Handles POST /books, sent by the create form. The book goes through the
+// repository like one sent to POST /api/books. On success the answer is
+// the new table row, which HTMX appends to the table below the form; an
+// invalid book re-renders the form with 422 and the error of each field.
+func createBookForm(books bookRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		form := bookForm{Values: map[string]string{}, Errors: validationErrors{}}
+		for _, field := range bookFormFields {
+			form.Values[field] = strings.TrimSpace(c.FormValue(field))
+		}
+
+		book := BookStore{
+			ID:          form.Values["id"],
+			BookName:    form.Values["title"],
+			BookAuthor:  form.Values["author"],
+			BookEdition: form.Values["edition"],
+			Series:      form.Values["series"],
+		}
+		if tags := form.Values["tags"]; tags != "" {
+			book.Tags = strings.Split(tags, ",")
+		}
+		for field, target := range map[string]*flexInt{"pages": &book.BookPages, "year": &book.BookYear, "series_index": &book.SeriesIndex} {
+			n, err := parseFlexInt(form.Values[field])
+			if err != nil {
+				form.Errors[field] = "must be a whole number"
+			}
+			*target = n
+		}
+		if len(form.Errors) > 0 {
+			// Report the other fields as well, not just the numbers.
+			for field, msg := range validateStruct(&book) {
+				if _, ok := form.Errors[field]; !ok {
+					form.Errors[field] = msg
+				}
+			}
+		} else {
+			var errs validationErrors
+			err := books.Create(c.Request().Context(), &book)
+			switch {
+			case errors.As(err, &errs):
+				form.Errors = errs
+			case err == errBookExists:
+				form.Errors["id"] = "is already taken by another book"
+			case err != nil:
+				log.Printf("Error creating book %s from the form: %v", book.ID, err)
+				return c.NoContent(http.StatusInternalServerError)
+			}
+		}
+
+		if len(form.Errors) > 0 {
+			// The form itself is replaced instead of the table.
+			c.Response().Header().Set("HX-Retarget", "#create-form")
+			c.Response().Header().Set("HX-Reswap", "outerHTML")
+			return renderWithFlashes(c, http.StatusUnprocessableEntity, "create-form", form)
+		}
+		addFlash(c, flashCreated, "Created \""+book.BookName+"\".")
+		// Without HTMX, the browser posted the form itself and is sent back
+		// to the start page, which shows the message.
+		if c.Request().Header.Get("HX-Request") == "" {
+			return c.Redirect(http.StatusSeeOther, "/")
+		}
+		return renderWithFlashes(c, http.StatusOK, "book-row", bookToMap(book))
+	}
+}
+
+// The columns of the book table that can be edited in place.
+var bookRowFields = []string{"title", "author", "edition", "pages"}
+
+// What the "book-edit-row" template shows: the book, the values entered
+// for it, and the problems found with them.
+type bookRowForm struct {
+	Book   map[string]interface{}
+	Values map[string]string
+	Errors validationErrors
+}
+
+// Handles GET /books/:id/row, the plain table row of a book. Cancelling an
+// edit swaps it back in.
+func bookRow(books bookRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		book, err := books.Get(c.Request().Context(), c.Param("id"))
+		if err != nil {
+			return rowFailed(c, err, c.Param("id"), "fetch")
+		}
+		return c.Render(http.StatusOK, "book-row", bookToMap(book))
+	}
+}
+
+// Handles GET /books/:id/edit, the table row of a book with inputs in place
+// of its values.
+func editBookRow(books bookRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		book, err := books.Get(c.Request().Context(), c.Param("id"))
+		if err != nil {
+			return rowFailed(c, err, c.Param("id"), "fetch")
+		}
+		values := bookToMap(book)
+		form := bookRowForm{Book: values, Values: map[string]string{}, Errors: validationErrors{}}
+		for _, field := range bookRowFields {
+			form.Values[field] = fmt.Sprint(values[field])
+		}
+		return c.Render(http.StatusOK, "book-edit-row", form)
+	}
+}
+
+// Handles PUT /books/:id, sent by the edit row. The changes are validated
+// like those sent to PUT /api/books/:id and only saved if the book still is
+// in the version that was edited. The answer is the updated row, or the
+// edit row again with 422 and the errors.
+func updateBookRow(books bookRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		id := c.Param("id")
+		form := bookRowForm{Values: map[string]string{}, Errors: validationErrors{}}
+		payload := map[string]interface{}{}
+		for _, field := range bookRowFields {
+			form.Values[field] = strings.TrimSpace(c.FormValue(field))
+			payload[field] = form.Values[field]
+		}
+		var version *int
+		if n, err := strconv.Atoi(c.FormValue("version")); err == nil {
+			version = &n
+		}
+
+		form.Errors = validateUpdate(payload)
+		if len(form.Errors) == 0 {
+			book, err := books.Update(ctx, id, changesFromPayload(payload), version)
+			var errs validationErrors
+			switch {
+			case err == nil:
+				addFlash(c, flashUpdated, "Saved \""+book.BookName+"\".")
+				return renderWithFlashes(c, http.StatusOK, "book-row", bookToMap(book))
+			case errors.As(err, &errs):
+				form.Errors = errs
+			case err == errStaleVersion:
+				addFlash(c, flashError, "Someone else changed this book in the meantime. Cancel to see their changes.")
+			default:
+				return rowFailed(c, err, id, "update")
+			}
+		}
+
+		book, err := books.Get(ctx, id)
+		if err != nil {
+			return rowFailed(c, err, id, "fetch")
+		}
+		form.Book = bookToMap(book)
+		if version != nil {
+			// Keep the edited version, so saving again still notices the
+			// other change.
+			form.Book["version"] = *version
+		}
+		return renderWithFlashes(c, http.StatusUnprocessableEntity, "book-edit-row", form)
+	}
+}
+
+// Handles DELETE /books/:id, which moves the book to the recycle bin. The
+// answer holds nothing but the flash message, so its row is removed.
+func deleteBookRow(books bookRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if err := books.Delete(c.Request().Context(), c.Param("id"), nil); err != nil {
+			return rowFailed(c, err, c.Param("id"), "delete")
+		}
+		addFlash(c, flashDeleted, "Moved book "+c.Param("id")+" to the recycle bin.")
+		return renderWithFlashes(c, http.StatusOK, "", nil)
+	}
+}
+
+// Answers a failed repository call on a table row. The HTML routes answer
+// without a body, like the other pages do.
+func rowFailed(c echo.Context, err error, id, action string) error {
+	if err == errBookNotFound {
+		return c.NoContent(http.StatusNotFound)
+	}
+	log.Printf("Error trying to %s book %s: %v", action, id, err)
+	reportError(c, err)
+	return c.NoContent(http.StatusInternalServerError)
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// The GraphQL API at /graphql offers the same books, authors, and years as
+// the REST API. Books are read and written through the book repository, so
+// validation, author linking, and versioning work exactly as with REST.
+// Queries need the reader role; creating and updating books the editor
+// role, deleting them the admin role.
+
+// Context key under which the GraphQL handler stores a func(role string)
+// bool telling the resolvers whether the caller holds a role.
+type graphqlCallerKey struct{}
+
+// An error reported in the "errors" list of a GraphQL response. The code,
+// and for invalid input the offending fields, end up in "extensions".
+type graphqlError struct {
+	message string
+	code    string
+	fields  validationErrors
+}
+
+func (e graphqlError) Error() string {
+	return e.message
+}
+
+func (e graphqlError) Extensions() map[string]interface{} {
+	ext := map[string]interface{}{"code": e.code}
+	if len(e.fields) > 0 {
+		ext["fields"] = e.fields
+	}
+	return ext
+}
+
+// Translates a repository error into a GraphQL error, like bookFailed does
+// for REST.
+func graphqlFailed(err error, id, action string) error {
+	var errs validationErrors
+	switch {
+	case errors.As(err, &errs):
+		return graphqlError{message: "Validation failed", code: "VALIDATION_FAILED", fields: errs}
+	case err == errBookNotFound:
+		return graphqlError{message: "Book not found with ID " + id, code: "NOT_FOUND"}
+	case err == errBookExists:
+		return graphqlError{message: "Book with ID " + id + " already exists", code: "CONFLICT"}
+	case err == errStaleVersion:
+		return graphqlError{message: "Book with ID " + id + " was modified by someone else", code: "CONFLICT"}
+	case err == errReadOnly:
+		return graphqlError{message: "The service is read-only at the moment, try again later", code: "UNAVAILABLE"}
+	case err == errCircuitOpen:
+		return graphqlError{message: "The database is unavailable at the moment, try again later", code: "UNAVAILABLE"}
+	}
+	log.Printf("Error trying to %s book %s: %v", action, id, err)
+	return graphqlError{message: "Failed to " + action + " book", code: "INTERNAL"}
+}
+
+// Fails unless the caller holds at least the given role.
+func requireRole(ctx context.Context, role string) error {
+	if allows, ok := ctx.Value(graphqlCallerKey{}).(func(string) bool); ok && !allows(role) {
+		return graphqlError{message: "The " + role + " role is required", code: "FORBIDDEN"}
+	}
+	return nil
+}
+
+// A field read from the source object of type T, e.g. the title of a book.
+func sourceField[T any](typ graphql.Output, get func(T) interface{}) *graphql.Field {
+	return &graphql.Field{
+		Type: typ,
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return get(p.Source.(T)), nil
+		},
+	}
+}
+
+// Empty strings, zero numbers, and zero times stand for "unknown" and are
+// returned as null.
+func optional[T comparable](value T) interface{} {
+	var zero T
+	if value == zero {
+		return nil
+	}
+	return value
+}
+
+// The JSON names of the book fields, by their GraphQL names. Input is
+// converted to a JSON payload, so it is decoded and validated by the same
+// code as a REST request.
+var graphqlBookFields = map[string]string{
+	"id":          "id",
+	"title":       "title",
+	"author":      "author",
+	"authorId":    "author_id",
+	"edition":     "edition",
+	"pages":       "pages",
+	"year":        "year",
+	"tags":        "tags",
+	"series":      "series",
+	"seriesIndex": "series_index",
+}
+
+func graphqlPayload(input map[string]interface{}) map[string]interface{} {
+	payload := map[string]interface{}{}
+	for name, value := range input {
+		if field, ok := graphqlBookFields[name]; ok {
+			payload[field] = value
+		}
+	}
+	return payload
+}
+
+// Reads an optional Int argument.
+func intArg(args map[string]interface{}, name string) *int {
+	if value, ok := args[name].(int); ok {
+		return &value
+	}
+	return nil
+}
+
+// Builds the schema on top of the book repository. Authors and years are
+// read from their collections directly, as the REST API does.
+func newGraphQLSchema(books bookRepository, coll, authors *mongo.Collection) (graphql.Schema, error) {
+	ratingType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Rating",
+		Fields: graphql.Fields{
+			"average": sourceField(graphql.NewNonNull(graphql.Float), func(r bookRating) interface{} { return r.Average }),
+			"count":   sourceField(graphql.NewNonNull(graphql.Int), func(r bookRating) interface{} { return r.Count }),
+		},
+	})
+
+	bookType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Book",
+		Fields: graphql.Fields{
+			"id":       sourceField(graphql.NewNonNull(graphql.ID), func(b BookStore) interface{} { return b.ID }),
+			"title":    sourceField(graphql.NewNonNull(graphql.String), func(b BookStore) interface{} { return b.BookName }),
+			"author":   sourceField(graphql.String, func(b BookStore) interface{} { return optional(b.BookAuthor) }),
+			"authorId": sourceField(graphql.ID, func(b BookStore) interface{} { return optional(b.AuthorID) }),
+			"edition":  sourceField(graphql.String, func(b BookStore) interface{} { return optional(b.BookEdition) }),
+			"pages":    sourceField(graphql.Int, func(b BookStore) interface{} { return optional(int(b.BookPages)) }),
+			"year":     sourceField(graphql.Int, func(b BookStore) interface{} { return optional(int(b.BookYear)) }),
+			"tags": sourceField(graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String))), func(b BookStore) interface{} {
+				if b.Tags == nil {
+					return []string{}
+				}
+				return b.Tags
+			}),
+			"series":      sourceField(graphql.String, func(b BookStore) interface{} { return optional(b.Series) }),
+			"seriesIndex": sourceField(graphql.Int, func(b BookStore) interface{} { return optional(int(b.SeriesIndex)) }),
+			"rating": sourceField(ratingType, func(b BookStore) interface{} {
+				if b.Rating == nil {
+					return nil
+				}
+				return *b.Rating
+			}),
+			"available": sourceField(graphql.NewNonNull(graphql.Boolean), func(b BookStore) interface{} { return b.Checkout == nil }),
+			"version":   sourceField(graphql.NewNonNull(graphql.Int), func(b BookStore) interface{} { return b.Version }),
+			"createdAt": sourceField(graphql.DateTime, func(b BookStore) interface{} { return optional(b.CreatedAt) }),
+			"updatedAt": sourceField(graphql.DateTime, func(b BookStore) interface{} { return optional(b.UpdatedAt) }),
+		},
+	})
+	bookList := graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(bookType)))
+
+	listBooks := func(ctx context.Context, q bookQuery) (interface{}, error) {
+		found, err := books.List(ctx, q)
+		if err != nil {
+			return nil, graphqlFailed(err, "", "list")
+		}
+		if found == nil {
+			found = []BookStore{}
+		}
+		return found, nil
+	}
+
+	authorType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Author",
+		Fields: graphql.Fields{
+			"id":        sourceField(graphql.NewNonNull(graphql.ID), func(a Author) interface{} { return a.ID }),
+			"name":      sourceField(graphql.NewNonNull(graphql.String), func(a Author) interface{} { return a.Name }),
+			"bio":       sourceField(graphql.String, func(a Author) interface{} { return optional(a.Bio) }),
+			"birthYear": sourceField(graphql.Int, func(a Author) interface{} { return optional(int(a.BirthYear)) }),
+			"books": &graphql.Field{
+				Type: bookList,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return listBooks(p.Context, bookQuery{AuthorID: p.Source.(Author).ID})
+				},
+			},
+		},
+	})
+
+	yearType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Year",
+		Fields: graphql.Fields{
+			"year":      sourceField(graphql.NewNonNull(graphql.Int), func(y map[string]interface{}) interface{} { return int(y["BookYear"].(flexInt)) }),
+			"bookCount": sourceField(graphql.NewNonNull(graphql.Int), func(y map[string]interface{}) interface{} { return y["BookCount"] }),
+		},
+	})
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"books": &graphql.Field{
+				Type:        bookList,
+				Description: "Lists books, optionally filtered and paged. Without a limit, all matching books are returned.",
+				Args: graphql.FieldConfigArgument{
+					"yearFrom": {Type: graphql.Int},
+					"yearTo":   {Type: graphql.Int},
+					"minPages": {Type: graphql.Int},
+					"maxPages": {Type: graphql.Int},
+					"tags":     {Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+					"authorId": {Type: graphql.ID},
+					"offset":   {Type: graphql.Int, DefaultValue: 0},
+					"limit":    {Type: graphql.Int, DefaultValue: 0},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					q := bookQuery{
+						YearFrom: intArg(p.Args, "yearFrom"),
+						YearTo:   intArg(p.Args, "yearTo"),
+						MinPages: intArg(p.Args, "minPages"),
+						MaxPages: intArg(p.Args, "maxPages"),
+						Offset:   int64(p.Args["offset"].(int)),
+						Limit:    int64(p.Args["limit"].(int)),
+					}
+					q.AuthorID, _ = p.Args["authorId"].(string)
+					if tags, ok := p.Args["tags"].([]interface{}); ok {
+						for _, tag := range tags {
+							q.Tags = append(q.Tags, tag.(string))
+						}
+						q.Tags = normalizeTags(q.Tags)
+					}
+					errs := validationErrors{}
+					if q.Offset < 0 {
+						errs["offset"] = "must be at least 0"
+					}
+					if q.Limit < 0 {
+						errs["limit"] = "must be at least 0"
+					}
+					if len(errs) > 0 {
+						return nil, graphqlFailed(errs, "", "list")
+					}
+					return listBooks(p.Context, q)
+				},
+			},
+			"book": &graphql.Field{
+				Type: bookType,
+				Args: graphql.FieldConfigArgument{
+					"id": {Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					id := p.Args["id"].(string)
+					book, err := books.Get(p.Context, id)
+					if err == errBookNotFound {
+						return nil, nil
+					} else if err != nil {
+						return nil, graphqlFailed(err, id, "fetch")
+					}
+					return book, nil
+				},
+			},
+			"authors": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(authorType))),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					ret, err := findAuthors(p.Context, authors)
+					if err != nil {
+						log.Printf("Error listing authors: %v", err)
+						return nil, graphqlError{message: "Failed to list authors", code: "INTERNAL"}
+					}
+					return ret, nil
+				},
+			},
+			"author": &graphql.Field{
+				Type: authorType,
+				Args: graphql.FieldConfigArgument{
+					"id": {Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					var author Author
+					err := authors.FindOne(p.Context, bson.M{"id": p.Args["id"]}).Decode(&author)
+					if err == mongo.ErrNoDocuments {
+						return nil, nil
+					} else if err != nil {
+						log.Printf("Error fetching author with ID %v: %v", p.Args["id"], err)
+						return nil, graphqlError{message: "Failed to fetch author", code: "INTERNAL"}
+					}
+					return author, nil
+				},
+			},
+			"years": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(yearType))),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					years := findAllYears(p.Context, coll)
+					if years == nil {
+						years = []map[string]interface{}{}
+					}
+					return years, nil
+				},
+			},
+		},
+	})
+
+	bookFields := func(required ...string) graphql.InputObjectConfigFieldMap {
+		fields := graphql.InputObjectConfigFieldMap{
+			"title":       {Type: graphql.String},
+			"author":      {Type: graphql.String},
+			"authorId":    {Type: graphql.ID},
+			"edition":     {Type: graphql.String},
+			"pages":       {Type: graphql.Int},
+			"year":        {Type: graphql.Int},
+			"tags":        {Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+			"series":      {Type: graphql.String},
+			"seriesIndex": {Type: graphql.Int},
+		}
+		for _, name := range required {
+			fields[name] = &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)}
+		}
+		return fields
+	}
+	bookInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name:   "BookInput",
+		Fields: bookFields("id", "title"),
+	})
+	bookChangesInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name:   "BookChanges",
+		Fields: bookFields(),
+	})
+
+	mutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"createBook": &graphql.Field{
+				Type: graphql.NewNonNull(bookType),
+				Args: graphql.FieldConfigArgument{
+					"input": {Type: graphql.NewNonNull(bookInput)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if err := requireRole(p.Context, RoleEditor); err != nil {
+						return nil, err
+					}
+					raw, _ := json.Marshal(graphqlPayload(p.Args["input"].(map[string]interface{})))
+					var book BookStore
+					if err := json.Unmarshal(raw, &book); err != nil {
+						return nil, graphqlError{message: "Invalid book", code: "BAD_REQUEST"}
+					}
+					if err := books.Create(p.Context, &book); err != nil {
+						return nil, graphqlFailed(err, book.ID, "create")
+					}
+					return book, nil
+				},
+			},
+			"updateBook": &graphql.Field{
+				Type:        graphql.NewNonNull(bookType),
+				Description: "Changes the given fields of a book. With a version, the update only happens if nobody changed the book since.",
+				Args: graphql.FieldConfigArgument{
+					"id":      {Type: graphql.NewNonNull(graphql.ID)},
+					"changes": {Type: graphql.NewNonNull(bookChangesInput)},
+					"version": {Type: graphql.Int},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if err := requireRole(p.Context, RoleEditor); err != nil {
+						return nil, err
+					}
+					id := p.Args["id"].(string)
+					payload := graphqlPayload(p.Args["changes"].(map[string]interface{}))
+					if errs := validateUpdate(payload); len(errs) > 0 {
+						return nil, graphqlFailed(errs, id, "update")
+					}
+					changes := changesFromPayload(payload)
+					if changes.empty() {
+						return nil, graphqlError{message: "No valid fields provided for update", code: "BAD_REQUEST"}
+					}
+					book, err := books.Update(p.Context, id, changes, intArg(p.Args, "version"))
+					if err != nil {
+						return nil, graphqlFailed(err, id, "update")
+					}
+					return book, nil
+				},
+			},
+			"deleteBook": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.Boolean),
+				Description: "Moves a book to the recycle bin.",
+				Args: graphql.FieldConfigArgument{
+					"id":      {Type: graphql.NewNonNull(graphql.ID)},
+					"version": {Type: graphql.Int},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if err := requireRole(p.Context, RoleAdmin); err != nil {
+						return nil, err
+					}
+					id := p.Args["id"].(string)
+					if err := books.Delete(p.Context, id, intArg(p.Args, "version")); err != nil {
+						return nil, graphqlFailed(err, id, "delete")
+					}
+					return true, nil
+				},
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{Query: query, Mutation: mutation})
+}
+
+// Whether every operation of the document is a query. Documents that do
+// not parse run nothing, so they count as queries and get their syntax
+// errors from graphql.Do.
+func onlyQueries(query string) bool {
+	doc, err := parser.Parse(parser.ParseParams{Source: query})
+	if err != nil {
+		return true
+	}
+	for _, def := range doc.Definitions {
+		if op, ok := def.(*ast.OperationDefinition); ok && op.Operation != ast.OperationTypeQuery {
+			return false
+		}
+	}
+	return true
+}
+
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+}
+
+// Handles GET and POST /graphql. POST takes the usual JSON body with query,
+// variables, and operationName; GET takes them as query parameters, with
+// the variables as JSON, and only runs queries: a link or an image must
+// not change books, and caches may repeat GETs. Mutations sent with GET
+// answer 405. Like any GraphQL server, it answers 200 even when the query
+// failed, with the problems listed in "errors".
+func graphqlHandler(schema graphql.Schema, access accessControl) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req graphqlRequest
+		if c.Request().Method == http.MethodGet {
+			req.Query = c.QueryParam("query")
+			req.OperationName = c.QueryParam("operationName")
+			if raw := c.QueryParam("variables"); raw != "" {
+				if err := json.Unmarshal([]byte(raw), &req.Variables); err != nil {
+					return c.JSON(http.StatusBadRequest, map[string]string{"error": "The variables must be a JSON object"})
+				}
+			}
+		} else if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+		}
+		if req.Query == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "The query is missing"})
+		}
+		if c.Request().Method == http.MethodGet && !onlyQueries(req.Query) {
+			c.Response().Header().Set(echo.HeaderAllow, http.MethodPost)
+			return c.JSON(http.StatusMethodNotAllowed, map[string]string{"error": "Mutations must be sent with POST"})
+		}
+
+		allows := func(role string) bool { return access.Allows(c, role) }
+		ctx := context.WithValue(c.Request().Context(), graphqlCallerKey{}, allows)
+		result := graphql.Do(graphql.Params{
+			Schema:         schema,
+			RequestString:  req.Query,
+			VariableValues: req.Variables,
+			OperationName:  req.OperationName,
+			Context:        ctx,
+		})
+		return c.JSON(http.StatusOK, result)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/CAPS-Cloud/exercises/bookpb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// The gRPC BookService (see bookpb/book.proto) runs next to the HTTP server,
+// on its own port. Like GraphQL, it goes through the book repository, so a
+// book created over gRPC is validated and stored exactly like one sent to
+// POST /api/books.
+type bookService struct {
+	bookpb.UnimplementedBookServiceServer
+	books  bookRepository
+	events *bookEvents
+}
+
+// The role each method needs when authentication is enabled.
+var grpcRoles = map[string]string{
+	bookpb.BookService_List_FullMethodName:   RoleReader,
+	bookpb.BookService_Get_FullMethodName:    RoleReader,
+	bookpb.BookService_Watch_FullMethodName:  RoleReader,
+	bookpb.BookService_Create_FullMethodName: RoleEditor,
+	bookpb.BookService_Update_FullMethodName: RoleEditor,
+	bookpb.BookService_Delete_FullMethodName: RoleAdmin,
+}
+
+func toProtoBook(book BookStore) *bookpb.Book {
+	pb := &bookpb.Book{
+		Id:          book.ID,
+		Title:       book.BookName,
+		Author:      book.BookAuthor,
+		AuthorId:    book.AuthorID,
+		Edition:     book.BookEdition,
+		Pages:       int32(book.BookPages),
+		Year:        int32(book.BookYear),
+		Tags:        book.Tags,
+		Series:      book.Series,
+		SeriesIndex: int32(book.SeriesIndex),
+		Available:   book.Checkout == nil,
+		Version:     int32(book.Version),
+	}
+	if book.Rating != nil {
+		pb.RatingAverage = book.Rating.Average
+		pb.RatingCount = int32(book.Rating.Count)
+	}
+	if !book.CreatedAt.IsZero() {
+		pb.CreatedAt = timestamppb.New(book.CreatedAt)
+	}
+	if !book.UpdatedAt.IsZero() {
+		pb.UpdatedAt = timestamppb.New(book.UpdatedAt)
+	}
+	return pb
+}
+
+// The JSON payload for the given changes, so they are validated by the
+// same code as a PUT request.
+func changesPayload(ch *bookpb.BookChanges) map[string]interface{} {
+	payload := map[string]interface{}{}
+	if ch == nil {
+		return payload
+	}
+	if ch.Title != nil {
+		payload["title"] = ch.GetTitle()
+	}
+	if ch.Author != nil {
+		payload["author"] = ch.GetAuthor()
+	}
+	if ch.AuthorId != nil {
+		payload["author_id"] = ch.GetAuthorId()
+	}
+	if ch.Edition != nil {
+		payload["edition"] = ch.GetEdition()
+	}
+	if ch.Pages != nil {
+		payload["pages"] = int(ch.GetPages())
+	}
+	if ch.Year != nil {
+		payload["year"] = int(ch.GetYear())
+	}
+	if ch.Tags != nil {
+		tags := []interface{}{}
+		for _, tag := range ch.Tags.GetTags() {
+			tags = append(tags, tag)
+		}
+		payload["tags"] = tags
+	}
+	if ch.Series != nil {
+		payload["series"] = ch.GetSeries()
+	}
+	if ch.SeriesIndex != nil {
+		payload["series_index"] = int(ch.GetSeriesIndex())
+	}
+	return payload
+}
+
+// Optional proto fields arrive as *int32.
+func optionalInt(value *int32) *int {
+	if value == nil {
+		return nil
+	}
+	n := int(*value)
+	return &n
+}
+
+// Translates a repository error into a gRPC status, like bookFailed does
+// for REST. Invalid books carry a BadRequest detail naming each field.
+func grpcFailed(err error, id, action string) error {
+	var errs validationErrors
+	switch {
+	case errors.As(err, &errs):
+		st := status.New(codes.InvalidArgument, "Validation failed")
+		violations := &errdetails.BadRequest{}
+		fields := make([]string, 0, len(errs))
+		for field := range errs {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			violations.FieldViolations = append(violations.FieldViolations, &errdetails.BadRequest_FieldViolation{Field: field, Description: errs[field]})
+		}
+		if detailed, err := st.WithDetails(violations); err == nil {
+			st = detailed
+		}
+		return st.Err()
+	case err == errBookNotFound:
+		return status.Error(codes.NotFound, "Book not found with ID "+id)
+	case err == errBookExists:
+		return status.Error(codes.AlreadyExists, "Book with ID "+id+" already exists")
+	case err == errStaleVersion:
+		return status.Error(codes.Aborted, "Book with ID "+id+" was modified by someone else")
+	case err == errReadOnly:
+		return status.Error(codes.Unavailable, "The service is read-only at the moment, try again later")
+	case err == errCircuitOpen:
+		return status.Error(codes.Unavailable, "The database is unavailable at the moment, try again later")
+	}
+	log.Printf("Error trying to %s book %s: %v", action, id, err)
+	return status.Error(codes.Internal, "Failed to "+action+" book")
+}
+
+func (s *bookService) List(ctx context.Context, req *bookpb.ListBooksRequest) (*bookpb.ListBooksResponse, error) {
+	if req.GetOffset() < 0 || req.GetLimit() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "Offset and limit must be at least 0")
+	}
+	q := bookQuery{
+		YearFrom: optionalInt(req.YearFrom),
+		YearTo:   optionalInt(req.YearTo),
+		MinPages: optionalInt(req.MinPages),
+		MaxPages: optionalInt(req.MaxPages),
+		Tags:     normalizeTags(req.GetTags()),
+		AuthorID: req.GetAuthorId(),
+		Offset:   req.GetOffset(),
+		Limit:    req.GetLimit(),
+	}
+	found, err := s.books.List(ctx, q)
+	if err != nil {
+		return nil, grpcFailed(err, "", "list")
+	}
+	resp := &bookpb.ListBooksResponse{}
+	for _, book := range found {
+		resp.Books = append(resp.Books, toProtoBook(book))
+	}
+	return resp, nil
+}
+
+func (s *bookService) Get(ctx context.Context, req *bookpb.GetBookRequest) (*bookpb.Book, error) {
+	book, err := s.books.Get(ctx, req.GetId())
+	if err != nil {
+		return nil, grpcFailed(err, req.GetId(), "fetch")
+	}
+	return toProtoBook(book), nil
+}
+
+func (s *bookService) Create(ctx context.Context, req *bookpb.CreateBookRequest) (*bookpb.Book, error) {
+	pb := req.GetBook()
+	book := BookStore{
+		ID:          pb.GetId(),
+		BookName:    pb.GetTitle(),
+		BookAuthor:  pb.GetAuthor(),
+		AuthorID:    pb.GetAuthorId(),
+		BookEdition: pb.GetEdition(),
+		BookPages:   flexInt(pb.GetPages()),
+		BookYear:    flexInt(pb.GetYear()),
+		Tags:        pb.GetTags(),
+		Series:      pb.GetSeries(),
+		SeriesIndex: flexInt(pb.GetSeriesIndex()),
+	}
+	if err := s.books.Create(ctx, &book); err != nil {
+		return nil, grpcFailed(err, book.ID, "create")
+	}
+	return toProtoBook(book), nil
+}
+
+func (s *bookService) Update(ctx context.Context, req *bookpb.UpdateBookRequest) (*bookpb.Book, error) {
+	payload := changesPayload(req.GetChanges())
+	if errs := validateUpdate(payload); len(errs) > 0 {
+		return nil, grpcFailed(errs, req.GetId(), "update")
+	}
+	changes := changesFromPayload(payload)
+	if changes.empty() {
+		return nil, status.Error(codes.InvalidArgument, "No valid fields provided for update")
+	}
+	book, err := s.books.Update(ctx, req.GetId(), changes, optionalInt(req.Version))
+	if err != nil {
+		return nil, grpcFailed(err, req.GetId(), "update")
+	}
+	return toProtoBook(book), nil
+}
+
+func (s *bookService) Delete(ctx context.Context, req *bookpb.DeleteBookRequest) (*emptypb.Empty, error) {
+	if err := s.books.Delete(ctx, req.GetId(), optionalInt(req.Version)); err != nil {
+		return nil, grpcFailed(err, req.GetId(), "delete")
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// Streams book events until the client goes away.
+func (s *bookService) Watch(req *bookpb.WatchBooksRequest, stream bookpb.BookService_WatchServer) error {
+	events, stop := s.events.Subscribe()
+	defer stop()
+	types := map[string]bookpb.BookEvent_Type{
+		bookCreated: bookpb.BookEvent_CREATED,
+		bookUpdated: bookpb.BookEvent_UPDATED,
+		bookDeleted: bookpb.BookEvent_DELETED,
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case event := <-events:
+			if err := stream.Send(&bookpb.BookEvent{Type: types[event.Type], Book: toProtoBook(event.Book)}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Checks the bearer token in the "authorization" metadata against the role
+// the method needs. Like the HTTP middleware, it lets everything through
+// when authentication is disabled.
+func (a accessControl) authorizeRPC(ctx context.Context, method string) error {
+	if !a.enabled() {
+		return nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return status.Error(codes.Unauthenticated, "Missing or invalid token")
+	}
+	claims, err := a.tokenClaims(strings.TrimPrefix(values[0], "Bearer "))
+	if err != nil {
+		return status.Error(codes.Unauthenticated, "Missing or invalid token")
+	}
+	// The BookService only serves the default library; see tenants.go.
+	if claims.Tenant != "" {
+		return status.Error(codes.NotFound, "Not available for the library "+claims.Tenant)
+	}
+	if required := grpcRoles[method]; roleRank[claims.Role] < roleRank[required] {
+		return status.Error(codes.PermissionDenied, "The "+required+" role is required")
+	}
+	return nil
+}
+
+// Listens on addr and serves the BookService in the background. An empty
+// address disables gRPC.
+func startGRPCServer(addr string, books bookRepository, events *bookEvents, access accessControl) {
+	if addr == "" {
+		return
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Error listening for gRPC on %s: %v", addr, err)
+	}
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if err := access.authorizeRPC(ctx, info.FullMethod); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := access.authorizeRPC(ss.Context(), info.FullMethod); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	)
+	bookpb.RegisterBookServiceServer(server, &bookService{books: books, events: events})
+	go func() {
+		log.Printf("Serving gRPC on %s", addr)
+		if err := server.Serve(listener); err != nil {
+			log.Printf("Error serving gRPC: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Every update keeps a copy of the book as it was before, in the
+// book_history collection. Editors can list these revisions and revert a
+// book to any of them.
+type bookRevision struct {
+	BookID     string    `bson:"bookid" json:"id"`
+	Version    int       `bson:"version" json:"version"`
+	RecordedAt time.Time `bson:"recordedat" json:"recorded_at"`
+	Book       BookStore `bson:"book" json:"-"`
+}
+
+// A revision as listed by GET /api/books/:id/history.
+type revisionItem struct {
+	Version    int       `json:"version"`
+	RecordedAt time.Time `json:"recorded_at"`
+	Book       bookItem  `json:"book"`
+}
+
+// Applies the given fields to the book matched by filter, bumps its version,
+// and stores the previous state as a revision. It returns
+// mongo.ErrNoDocuments when the filter matched nothing.
+func updateWithHistory(ctx context.Context, coll, history *mongo.Collection, filter bson.M, set bson.M) (BookStore, error) {
+	set["updatedat"] = now()
+	update := bson.M{"$set": withSearchKeys(set), "$inc": bson.M{"version": 1}}
+
+	// Returning the document as it was *before* the update gives us the
+	// revision to keep, without a second read that could race.
+	var previous BookStore
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.Before)
+	if err := coll.FindOneAndUpdate(ctx, filter, update, opts).Decode(&previous); err != nil {
+		return BookStore{}, err
+	}
+
+	revision := bookRevision{
+		BookID:     previous.ID,
+		Version:    previous.Version,
+		RecordedAt: set["updatedat"].(time.Time),
+		Book:       previous,
+	}
+	if _, err := history.InsertOne(ctx, revision); err != nil {
+		// The update itself went through, so we only log the lost revision.
+		log.Printf("Error recording revision %d of book %s: %v", previous.Version, previous.ID, err)
+	}
+	return previous, nil
+}
+
+// Handles GET /api/books/:id/history, listing the stored revisions of a
+// book, newest first.
+func listHistory(history *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		opts := options.Find().SetSort(bson.D{{Key: "version", Value: -1}})
+		cursor, err := history.Find(ctx, bson.M{"bookid": c.Param("id")}, opts)
+		if err != nil {
+			log.Printf("Error listing history of book %s: %v", c.Param("id"), err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to list history"})
+		}
+		var revisions []bookRevision
+		if err := cursor.All(ctx, &revisions); err != nil {
+			log.Printf("Error listing history of book %s: %v", c.Param("id"), err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to list history"})
+		}
+
+		ret := []revisionItem{}
+		for _, revision := range revisions {
+			ret = append(ret, revisionItem{Version: revision.Version, RecordedAt: revision.RecordedAt, Book: bookToMap(revision.Book)})
+		}
+		return c.JSON(http.StatusOK, ret)
+	}
+}
+
+// Handles POST /api/books/:id/revert/:version. The fields of the stored
+// revision are written back as a new update, so the revert itself shows up
+// in the history and can be undone as well.
+func revertBook(coll, history, authors *mongo.Collection, events directEvents) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		idParam := c.Param("id")
+		version, err := strconv.Atoi(c.Param("version"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "The version must be a number"})
+		}
+
+		var revision bookRevision
+		err = history.FindOne(ctx, bson.M{"bookid": idParam, "version": version}).Decode(&revision)
+		if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "No revision " + c.Param("version") + " for book " + idParam})
+		} else if err != nil {
+			log.Printf("Error loading revision %d of book %s: %v", version, idParam, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to revert book"})
+		}
+
+		old := revision.Book
+		// The author may have been renamed or deleted since, and revisions
+		// from before the authors collection carry no author ID at all.
+		if err := fillAuthorName(ctx, authors, &old); err != nil {
+			old.AuthorID = ""
+		}
+		if err := linkAuthor(ctx, authors, &old); err != nil {
+			log.Printf("Error linking author of book %s: %v", idParam, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to revert book"})
+		}
+		set := bson.M{
+			"bookname":    old.BookName,
+			"bookauthor":  old.BookAuthor,
+			"authorid":    old.AuthorID,
+			"bookedition": old.BookEdition,
+			"bookpages":   old.BookPages,
+			"bookyear":    old.BookYear,
+			"tags":        normalizeTags(old.Tags),
+			"series":      old.Series,
+			"seriesindex": old.SeriesIndex,
+			"publisher":   old.Publisher,
+			"language":    old.Language,
+			"description": old.Description,
+			"price":       old.Price,
+		}
+		if _, err := updateWithHistory(ctx, coll, history, notDeleted(bson.M{"id": idParam}), set); err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Book not found with ID " + idParam})
+		} else if err != nil {
+			log.Printf("Error reverting book %s to version %d: %v", idParam, version, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to revert book"})
+		}
+
+		book, err := findBook(ctx, coll, idParam)
+		if err != nil {
+			log.Printf("Error fetching reverted book %s: %v", idParam, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve reverted book"})
+		}
+		events.Publish(bookEvent{Type: bookUpdated, Book: book})
+		return c.JSON(http.StatusOK, bookToMap(book))
+	}
+}
+
+// The scheduler task compacting the history: revisions recorded more than
+// retention ago are dropped.
+func compactHistoryTask(history *mongo.Collection, retention time.Duration) taskFunc {
+	return func(ctx context.Context) (string, error) {
+		res, err := history.DeleteMany(ctx, bson.M{"recordedat": bson.M{"$lt": now().Add(-retention)}})
+		if err != nil || res.DeletedCount == 0 {
+			return "", err
+		}
+		return fmt.Sprintf("Dropped %d old revisions", res.DeletedCount), nil
+	}
+}
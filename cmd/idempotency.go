@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// A client that is not sure whether its POST went through, e.g. because the
+// connection dropped before the answer came, can simply send it again with
+// the same Idempotency-Key header. The first answer to a key is kept in the
+// idempotency_keys collection and sent again for every retry, so the book
+// is only created once.
+type idempotencyRecord struct {
+	// The caller, the path, and the key, so keys of different users or
+	// endpoints never collide.
+	ID string `bson:"_id"`
+	// A hash of the request body; reusing a key for another request is an
+	// error.
+	RequestHash string    `bson:"request_hash"`
+	CreatedAt   time.Time `bson:"created_at"`
+	// Set once the first request is answered.
+	Done        bool   `bson:"done"`
+	Status      int    `bson:"status,omitempty"`
+	ContentType string `bson:"content_type,omitempty"`
+	Location    string `bson:"location,omitempty"`
+	Body        []byte `bson:"body,omitempty"`
+}
+
+const maxIdempotencyKeyLength = 255
+
+// Makes a POST route idempotent for requests carrying an Idempotency-Key.
+// Keys are remembered for ttl. Answers with a 5xx status are not kept, so
+// the request can be retried with the same key after a server error.
+func idempotent(keys *mongo.Collection, ttl time.Duration) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			key := c.Request().Header.Get("Idempotency-Key")
+			if key == "" {
+				return next(c)
+			}
+			if len(key) > maxIdempotencyKeyLength {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("The Idempotency-Key must not be longer than %d characters", maxIdempotencyKeyLength)})
+			}
+			body, err := io.ReadAll(c.Request().Body)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+			}
+			c.Request().Body = io.NopCloser(bytes.NewReader(body))
+			sum := sha256.Sum256(body)
+
+			ctx := c.Request().Context()
+			scope := callerSubject(c) + " " + c.Request().URL.Path
+			if tenant := tenantFrom(ctx); tenant != "" {
+				scope = tenant + " " + scope
+			}
+			record := idempotencyRecord{
+				ID:          scope + " " + key,
+				RequestHash: hex.EncodeToString(sum[:]),
+				CreatedAt:   now(),
+			}
+			previous, err := claimIdempotencyKey(ctx, keys, record, ttl)
+			if err != nil {
+				log.Printf("Error claiming idempotency key %s: %v", key, err)
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to check the Idempotency-Key"})
+			}
+			if previous != nil {
+				return replayIdempotent(c, previous, record.RequestHash)
+			}
+
+			res := c.Response()
+			w := &recordingWriter{ResponseWriter: res.Writer}
+			res.Writer = w
+			err = next(c)
+			res.Writer = w.ResponseWriter
+
+			if err != nil || res.Status >= http.StatusInternalServerError {
+				// Let the client try again with the same key.
+				if _, delErr := keys.DeleteOne(context.Background(), bson.M{"_id": record.ID}); delErr != nil {
+					log.Printf("Error releasing idempotency key %s: %v", key, delErr)
+				}
+				return err
+			}
+			update := bson.M{"$set": bson.M{
+				"done":         true,
+				"status":       res.Status,
+				"content_type": res.Header().Get(echo.HeaderContentType),
+				"location":     res.Header().Get(echo.HeaderLocation),
+				"body":         w.body.Bytes(),
+			}}
+			if _, err := keys.UpdateByID(context.Background(), record.ID, update); err != nil {
+				log.Printf("Error saving the answer for idempotency key %s: %v", key, err)
+			}
+			return nil
+		}
+	}
+}
+
+// Stores the record for a new key. When the key was used before, the
+// record of the earlier request is returned instead; an expired one is
+// replaced.
+func claimIdempotencyKey(ctx context.Context, keys *mongo.Collection, record idempotencyRecord, ttl time.Duration) (*idempotencyRecord, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		_, err := keys.InsertOne(ctx, record)
+		if err == nil {
+			return nil, nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return nil, err
+		}
+		previous := new(idempotencyRecord)
+		err = keys.FindOne(ctx, bson.M{"_id": record.ID}).Decode(previous)
+		if err == mongo.ErrNoDocuments {
+			// Released in the meantime; try again.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if previous.CreatedAt.After(record.CreatedAt.Add(-ttl)) {
+			return previous, nil
+		}
+		if _, err := keys.DeleteOne(ctx, bson.M{"_id": record.ID, "created_at": previous.CreatedAt}); err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("key %s keeps changing", record.ID)
+}
+
+// Answers a retry with the answer to the first request.
+func replayIdempotent(c echo.Context, previous *idempotencyRecord, requestHash string) error {
+	if previous.RequestHash != requestHash {
+		return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": "The Idempotency-Key was already used for a different request"})
+	}
+	if !previous.Done {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "A request with this Idempotency-Key is still in progress"})
+	}
+	header := c.Response().Header()
+	header.Set("Idempotent-Replayed", "true")
+	if previous.Location != "" {
+		header.Set(echo.HeaderLocation, previous.Location)
+	}
+	return c.Blob(previous.Status, previous.ContentType, previous.Body)
+}
+
+// The scheduler task forgetting expired idempotency keys.
+func purgeIdempotencyKeysTask(keys *mongo.Collection, ttl time.Duration) taskFunc {
+	return func(ctx context.Context) (string, error) {
+		result, err := keys.DeleteMany(ctx, bson.M{"created_at": bson.M{"$lt": now().Add(-ttl)}})
+		if err != nil || result.DeletedCount == 0 {
+			return "", err
+		}
+		return fmt.Sprintf("Forgot %d idempotency keys", result.DeletedCount), nil
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// One line of the report returned by the import. Row numbers count the
+// header as row 1, just like a spreadsheet would show them.
+type importResult struct {
+	Row    int    `json:"row"`
+	ID     string `json:"id,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type importReport struct {
+	Created int            `json:"created"`
+	Failed  int            `json:"failed"`
+	Rows    []importResult `json:"rows"`
+}
+
+// Handles POST /api/books/import. The request is a multipart form with the
+// CSV in the "file" field, using the same columns as the export. Every row
+// is validated on its own; valid rows are inserted together with a single
+// InsertMany and the response lists what happened to each row.
+func importBooks(coll, authors *mongo.Collection, events directEvents) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		header, err := c.FormFile("file")
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Missing CSV upload in field \"file\""})
+		}
+		file, err := header.Open()
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Could not read the uploaded file"})
+		}
+		defer file.Close()
+
+		books, report, err := parseBookCSV(file)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+
+		if err := insertImportedBooks(c.Request().Context(), coll, authors, books, report, events); err != nil {
+			log.Printf("Error importing books: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to import books"})
+		}
+
+		report.count()
+		return c.JSON(http.StatusOK, report)
+	}
+}
+
+// Reads the CSV and validates each row. Valid books are returned keyed by
+// the index of their entry in report.Rows, so the insert step can update the
+// entry later on.
+func parseBookCSV(r io.Reader) (map[int]BookStore, *importReport, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	head, err := reader.Read()
+	if err != nil {
+		return nil, nil, errors.New("The CSV file is empty or malformed")
+	}
+	columns := map[string]int{}
+	for i, name := range head {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"id", "title", "author"} {
+		if _, ok := columns[required]; !ok {
+			return nil, nil, errors.New("The CSV header is missing the " + required + " column")
+		}
+	}
+
+	report := &importReport{Rows: []importResult{}}
+	books := map[int]BookStore{}
+	seen := map[string]bool{}
+	for row := 2; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			report.Rows = append(report.Rows, importResult{Row: row, Status: bulkFailed, Error: "Malformed CSV row"})
+			continue
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		book := BookStore{
+			ID:          field("id"),
+			BookName:    field("title"),
+			BookAuthor:  field("author"),
+			AuthorID:    field("author_id"),
+			BookEdition: field("edition"),
+			Series:      field("series"),
+			Publisher:   field("publisher"),
+			Language:    field("language"),
+			Description: field("description"),
+		}
+		if tags := field("tags"); tags != "" {
+			book.Tags = strings.Split(tags, ",")
+		}
+		pages, pagesErr := parseFlexInt(field("pages"))
+		year, yearErr := parseFlexInt(field("year"))
+		seriesIndex, seriesIndexErr := parseFlexInt(field("series_index"))
+		book.BookPages, book.BookYear, book.SeriesIndex = pages, year, seriesIndex
+		var priceErr error
+		if text := field("price"); text != "" {
+			var price bookPrice
+			price, priceErr = parsePriceText(text)
+			book.Price = &price
+		}
+
+		result := importResult{Row: row, ID: book.ID, Status: bulkFailed}
+		if pagesErr != nil {
+			result.Error = "pages must be a whole number"
+		} else if yearErr != nil {
+			result.Error = "year must be a whole number"
+		} else if seriesIndexErr != nil {
+			result.Error = "series_index must be a whole number"
+		} else if priceErr != nil {
+			result.Error = "price must be an amount and an ISO 4217 currency code like 12.99 EUR"
+		} else if msg := validateBulkBook(book); msg != "" {
+			result.Error = msg
+		} else if seen[book.ID] {
+			result.Error = "Duplicate ID within the file"
+		} else {
+			seen[book.ID] = true
+			books[len(report.Rows)] = book
+		}
+		report.Rows = append(report.Rows, result)
+	}
+	return books, report, nil
+}
+
+// Adds up the created and failed rows.
+func (report *importReport) count() {
+	for _, row := range report.Rows {
+		if row.Status == bulkCreated {
+			report.Created++
+		} else {
+			report.Failed++
+		}
+	}
+}
+
+func insertImportedBooks(ctx context.Context, coll, authors *mongo.Collection, books map[int]BookStore, report *importReport, events directEvents) error {
+	var pending []BookStore
+	var rows []int
+	for idx := range report.Rows {
+		if book, ok := books[idx]; ok {
+			pending = append(pending, book)
+			rows = append(rows, idx)
+		}
+	}
+	outcomes, err := insertBooksUnordered(ctx, coll, authors, pending, events)
+	if err != nil {
+		return err
+	}
+	for i, idx := range rows {
+		report.Rows[idx].Status = outcomes[i].Status
+		report.Rows[idx].Error = outcomes[i].Error
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Admins can list, create, and drop the indexes of the books collection
+// through the API, to tune queries without a mongo shell. The indexes the
+// server needs itself are created again on the next start if dropped.
+
+// One field of an index: its name and 1 or -1 for the order, or a kind of
+// index like "text" or "hashed".
+type indexKey struct {
+	Field string      `json:"field"`
+	Order interface{} `json:"order"`
+}
+
+// An index as listed by GET /api/admin/indexes. Accesses counts the queries
+// that used it since Mongo started, where Mongo tells.
+type indexInfo struct {
+	Name     string     `json:"name"`
+	Keys     []indexKey `json:"keys"`
+	Unique   bool       `json:"unique,omitempty"`
+	Sparse   bool       `json:"sparse,omitempty"`
+	Accesses *int64     `json:"accesses,omitempty"`
+}
+
+// The body of POST /api/admin/indexes. Without a name, Mongo derives one
+// from the keys, like "bookyear_1".
+type indexPayload struct {
+	Name   string     `json:"name"`
+	Keys   []indexKey `json:"keys"`
+	Unique bool       `json:"unique"`
+	Sparse bool       `json:"sparse"`
+}
+
+// The kinds of indexes that can be created besides ascending and
+// descending ones.
+var indexKinds = map[string]bool{"text": true, "hashed": true, "2dsphere": true}
+
+// Mongo's error codes for a missing index, and for an index that exists
+// with other options or under another name.
+const (
+	codeIndexNotFound         = 27
+	codeIndexOptionsConflict  = 85
+	codeIndexKeySpecsConflict = 86
+)
+
+// Handles GET /api/admin/indexes.
+func listIndexes(coll *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		cursor, err := coll.Indexes().List(ctx)
+		if err != nil {
+			log.Printf("Error listing indexes: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to list indexes"})
+		}
+		var found []struct {
+			Name   string `bson:"name"`
+			Key    bson.D `bson:"key"`
+			Unique bool   `bson:"unique"`
+			Sparse bool   `bson:"sparse"`
+		}
+		if err := cursor.All(ctx, &found); err != nil {
+			log.Printf("Error listing indexes: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to list indexes"})
+		}
+
+		// Usage counts are a bonus; not every deployment lets us read them.
+		accesses := map[string]int64{}
+		stats, err := coll.Aggregate(ctx, mongo.Pipeline{{{Key: "$indexStats", Value: bson.M{}}}})
+		if err == nil {
+			var usage []struct {
+				Name     string `bson:"name"`
+				Accesses struct {
+					Ops int64 `bson:"ops"`
+				} `bson:"accesses"`
+			}
+			if err = stats.All(ctx, &usage); err == nil {
+				for _, index := range usage {
+					accesses[index.Name] = index.Accesses.Ops
+				}
+			}
+		}
+		if err != nil {
+			log.Printf("Error reading index usage: %v", err)
+		}
+
+		ret := []indexInfo{}
+		for _, index := range found {
+			info := indexInfo{Name: index.Name, Keys: []indexKey{}, Unique: index.Unique, Sparse: index.Sparse}
+			for _, key := range index.Key {
+				info.Keys = append(info.Keys, indexKey{Field: key.Key, Order: key.Value})
+			}
+			if n, ok := accesses[index.Name]; ok {
+				info.Accesses = &n
+			}
+			ret = append(ret, info)
+		}
+		return c.JSON(http.StatusOK, ret)
+	}
+}
+
+// Checks the keys of a new index, and returns them as Mongo expects them.
+func indexKeys(keys []indexKey) (bson.D, validationErrors) {
+	errs := validationErrors{}
+	if len(keys) == 0 {
+		errs["keys"] = "are required"
+	}
+	doc := bson.D{}
+	for i, key := range keys {
+		field := "keys[" + strconv.Itoa(i) + "]"
+		if key.Field == "" {
+			errs[field] = "needs a field"
+			continue
+		}
+		switch order := key.Order.(type) {
+		case float64:
+			if order != 1 && order != -1 {
+				errs[field] = "order must be 1, -1, text, hashed, or 2dsphere"
+				continue
+			}
+			doc = append(doc, bson.E{Key: key.Field, Value: int32(order)})
+		case string:
+			if !indexKinds[order] {
+				errs[field] = "order must be 1, -1, text, hashed, or 2dsphere"
+				continue
+			}
+			doc = append(doc, bson.E{Key: key.Field, Value: order})
+		default:
+			errs[field] = "order must be 1, -1, text, hashed, or 2dsphere"
+		}
+	}
+	return doc, errs
+}
+
+// Handles POST /api/admin/indexes, answering 201 with the name of the new
+// index. Creating an index that exists with the same keys and options
+// succeeds; one that clashes with an existing index answers 409.
+func createIndex(coll *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var payload indexPayload
+		if err := c.Bind(&payload); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+		}
+		keys, errs := indexKeys(payload.Keys)
+		if len(errs) > 0 {
+			return validationFailed(c, errs)
+		}
+		opts := options.Index().SetUnique(payload.Unique).SetSparse(payload.Sparse)
+		if payload.Name != "" {
+			opts.SetName(payload.Name)
+		}
+		name, err := coll.Indexes().CreateOne(c.Request().Context(), mongo.IndexModel{Keys: keys, Options: opts})
+		if err != nil {
+			var cmdErr mongo.CommandError
+			if errors.As(err, &cmdErr) && (cmdErr.Code == codeIndexOptionsConflict || cmdErr.Code == codeIndexKeySpecsConflict) {
+				return c.JSON(http.StatusConflict, map[string]string{"error": cmdErr.Message})
+			}
+			if mongo.IsDuplicateKeyError(err) {
+				return c.JSON(http.StatusConflict, map[string]string{"error": "Books have duplicate values for a unique index"})
+			}
+			log.Printf("Error creating index %v: %v", keys, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create index"})
+		}
+		return c.JSON(http.StatusCreated, map[string]string{"name": name})
+	}
+}
+
+// Handles DELETE /api/admin/indexes/:name. The index on _id cannot be
+// dropped, and neither can all indexes at once with "*".
+func dropIndex(coll *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		name := c.Param("name")
+		if name == "_id_" || name == "*" {
+			return validationFailed(c, validationErrors{"name": "must name an index other than _id_"})
+		}
+		_, err := coll.Indexes().DropOne(c.Request().Context(), name)
+		var cmdErr mongo.CommandError
+		if errors.As(err, &cmdErr) && cmdErr.Code == codeIndexNotFound {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Index not found with name " + name})
+		}
+		if err != nil {
+			log.Printf("Error dropping index %s: %v", name, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to drop index"})
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,780 @@
+//go:build integration
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The integration tests run the routes of newServer against a real MongoDB:
+//
+//	go test -tags integration ./cmd
+//
+// They start a throwaway mongo container with the docker CLI and remove it
+// afterwards. The mongodb module of testcontainers-go would do the same,
+// but it is not a dependency of this module yet; adding it only changes
+// startMongoContainer and the removal in run. With INTEGRATION_MONGODB_URI
+// set, they use that server instead; its exercise-1 database is written
+// to, so do not point it at data you care about.
+
+var (
+	testServer *httptest.Server
+	// The database behind testServer, for tests that call handlers directly.
+	testDB *mongo.Database
+	// The search index testServer mirrors its books to.
+	testIndex = &fakeIndex{docs: map[string]map[string]interface{}{}}
+)
+
+const mongoImage = "mongo:7"
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	// os.Exit skips deferred calls, so the container is removed in run.
+	os.Exit(run(m))
+}
+
+func run(m *testing.M) int {
+	uri := os.Getenv("INTEGRATION_MONGODB_URI")
+	if uri == "" {
+		container, addr, err := startMongoContainer()
+		if err != nil {
+			log.Printf("Error starting MongoDB: %v", err)
+			return 1
+		}
+		defer exec.Command("docker", "rm", "-f", container).Run()
+		uri = "mongodb://" + addr
+	}
+
+	client, err := connectWhenReady(uri, time.Minute)
+	if err != nil {
+		log.Printf("Error connecting to MongoDB: %v", err)
+		return 1
+	}
+	defer client.Disconnect(context.Background())
+	if err := client.Database(databaseName).Drop(context.Background()); err != nil {
+		log.Printf("Error clearing the database: %v", err)
+		return 1
+	}
+
+	testDB = client.Database(databaseName)
+
+	cfg := loadConfig()
+	cfg.MongoURI = uri
+	cfg.GRPCAddr = ""
+	cfg.RateLimit = 0
+	cfg.SeedOnStart = false
+	cfg.AccessLogLevel = "error"
+	cfg.Tenants, cfg.TenantSources = []string{"acme"}, []string{"path"}
+	index := httptest.NewServer(testIndex)
+	defer index.Close()
+	cfg.ElasticsearchURL = index.URL
+	testServer = httptest.NewServer(newServer(cfg, client, readBuildInfo()))
+	defer testServer.Close()
+
+	return m.Run()
+}
+
+// Stands in for Elasticsearch, keeping the documents the server puts into
+// its index. It only knows the requests of elasticIndex.Follow, and says
+// that the index exists already.
+type fakeIndex struct {
+	mu   sync.Mutex
+	docs map[string]map[string]interface{}
+}
+
+func (f *fakeIndex) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, id, _ := strings.Cut(r.URL.Path, "/_doc/")
+	switch {
+	case id == "":
+	case r.Method == http.MethodPut:
+		var doc map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&doc); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.docs[id] = doc
+	case r.Method == http.MethodDelete:
+		delete(f.docs, id)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, "{}")
+}
+
+// The document of the book with the ID, or nil.
+func (f *fakeIndex) doc(id string) map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.docs[id]
+}
+
+// Starts a mongo container on a free port of localhost, and returns its ID
+// and address.
+func startMongoContainer() (string, string, error) {
+	out, err := exec.Command("docker", "run", "-d", "--rm", "-p", "127.0.0.1::27017", mongoImage).Output()
+	if err != nil {
+		return "", "", fmt.Errorf("docker run: %w", err)
+	}
+	container := strings.TrimSpace(string(out))
+	out, err = exec.Command("docker", "port", container, "27017/tcp").Output()
+	if err != nil {
+		exec.Command("docker", "rm", "-f", container).Run()
+		return "", "", fmt.Errorf("docker port: %w", err)
+	}
+	addr, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	return container, addr, nil
+}
+
+// Connects to uri, waiting for the server to come up.
+func connectWhenReady(uri string, timeout time.Duration) (*mongo.Client, error) {
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		err = client.Ping(ctx, nil)
+		cancel()
+		if err == nil {
+			return client, nil
+		}
+		if time.Now().After(deadline) {
+			client.Disconnect(context.Background())
+			return nil, err
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// Sends a request with body as JSON, unless it is a string, which is sent
+// as is, and decodes the JSON answer, if any.
+func call(t *testing.T, method, path string, body interface{}) (int, map[string]interface{}) {
+	t.Helper()
+	var reader io.Reader
+	switch b := body.(type) {
+	case nil:
+	case string:
+		reader = strings.NewReader(b)
+	default:
+		raw, err := json.Marshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequest(method, testServer.URL+path, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reader != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := testServer.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var answer map[string]interface{}
+	raw, _ := io.ReadAll(res.Body)
+	if len(bytes.TrimSpace(raw)) > 0 && raw[0] == '{' {
+		if err := json.Unmarshal(raw, &answer); err != nil {
+			t.Fatalf("%s %s answered invalid JSON: %s", method, path, raw)
+		}
+	}
+	return res.StatusCode, answer
+}
+
+func expectStatus(t *testing.T, method, path string, body interface{}, want int) map[string]interface{} {
+	t.Helper()
+	status, answer := call(t, method, path, body)
+	if status != want {
+		t.Fatalf("%s %s answered %d, want %d: %v", method, path, status, want, answer)
+	}
+	return answer
+}
+
+// Uploads csv as the "file" field of a form, like the import page does.
+func upload(t *testing.T, path, csv string, want int) {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	file, err := form.CreateFormFile("file", "books.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(file, csv)
+	form.Close()
+	res, err := testServer.Client().Post(testServer.URL+path, form.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != want {
+		raw, _ := io.ReadAll(res.Body)
+		t.Fatalf("POST %s answered %d, want %d: %s", path, res.StatusCode, want, raw)
+	}
+}
+
+// A valid book with an ID of its own for each test.
+func testBook(t *testing.T) map[string]interface{} {
+	return map[string]interface{}{
+		"id":      strings.ReplaceAll(strings.ToLower(t.Name()), "/", "-"),
+		"title":   "Dracula",
+		"author":  "Bram Stoker",
+		"edition": "9783649646099",
+		"pages":   418,
+		"year":    1897,
+	}
+}
+
+func TestCreateAndGetBook(t *testing.T) {
+	book := testBook(t)
+	path := "/api/books/" + book["id"].(string)
+	created := expectStatus(t, http.MethodPost, "/api/books", book, http.StatusCreated)
+	if created["version"] != 1.0 {
+		t.Errorf("created version %v, want 1", created["version"])
+	}
+
+	got := expectStatus(t, http.MethodGet, path, nil, http.StatusOK)
+	for _, field := range []string{"id", "title", "author", "edition"} {
+		if got[field] != book[field] {
+			t.Errorf("%s is %v, want %v", field, got[field], book[field])
+		}
+	}
+	if got["pages"] != 418.0 || got["year"] != 1897.0 {
+		t.Errorf("pages and year are %v and %v, want 418 and 1897", got["pages"], got["year"])
+	}
+
+	status, _ := call(t, http.MethodGet, "/api/books?title="+book["title"].(string), nil)
+	if status != http.StatusOK {
+		t.Errorf("listing the books answered %d", status)
+	}
+}
+
+func TestCreateBookErrors(t *testing.T) {
+	book := testBook(t)
+	expectStatus(t, http.MethodPost, "/api/books", book, http.StatusCreated)
+
+	tests := []struct {
+		name string
+		body interface{}
+		want int
+	}{
+		{"existing ID", book, http.StatusConflict},
+		{"malformed JSON", `{"id": `, http.StatusBadRequest},
+		{"missing title", map[string]interface{}{"id": "untitled", "author": "Nobody", "pages": 1, "year": 2000}, http.StatusUnprocessableEntity},
+		{"pages not a number", map[string]interface{}{"id": "pageless", "title": "T", "author": "A", "pages": "many", "year": 2000}, http.StatusUnprocessableEntity},
+		{"year in the future", map[string]interface{}{"id": "future", "title": "T", "author": "A", "pages": 1, "year": time.Now().Year() + 10}, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expectStatus(t, http.MethodPost, "/api/books", tt.body, tt.want)
+		})
+	}
+}
+
+func TestGetMissingBook(t *testing.T) {
+	expectStatus(t, http.MethodGet, "/api/books/no-such-book", nil, http.StatusNotFound)
+}
+
+func TestReplaceBook(t *testing.T) {
+	book := testBook(t)
+	path := "/api/books/" + book["id"].(string)
+	expectStatus(t, http.MethodPost, "/api/books", book, http.StatusCreated)
+
+	book["title"] = "Dracula's Guest"
+	updated := expectStatus(t, http.MethodPut, path, book, http.StatusOK)
+	if updated["title"] != "Dracula's Guest" || updated["version"] != 2.0 {
+		t.Errorf("replaced book is %v, want the new title in version 2", updated)
+	}
+	got := expectStatus(t, http.MethodGet, path, nil, http.StatusOK)
+	if got["title"] != "Dracula's Guest" {
+		t.Errorf("title after PUT is %v", got["title"])
+	}
+
+	stale := map[string]interface{}{}
+	for k, v := range book {
+		stale[k] = v
+	}
+	stale["version"] = 1
+	expectStatus(t, http.MethodPut, path, stale, http.StatusConflict)
+
+	other := testBook(t)
+	other["id"] = "someone-else"
+	expectStatus(t, http.MethodPut, path, other, http.StatusUnprocessableEntity)
+
+	missing := testBook(t)
+	delete(missing, "id")
+	expectStatus(t, http.MethodPut, path+"-missing", missing, http.StatusNotFound)
+	expectStatus(t, http.MethodPut, path+"-missing?upsert=true", missing, http.StatusCreated)
+}
+
+func TestPatchBook(t *testing.T) {
+	book := testBook(t)
+	path := "/api/books/" + book["id"].(string)
+	expectStatus(t, http.MethodPost, "/api/books", book, http.StatusCreated)
+
+	patched := expectStatus(t, http.MethodPatch, path, map[string]interface{}{"pages": 420}, http.StatusOK)
+	if patched["pages"] != 420.0 || patched["title"] != book["title"] {
+		t.Errorf("patched book is %v, want 420 pages and the title unchanged", patched)
+	}
+	expectStatus(t, http.MethodPatch, path, map[string]interface{}{"pages": -1}, http.StatusUnprocessableEntity)
+	expectStatus(t, http.MethodPatch, path+"-missing", map[string]interface{}{"pages": 1}, http.StatusNotFound)
+}
+
+func TestDeleteBook(t *testing.T) {
+	book := testBook(t)
+	path := "/api/books/" + book["id"].(string)
+	expectStatus(t, http.MethodPost, "/api/books", book, http.StatusCreated)
+
+	expectStatus(t, http.MethodDelete, path, nil, http.StatusOK)
+	expectStatus(t, http.MethodGet, path, nil, http.StatusNotFound)
+	expectStatus(t, http.MethodDelete, path, nil, http.StatusNotFound)
+
+	// The ID is free again once the book is deleted.
+	expectStatus(t, http.MethodPost, "/api/books", book, http.StatusCreated)
+}
+
+func TestBookCopies(t *testing.T) {
+	book := testBook(t)
+	path := "/api/books/" + book["id"].(string)
+	expectStatus(t, http.MethodPost, "/api/books", book, http.StatusCreated)
+
+	first, second := book["id"].(string)+"-1", book["id"].(string)+"-2"
+	added := expectStatus(t, http.MethodPost, path+"/copies", map[string]interface{}{"barcode": first, "location": "A3"}, http.StatusCreated)
+	if added["condition"] != "good" || added["available"] != true {
+		t.Errorf("added copy %v, want it available in good condition", added)
+	}
+	expectStatus(t, http.MethodPost, path+"/copies", map[string]interface{}{"barcode": second, "condition": "poor"}, http.StatusCreated)
+	expectStatus(t, http.MethodPost, path+"/copies", map[string]interface{}{"barcode": first}, http.StatusConflict)
+	expectStatus(t, http.MethodPost, path+"/copies", map[string]interface{}{"barcode": "x", "condition": "soggy"}, http.StatusUnprocessableEntity)
+	expectStatus(t, http.MethodPost, "/api/books/no-such-book/copies", map[string]interface{}{"barcode": "orphan"}, http.StatusNotFound)
+	expectStatus(t, http.MethodPatch, path+"/copies/"+second, map[string]interface{}{"available": false}, http.StatusOK)
+
+	got := expectStatus(t, http.MethodGet, path, nil, http.StatusOK)
+	if copies, _ := got["copies"].(map[string]interface{}); copies["total"] != 2.0 || copies["available"] != 1.0 {
+		t.Errorf("copies of the book are %v, want 1 of 2 available", got["copies"])
+	}
+
+	expectStatus(t, http.MethodDelete, path+"/copies/"+first, nil, http.StatusOK)
+	expectStatus(t, http.MethodDelete, path+"/copies/"+first, nil, http.StatusNotFound)
+	expectStatus(t, http.MethodDelete, path+"/copies/"+second, nil, http.StatusOK)
+	if got := expectStatus(t, http.MethodGet, path, nil, http.StatusOK); got["copies"] != nil {
+		t.Errorf("book without copies shows %v", got["copies"])
+	}
+}
+
+// The books of a tenant are written through the same middleware as the
+// rest of the API: no CSRF token, and CORS for other origins.
+func TestTenantPaths(t *testing.T) {
+	book := testBook(t)
+	expectStatus(t, http.MethodPost, "/t/acme/api/books", book, http.StatusCreated)
+	expectStatus(t, http.MethodGet, "/t/acme/api/books/"+book["id"].(string), nil, http.StatusOK)
+	expectStatus(t, http.MethodGet, "/api/books/"+book["id"].(string), nil, http.StatusNotFound)
+
+	req, err := http.NewRequest(http.MethodOptions, testServer.URL+"/t/acme/api/books", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(echo.HeaderOrigin, "https://example.com")
+	req.Header.Set(echo.HeaderAccessControlRequestMethod, http.MethodPost)
+	res, err := testServer.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.Header.Get(echo.HeaderAccessControlAllowOrigin) == "" {
+		t.Errorf("the preflight of a tenant path answered %d without CORS headers", res.StatusCode)
+	}
+}
+
+// A book exported as CSV is the same book once the file is imported again.
+func TestExportImportRoundTrip(t *testing.T) {
+	book := testBook(t)
+	id := book["id"].(string)
+	book["tags"] = []string{"gothic", "vampires"}
+	book["series"], book["series_index"] = "Dracula's Family", 1
+	book["publisher"], book["language"] = "Archibald Constable", "en-GB"
+	book["description"] = "Told in letters, \"diaries\", and clippings,\nsorted by date."
+	book["price"] = map[string]interface{}{"amount": 12.99, "currency": "EUR"}
+	created := expectStatus(t, http.MethodPost, "/api/books", book, http.StatusCreated)
+
+	res, err := testServer.Client().Get(testServer.URL + "/api/books/export?format=csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(res.Body).ReadAll()
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the header and the row of the book are imported again.
+	var file strings.Builder
+	w := csv.NewWriter(&file)
+	for i, record := range records {
+		if i == 0 || record[0] == id {
+			w.Write(record)
+		}
+	}
+	w.Flush()
+
+	expectStatus(t, http.MethodDelete, "/api/books/"+id, nil, http.StatusOK)
+	upload(t, "/api/books/import", file.String(), http.StatusOK)
+	imported := expectStatus(t, http.MethodGet, "/api/books/"+id, nil, http.StatusOK)
+	if created["author_id"] == nil {
+		t.Errorf("created %v, want it linked to its author", created)
+	}
+	for _, field := range []string{"title", "author", "author_id", "edition", "pages", "year", "tags", "series", "series_index", "publisher", "language", "description", "price"} {
+		if !reflect.DeepEqual(imported[field], created[field]) {
+			t.Errorf("imported %s is %v, want %v", field, imported[field], created[field])
+		}
+	}
+}
+
+// Pages rendered from the templates are compressed on their way out, and
+// event streams, which the request timeout leaves open, still reach the
+// client the moment something happens.
+func TestCompressedPagesAndStreams(t *testing.T) {
+	book := testBook(t)
+	id := book["id"].(string)
+	expectStatus(t, http.MethodPost, "/api/books", book, http.StatusCreated)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	get := func(path string) (*http.Response, io.Reader) {
+		t.Helper()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, testServer.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Setting the header ourselves keeps the client from decoding the
+		// answer behind our back.
+		req.Header.Set(echo.HeaderAcceptEncoding, "gzip")
+		res, err := testServer.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { res.Body.Close() })
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s answered %d", path, res.StatusCode)
+		}
+		if res.Header.Get(echo.HeaderContentEncoding) != "gzip" {
+			return res, res.Body
+		}
+		body, err := gzip.NewReader(res.Body)
+		if err != nil {
+			t.Fatalf("GET %s answered no gzip: %v", path, err)
+		}
+		return res, body
+	}
+
+	res, body := get("/books")
+	if res.Header.Get(echo.HeaderContentEncoding) != "gzip" {
+		t.Errorf("page came with Content-Encoding %q, want gzip", res.Header.Get(echo.HeaderContentEncoding))
+	}
+	page, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(page, []byte("Dracula")) || !bytes.Contains(page, []byte("</html>")) {
+		t.Errorf("page is %q, want the whole list of books", page)
+	}
+
+	res, body = get("/api/books/events")
+	if mediaType := res.Header.Get(echo.HeaderContentType); mediaType != "text/event-stream" {
+		t.Fatalf("event stream came as %q", mediaType)
+	}
+	lines := make(chan string, 64)
+	go func() {
+		scanner := bufio.NewScanner(body)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	expectLine := func(want string) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case line := <-lines:
+				if line == want {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("the event stream never said %q", want)
+			}
+		}
+	}
+	expectLine("retry: 5000")
+	expectStatus(t, http.MethodPatch, "/api/books/"+id, map[string]interface{}{"pages": 419}, http.StatusOK)
+	expectLine("event: updated")
+}
+
+// The cart lives in the session cookie, so the client keeps its cookies.
+func TestCartAndOrders(t *testing.T) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testServer.Client().Jar = jar
+	t.Cleanup(func() { testServer.Client().Jar = nil })
+
+	book := testBook(t)
+	id := book["id"].(string)
+	expectStatus(t, http.MethodPost, "/api/books", book, http.StatusCreated)
+
+	expectStatus(t, http.MethodPost, "/api/orders", nil, http.StatusUnprocessableEntity)
+	expectStatus(t, http.MethodPost, "/api/cart/items", map[string]interface{}{"book_id": "no-such-book"}, http.StatusNotFound)
+	expectStatus(t, http.MethodPost, "/api/cart/items", map[string]interface{}{"book_id": id, "quantity": 0}, http.StatusUnprocessableEntity)
+	expectStatus(t, http.MethodPost, "/api/cart/items", map[string]interface{}{"book_id": id}, http.StatusOK)
+	cart := expectStatus(t, http.MethodPost, "/api/cart/items", map[string]interface{}{"book_id": id, "quantity": 2}, http.StatusOK)
+	if cart["count"] != 3.0 {
+		t.Errorf("cart is %v, want 3 books", cart)
+	}
+	expectStatus(t, http.MethodDelete, "/api/cart/items/no-such-book", nil, http.StatusNotFound)
+
+	order := expectStatus(t, http.MethodPost, "/api/orders", nil, http.StatusCreated)
+	items, _ := order["items"].([]interface{})
+	if order["status"] != "pending" || len(items) != 1 || items[0].(map[string]interface{})["title"] != "Dracula" {
+		t.Errorf("placed %v, want a pending order of Dracula", order)
+	}
+	if cart := expectStatus(t, http.MethodGet, "/api/cart", nil, http.StatusOK); cart["count"] != 0.0 {
+		t.Errorf("cart after the order is %v, want it empty", cart)
+	}
+
+	path := "/api/orders/" + order["id"].(string)
+	if got := expectStatus(t, http.MethodGet, path, nil, http.StatusOK); got["id"] != order["id"] || got["status"] != "pending" {
+		t.Errorf("got order %v, want %v", got, order)
+	}
+	expectStatus(t, http.MethodGet, "/api/orders/000000000000000000000000", nil, http.StatusNotFound)
+	expectStatus(t, http.MethodGet, "/api/orders/nonsense", nil, http.StatusNotFound)
+
+	// testServer runs without authentication, so the order has no customer;
+	// give it one and ask for it with the tokens of the owner and of another
+	// customer.
+	orderID, _ := primitive.ObjectIDFromHex(order["id"].(string))
+	if _, err := testDB.Collection("orders").UpdateByID(context.Background(), orderID, bson.M{"$set": bson.M{"customer": "alice"}}); err != nil {
+		t.Fatal(err)
+	}
+	access := newAccessControl("integration-test-secret")
+	getAs := func(subject string) int {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, path, nil), rec)
+		c.SetParamNames("id")
+		c.SetParamValues(order["id"].(string))
+		claims := &bookClaims{Role: RoleReader, RegisteredClaims: jwt.RegisteredClaims{Subject: subject}}
+		c.Set("user", &jwt.Token{Claims: claims, Method: jwt.SigningMethodHS256, Valid: true})
+		if err := getOrder(testDB.Collection("orders"), access)(c); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code
+	}
+	if status := getAs("alice"); status != http.StatusOK {
+		t.Errorf("owner got the order with %d, want 200", status)
+	}
+	if status := getAs("bob"); status != http.StatusNotFound {
+		t.Errorf("another customer got the order with %d, want 404", status)
+	}
+
+	expectStatus(t, http.MethodPut, path+"/status", map[string]interface{}{"status": "shipped"}, http.StatusConflict)
+	expectStatus(t, http.MethodPut, path+"/status", map[string]interface{}{"status": "paid"}, http.StatusOK)
+	expectStatus(t, http.MethodPut, path+"/status", map[string]interface{}{"status": "paid"}, http.StatusConflict)
+	shipped := expectStatus(t, http.MethodPut, path+"/status", map[string]interface{}{"status": "shipped"}, http.StatusOK)
+	if history, _ := shipped["history"].([]interface{}); len(history) != 3 {
+		t.Errorf("order history is %v, want pending, paid, and shipped", shipped["history"])
+	}
+	expectStatus(t, http.MethodPut, path+"/status", map[string]interface{}{"status": "pending"}, http.StatusUnprocessableEntity)
+	expectStatus(t, http.MethodPut, "/api/orders/000000000000000000000000/status", map[string]interface{}{"status": "paid"}, http.StatusNotFound)
+
+	// Books deleted while in the cart cannot be ordered.
+	expectStatus(t, http.MethodPost, "/api/cart/items", map[string]interface{}{"book_id": id}, http.StatusOK)
+	expectStatus(t, http.MethodDelete, "/api/books/"+id, nil, http.StatusOK)
+	expectStatus(t, http.MethodPost, "/api/orders", nil, http.StatusConflict)
+	expectStatus(t, http.MethodDelete, "/api/cart/items/"+id, nil, http.StatusOK)
+}
+
+// Follows /api/books/events until the test ends. The events of books whose
+// ID starts with prefix come out of the channel as "type id".
+func followEvents(t *testing.T, prefix string) <-chan string {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, testServer.URL+"/api/books/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := testServer.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		t.Fatalf("GET /api/books/events answered %d", res.StatusCode)
+	}
+	events := make(chan string, 64)
+	go func() {
+		defer res.Body.Close()
+		var kind string
+		lines := bufio.NewScanner(res.Body)
+		for lines.Scan() {
+			if value, ok := strings.CutPrefix(lines.Text(), "event: "); ok {
+				kind = value
+			}
+			data, ok := strings.CutPrefix(lines.Text(), "data: ")
+			var book struct {
+				ID string `json:"id"`
+			}
+			if !ok || json.Unmarshal([]byte(data), &book) != nil || !strings.HasPrefix(book.ID, prefix) {
+				continue
+			}
+			select {
+			case events <- kind + " " + book.ID:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events
+}
+
+// Waits for as many events as want lists, and compares them in any order.
+func expectEvents(t *testing.T, events <-chan string, want []string) {
+	t.Helper()
+	var got []string
+	timeout := time.After(10 * time.Second)
+	for len(got) < len(want) {
+		select {
+		case event := <-events:
+			got = append(got, event)
+		case <-timeout:
+			t.Fatalf("got events %v, want %v", got, want)
+		}
+	}
+	want = slices.Clone(want)
+	slices.Sort(got)
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Errorf("got events %v, want %v", got, want)
+	}
+}
+
+// Writes books named prefix-a to prefix-d with the endpoints that store
+// them without the repository: batch create, both imports, revert, merge,
+// and restore. It returns the events these writes, and the repository
+// writes in between, should cause. When it is done, prefix-a carries the
+// tag gothic and its first title again, prefix-c is merged into it, and
+// prefix-d is still being imported by a job.
+func writeAroundRepository(t *testing.T, prefix string) []string {
+	t.Helper()
+	a, b, c, d := prefix+"-a", prefix+"-b", prefix+"-c", prefix+"-d"
+	expectStatus(t, http.MethodPost, "/api/books/batch", []map[string]interface{}{
+		{"id": a, "title": "Dracula", "author": "Bram Stoker"},
+		{"id": b, "title": "The Jewel of Seven Stars", "author": "Bram Stoker"},
+	}, http.StatusCreated)
+	upload(t, "/api/books/import", "id,title,author\n"+c+",Dracula's Guest,Bram Stoker\n", http.StatusOK)
+	expectStatus(t, http.MethodPost, "/api/books/"+a+"/tags", map[string]interface{}{"tags": []string{"gothic"}}, http.StatusOK)
+	expectStatus(t, http.MethodDelete, "/api/books/"+b, nil, http.StatusOK)
+	expectStatus(t, http.MethodPost, "/api/books/"+b+"/restore", nil, http.StatusOK)
+	expectStatus(t, http.MethodPatch, "/api/books/"+a, map[string]interface{}{"title": "Dracula (annotated)"}, http.StatusOK)
+	// Version 2 is the book with its tag and first title.
+	expectStatus(t, http.MethodPost, "/api/books/"+a+"/revert/2", nil, http.StatusOK)
+	expectStatus(t, http.MethodPost, "/api/books/merge", map[string]interface{}{"target": a, "source": c}, http.StatusOK)
+	upload(t, "/api/imports", "id,title,author\n"+d+",The Lair of the White Worm,Bram Stoker\n", http.StatusAccepted)
+	return []string{
+		"created " + a, "created " + b, "created " + c,
+		"updated " + a,
+		"deleted " + b, "created " + b,
+		"updated " + a, "updated " + a,
+		"deleted " + c, "updated " + a,
+		"created " + d,
+	}
+}
+
+// testServer runs on a standalone mongod, which has no change streams, so
+// the handlers have to announce their writes themselves.
+func TestEventsWithoutChangeStream(t *testing.T) {
+	prefix := testBook(t)["id"].(string)
+	events := followEvents(t, prefix)
+	expectEvents(t, events, writeAroundRepository(t, prefix))
+}
+
+// Webhooks hear about the same writes as the event stream.
+func TestWebhooksWithoutChangeStream(t *testing.T) {
+	prefix := testBook(t)["id"].(string)
+	deliveries := make(chan string, 64)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var delivery struct {
+			Event string `json:"event"`
+			Book  struct {
+				ID string `json:"id"`
+			} `json:"book"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&delivery); err != nil {
+			t.Errorf("webhook delivery is not JSON: %v", err)
+		} else if strings.HasPrefix(delivery.Book.ID, prefix) {
+			deliveries <- delivery.Event + " " + delivery.Book.ID
+		}
+	}))
+	defer receiver.Close()
+
+	hook := expectStatus(t, http.MethodPost, "/api/webhooks", map[string]interface{}{"url": receiver.URL}, http.StatusCreated)
+	t.Cleanup(func() { expectStatus(t, http.MethodDelete, "/api/webhooks/"+hook["id"].(string), nil, http.StatusOK) })
+	expectEvents(t, deliveries, writeAroundRepository(t, prefix))
+}
+
+// The search index follows the same writes, and ends up with the books as
+// they are stored.
+func TestSearchIndexWithoutChangeStream(t *testing.T) {
+	prefix := testBook(t)["id"].(string)
+	events := followEvents(t, prefix)
+	expectEvents(t, events, writeAroundRepository(t, prefix))
+
+	indexed := func() string {
+		a := testIndex.doc(prefix + "-a")
+		tags, _ := a["tags"].([]interface{})
+		return fmt.Sprintf("a: %v %v, b: %t, c: %t, d: %t", a["title"], tags,
+			testIndex.doc(prefix+"-b") != nil, testIndex.doc(prefix+"-c") != nil, testIndex.doc(prefix+"-d") != nil)
+	}
+	want := "a: Dracula [gothic], b: true, c: false, d: true"
+	// The index is written after the events went out.
+	deadline := time.Now().Add(5 * time.Second)
+	for indexed() != want && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if got := indexed(); got != want {
+		t.Errorf("index holds %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Large CSV imports take a while, so POST /api/imports only stores the
+// upload as a job and answers right away. A pool of workers imports the
+// rows in the background and records its progress in the import_jobs
+// collection, where GET /api/imports/:id reads it.
+type importJob struct {
+	MongoID       primitive.ObjectID `bson:"_id" json:"id"`
+	Status        string             `json:"status"`
+	FileName      string             `json:"file_name"`
+	TotalRows     int                `json:"total_rows"`
+	ProcessedRows int                `json:"processed_rows"`
+	Created       int                `json:"created"`
+	Failed        int                `json:"failed"`
+	// The rows that could not be imported, in the same form as the report
+	// of POST /api/books/import.
+	Errors []importResult `json:"errors"`
+	// Set when the job as a whole failed, e.g. on a broken CSV header.
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// States of an import job.
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// Rows are inserted, and the progress recorded, in chunks of this size.
+const importChunkSize = 200
+
+type importTask struct {
+	id   primitive.ObjectID
+	data []byte
+}
+
+// Accepts import jobs and hands them to the workers.
+type importRunner struct {
+	coll    *mongo.Collection
+	authors *mongo.Collection
+	jobs    *mongo.Collection
+	queue   chan importTask
+	notify  *notifications
+	events  directEvents
+}
+
+// Starts the given number of import workers. Jobs left unfinished by an
+// earlier run of the server cannot be resumed, since their uploads were
+// only kept in memory; they are marked as failed.
+func startImportRunner(ctx context.Context, coll, authors, jobs *mongo.Collection, workers int, notify *notifications, events directEvents) *importRunner {
+	r := &importRunner{coll: coll, authors: authors, jobs: jobs, queue: make(chan importTask, 100), notify: notify, events: events}
+	unfinished := bson.M{"status": bson.M{"$in": bson.A{jobQueued, jobRunning}}}
+	interrupted := bson.M{"$set": bson.M{"status": jobFailed, "error": "Interrupted by a restart of the server", "finishedat": now()}}
+	if _, err := jobs.UpdateMany(ctx, unfinished, interrupted); err != nil {
+		log.Printf("Error marking interrupted import jobs: %v", err)
+	}
+	for i := 0; i < max(1, workers); i++ {
+		go r.work(ctx)
+	}
+	return r
+}
+
+func (r *importRunner) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case task := <-r.queue:
+			r.run(ctx, task)
+		}
+	}
+}
+
+func (r *importRunner) update(ctx context.Context, id primitive.ObjectID, update bson.M) {
+	if _, err := r.jobs.UpdateByID(ctx, id, update); err != nil {
+		log.Printf("Error updating import job %s: %v", id.Hex(), err)
+	}
+}
+
+// Imports the rows of one job, chunk by chunk.
+func (r *importRunner) run(ctx context.Context, task importTask) {
+	defer r.finished(ctx, task.id)
+	r.update(ctx, task.id, bson.M{"$set": bson.M{"status": jobRunning, "startedat": now()}})
+
+	books, report, err := parseBookCSV(bytes.NewReader(task.data))
+	if err != nil {
+		r.update(ctx, task.id, bson.M{"$set": bson.M{"status": jobFailed, "error": err.Error(), "finishedat": now()}})
+		return
+	}
+	r.update(ctx, task.id, bson.M{"$set": bson.M{"totalrows": len(report.Rows)}})
+
+	for start := 0; start < len(report.Rows); start += importChunkSize {
+		end := min(start+importChunkSize, len(report.Rows))
+		chunk := &importReport{Rows: report.Rows[start:end]}
+		chunkBooks := map[int]BookStore{}
+		for idx := start; idx < end; idx++ {
+			if book, ok := books[idx]; ok {
+				chunkBooks[idx-start] = book
+			}
+		}
+		if err := insertImportedBooks(ctx, r.coll, r.authors, chunkBooks, chunk, r.events); err != nil {
+			log.Printf("Error importing books for job %s: %v", task.id.Hex(), err)
+			r.update(ctx, task.id, bson.M{"$set": bson.M{"status": jobFailed, "error": "Failed to import books", "finishedat": now()}})
+			return
+		}
+
+		created := 0
+		failures := []importResult{}
+		for _, row := range chunk.Rows {
+			if row.Status == bulkCreated {
+				created++
+			} else {
+				failures = append(failures, row)
+			}
+		}
+		r.update(ctx, task.id, bson.M{
+			"$inc":  bson.M{"processedrows": len(chunk.Rows), "created": created, "failed": len(failures)},
+			"$push": bson.M{"errors": bson.M{"$each": failures}},
+		})
+	}
+	r.update(ctx, task.id, bson.M{"$set": bson.M{"status": jobDone, "finishedat": now()}})
+}
+
+// Tells the staff how a job went.
+func (r *importRunner) finished(ctx context.Context, id primitive.ObjectID) {
+	if !r.notify.Wants(notifyImportFinished) {
+		return
+	}
+	var job importJob
+	if err := r.jobs.FindOne(ctx, bson.M{"_id": id}).Decode(&job); err != nil {
+		log.Printf("Error loading import job %s: %v", id.Hex(), err)
+		return
+	}
+	r.notify.ImportFinished(ctx, job)
+}
+
+// Handles POST /api/imports, a multipart form with the CSV in the "file"
+// field. It answers 202 with the new job; the Location header points to
+// its progress.
+func createImportJob(runner *importRunner) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		header, err := c.FormFile("file")
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Missing CSV upload in field \"file\""})
+		}
+		file, err := header.Open()
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Could not read the uploaded file"})
+		}
+		defer file.Close()
+		data, err := io.ReadAll(file)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Could not read the uploaded file"})
+		}
+
+		job := importJob{
+			MongoID:   primitive.NewObjectID(),
+			Status:    jobQueued,
+			FileName:  header.Filename,
+			Errors:    []importResult{},
+			CreatedAt: now(),
+		}
+		if _, err := runner.jobs.InsertOne(c.Request().Context(), job); err != nil {
+			log.Printf("Error creating import job: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create import job"})
+		}
+		select {
+		case runner.queue <- importTask{id: job.MongoID, data: data}:
+		default:
+			runner.update(c.Request().Context(), job.MongoID, bson.M{"$set": bson.M{"status": jobFailed, "error": "Too many imports waiting", "finishedat": now()}})
+			return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Too many imports waiting, try again later"})
+		}
+		c.Response().Header().Set(echo.HeaderLocation, "/api/imports/"+job.MongoID.Hex())
+		return c.JSON(http.StatusAccepted, job)
+	}
+}
+
+// Handles GET /api/imports, listing the 50 most recent jobs.
+func listImportJobs(jobs *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		opts := options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(50)
+		cursor, err := jobs.Find(ctx, bson.M{}, opts)
+		if err != nil {
+			log.Printf("Error listing import jobs: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to list import jobs"})
+		}
+		ret := []importJob{}
+		if err := cursor.All(ctx, &ret); err != nil {
+			log.Printf("Error listing import jobs: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to list import jobs"})
+		}
+		return c.JSON(http.StatusOK, ret)
+	}
+}
+
+// Handles GET /api/imports/:id, the progress of one job.
+func getImportJob(jobs *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		idParam := c.Param("id")
+		id, err := primitive.ObjectIDFromHex(idParam)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Import job not found with ID " + idParam})
+		}
+		var job importJob
+		err = jobs.FindOne(c.Request().Context(), bson.M{"_id": id}).Decode(&job)
+		if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Import job not found with ID " + idParam})
+		} else if err != nil {
+			log.Printf("Error fetching import job %s: %v", idParam, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch import job"})
+		}
+		return c.JSON(http.StatusOK, job)
+	}
+}
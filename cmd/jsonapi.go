@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Clients that standardized on JSON:API (https://jsonapi.org) get books
+// and authors in it when they send Accept: application/vnd.api+json. Each
+// book or author is a resource object with its ID, its fields as
+// attributes, and its links:
+//
+//	{"data": {"type": "books", "id": "dracula",
+//	  "attributes": {"title": "Dracula", "author_name": "Bram Stoker", ...},
+//	  "relationships": {"author": {"data": {"type": "authors", "id": "bram-stoker"},
+//	    "links": {"related": "/api/authors/bram-stoker"}}},
+//	  "links": {"self": "/api/books/dracula"}}}
+//
+// Attributes and relationships share their names in JSON:API, so the name
+// of the author of a book is the attribute author_name there, next to the
+// author relationship. Sparse fieldsets like ?fields[books]=title,author
+// limit the attributes and relationships sent. Only answers are written
+// in JSON:API; requests keep sending plain JSON.
+
+const jsonAPIMediaType = "application/vnd.api+json"
+
+// Values that can be written as a JSON:API document.
+type jsonAPIEncodable interface {
+	JSONAPIDocument() jsonAPIDocument
+}
+
+type jsonAPIDocument struct {
+	JSONAPI map[string]string `json:"jsonapi"`
+	// A jsonAPIResource, or a slice of them for a collection.
+	Data interface{} `json:"data"`
+}
+
+func (d jsonAPIDocument) JSONAPIDocument() jsonAPIDocument {
+	return d
+}
+
+func newJSONAPIDocument(data interface{}) jsonAPIDocument {
+	return jsonAPIDocument{JSONAPI: map[string]string{"version": "1.1"}, Data: data}
+}
+
+type jsonAPIResource struct {
+	Type       string                 `json:"type"`
+	ID         string                 `json:"id"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	// A relationship holds "data", the identifier of the related resource
+	// or null, and/or "links" to it.
+	Relationships map[string]map[string]interface{} `json:"relationships,omitempty"`
+	Links         map[string]string                 `json:"links,omitempty"`
+}
+
+// Drops the attributes and relationships not named in fields, a comma
+// separated sparse fieldset. An empty fieldset keeps all of them.
+func (r jsonAPIResource) sparse(fields string) jsonAPIResource {
+	if fields == "" {
+		return r
+	}
+	keep := strings.Split(fields, ",")
+	for name := range r.Attributes {
+		if !slices.Contains(keep, name) {
+			delete(r.Attributes, name)
+		}
+	}
+	for name := range r.Relationships {
+		if !slices.Contains(keep, name) {
+			delete(r.Relationships, name)
+		}
+	}
+	return r
+}
+
+// Whether the client would rather have JSON:API than plain JSON.
+func prefersJSONAPI(c echo.Context) bool {
+	enc, ok := negotiateEncoder(c.Request().Header.Get(echo.HeaderAccept), jsonAPIDocument{})
+	return ok && enc.mediaType == jsonAPIMediaType
+}
+
+// The names of the book fields in JSON:API, where they differ from the
+// plain JSON ones.
+var jsonAPIBookFields = map[string]string{
+	"author":    "author_name",
+	"author_id": "author",
+}
+
+// Reads ?fields[books]=title,author_name into the plain JSON field names
+// bookFields understands. The ID is always read, as JSON:API needs it.
+func jsonAPIBookFieldset(raw string) string {
+	fields := []string{"id"}
+	for _, field := range strings.Split(raw, ",") {
+		field = strings.TrimSpace(field)
+		for plain, renamed := range jsonAPIBookFields {
+			if field == renamed {
+				field = plain
+				break
+			}
+		}
+		if field != "" && field != "id" {
+			fields = append(fields, field)
+		}
+	}
+	return strings.Join(fields, ",")
+}
+
+// A book as bookToMap returns it, maybe projected, as a resource.
+func bookResource(book map[string]interface{}) jsonAPIResource {
+	id := fmt.Sprint(book["id"])
+	res := jsonAPIResource{
+		Type:       "books",
+		ID:         id,
+		Attributes: map[string]interface{}{},
+		Links:      map[string]string{"self": "/api/books/" + id},
+	}
+	for field, value := range book {
+		if renamed, ok := jsonAPIBookFields[field]; ok {
+			field = renamed
+		}
+		if field != "id" && field != "author" {
+			res.Attributes[field] = value
+		}
+	}
+	if authorID, ok := book["author_id"].(string); ok && authorID != "" {
+		res.Relationships = map[string]map[string]interface{}{"author": {
+			"data":  map[string]string{"type": "authors", "id": authorID},
+			"links": map[string]string{"related": "/api/authors/" + authorID},
+		}}
+	}
+	return res
+}
+
+func (b bookItem) JSONAPIDocument() jsonAPIDocument {
+	return newJSONAPIDocument(bookResource(b))
+}
+
+func (l bookList) JSONAPIDocument() jsonAPIDocument {
+	data := make([]jsonAPIResource, len(l))
+	for i, book := range l {
+		data[i] = bookResource(book)
+	}
+	return newJSONAPIDocument(data)
+}
+
+func authorResourceObject(author Author) jsonAPIResource {
+	attributes := map[string]interface{}{
+		"name":       author.Name,
+		"bio":        author.Bio,
+		"birth_year": author.BirthYear,
+	}
+	if !author.CreatedAt.IsZero() {
+		attributes["created_at"] = author.CreatedAt
+		attributes["updated_at"] = author.UpdatedAt
+	}
+	return jsonAPIResource{
+		Type:       "authors",
+		ID:         author.ID,
+		Attributes: attributes,
+		Relationships: map[string]map[string]interface{}{"books": {
+			"links": map[string]string{"related": "/api/authors/" + author.ID + "/books"},
+		}},
+		Links: map[string]string{"self": "/api/authors/" + author.ID},
+	}
+}
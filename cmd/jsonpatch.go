@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// A JSON Patch (RFC 6902) is a list of operations applied in order, e.g.
+//
+//	[{"op": "replace", "path": "/title", "value": "Dracula"},
+//	 {"op": "add", "path": "/tags/-", "value": "gothic"}]
+//
+// The document is what encoding/json decodes into an interface{}: maps,
+// slices, strings, float64s, bools, and nil.
+type jsonPatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from"`
+	Value interface{} `json:"value"`
+}
+
+var (
+	// The patch itself is malformed, e.g. it names an unknown operation.
+	errBadPatch = errors.New("invalid JSON patch")
+	// The patch is fine, but does not fit the document, e.g. a "test"
+	// failed or a path does not exist.
+	errPatchConflict = errors.New("JSON patch does not apply")
+)
+
+// Applies the operations to doc, which is changed in place where possible.
+// It returns the patched document, since replacing the root makes a new one.
+func applyJSONPatch(doc interface{}, ops []jsonPatchOp) (interface{}, error) {
+	var err error
+	for _, op := range ops {
+		switch op.Op {
+		case "add":
+			doc, err = pointerAdd(doc, op.Path, op.Value)
+		case "remove":
+			doc, _, err = pointerRemove(doc, op.Path)
+		case "replace":
+			if doc, _, err = pointerRemove(doc, op.Path); err == nil {
+				doc, err = pointerAdd(doc, op.Path, op.Value)
+			}
+		case "move":
+			var value interface{}
+			if strings.HasPrefix(op.Path, op.From+"/") {
+				return nil, errBadPatch
+			}
+			if doc, value, err = pointerRemove(doc, op.From); err == nil {
+				doc, err = pointerAdd(doc, op.Path, value)
+			}
+		case "copy":
+			var value interface{}
+			if value, err = pointerGet(doc, op.From); err == nil {
+				doc, err = pointerAdd(doc, op.Path, deepCopy(value))
+			}
+		case "test":
+			var value interface{}
+			if value, err = pointerGet(doc, op.Path); err == nil && !reflect.DeepEqual(value, op.Value) {
+				err = errPatchConflict
+			}
+		default:
+			return nil, errBadPatch
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// Splits a JSON Pointer (RFC 6901) like "/tags/0" into its reference tokens.
+func pointerTokens(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, errBadPatch
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// The position of token in an array of length n. With end set, "-" and n
+// name the position after the last element, where "add" appends.
+func arrayIndex(token string, n int, end bool) (int, error) {
+	if end && token == "-" {
+		return n, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, errBadPatch
+	}
+	if i > n || (i == n && !end) {
+		return 0, errPatchConflict
+	}
+	return i, nil
+}
+
+func pointerGet(doc interface{}, pointer string) (interface{}, error) {
+	tokens, err := pointerTokens(pointer)
+	if err != nil {
+		return nil, err
+	}
+	for _, token := range tokens {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, errPatchConflict
+			}
+			doc = value
+		case []interface{}:
+			i, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[i]
+		default:
+			return nil, errPatchConflict
+		}
+	}
+	return doc, nil
+}
+
+// Splits a pointer into the container it points into and the last token.
+func pointerParent(doc interface{}, pointer string) (interface{}, string, error) {
+	i := strings.LastIndex(pointer, "/")
+	if i < 0 {
+		return nil, "", errBadPatch
+	}
+	parent, err := pointerGet(doc, pointer[:i])
+	if err != nil {
+		return nil, "", err
+	}
+	last, _ := pointerTokens(pointer[i:])
+	return parent, last[0], nil
+}
+
+// Writes value at pointer. Arrays are copied when they grow, so the new
+// array is stored back into its own parent.
+func pointerAdd(doc interface{}, pointer string, value interface{}) (interface{}, error) {
+	if pointer == "" {
+		return value, nil
+	}
+	parent, token, err := pointerParent(doc, pointer)
+	if err != nil {
+		return nil, err
+	}
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[token] = value
+		return doc, nil
+	case []interface{}:
+		i, err := arrayIndex(token, len(node), true)
+		if err != nil {
+			return nil, err
+		}
+		grown := append(append(append([]interface{}{}, node[:i]...), value), node[i:]...)
+		return replaceParent(doc, pointer, grown)
+	}
+	return nil, errPatchConflict
+}
+
+// Removes the value at pointer and returns it.
+func pointerRemove(doc interface{}, pointer string) (interface{}, interface{}, error) {
+	if pointer == "" {
+		return nil, doc, nil
+	}
+	parent, token, err := pointerParent(doc, pointer)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		value, ok := node[token]
+		if !ok {
+			return nil, nil, errPatchConflict
+		}
+		delete(node, token)
+		return doc, value, nil
+	case []interface{}:
+		i, err := arrayIndex(token, len(node), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		value := node[i]
+		shrunk := append(append([]interface{}{}, node[:i]...), node[i+1:]...)
+		doc, err = replaceParent(doc, pointer, shrunk)
+		return doc, value, err
+	}
+	return nil, nil, errPatchConflict
+}
+
+// Stores a new version of the array holding pointer in place of the old.
+func replaceParent(doc interface{}, pointer string, array []interface{}) (interface{}, error) {
+	parentPointer := pointer[:strings.LastIndex(pointer, "/")]
+	if parentPointer == "" {
+		return array, nil
+	}
+	grandparent, token, err := pointerParent(doc, parentPointer)
+	if err != nil {
+		return nil, err
+	}
+	switch node := grandparent.(type) {
+	case map[string]interface{}:
+		node[token] = array
+	case []interface{}:
+		i, err := arrayIndex(token, len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		node[i] = array
+	}
+	return doc, nil
+}
+
+func deepCopy(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			copied[key] = deepCopy(item)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, item := range v {
+			copied[i] = deepCopy(item)
+		}
+		return copied
+	}
+	return value
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// Limits keeping slow or oversized requests from tying up the server:
+// READ_TIMEOUT for reading a whole request, WRITE_TIMEOUT for answering it,
+// and IDLE_TIMEOUT for keep-alive connections waiting for the next request.
+// Streams that run for as long as the client wants, like the event stream
+// and the exports, lift the write timeout for themselves. Request bodies
+// may not exceed MAX_BODY_SIZE, and bodies sent to /api must be JSON,
+// except for the uploads.
+
+// The /api routes that take something other than JSON, i.e. multipart
+// uploads.
+var nonJSONRoutes = []string{
+	"/api/books/:id/cover",
+	"/api/books/import",
+	"/api/imports",
+}
+
+// Sets the timeouts on the servers echo starts, plain and TLS.
+func applyServerTimeouts(e *echo.Echo, cfg Config) {
+	for _, server := range []*http.Server{e.Server, e.TLSServer} {
+		setTimeouts(server, cfg)
+	}
+}
+
+func setTimeouts(server *http.Server, cfg Config) {
+	server.ReadTimeout = cfg.ReadTimeout
+	server.WriteTimeout = cfg.WriteTimeout
+	server.IdleTimeout = cfg.IdleTimeout
+}
+
+// Refuses bodies beyond MAX_BODY_SIZE, like "10M", with 413. Bodies sent
+// without a Content-Length are cut off there instead, which makes them
+// fail to parse.
+func bodyLimit(cfg Config) echo.MiddlewareFunc {
+	limit := middleware.BodyLimit(cfg.MaxBodySize)
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		limited := limit(next)
+		return func(c echo.Context) error {
+			err := limited(c)
+			if err == echo.ErrStatusRequestEntityTooLarge {
+				return c.JSON(http.StatusRequestEntityTooLarge, map[string]string{"error": "The request body is larger than " + cfg.MaxBodySize})
+			}
+			return err
+		}
+	}
+}
+
+// Answers requests to the JSON endpoints whose body is something else with
+// 415. Bodies without a Content-Type are taken to be JSON, as before; types
+// like application/merge-patch+json count as JSON.
+func requireJSON() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			if req.ContentLength == 0 || slices.Contains(nonJSONRoutes, c.Path()) {
+				return next(c)
+			}
+			header := req.Header.Get(echo.HeaderContentType)
+			if header == "" {
+				return next(c)
+			}
+			mediaType, _, err := mime.ParseMediaType(header)
+			if err != nil || (mediaType != echo.MIMEApplicationJSON && !strings.HasSuffix(mediaType, "+json")) {
+				return c.JSON(http.StatusUnsupportedMediaType, map[string]string{"error": "The request body must be JSON (" + echo.MIMEApplicationJSON + ")"})
+			}
+			return next(c)
+		}
+	}
+}
+
+// Lifts the write timeout for a response that streams for as long as it
+// takes, instead of being cut off after WRITE_TIMEOUT.
+func withoutWriteTimeout(c echo.Context) {
+	http.NewResponseController(c.Response()).SetWriteDeadline(time.Time{})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+// Browsers connect to /ws to see book changes as they happen. Every change
+// is sent as a JSON message with its type ("created", "updated", or
+// "deleted") and the ID of the book. Created and updated books come with
+// their new table row, rendered by the "book-row" template, which the
+// script in index.html puts in place.
+type liveMessage struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+	HTML string `json:"html,omitempty"`
+}
+
+const (
+	// Idle connections are pinged this often, so proxies keep them open.
+	livePingInterval = 30 * time.Second
+	// Browsers that do not take a message within this time are dropped.
+	liveWriteTimeout = 10 * time.Second
+)
+
+// The default upgrader only accepts connections from pages of our own
+// origin.
+var liveUpgrader = websocket.Upgrader{}
+
+// Handles GET /ws, forwarding the events of the broadcast hub to the
+// browser until it goes away.
+func liveBooks(events *bookEvents) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		conn, err := liveUpgrader.Upgrade(c.Response(), c.Request(), nil)
+		if err != nil {
+			// The upgrader has already answered the request.
+			return nil
+		}
+		defer conn.Close()
+		// The connection outlives the request, and with it READ_TIMEOUT;
+		// writes have their own deadline below.
+		conn.SetReadDeadline(time.Time{})
+
+		changes, stop := events.Subscribe()
+		defer stop()
+
+		// Browsers never send anything, but reading is how we notice that
+		// they closed the connection.
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		ping := time.NewTicker(livePingInterval)
+		defer ping.Stop()
+		for {
+			select {
+			case <-closed:
+				return nil
+			case <-ping.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(liveWriteTimeout)); err != nil {
+					return nil
+				}
+			case event := <-changes:
+				msg := liveMessage{Type: event.Type, ID: event.Book.ID}
+				if event.Type != bookDeleted {
+					var row bytes.Buffer
+					if err := c.Echo().Renderer.Render(&row, "book-row", bookToMap(event.Book), c); err != nil {
+						log.Printf("Error rendering row of book %s: %v", event.Book.ID, err)
+						continue
+					}
+					msg.HTML = row.String()
+				}
+				conn.SetWriteDeadline(time.Now().Add(liveWriteTimeout))
+				if err := conn.WriteJSON(msg); err != nil {
+					return nil
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Every checkout is recorded in the loans collection. The book itself
+// remembers its current loan in the checkout field, which is what makes a
+// book unavailable, and lets listings show availability without looking at
+// the loans.
+type Loan struct {
+	MongoID      primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	BookID       string             `bson:"bookid" json:"book_id"`
+	Borrower     string             `json:"borrower"`
+	CheckedOutAt time.Time          `json:"checked_out_at"`
+	DueAt        time.Time          `json:"due_at"`
+	ReturnedAt   *time.Time         `bson:"returnedat,omitempty" json:"returned_at,omitempty"`
+	// When the borrower was reminded that the loan is due; see notify.go.
+	RemindedAt *time.Time `bson:"remindedat,omitempty" json:"reminded_at,omitempty"`
+}
+
+// The current loan of a book, as stored in the book.
+type bookCheckout struct {
+	Borrower string    `json:"borrower"`
+	DueAt    time.Time `bson:"dueat" json:"due_at"`
+}
+
+// The body of POST /api/books/:id/checkout. Without a due date, the loan
+// lasts for the configured loan period.
+type checkoutPayload struct {
+	Borrower string     `json:"borrower"`
+	DueAt    *time.Time `json:"due_at"`
+}
+
+// Handles POST /api/books/:id/checkout. The book is marked as checked out
+// with a single conditional update, so two clients can never borrow the
+// same book at once.
+func checkoutBook(coll, loans *mongo.Collection, period time.Duration) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		idParam := c.Param("id")
+		var payload checkoutPayload
+		if err := c.Bind(&payload); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+		}
+		if payload.Borrower == "" {
+			payload.Borrower = callerSubject(c)
+		}
+
+		loan := Loan{
+			MongoID:      primitive.NewObjectID(),
+			BookID:       idParam,
+			Borrower:     payload.Borrower,
+			CheckedOutAt: now(),
+		}
+		loan.DueAt = loan.CheckedOutAt.Add(period)
+		if payload.DueAt != nil {
+			loan.DueAt = payload.DueAt.UTC().Truncate(time.Millisecond)
+		}
+		errs := validationErrors{}
+		if loan.Borrower == "" {
+			errs["borrower"] = "is required"
+		}
+		if !loan.DueAt.After(loan.CheckedOutAt) {
+			errs["due_at"] = "must be in the future"
+		}
+		if len(errs) > 0 {
+			return validationFailed(c, errs)
+		}
+
+		checkout := bookCheckout{Borrower: loan.Borrower, DueAt: loan.DueAt}
+		filter := notDeleted(bson.M{"id": idParam, "checkout": nil})
+		result, err := coll.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"checkout": checkout}})
+		if err != nil {
+			log.Printf("Error checking out book %s: %v", idParam, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to check out book"})
+		}
+		if result.MatchedCount == 0 {
+			if _, err := findBook(ctx, coll, idParam); err == nil {
+				return c.JSON(http.StatusConflict, map[string]string{"error": "Book with ID " + idParam + " is already checked out"})
+			}
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Book not found with ID " + idParam})
+		}
+
+		if _, err := loans.InsertOne(ctx, loan); err != nil {
+			log.Printf("Error recording loan of book %s: %v", idParam, err)
+			// Without a loan record the book must not stay checked out.
+			coll.UpdateOne(ctx, bson.M{"id": idParam}, bson.M{"$unset": bson.M{"checkout": ""}})
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to check out book"})
+		}
+		return c.JSON(http.StatusCreated, loan)
+	}
+}
+
+// Handles POST /api/books/:id/return, closing the open loan of a book.
+func returnBook(coll, loans *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		idParam := c.Param("id")
+
+		result, err := coll.UpdateOne(ctx, bson.M{"id": idParam, "checkout": bson.M{"$ne": nil}}, bson.M{"$unset": bson.M{"checkout": ""}})
+		if err != nil {
+			log.Printf("Error returning book %s: %v", idParam, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to return book"})
+		}
+		if result.MatchedCount == 0 {
+			if _, err := findBook(ctx, coll, idParam); err == nil {
+				return c.JSON(http.StatusConflict, map[string]string{"error": "Book with ID " + idParam + " is not checked out"})
+			}
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Book not found with ID " + idParam})
+		}
+
+		var loan Loan
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+		open := bson.M{"bookid": idParam, "returnedat": nil}
+		err = loans.FindOneAndUpdate(ctx, open, bson.M{"$set": bson.M{"returnedat": now()}}, opts).Decode(&loan)
+		if err != nil {
+			log.Printf("Error closing the loan of book %s: %v", idParam, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to record the return"})
+		}
+		return c.JSON(http.StatusOK, loan)
+	}
+}
+
+// Handles GET /api/loans, newest first. ?status=active, overdue, or
+// returned narrows the list down.
+func listLoans(loans *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		filter := bson.M{}
+		switch c.QueryParam("status") {
+		case "":
+		case "active":
+			filter["returnedat"] = nil
+		case "overdue":
+			filter["returnedat"] = nil
+			filter["dueat"] = bson.M{"$lt": now()}
+		case "returned":
+			filter["returnedat"] = bson.M{"$ne": nil}
+		default:
+			return validationFailed(c, validationErrors{"status": "must be active, overdue, or returned"})
+		}
+		if borrower := c.QueryParam("borrower"); borrower != "" {
+			filter["borrower"] = borrower
+		}
+
+		opts := options.Find().SetSort(bson.D{{Key: "checkedoutat", Value: -1}})
+		cursor, err := loans.Find(ctx, filter, opts)
+		if err != nil {
+			log.Printf("Error listing loans: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to list loans"})
+		}
+		ret := []Loan{}
+		if err := cursor.All(ctx, &ret); err != nil {
+			log.Printf("Error listing loans: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to list loans"})
+		}
+		return c.JSON(http.StatusOK, ret)
+	}
+}
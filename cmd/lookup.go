@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/CAPS-Cloud/exercises/isbn"
+	"github.com/CAPS-Cloud/exercises/openlibrary"
+	"github.com/labstack/echo/v4"
+)
+
+// Handles POST /api/books/lookup?isbn=..., answering with the metadata the
+// Open Library has for the ISBN, in the shape of a book. Clients use it to
+// prefill the create form.
+func lookupBook(client *openlibrary.Client) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		number, err := isbn.Normalize(c.QueryParam("isbn"))
+		if err != nil {
+			return validationFailed(c, validationErrors{"isbn": "must be an ISBN-10 or ISBN-13"})
+		}
+		found, err := client.Lookup(c.Request().Context(), number)
+		if errors.Is(err, openlibrary.ErrNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "No book found with ISBN " + number})
+		} else if err != nil {
+			log.Printf("Error looking up ISBN %s: %v", number, err)
+			return c.JSON(http.StatusBadGateway, map[string]string{"error": "The Open Library did not answer"})
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"edition": number,
+			"title":   found.Title,
+			"author":  found.Author,
+			"pages":   flexInt(found.Pages),
+			"year":    flexInt(found.Year),
+		})
+	}
+}
+
+// Fills the empty fields of a book with what the Open Library knows about
+// its edition. Books without an ISBN edition are left alone, and so are
+// books whose lookup fails: the validation that follows reports anything
+// that is still missing.
+func enrichBook(ctx context.Context, client *openlibrary.Client, book *BookStore) {
+	number, err := isbn.Normalize(book.BookEdition)
+	if !looksLikeISBN(book.BookEdition) || err != nil {
+		return
+	}
+	found, err := client.Lookup(ctx, number)
+	if err != nil {
+		if !errors.Is(err, openlibrary.ErrNotFound) {
+			log.Printf("Error looking up ISBN %s: %v", number, err)
+		}
+		return
+	}
+	if book.BookName == "" {
+		book.BookName = found.Title
+	}
+	if book.BookAuthor == "" && book.AuthorID == "" {
+		book.BookAuthor = found.Author
+	}
+	if book.BookPages == 0 {
+		book.BookPages = flexInt(found.Pages)
+	}
+	if book.BookYear == 0 {
+		book.BookYear = flexInt(found.Year)
+	}
+}
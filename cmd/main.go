@@ -2,18 +2,24 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"errors"
+	"expvar"
 	"html/template"
 	"io"
+	"io/fs"
 	"log"
 	"net/http"
+	"os"
 	"slices"
 	"time"
 
+	"github.com/CAPS-Cloud/exercises"
+	"github.com/CAPS-Cloud/exercises/openlibrary"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -22,22 +28,70 @@ import (
 // frontend or the database
 // More on these "tags" like `bson:"_id,omitempty"`: https://go.dev/wiki/Well-known-struct-tags
 type BookStore struct {
-	MongoID     primitive.ObjectID `bson:"_id,omitempty" json:"mongo_id,omitempty"`
-	ID          string             `json:"id"`
-	BookName    string             `json:"title"`
-	BookAuthor  string             `json:"author"`
-	BookEdition string             `json:"edition"`
-	BookPages   string             `json:"pages"`
-	BookYear    string             `json:"year"`
+	// Only used inside the server; clients know a book by its ID.
+	MongoID     primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	ID          string             `json:"id" validate:"required"`
+	BookName    string             `json:"title" validate:"required"`
+	BookAuthor  string             `json:"author" validate:"required"`
+	BookEdition string             `json:"edition" validate:"isbn"`
+	BookPages   flexInt            `json:"pages" validate:"min=1"`
+	BookYear    flexInt            `json:"year" validate:"min=-3000,notfuture"`
+	Tags        []string           `bson:"tags,omitempty" json:"tags,omitempty"`
+	Series      string             `bson:"series,omitempty" json:"series,omitempty"`
+	SeriesIndex flexInt            `bson:"seriesindex,omitempty" json:"series_index,omitempty" validate:"min=1"`
+	Publisher   string             `bson:"publisher,omitempty" json:"publisher,omitempty"`
+	// A BCP 47 language tag like en or pt-BR, stored in its canonical
+	// spelling; see normalizeLanguage.
+	Language    string `bson:"language,omitempty" json:"language,omitempty" validate:"bcp47"`
+	Description string `bson:"description,omitempty" json:"description,omitempty"`
+	// Stored in the minor unit of its currency; see price.go.
+	Price *bookPrice `bson:"price,omitempty" json:"price,omitempty"`
+	// Summary of the reviews, maintained by the server; see reviews.go.
+	Rating *bookRating `bson:"rating,omitempty" json:"rating,omitempty"`
+	// The number of copies and of those available, maintained by the
+	// server; see copies.go.
+	Copies *bookCopies `bson:"copies,omitempty" json:"copies,omitempty"`
+	// The current loan, maintained by the server; see loans.go.
+	Checkout *bookCheckout `bson:"checkout,omitempty" json:"checkout,omitempty"`
+	// The cover image in GridFS, if one was uploaded; see covers.go.
+	Cover *bookCover `bson:"cover,omitempty" json:"-"`
+	// The author in the authors collection. BookAuthor keeps a copy of the
+	// name for display; see authors.go.
+	AuthorID string `bson:"authorid,omitempty" json:"author_id,omitempty"`
+	// Maintained by the server: set when the book is inserted and refreshed
+	// on every update. Clients cannot change them.
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Incremented on every update. Clients send the version they last saw
+	// with a PUT, and the update is rejected if the book moved on since.
+	Version int `json:"version"`
+	// Set when the book is moved to the recycle bin. Deleted books are
+	// hidden from every listing until they are restored or purged.
+	DeletedAt *time.Time `bson:"deletedat,omitempty" json:"deleted_at,omitempty"`
+	// The book a deleted book was merged into; see duplicates.go.
+	MergedInto string `bson:"mergedinto,omitempty" json:"merged_into,omitempty"`
+	// Lowercased title and author for suggestions, maintained by the
+	// server; see suggest.go.
+	TitleKey  string `bson:"titlekey,omitempty" json:"-"`
+	AuthorKey string `bson:"authorkey,omitempty" json:"-"`
+	// Edge n-grams of the words in title and author for searches; see
+	// search.go.
+	TitleGrams  []string `bson:"titlegrams,omitempty" json:"-"`
+	AuthorGrams []string `bson:"authorgrams,omitempty" json:"-"`
+	GramSize    string   `bson:"gramsize,omitempty" json:"-"`
 }
 
 // Wraps the "Template" struct to associate a necessary method
 // to determine the rendering procedure
 type Template struct {
 	tmpl *template.Template
+	// Set in development mode: the templates are then parsed again from
+	// these files on every render, so edits show up on the next reload of
+	// the page.
+	reload fs.FS
 }
 
-// Preload the available templates for the view folder.
+// Preload the available templates for the view folder of the given assets.
 // This builds a local "database" of all available "blocks"
 // to render upon request, i.e., replace the respective
 // variable or expression.
@@ -45,10 +99,20 @@ type Template struct {
 // to get to know more about templating
 // You can also read Golang's documentation on their templating
 // https://pkg.go.dev/text/template
-func loadTemplates() *Template {
-	return &Template{
-		tmpl: template.Must(template.ParseGlob("views/*.html")),
+func loadTemplates(assets fs.FS, hotReload bool) *Template {
+	t := &Template{
+		tmpl: template.Must(parseTemplates(assets)),
 	}
+	if hotReload {
+		t.reload = assets
+	}
+	return t
+}
+
+// Parses the views together with the formatting functions of
+// templatefuncs.go.
+func parseTemplates(assets fs.FS) (*template.Template, error) {
+	return template.New("views").Funcs(templateFuncs).ParseFS(assets, "views/*.html")
 }
 
 // Method definition of the required "Render" to be passed for the Rendering
@@ -59,9 +123,19 @@ func loadTemplates() *Template {
 // implement them, i.e., only define them. Such differentiation is important
 // for a compiler to ensure types provide implementations of such methods.
 func (t *Template) Render(w io.Writer, name string, data interface{}, ctx echo.Context) error {
+	if t.reload != nil {
+		tmpl, err := parseTemplates(t.reload)
+		if err != nil {
+			return err
+		}
+		return tmpl.ExecuteTemplate(w, name, data)
+	}
 	return t.tmpl.ExecuteTemplate(w, name, data)
 }
 
+// The database all collections live in.
+const databaseName = "exercise-1"
+
 // Here we make sure the connection to the database is correct and initial
 // configurations exists. Otherwise, we create the proper database and collection
 // we will store the data.
@@ -78,7 +152,7 @@ func prepareDatabase(client *mongo.Client, dbName string, collecName string) (*m
 		return nil, err
 	}
 	if !slices.Contains(names, collecName) {
-		cmd := bson.D{{"create", collecName}}
+		cmd := bson.D{{Key: "create", Value: collecName}}
 		var result bson.M
 		if err = db.RunCommand(context.TODO(), cmd).Decode(&result); err != nil {
 			log.Fatal(err)
@@ -90,65 +164,42 @@ func prepareDatabase(client *mongo.Client, dbName string, collecName string) (*m
 	return coll, nil
 }
 
-// Here we prepare some fictional data and we insert it into the database
-// the first time we connect to it. Otherwise, we check if it already exists.
-func prepareData(client *mongo.Client, coll *mongo.Collection) {
-	startData := []BookStore{
-		{
-			ID:          "example1",
-			BookName:    "The Vortex",
-			BookAuthor:  "José Eustasio Rivera",
-			BookEdition: "958-30-0804-4",
-			BookPages:   "292",
-			BookYear:    "1924",
-		},
-		{
-			ID:          "example2",
-			BookName:    "Frankenstein",
-			BookAuthor:  "Mary Shelley",
-			BookEdition: "978-3-649-64609-9",
-			BookPages:   "280",
-			BookYear:    "1818",
-		},
-		{
-			ID:          "example3",
-			BookName:    "The Black Cat",
-			BookAuthor:  "Edgar Allan Poe",
-			BookEdition: "978-3-99168-238-7",
-			BookPages:   "280",
-			BookYear:    "1843",
-		},
-	}
-
-	// This syntax helps us iterate over arrays. It behaves similar to Python
-	// However, range always returns a tuple: (idx, elem). You can ignore the idx
-	// by using _.
-	// In the topic of function returns: sadly, there is no standard on return types from function. Most functions
-	// return a tuple with (res, err), but this is not granted. Some functions
-	// might return a ret value that includes res and the err, others might have
-	// an out parameter.
+// Here we insert the seed books into the database the first time we
+// connect to it. Each book is an upsert keyed on the unique index on id,
+// which only writes the book when no book has its ID yet, so seeding
+// twice, or from two servers at once, leaves a single copy. All of them go
+// to Mongo in one unordered bulk write; books that fail are logged and the
+// others are inserted anyway. See seeds.go.
+func prepareData(ctx context.Context, coll *mongo.Collection, startData []BookStore) {
+	if len(startData) == 0 {
+		return
+	}
+	models := make([]mongo.WriteModel, 0, len(startData))
 	for _, book := range startData {
-		cursor, err := coll.Find(context.TODO(), book)
-		var results []BookStore
-		if err = cursor.All(context.TODO(), &results); err != nil {
-			panic(err)
-		}
-		if len(results) > 1 {
-			log.Fatal("more records were found")
-		} else if len(results) == 0 {
-			result, err := coll.InsertOne(context.TODO(), book)
-			if err != nil {
-				panic(err)
-			} else {
-				fmt.Printf("%+v\n", result)
-			}
+		book.CreatedAt = now()
+		book.UpdatedAt = book.CreatedAt
+		book.Version = 1
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"id": book.ID}).
+			SetUpdate(bson.M{"$setOnInsert": book}).
+			SetUpsert(true))
+	}
 
-		} else {
-			for _, res := range results {
-				cursor.Decode(&res)
-				fmt.Printf("%+v\n", res)
-			}
+	result, err := coll.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) {
+		for _, writeErr := range bulkErr.WriteErrors {
+			log.Printf("Error seeding book %s: %s", startData[writeErr.Index].ID, writeErr.Message)
+		}
+		if bulkErr.WriteConcernError != nil {
+			log.Printf("Error seeding books: %s", bulkErr.WriteConcernError.Message)
 		}
+	} else if err != nil {
+		log.Printf("Error seeding books: %v", err)
+		return
+	}
+	if result != nil {
+		log.Printf("Seeded %d books, %d were there already", result.UpsertedCount, result.MatchedCount)
 	}
 }
 
@@ -156,69 +207,188 @@ func prepareData(client *mongo.Client, coll *mongo.Collection) {
 // it is not :D ), and then we convert it into an array of map. In Golang, you
 // define a map by writing map[<key type>]<value type>{<key>:<value>}.
 // interface{} is a special type in Golang, basically a wildcard...
-func findAllBooks(coll *mongo.Collection) []map[string]interface{} {
-	cursor, err := coll.Find(context.TODO(), bson.D{{}})
+func findAllBooks(ctx context.Context, coll *mongo.Collection) []map[string]interface{} {
+	return findBooks(ctx, coll, bson.M{})
+}
+
+// Same as findAllBooks, but only returns the books matching filter.
+func findBooks(ctx context.Context, coll *mongo.Collection, filter bson.M) []map[string]interface{} {
+	cursor, err := coll.Find(ctx, notDeleted(filter))
+	if err != nil {
+		panic(err)
+	}
 	var results []BookStore
-	if err = cursor.All(context.TODO(), &results); err != nil {
+	if err = cursor.All(ctx, &results); err != nil {
 		panic(err)
 	}
 
 	var ret []map[string]interface{}
 	for _, res := range results {
-		ret = append(ret, map[string]interface{}{
-			"id":      res.ID,
-			"title":   res.BookName,
-			"author":  res.BookAuthor,
-			"pages":   res.BookPages,
-			"edition": res.BookEdition,
-			"year":    res.BookYear,
-		})
+		ret = append(ret, bookToMap(res))
 	}
 
 	return ret
 }
 
-func findAllAuthors(coll *mongo.Collection) []map[string]interface{} {
-	books := findAllBooks(coll)
-	uniqueAuthorsMap := make(map[string]bool)
+// Looks up one book by its public ID. Books in the recycle bin are not
+// found.
+func findBook(ctx context.Context, coll *mongo.Collection, id string) (BookStore, error) {
+	var book BookStore
+	err := coll.FindOne(ctx, notDeleted(bson.M{"id": id})).Decode(&book)
+	return book, err
+}
 
-	for _, book := range books {
-		if author, ok := book["author"].(string); ok {
-			uniqueAuthorsMap[author] = true
-		}
+// Converts a book into the shape the API and the templates expect, the
+// answer type of the API; see dto.go. Note that the MongoID is left out on
+// purpose.
+func bookToMap(book BookStore) bookItem {
+	ret := bookItem{
+		"id":      book.ID,
+		"title":   book.BookName,
+		"author":  book.BookAuthor,
+		"pages":   book.BookPages,
+		"edition": book.BookEdition,
+		"year":    book.BookYear,
+		"version": book.Version,
+	}
+	if book.AuthorID != "" {
+		ret["author_id"] = book.AuthorID
 	}
+	if len(book.Tags) > 0 {
+		ret["tags"] = book.Tags
+	}
+	ret["available"] = book.Checkout == nil
+	if book.Checkout != nil {
+		ret["due_at"] = book.Checkout.DueAt
+	}
+	if book.Cover != nil {
+		ret["cover_url"] = coverURL(book.ID, "")
+		ret["thumbnail_url"] = coverURL(book.ID, "thumb")
+	}
+	if book.Rating != nil {
+		ret["rating"] = book.Rating
+	}
+	if book.Copies != nil {
+		ret["copies"] = book.Copies
+	}
+	if book.Series != "" {
+		ret["series"] = book.Series
+	}
+	if book.SeriesIndex != 0 {
+		ret["series_index"] = book.SeriesIndex
+	}
+	if book.Publisher != "" {
+		ret["publisher"] = book.Publisher
+	}
+	if book.Language != "" {
+		ret["language"] = book.Language
+	}
+	if book.Description != "" {
+		ret["description"] = book.Description
+	}
+	if book.Price != nil {
+		ret["price"] = book.Price
+	}
+	// Books stored before timestamps existed simply don't have them.
+	if !book.CreatedAt.IsZero() {
+		ret["created_at"] = book.CreatedAt
+	}
+	if !book.UpdatedAt.IsZero() {
+		ret["updated_at"] = book.UpdatedAt
+	}
+	return ret
+}
 
-	var ret []map[string]interface{}
-	for author := range uniqueAuthorsMap {
-		ret = append(ret, map[string]interface{}{"AuthorName": author})
+// The current time as Mongo stores it: in UTC with millisecond precision.
+// Truncating here means what we return right after a write is exactly what
+// a later read will give back.
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
+
+// Returns the most recently added books, newest first. Books stored before
+// timestamps were introduced have no createdat field and sort last.
+func findRecentBooks(ctx context.Context, coll *mongo.Collection, limit int64) []map[string]interface{} {
+	opts := options.Find().SetSort(bson.D{{Key: "createdat", Value: -1}}).SetLimit(limit)
+	cursor, err := coll.Find(ctx, notDeleted(bson.M{}), opts)
+	if err != nil {
+		panic(err)
+	}
+	var results []BookStore
+	if err = cursor.All(ctx, &results); err != nil {
+		panic(err)
 	}
 
+	var ret []map[string]interface{}
+	for _, res := range results {
+		ret = append(ret, bookToMap(res))
+	}
 	return ret
 }
 
-func findAllYears(coll *mongo.Collection) []map[string]interface{} {
-	books := findAllBooks(coll)
-	uniqueYearsMap := make(map[string]bool)
-
-	for _, book := range books {
-		// Assuming "BookYear" is a field in your book map
-		// and its value is a string.
-		// You might need to adjust the key and type assertion
-		// if your data structure is different.
-		if year, ok := book["year"].(string); ok {
-			uniqueYearsMap[year] = true
-		}
+// Lists every author together with the number of books they wrote. The
+// grouping happens in Mongo, so only one row per author leaves the database.
+func findAllAuthors(ctx context.Context, coll *mongo.Collection) []map[string]interface{} {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: notDeleted(bson.M{})}},
+		{{Key: "$group", Value: bson.M{"_id": "$bookauthor", "count": bson.M{"$sum": 1}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+	}
+	var rows []struct {
+		Author string `bson:"_id"`
+		Count  int    `bson:"count"`
 	}
+	aggregate(ctx, coll, pipeline, &rows)
 
 	var ret []map[string]interface{}
-	for year := range uniqueYearsMap {
-		ret = append(ret, map[string]interface{}{"BookYear": year})
+	for _, row := range rows {
+		ret = append(ret, map[string]interface{}{"AuthorName": row.Author, "BookCount": row.Count})
+	}
+	return ret
+}
+
+// Lists every publication year together with the number of books from that
+// year, oldest first.
+func findAllYears(ctx context.Context, coll *mongo.Collection) []map[string]interface{} {
+	// Years are numbers now; null means the year is unknown, so such books
+	// don't show up as a year of their own.
+	match := notDeleted(bson.M{})
+	match["bookyear"] = bson.M{"$nin": bson.A{nil, 0}}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.M{"_id": "$bookyear", "count": bson.M{"$sum": 1}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
 	}
+	var rows []struct {
+		Year  flexInt `bson:"_id"`
+		Count int     `bson:"count"`
+	}
+	aggregate(ctx, coll, pipeline, &rows)
 
+	var ret []map[string]interface{}
+	for _, row := range rows {
+		ret = append(ret, map[string]interface{}{"BookYear": row.Year, "BookCount": row.Count})
+	}
 	return ret
 }
 
-func main() {
+// Runs an aggregation pipeline and decodes all resulting documents into
+// results, which must be a pointer to a slice.
+func aggregate(ctx context.Context, coll *mongo.Collection, pipeline mongo.Pipeline, results interface{}) {
+	cursor, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		panic(err)
+	}
+	if err = cursor.All(ctx, results); err != nil {
+		panic(err)
+	}
+}
+
+// Runs the web server; see cli.go for the other commands.
+func runServer(cfg Config) {
+	build := readBuildInfo()
+	log.Printf("Starting %s %s", cfg.ServiceName, build)
+
 	// Connect to the database. Such defer keywords are used once the local
 	// context returns; for this case, the local context is the main function
 	// By user defer function, we make sure we don't leave connections
@@ -226,8 +396,26 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	// TODO: make sure to pass the proper username, password, and port
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://localhost:27017"))
+	// The access log adds up the time each request waits for Mongo, and
+	// requests and the Mongo commands they send are traced when an OTLP
+	// endpoint is configured; see accesslog.go and tracing.go.
+	monitors := []*event.CommandMonitor{mongoTiming()}
+	if cfg.OTLPEndpoint != "" {
+		shutdown, err := setupTracing(ctx, cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer shutdown(context.Background())
+		monitors = append(monitors, mongoTracing())
+	}
+	// The username, password, and port go into MONGODB_URI; pool sizes,
+	// read preference, and the like have variables of their own. See
+	// mongoclient.go.
+	clientOptions, err := mongoClientOptions(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	client, err := mongo.Connect(ctx, clientOptions.SetMonitor(combineMonitors(monitors...)))
 
 	// This is another way to specify the call of a function. You can define inline
 	// functions (or anonymous functions, similar to the behavior in Python)
@@ -237,55 +425,293 @@ func main() {
 		}
 	}()
 
+	// Panics and failed requests go to Sentry when it is configured; see
+	// errortracking.go.
+	if cfg.SentryDSN != "" {
+		if err := setupErrorTracking(cfg); err != nil {
+			log.Fatal(err)
+		}
+		defer flushErrors()
+	}
+	e := newServer(cfg, client, build)
+
+	// We start the server and bind it to port 3030. For future references, this
+	// is the application's port and not the external one. For this first exercise,
+	// they could be the same if you use a Cloud Provider. If you use ngrok or similar,
+	// they might differ.
+	// In the submission website for this exercise, you will have to provide the internet-reachable
+	// endpoint: http://<host>:<external-port>
+	// With TLS configured, it serves HTTPS instead; see tls.go.
+	e.Logger.Fatal(serve(e, cfg))
+}
+
+// Prepares the collections and the data, starts the background work, and
+// sets up the routes of the web server and the gRPC server. runServer then
+// serves it; the integration tests serve it with httptest.
+func newServer(cfg Config, client *mongo.Client, build buildInfo) *echo.Echo {
 	// You can use such name for the database and collection, or come up with
 	// one by yourself!
-	coll, err := prepareDatabase(client, "exercise-1", "information")
+	coll, err := prepareDatabase(client, databaseName, "information")
+	history, err := prepareDatabase(client, databaseName, "book_history")
+	authors, err := prepareDatabase(client, databaseName, "authors")
+	reviews, err := prepareDatabase(client, databaseName, "reviews")
+	loans, err := prepareDatabase(client, databaseName, "loans")
+	copies, err := prepareDatabase(client, databaseName, "copies")
+	orders, err := prepareDatabase(client, databaseName, "orders")
+	users, err := prepareDatabase(client, databaseName, "users")
+	webhooks, err := prepareDatabase(client, databaseName, "webhooks")
+	importJobs, err := prepareDatabase(client, databaseName, "import_jobs")
+	idempotencyKeys, err := prepareDatabase(client, databaseName, "idempotency_keys")
+
+	// Changes to how the data is stored are applied as migrations; see
+	// migrations.go. The migrate command applies them without starting
+	// the server.
+	db := client.Database(databaseName)
+	if cfg.MigrateOnStart {
+		if _, err := migrate(context.Background(), db); err != nil {
+			log.Fatal(err)
+		}
+	} else if pending, err := pendingMigrations(context.Background(), db); err != nil {
+		log.Fatal(err)
+	} else if len(pending) > 0 {
+		log.Printf("%d migrations are pending; apply them with the migrate command", len(pending))
+	}
 
-	prepareData(client, coll)
+	if cfg.SeedOnStart {
+		seeds, err := loadSeeds(cfg.SeedFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		prepareData(context.TODO(), coll, seeds)
+	}
+	if err := backfillAuthors(context.TODO(), coll, authors); err != nil {
+		log.Fatal(err)
+	}
+	if cfg.SearchNGramMin < 1 || cfg.SearchNGramMax < cfg.SearchNGramMin {
+		log.Fatalf("SEARCH_NGRAM_MIN must be at least 1 and at most SEARCH_NGRAM_MAX")
+	}
+	ngramRange.Min, ngramRange.Max = cfg.SearchNGramMin, cfg.SearchNGramMax
+	if err := prepareSearchKeys(context.TODO(), coll); err != nil {
+		log.Fatal(err)
+	}
+
+	// Templates and CSS are built into the binary. In development mode they
+	// are read from views/ and css/ in the working directory instead, and
+	// the templates are parsed again on every request, so edits show up
+	// without restarting the server.
+	var assets fs.FS = exercises.Assets
+	if cfg.Dev {
+		assets = os.DirFS(".")
+	}
+	renderer := loadTemplates(assets, cfg.Dev)
+	// Emails are rendered like the pages; see notify.go.
+	notify, err := newNotifications(cfg, renderer)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Maintenance runs in the background; a retention of 0 disables the
+	// matching task.
+	stats := newStatsCache(coll)
+	tasks := newScheduler()
+	if cfg.TrashRetention > 0 {
+		tasks.Register("purge-trash", cfg.TrashSweepInterval, purgeTrashTask(coll, cfg.TrashRetention))
+	}
+	if cfg.HistoryRetention > 0 {
+		tasks.Register("compact-history", cfg.HistoryCompactInterval, compactHistoryTask(history, cfg.HistoryRetention))
+	}
+	tasks.Register("refresh-stats", cfg.StatsRefreshInterval, stats.refresh)
+	tasks.Register("purge-idempotency-keys", time.Hour, purgeIdempotencyKeysTask(idempotencyKeys, cfg.IdempotencyKeyTTL))
+	if notify.Wants(notifyLoanDue) {
+		tasks.Register("remind-loans", cfg.LoanReminderInterval, remindLoansTask(coll, loans, notify, cfg.LoanReminderBefore))
+	}
+	tasks.Start(context.Background())
+
+	// REST, GraphQL, and gRPC read and write books through the same
+	// repository. Changes are announced to watchers from a change stream,
+	// or, where Mongo offers none, by the repository itself.
+	events := newBookEvents()
+	// Calls fail fast while Mongo is down, and are tried again on
+	// transient errors; see breaker.go and retry.go.
+	breaker := newCircuitBreaker(cfg.BreakerThreshold, cfg.BreakerCooldown)
+	retries := retryPolicy{attempts: cfg.RetryAttempts, backoff: cfg.RetryBackoff, writes: cfg.RetryWrites}
+	var books bookRepository = breakerBooks{retryingBooks{newMongoBooks(coll, history, authors), retries}, breaker}
+	// The batch endpoints, imports, merges, reverts, and restores write to
+	// the collection themselves and announce their changes with direct.
+	var direct directEvents
+	if !watchBookChanges(context.Background(), coll, events) {
+		books = publishingBooks{books, events}
+		direct = directEvents{events}
+	}
+	// Books are mirrored into Elasticsearch when it is configured; see
+	// elastic.go. GET /api/books/search runs on the backend chosen by
+	// SEARCH_BACKEND; see search.go.
+	var es *elasticIndex
+	if cfg.ElasticsearchURL != "" {
+		es = newElasticIndex(cfg.ElasticsearchURL, cfg.ElasticsearchIndex, coll)
+		if err := es.prepare(context.TODO()); err != nil {
+			log.Printf("Error creating the Elasticsearch index: %v", err)
+		}
+		es.Follow(context.Background(), events)
+	}
+	searcher, err := newBookSearcher(context.TODO(), cfg, coll, es)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Tenants keep their books in collections of their own, and their
+	// changes are not announced to the watchers of the default library;
+	// see tenants.go.
+	tenants, err := newTenancy(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Prices can be shown in other currencies; see price.go.
+	rates, err := newFixedRates(cfg.ExchangeBase, cfg.ExchangeRates)
+	if err != nil {
+		log.Fatal(err)
+	}
+	books = newTenantBooks(books, func(tenant string) bookRepository {
+		coll, history, authors := tenantCollections(db, tenant)
+		return breakerBooks{retryingBooks{newMongoBooks(coll, history, authors), retries}, breaker}
+	})
+	modes := newServiceModes(cfg)
+	books = guardedBooks{books, modes}
+	cache := newResponseCache(cfg)
+	cache.PurgeOnEvents(context.Background(), events)
+	startWebhooks(context.Background(), webhooks, events)
+	notify.Follow(context.Background(), events)
+	imports := startImportRunner(context.Background(), coll, authors, importJobs, cfg.ImportWorkers, notify, direct)
 
 	// Here we prepare the server
 	e := echo.New()
 
+	access := newAccessControl(cfg.JWTSecret)
+
 	// Define our custom renderer
-	e.Renderer = loadTemplates()
+	e.Renderer = renderer
 
-	// Log the requests. Please have a look at echo's documentation on more
-	// middleware
-	e.Use(middleware.Logger())
+	// And our validator, used by c.Validate in the handlers
+	e.Validator = bookValidator{}
 
-	e.Static("/css", "css")
+	if cfg.OTLPEndpoint != "" {
+		e.Use(tracing())
+	}
+	// Log the requests, each with an ID that is also sent back in the
+	// X-Request-Id header. Please have a look at echo's documentation on
+	// more middleware
+	accessLogOutput, err := openAccessLog(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	accessLogger, err := newAccessLogger(cfg, accessLogOutput)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := setJSONFieldNaming(cfg.JSONFieldNaming); err != nil {
+		log.Fatal(err)
+	}
+	e.Use(accessLog(accessLogger))
+	e.Use(middleware.RequestID())
+	e.Use(bodyLimit(cfg))
+	// Panics and failed requests go to Sentry when it is configured; see
+	// errortracking.go.
+	if cfg.SentryDSN != "" {
+		e.Use(errorTracking())
+	}
+	e.Use(newSessionStore(cfg.SessionSecret).Middleware())
+	e.Use(csrfProtection())
+	e.Use(modes.Middleware())
+	e.Use(cache.PurgeOnWrites())
+	e.Use(apiCORS(cfg))
+	e.Use(compression(cfg))
+	e.Use(requestTimeout(cfg))
+
+	e.StaticFS("/css", echo.MustSubFS(assets, "css"))
+
+	// Counters like the cache hits, and Go's memory statistics, as JSON.
+	e.GET("/metrics", echo.WrapHandler(expvar.Handler()))
+	e.GET("/readyz", readiness(client, breaker))
+	if cfg.Pprof {
+		registerPprof(e, access)
+	}
 
 	// Endpoint definition. Here, we divided into two groups: top-level routes
 	// starting with /, which usually serve webpages. For our RESTful endpoints,
 	// we prefix the route with /api to indicate more information or resources
 	// are available under such route.
 	e.GET("/", func(c echo.Context) error {
-		return c.Render(200, "index", nil)
+		return c.Render(200, "index", map[string]interface{}{
+			"Flashes": takeFlashes(c),
+			"Session": currentSession(c),
+			"Logins":  access.enabled(),
+			"CSRF":    csrfToken(c),
+		})
 	})
 
-	e.GET("/books", func(c echo.Context) error {
-		books := findAllBooks(coll)
-		print(books)
+	e.GET("/books", booksPage(books, rates))
+
+	e.GET("/recent", func(c echo.Context) error {
+		books := findRecentBooks(c.Request().Context(), coll, 10)
 		return c.Render(200, "book-table", books)
 	})
 
 	e.GET("/authors", func(c echo.Context) error {
-		authors := findAllAuthors(coll)
+		authors := findAllAuthors(c.Request().Context(), coll)
 		return c.Render(200, "author-table", authors)
 	})
 
 	e.GET("/years", func(c echo.Context) error {
-		years := findAllYears(coll)
+		years := findAllYears(c.Request().Context(), coll)
 		return c.Render(200, "year-table", years)
 	})
 
+	e.GET("/series", func(c echo.Context) error {
+		series, err := findSeries(c.Request().Context(), coll, bson.M{})
+		if err != nil {
+			log.Printf("Error listing series: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		return c.Render(200, "series-table", series)
+	})
+
+	e.GET("/series/:name", seriesPage(coll))
+
+	registerOPDS(e, coll, authors)
+	e.GET("/feed.xml", recentBooksFeed(coll, cfg.FeedSize))
+
+	e.GET("/users/:username/lists", readingListsPage(coll, users, access), access.SessionUser())
+	e.GET("/ws", liveBooks(events))
+
+	e.GET("/stats", func(c echo.Context) error {
+		figures, err := stats.get(c.Request().Context())
+		if err != nil {
+			log.Printf("Error computing statistics: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		return c.Render(200, "stats-dashboard", figures)
+	})
+
 	e.GET("/search", func(c echo.Context) error {
 		return c.Render(200, "search-bar", nil)
 	})
+	e.GET("/suggest", suggestionDropdown(coll))
 
-	e.GET("/create", func(c echo.Context) error {
-		return c.NoContent(http.StatusNoContent)
-	})
+	// The web pages log in to a session instead of sending tokens.
+	e.GET("/login", loginPage)
+	e.POST("/login", webLogin(users, access, cfg.TokenTTL))
+	e.POST("/logout", webLogout)
+
+	// Creating a book needs the editor role, like POST /api/books.
+	e.GET("/create", createBookPage)
+	e.POST("/books", createBookForm(books), tenants.DefaultOnly(), access.SessionUser(), access.Require(RoleEditor))
+
+	// The rows of the book table can be edited and deleted in place.
+	e.GET("/books/:id", bookPage(books, reviews))
+	e.GET("/books/:id/similar", similarBooksFragment(coll))
+	e.GET("/books/:id/row", bookRow(books))
+	e.GET("/books/:id/edit", editBookRow(books))
+	e.PUT("/books/:id", updateBookRow(books), tenants.DefaultOnly(), access.SessionUser(), access.Require(RoleEditor))
+	e.DELETE("/books/:id", deleteBookRow(books), tenants.DefaultOnly(), access.SessionUser(), access.Require(RoleAdmin))
 
 	// You will have to expand on the allowed methods for the path
 	// `/api/route`, following the common standard.
@@ -293,132 +719,267 @@ func main() {
 	// https://developer.mozilla.org/en-US/docs/Web/HTTP/Reference/Methods
 	// It specifies the expected returned codes for each type of request
 	// method.
-	e.GET("/api/books", func(c echo.Context) error {
-		books := findAllBooks(coll)
-		return c.JSON(http.StatusOK, books)
-	})
-	e.POST("/api/books", func(c echo.Context) error {
-		book := new(BookStore)
-		if err := c.Bind(book); err != nil {
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
-		}
-
-		// Generate a new ObjectID for MongoDB
-		book.MongoID = primitive.NewObjectID()
-
-		// We should also ensure the plain ID field is set, perhaps from the payload or generated.
-		// For now, let's assume it might come from the payload or needs a generation strategy.
-		// If ID is meant to be unique and user-provided, ensure it's present.
-		// If it's to be generated, you'd add logic here.
-		// For simplicity, if BookStore.ID is empty, we can use the MongoID as a string.
-		if book.ID == "" {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create book"})
-		}
-		// Check if a book with the same ID already exists
-		var existingBook BookStore
-		err := coll.FindOne(context.TODO(), bson.M{"id": book.ID}).Decode(&existingBook)
-		if err == nil {
-			// A book with this ID already exists
-			return c.JSON(http.StatusConflict, map[string]string{"error": "Book with ID " + book.ID + " already exists"})
-		} else if err != mongo.ErrNoDocuments {
-			// Some other error occurred during the find operation
-			log.Printf("Error checking for existing book: %v", err)
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create book due to a database error"})
+	// All RESTful endpoints live in the /api group. When a JWT secret is
+	// configured, every request must carry a token, and the role inside it
+	// decides what the caller may do: readers only GET, editors also POST
+	// and PUT, and admins can DELETE as well. Before that, each client IP is
+	// rate limited so a single caller cannot starve everybody else.
+	library := openlibrary.New(cfg.LookupTimeout, cfg.LookupCacheTTL)
+	limit := rateLimiter(cfg)
+	// Tenants may only reach the routes of registerBookRoutes, which fill
+	// open below.
+	open := map[string]bool{}
+	api := e.Group("/api", limit, requireJSON(), access.Authenticate(), tenants.Resolve(open))
+
+	// Registering and logging in obviously work without a token.
+	accounts := e.Group("/api", limit, requireJSON())
+	accounts.POST("/users", registerUser(users))
+	accounts.POST("/login", loginUser(users, access, cfg.TokenTTL))
+	// So is checking which build is deployed.
+	accounts.GET("/version", getVersion(build))
+	api.PUT("/users/:username/role", setUserRole(users), access.Require(RoleAdmin))
+
+	// Webhooks are called on every book change; only admins manage them.
+	hooks := webhookResource(webhooks)
+	api.GET("/webhooks", hooks.List(), access.Require(RoleAdmin))
+	api.POST("/webhooks", hooks.Create(), access.Require(RoleAdmin), validateBody(webhookSchema))
+	api.DELETE("/webhooks/:id", hooks.Delete(), access.Require(RoleAdmin))
+
+	// Read-only and maintenance mode.
+	api.GET("/admin/mode", getServiceMode(modes), access.Require(RoleAdmin))
+	api.PUT("/admin/mode", setServiceMode(modes), access.Require(RoleAdmin))
+
+	// Maintenance tasks and how their last runs went.
+	api.GET("/admin/tasks", listTasks(tasks), access.Require(RoleAdmin))
+	api.POST("/admin/tasks/:name/run", runTask(tasks), access.Require(RoleAdmin))
+	api.POST("/admin/search/reindex", reindexSearch(es), access.Require(RoleAdmin))
+	api.GET("/admin/dbstats", getDBStats(coll), access.Require(RoleAdmin))
+	api.GET("/admin/indexes", listIndexes(coll), access.Require(RoleAdmin))
+	api.POST("/admin/indexes", createIndex(coll), access.Require(RoleAdmin))
+	api.DELETE("/admin/indexes/:name", dropIndex(coll), access.Require(RoleAdmin))
+
+	// The reading lists of the logged in user.
+	api.GET("/me/lists", myLists(users))
+	api.POST("/me/lists", createList(users))
+	api.GET("/me/lists/:name", myList(coll, users))
+	api.DELETE("/me/lists/:name", deleteList(users))
+	api.POST("/me/lists/:name/books", addToList(coll, users))
+	api.DELETE("/me/lists/:name/books/:book", removeFromList(users))
+
+	// GraphQL offers the same books through a single endpoint; the
+	// resolvers check the roles of mutations themselves.
+	schema, err := newGraphQLSchema(books, coll, authors)
+	if err != nil {
+		log.Fatal(err)
+	}
+	e.Match([]string{http.MethodGet, http.MethodPost}, "/graphql", graphqlHandler(schema, access),
+		limit, access.Authenticate(), tenants.DefaultOnly(), access.Require(RoleReader))
+
+	api.GET("/suggest", suggestBooks(coll), access.Require(RoleReader))
+	api.GET("/years", func(c echo.Context) error {
+		years := findAllYears(c.Request().Context(), coll)
+		if years == nil {
+			years = []map[string]interface{}{}
 		}
-
-		insertResult, err := coll.InsertOne(context.TODO(), book)
-		if err != nil {
-			log.Printf("Error inserting book: %v", err)
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create book"})
+		return c.JSON(http.StatusOK, years)
+	}, access.Require(RoleReader), cache.Middleware())
+	api.GET("/stats", getStats(stats), access.Require(RoleReader))
+	api.GET("/series", listSeries(coll), access.Require(RoleReader))
+	api.GET("/tags", listTags(coll), access.Require(RoleReader))
+	api.POST("/books/:id/tags", addTags(books), access.Require(RoleEditor))
+	api.DELETE("/books/:id/tags", removeTags(books), access.Require(RoleEditor))
+	api.GET("/books/:id/reviews", listReviews(reviews), access.Require(RoleReader))
+	api.POST("/books/:id/reviews", createReview(coll, reviews), access.Require(RoleEditor))
+	api.DELETE("/books/:id/reviews/:review", deleteReview(coll, reviews), access.Require(RoleAdmin))
+	api.GET("/loans", listLoans(loans), access.Require(RoleReader))
+	// Copies of a book on the shelves; see copies.go.
+	api.GET("/books/:id/copies", listCopies(copies), access.Require(RoleReader))
+	api.POST("/books/:id/copies", addCopy(coll, copies), access.Require(RoleEditor), validateBody(copySchema))
+	api.PATCH("/books/:id/copies/:barcode", updateCopy(coll, copies), access.Require(RoleEditor), validateBody(copyPatchSchema))
+	api.DELETE("/books/:id/copies/:barcode", removeCopy(coll, copies), access.Require(RoleEditor))
+	api.POST("/books/:id/checkout", checkoutBook(coll, loans, cfg.LoanPeriod), access.Require(RoleEditor))
+	api.POST("/books/:id/return", returnBook(coll, loans), access.Require(RoleEditor))
+	api.GET("/books/:id/cover", getCover(coll), access.Require(RoleReader))
+	api.POST("/books/:id/cover", uploadCover(coll), access.Require(RoleEditor))
+	api.DELETE("/books/:id/cover", deleteCover(coll), access.Require(RoleEditor))
+	api.GET("/books/:id/citation", bookCitation(coll), access.Require(RoleReader))
+	api.GET("/books/:id/similar", similarBooks(coll), access.Require(RoleReader))
+	api.GET("/books/events", bookEventStream(events), access.Require(RoleReader))
+	api.GET("/books/export", exportBooks(coll), access.Require(RoleReader))
+	api.GET("/books/stream", streamBooks(coll), access.Require(RoleReader))
+	api.GET("/books/search", searchBooks(searcher), access.Require(RoleReader))
+	api.GET("/books/trash", listTrash(coll), access.Require(RoleAdmin))
+	api.GET("/books/duplicates", listDuplicates(coll), access.Require(RoleEditor))
+	api.POST("/books/merge", mergeBooks(coll, history, reviews, loans, copies, users, direct), access.Require(RoleAdmin))
+	api.POST("/books/:id/restore", restoreBook(coll, direct), access.Require(RoleAdmin))
+	api.GET("/books/:id/history", listHistory(history), access.Require(RoleReader))
+	api.POST("/books/:id/revert/:version", revertBook(coll, history, authors, direct), access.Require(RoleEditor))
+	authorAPI := authorResource(coll, authors)
+	api.GET("/authors", authorAPI.List(), access.Require(RoleReader), cache.Middleware())
+	api.GET("/authors/:id", authorAPI.Get(), access.Require(RoleReader))
+	api.GET("/authors/:id/books", listAuthorBooks(coll), access.Require(RoleReader))
+	api.POST("/authors", authorAPI.Create(), access.Require(RoleEditor), validateBody(authorSchema))
+	api.PUT("/authors/:id", authorAPI.Replace(), access.Require(RoleEditor), validateBody(authorSchema))
+	api.DELETE("/authors/:id", authorAPI.Delete(), access.Require(RoleAdmin))
+	api.POST("/books/lookup", lookupBook(library), access.Require(RoleEditor))
+	api.POST("/books/import", importBooks(coll, authors, direct), access.Require(RoleEditor))
+	api.POST("/imports", createImportJob(imports), access.Require(RoleEditor))
+	api.GET("/imports", listImportJobs(importJobs), access.Require(RoleEditor))
+	api.GET("/imports/:id", getImportJob(importJobs), access.Require(RoleEditor))
+	// A retried POST with the same Idempotency-Key gets the first answer
+	// again instead of creating another book; see idempotency.go.
+	once := idempotent(idempotencyKeys, cfg.IdempotencyKeyTTL)
+	api.POST("/books/batch", batchCreateBooks(coll, authors, direct), access.Require(RoleEditor), once)
+	api.PATCH("/books/batch", batchUpdateBooks(coll, history, authors, direct), access.Require(RoleEditor))
+	api.DELETE("/books", batchDeleteBooks(coll, direct), access.Require(RoleAdmin))
+	// The storefront: a cart kept in the session, and the orders placed
+	// from it; see cart.go and orders.go.
+	api.GET("/cart", getCart(books), access.Require(RoleReader))
+	api.POST("/cart/items", addToCart(books), access.Require(RoleReader), validateBody(cartItemSchema))
+	api.DELETE("/cart/items/:book", removeFromCart(books), access.Require(RoleReader))
+	api.GET("/orders", listOrders(orders, access), access.Require(RoleReader))
+	api.POST("/orders", placeOrder(books, orders), access.Require(RoleReader), once)
+	api.GET("/orders/:id", getOrder(orders, access), access.Require(RoleReader))
+	api.PUT("/orders/:id/status", setOrderStatus(orders), access.Require(RoleAdmin), validateBody(orderStatusSchema))
+	// PUT, PATCH, and DELETE honour If-Match for optimistic concurrency; set
+	// REQUIRE_IF_MATCH to make it, or a version in the body, mandatory.
+	ifMatch := requireIfMatch(books, cfg.RequireIfMatch)
+	for key := range routeKeys(registerBookRoutes(api, books, library, rates, access, cache, once, ifMatch)) {
+		open[key] = true
+	}
+	if tenants.from("path") {
+		tenanted := e.Group("/t/:tenant/api", limit, requireJSON(), access.Authenticate(), tenants.Resolve(open))
+		for key := range routeKeys(registerBookRoutes(tenanted, books, library, rates, access, cache, once, ifMatch)) {
+			open[key] = true
 		}
+	}
 
-		// Optionally, you can retrieve the inserted document to return it fully populated
-		// For now, we'll return the input book struct, which now includes the MongoID
-		log.Printf("Inserted a single document: %v", insertResult.InsertedID)
-		return c.JSON(http.StatusCreated, book)
-	})
-
-	e.PUT("/api/books/:id", func(c echo.Context) error {
-		idParam := c.Param("id") // This is the custom string ID, e.g., "asd34343"
+	registerOptions(e)
 
-		var requestPayload map[string]interface{}
-		if err := c.Bind(&requestPayload); err != nil {
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
-		}
+	// Internal services may use the gRPC BookService on a port of its own.
+	startGRPCServer(cfg.GRPCAddr, books, events, access)
 
-		// The document in the database will be identified by idParam.
-		filter := bson.M{"id": idParam}
+	return e
+}
 
-		// Dynamically build the $set operation based on fields present in the request.
-		updateSet := bson.M{}
+// Registers the endpoints of /api/books that only need the repository, so
+// the contract tests can run them without Mongo, and tenants can use them;
+// see tenants.go. Returns the routes registered.
+func registerBookRoutes(api *echo.Group, books bookRepository, library *openlibrary.Client, rates exchangeRates, access accessControl, cache *responseCache, once, ifMatch echo.MiddlewareFunc) []*echo.Route {
+	// HEAD answers like GET without the body, e.g. to learn X-Total-Count.
+	// OPTIONS lists the methods of each route; see registerOptions.
+	routes := api.Match([]string{http.MethodGet, http.MethodHead}, "/books", listBooks(books, rates), access.Require(RoleReader), cache.Middleware())
+	routes = append(routes, api.Match([]string{http.MethodGet, http.MethodHead}, "/books/:id", getBook(books, rates), access.Require(RoleReader))...)
+	// Bodies are checked against a JSON Schema before binding; see schema.go.
+	return append(routes,
+		api.POST("/books", createBook(books, library), access.Require(RoleEditor), validateBody(newBookSchema), once),
+		// PUT replaces the whole book, PATCH changes single fields; see
+		// update.go.
+		api.PUT("/books/:id", replaceBook(books), access.Require(RoleEditor), validateBody(bookSchema), ifMatch),
+		api.PATCH("/books/:id", patchBook(books), access.Require(RoleEditor), validateBody(bookPatchSchema), ifMatch),
+		api.DELETE("/books/:id", deleteBook(books), access.Require(RoleAdmin), ifMatch),
+	)
+}
 
-		if title, ok := requestPayload["title"].(string); ok {
-			updateSet["bookname"] = title // Use BSON field name "bookname"
+// Handles GET /api/books.
+func listBooks(books bookRepository, rates exchangeRates) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		// Optional filters, e.g. ?year_from=1800&min_pages=200&tag=horror
+		query, errs := bookFilter(c)
+		if len(errs) > 0 {
+			return validationFailed(c, errs)
 		}
-		if author, ok := requestPayload["author"].(string); ok {
-			updateSet["bookauthor"] = author // Use BSON field name "bookauthor"
+		found, err := books.List(c.Request().Context(), query)
+		if err != nil {
+			return bookFailed(c, err, "", "list")
 		}
-		if edition, ok := requestPayload["edition"].(string); ok {
-			updateSet["bookedition"] = edition // Use BSON field name "bookedition"
+		// The total counts the books before the cursor, too.
+		counted := query
+		counted.After = nil
+		total, err := books.Count(c.Request().Context(), counted)
+		if err != nil {
+			return bookFailed(c, err, "", "count")
 		}
-		if pages, ok := requestPayload["pages"].(string); ok {
-			updateSet["bookpages"] = pages // Use BSON field name "bookpages"
+		setPaginationHeaders(c, query, total)
+		setCursorHeaders(c, query, found)
+		list := bookList{}
+		var lastModified time.Time
+		for _, book := range found {
+			item := bookToMap(book)
+			if err := addDisplayPrice(c.Request().Context(), rates, item, book, query.Currency); err != nil {
+				return bookFailed(c, err, "", "convert the price of")
+			}
+			list = append(list, query.project(item))
+			if book.UpdatedAt.After(lastModified) {
+				lastModified = book.UpdatedAt
+			}
 		}
-		if year, ok := requestPayload["year"].(string); ok {
-			updateSet["bookyear"] = year // Use BSON field name "bookyear"
+		if notModifiedSince(c, lastModified) {
+			return c.NoContent(http.StatusNotModified)
 		}
+		// JSON by default, XML or CSV when the Accept header asks for it.
+		return respond(c, http.StatusOK, list)
+	}
+}
 
-		// If no valid fields to update were provided in the request body
-		if len(updateSet) == 0 {
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": "No valid fields provided for update"})
+// Handles GET /api/books/:id, with the price in the currency of
+// ?currency= if asked for.
+func getBook(books bookRepository, rates exchangeRates) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		idParam := c.Param("id")
+		to, msg := displayCurrency(c)
+		if msg != "" {
+			return validationFailed(c, validationErrors{"currency": msg})
 		}
-
-		update := bson.M{"$set": updateSet}
-
-		updateResult, err := coll.UpdateOne(context.TODO(), filter, update)
+		book, err := books.Get(c.Request().Context(), idParam)
 		if err != nil {
-			log.Printf("Error updating book with ID %s: %v", idParam, err)
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update book"})
+			return bookFailed(c, err, idParam, "fetch")
 		}
-
-		if updateResult.MatchedCount == 0 {
-			return c.JSON(http.StatusNotFound, map[string]string{"error": "Book not found with ID " + idParam})
+		if notModifiedSince(c, book.UpdatedAt) {
+			return c.NoContent(http.StatusNotModified)
 		}
+		item := bookToMap(book)
+		if err := addDisplayPrice(c.Request().Context(), rates, item, book, to); err != nil {
+			return bookFailed(c, err, idParam, "convert the price of")
+		}
+		return respond(c, http.StatusOK, item)
+	}
+}
 
-		// Fetch the updated document from the database to return it
-		var updatedBookFromDB BookStore
-		err = coll.FindOne(context.TODO(), bson.M{"id": idParam}).Decode(&updatedBookFromDB)
-		if err != nil {
-			log.Printf("Error fetching updated book with ID %s after update: %v", idParam, err)
-			// This might indicate a race condition or an unexpected state if MatchedCount was > 0.
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve updated book details"})
+// Handles POST /api/books.
+func createBook(books bookRepository, library *openlibrary.Client) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		book := new(BookStore)
+		if err := bindBook(c, book); err != nil {
+			return bindFailed(c, err)
+		}
+		// With ?enrich=true, missing fields are looked up by the ISBN.
+		if c.QueryParam("enrich") == "true" {
+			enrichBook(c.Request().Context(), library, book)
 		}
+		// The repository fills in the MongoID, timestamps, and version,
+		// and validates the book; see repository.go.
+		if err := books.Create(c.Request().Context(), book); err != nil {
+			return bookFailed(c, err, book.ID, "create")
+		}
+		log.Printf("Inserted a single document: %v", book.MongoID)
+		return c.JSON(http.StatusCreated, bookToMap(*book))
+	}
+}
 
-		return c.JSON(http.StatusOK, updatedBookFromDB)
-	})
-	e.DELETE("/api/books/:id", func(c echo.Context) error {
+// Handles DELETE /api/books/:id.
+func deleteBook(books bookRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
 		idParam := c.Param("id") // This is the custom string ID
 
-		filter := bson.M{"id": idParam}
-
-		deleteResult, err := coll.DeleteOne(context.TODO(), filter)
-		if err != nil {
-			log.Printf("Error deleting book with ID %s: %v", idParam, err)
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete book"})
+		// Deleting only moves the book to the recycle bin; see trash.go.
+		var expected *int
+		if version, ok := c.Get(expectedVersionKey).(int); ok {
+			expected = &version
 		}
-
-		if deleteResult.DeletedCount == 0 {
-			return c.JSON(http.StatusNotFound, map[string]string{"error": "Book not found with ID " + idParam})
+		if err := books.Delete(c.Request().Context(), idParam, expected); err != nil {
+			return bookFailed(c, err, idParam, "delete")
 		}
-
 		return c.NoContent(http.StatusOK)
-	})
-
-	// We start the server and bind it to port 3030. For future references, this
-	// is the application's port and not the external one. For this first exercise,
-	// they could be the same if you use a Cloud Provider. If you use ngrok or similar,
-	// they might differ.
-	// In the submission website for this exercise, you will have to provide the internet-reachable
-	// endpoint: http://<host>:<external-port>
-	e.Logger.Fatal(e.Start(":3030"))
+	}
 }
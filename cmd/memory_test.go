@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"slices"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// A bookRepository that keeps the books in memory, for the contract tests.
+// It follows the rules of mongoBooks: books are validated, versions are
+// checked and counted, and deleted books stay in a recycle bin until a new
+// book takes their ID. There are no authors, so books cannot be linked to
+// one by ID, and no history.
+type memoryBooks struct {
+	mu    sync.Mutex
+	books []BookStore
+}
+
+func newMemoryBooks() *memoryBooks {
+	return &memoryBooks{}
+}
+
+// The index of the live book with the ID, or -1.
+func (r *memoryBooks) find(id string) int {
+	return slices.IndexFunc(r.books, func(b BookStore) bool {
+		return b.ID == id && b.DeletedAt == nil
+	})
+}
+
+func (r *memoryBooks) matching(q bookQuery) []BookStore {
+	var found []BookStore
+	within := func(value int, from, to *int) bool {
+		return (from == nil || value >= *from) && (to == nil || value <= *to)
+	}
+	for _, b := range r.books {
+		switch {
+		case b.DeletedAt != nil,
+			!within(int(b.BookYear), q.YearFrom, q.YearTo),
+			!within(int(b.BookPages), q.MinPages, q.MaxPages),
+			q.AuthorID != "" && b.AuthorID != q.AuthorID,
+			q.Publisher != "" && !strings.EqualFold(b.Publisher, q.Publisher),
+			q.Language != "" && !strings.EqualFold(b.Language, q.Language) && !strings.HasPrefix(strings.ToLower(b.Language), strings.ToLower(q.Language)+"-"),
+			q.After != nil && bytes.Compare(b.MongoID[:], q.After[:]) <= 0:
+			continue
+		}
+		tagged := true
+		for _, tag := range q.Tags {
+			tagged = tagged && slices.Contains(b.Tags, tag)
+		}
+		if tagged {
+			found = append(found, b)
+		}
+	}
+	return found
+}
+
+func (r *memoryBooks) List(ctx context.Context, q bookQuery) ([]BookStore, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	found := r.matching(q)
+	field, desc := strings.CutPrefix(q.Sort, "-")
+	slices.SortStableFunc(found, func(a, b BookStore) int {
+		var order int
+		switch field {
+		case "id":
+			order = strings.Compare(a.ID, b.ID)
+		case "title":
+			order = strings.Compare(a.BookName, b.BookName)
+		case "author":
+			order = strings.Compare(a.BookAuthor, b.BookAuthor)
+		case "edition":
+			order = strings.Compare(a.BookEdition, b.BookEdition)
+		case "pages":
+			order = cmp.Compare(a.BookPages, b.BookPages)
+		case "year":
+			order = cmp.Compare(a.BookYear, b.BookYear)
+		case "created_at":
+			order = a.CreatedAt.Compare(b.CreatedAt)
+		case "updated_at":
+			order = a.UpdatedAt.Compare(b.UpdatedAt)
+		}
+		if desc {
+			return -order
+		}
+		return order
+	})
+	if q.Limit > 0 {
+		start := min(int(q.Offset), len(found))
+		found = found[start:min(start+int(q.Limit), len(found))]
+	}
+	return found, nil
+}
+
+func (r *memoryBooks) Count(ctx context.Context, q bookQuery) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return int64(len(r.matching(q))), nil
+}
+
+func (r *memoryBooks) Get(ctx context.Context, id string) (BookStore, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if i := r.find(id); i >= 0 {
+		return r.books[i], nil
+	}
+	return BookStore{}, errBookNotFound
+}
+
+func (r *memoryBooks) Create(ctx context.Context, book *BookStore) error {
+	// Like mongoBooks, the author is looked up before validating.
+	if book.AuthorID != "" {
+		return validationErrors{"author_id": "does not match an author"}
+	}
+	if errs := validateStruct(book); len(errs) > 0 {
+		return errs
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.find(book.ID) >= 0 {
+		return errBookExists
+	}
+	r.books = slices.DeleteFunc(r.books, func(b BookStore) bool { return b.ID == book.ID })
+
+	book.MongoID = primitive.NewObjectID()
+	book.BookEdition = normalizeEdition(book.BookEdition)
+	book.Language = normalizeLanguage(book.Language)
+	book.Tags = normalizeTags(book.Tags)
+	book.CreatedAt = now()
+	book.UpdatedAt = book.CreatedAt
+	book.Version = 1
+	book.Rating = nil
+	book.Copies = nil
+	book.Checkout = nil
+	book.Cover = nil
+	r.books = append(r.books, *book)
+	return nil
+}
+
+// The live book with the ID, in the expected version if one is given.
+func (r *memoryBooks) current(id string, version *int) (int, error) {
+	i := r.find(id)
+	if i < 0 {
+		return -1, errBookNotFound
+	}
+	if version != nil && r.books[i].Version != *version {
+		return -1, errStaleVersion
+	}
+	return i, nil
+}
+
+func (r *memoryBooks) Update(ctx context.Context, id string, changes bookChanges, version *int) (BookStore, error) {
+	if changes.AuthorID != nil {
+		return BookStore{}, validationErrors{"author_id": "does not match an author"}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i, err := r.current(id, version)
+	if err != nil {
+		return BookStore{}, err
+	}
+	book := &r.books[i]
+	if changes.Title != nil {
+		book.BookName = *changes.Title
+	}
+	if changes.Author != nil {
+		book.BookAuthor = *changes.Author
+	}
+	if changes.Edition != nil {
+		book.BookEdition = normalizeEdition(*changes.Edition)
+	}
+	if changes.Pages != nil {
+		book.BookPages = *changes.Pages
+	}
+	if changes.Year != nil {
+		book.BookYear = *changes.Year
+	}
+	if changes.Tags != nil {
+		book.Tags = normalizeTags(*changes.Tags)
+	}
+	if changes.Series != nil {
+		book.Series = *changes.Series
+	}
+	if changes.SeriesIndex != nil {
+		book.SeriesIndex = *changes.SeriesIndex
+	}
+	if changes.Publisher != nil {
+		book.Publisher = *changes.Publisher
+	}
+	if changes.Language != nil {
+		book.Language = normalizeLanguage(*changes.Language)
+	}
+	if changes.Description != nil {
+		book.Description = *changes.Description
+	}
+	if changes.Price != nil {
+		book.Price = nil
+		if changes.Price.Currency != "" {
+			price := *changes.Price
+			book.Price = &price
+		}
+	}
+	book.UpdatedAt = now()
+	book.Version++
+	return *book, nil
+}
+
+func (r *memoryBooks) Delete(ctx context.Context, id string, version *int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i, err := r.current(id, version)
+	if err != nil {
+		return err
+	}
+	deletedAt := now()
+	r.books[i].DeletedAt = &deletedAt
+	r.books[i].UpdatedAt = deletedAt
+	r.books[i].Version++
+	return nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Changes to how data is stored, like converting a field or adding an
+// index, are migrations: Go functions with a version number, applied in
+// order, each once. The migrations collection records which ones were
+// applied and when. They run on start, unless MIGRATE_ON_START=false, or
+// with `go run ./cmd migrate`, which applies the pending ones and exits.
+// `go run ./cmd migrate status` only lists them.
+//
+// To change the data, append a migration with the next version to
+// migrations; never change or reorder one that may have been applied.
+
+const migrationsCollection = "migrations"
+
+type migration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context, db *mongo.Database) error
+}
+
+var migrations = []migration{
+	{Version: 1, Name: "store pages and years as numbers", Up: func(ctx context.Context, db *mongo.Database) error {
+		return migrateNumericFields(ctx, db.Collection("information"), db.Collection("book_history"))
+	}},
+	{Version: 2, Name: "index book IDs", Up: func(ctx context.Context, db *mongo.Database) error {
+		if _, err := db.Collection("information").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "id", Value: 1}}}); err != nil {
+			return err
+		}
+		for _, name := range []string{"book_history", "reviews", "loans"} {
+			if _, err := db.Collection(name).Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "bookid", Value: 1}}}); err != nil {
+				return fmt.Errorf("indexing %s: %w", name, err)
+			}
+		}
+		return nil
+	}},
+	{Version: 3, Name: "make book IDs unique", Up: func(ctx context.Context, db *mongo.Database) error {
+		// An index cannot be made unique in place. When this fails on
+		// books sharing an ID, the old index is gone already and the
+		// next run only has to create the new one.
+		coll := db.Collection("information")
+		if _, err := coll.Indexes().DropOne(ctx, "id_1"); err != nil && !isIndexNotFound(err) {
+			return err
+		}
+		_, err := coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.D{{Key: "id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		})
+		if mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("several books share an ID; give them IDs of their own and migrate again: %w", err)
+		}
+		return err
+	}},
+	{Version: 4, Name: "index copies", Up: func(ctx context.Context, db *mongo.Database) error {
+		_, err := db.Collection("copies").Indexes().CreateMany(ctx, []mongo.IndexModel{
+			{Keys: bson.D{{Key: "barcode", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "bookid", Value: 1}}},
+		})
+		return err
+	}},
+	{Version: 5, Name: "index orders", Up: func(ctx context.Context, db *mongo.Database) error {
+		_, err := db.Collection("orders").Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys: bson.D{{Key: "customer", Value: 1}, {Key: "createdat", Value: -1}},
+		})
+		return err
+	}},
+	{Version: 6, Name: "make usernames unique", Up: func(ctx context.Context, db *mongo.Database) error {
+		_, err := db.Collection("users").Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.D{{Key: "username", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		})
+		if mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("several users share a username; rename them and migrate again: %w", err)
+		}
+		return err
+	}},
+}
+
+// Whether err says that the index to drop does not exist.
+func isIndexNotFound(err error) bool {
+	var cmdErr mongo.CommandError
+	return errors.As(err, &cmdErr) && (cmdErr.Code == 27 || cmdErr.Code == 26) // IndexNotFound, NamespaceNotFound
+}
+
+// A migration as recorded in the migrations collection.
+type appliedMigration struct {
+	Version   int       `bson:"_id"`
+	Name      string    `bson:"name"`
+	AppliedAt time.Time `bson:"appliedat"`
+	Millis    int64     `bson:"millis"`
+}
+
+// The lock keeping two servers starting at once from applying the same
+// migration twice. A lock older than this was left behind by a server that
+// died while migrating.
+const (
+	migrationLockID      = "lock"
+	migrationLockTimeout = 10 * time.Minute
+)
+
+var errMigrationLocked = errors.New("another server is applying migrations")
+
+// Lists the migrations recorded as applied, by version.
+func appliedMigrations(ctx context.Context, db *mongo.Database) (map[int]appliedMigration, error) {
+	cursor, err := db.Collection(migrationsCollection).Find(ctx, bson.M{"_id": bson.M{"$type": "number"}})
+	if err != nil {
+		return nil, err
+	}
+	var found []appliedMigration
+	if err := cursor.All(ctx, &found); err != nil {
+		return nil, err
+	}
+	applied := map[int]appliedMigration{}
+	for _, m := range found {
+		applied[m.Version] = m
+	}
+	return applied, nil
+}
+
+// The migrations not applied yet, in order.
+func pendingMigrations(ctx context.Context, db *mongo.Database) ([]migration, error) {
+	applied, err := appliedMigrations(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	var pending []migration
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; !ok {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// Applies the pending migrations in order, and returns how many. It stops
+// at the first one that fails, which is applied again on the next run.
+func migrate(ctx context.Context, db *mongo.Database) (int, error) {
+	if err := lockMigrations(ctx, db); err != nil {
+		return 0, err
+	}
+	defer unlockMigrations(db)
+
+	pending, err := pendingMigrations(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+	for i, m := range pending {
+		log.Printf("Applying migration %d: %s", m.Version, m.Name)
+		start := time.Now()
+		if err := m.Up(ctx, db); err != nil {
+			return i, fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+		record := appliedMigration{Version: m.Version, Name: m.Name, AppliedAt: now(), Millis: time.Since(start).Milliseconds()}
+		if _, err := db.Collection(migrationsCollection).InsertOne(ctx, record); err != nil {
+			return i, fmt.Errorf("recording migration %d: %w", m.Version, err)
+		}
+	}
+	return len(pending), nil
+}
+
+// Takes the migration lock, waiting up to a minute for another server to
+// finish.
+func lockMigrations(ctx context.Context, db *mongo.Database) error {
+	coll := db.Collection(migrationsCollection)
+	deadline := time.Now().Add(time.Minute)
+	for {
+		stale := now().Add(-migrationLockTimeout)
+		_, err := coll.UpdateOne(ctx,
+			bson.M{"_id": migrationLockID, "lockedat": bson.M{"$lt": stale}},
+			bson.M{"$set": bson.M{"lockedat": now()}},
+			options.Update().SetUpsert(true))
+		if err == nil {
+			return nil
+		}
+		// The lock is held: the upsert collided with the fresh lock.
+		if !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return errMigrationLocked
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func unlockMigrations(db *mongo.Database) {
+	if _, err := db.Collection(migrationsCollection).DeleteOne(context.Background(), bson.M{"_id": migrationLockID}); err != nil {
+		log.Printf("Error releasing the migration lock: %v", err)
+	}
+}
+
+// Prints every migration and whether it was applied, for `migrate status`.
+func printMigrationStatus(ctx context.Context, db *mongo.Database) error {
+	applied, err := appliedMigrations(ctx, db)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		status := "pending"
+		if a, ok := applied[m.Version]; ok {
+			status = "applied " + a.AppliedAt.UTC().Format(time.RFC3339)
+		}
+		fmt.Printf("%4d  %-28s  %s\n", m.Version, status, m.Name)
+	}
+	return nil
+}
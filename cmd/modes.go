@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The service can be switched into two special modes while it runs, e.g.
+// during a migration. In read-only mode, every request that would change
+// something is refused with 503 and a Retry-After header. Maintenance mode
+// is read-only as well, and the web pages show a maintenance notice
+// instead of their content; the API keeps answering reads.
+type serviceModes struct {
+	readOnly    atomic.Bool
+	maintenance atomic.Bool
+	retryAfter  time.Duration
+}
+
+func newServiceModes(cfg Config) *serviceModes {
+	m := &serviceModes{retryAfter: cfg.ModeRetryAfter}
+	m.readOnly.Store(cfg.ReadOnly)
+	m.maintenance.Store(cfg.Maintenance)
+	return m
+}
+
+// Requests that still go through in read-only mode although they are no
+// reads: switching the modes back, and logging in.
+var modeExempt = map[string]bool{
+	"/api/admin/mode": true,
+	"/api/login":      true,
+	"/login":          true,
+	"/logout":         true,
+}
+
+// Whether a path, or the path of a route, belongs to the API: /api and
+// /graphql, and /t/<tenant>/api of the libraries of tenants.go. The API
+// authenticates with bearer tokens instead of the session of the web pages.
+func isAPIPath(path string) bool {
+	if rest, ok := strings.CutPrefix(path, "/t/"); ok {
+		_, rest, _ = strings.Cut(rest, "/")
+		return rest == "api" || strings.HasPrefix(rest, "api/")
+	}
+	return path == "/api" || strings.HasPrefix(path, "/api/") || path == "/graphql"
+}
+
+// Refuses what the current mode does not allow.
+func (m *serviceModes) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			path := c.Request().URL.Path
+			retry := strconv.Itoa(int(m.retryAfter.Seconds()))
+
+			if m.maintenance.Load() && !isAPIPath(path) && !strings.HasPrefix(path, "/css/") && path != "/metrics" {
+				c.Response().Header().Set(echo.HeaderRetryAfter, retry)
+				return c.Render(http.StatusServiceUnavailable, "maintenance", nil)
+			}
+			switch c.Request().Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				return next(c)
+			}
+			// GraphQL queries are POSTed as well. Its mutations, like gRPC,
+			// are refused by the repository instead; see guardedBooks.
+			if !m.Writable() && !modeExempt[path] && path != "/graphql" {
+				c.Response().Header().Set(echo.HeaderRetryAfter, retry)
+				return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "The service is read-only at the moment, try again later"})
+			}
+			return next(c)
+		}
+	}
+}
+
+// Whether writes are refused at the moment.
+func (m *serviceModes) Writable() bool {
+	return !m.readOnly.Load() && !m.maintenance.Load()
+}
+
+var errReadOnly = errors.New("the service is read-only")
+
+// Wraps a repository so it refuses writes while the service is read-only.
+// This covers GraphQL and gRPC, which the HTTP middleware cannot tell
+// apart from reads.
+type guardedBooks struct {
+	bookRepository
+	modes *serviceModes
+}
+
+func (g guardedBooks) Create(ctx context.Context, book *BookStore) error {
+	if !g.modes.Writable() {
+		return errReadOnly
+	}
+	return g.bookRepository.Create(ctx, book)
+}
+
+func (g guardedBooks) Update(ctx context.Context, id string, changes bookChanges, version *int) (BookStore, error) {
+	if !g.modes.Writable() {
+		return BookStore{}, errReadOnly
+	}
+	return g.bookRepository.Update(ctx, id, changes, version)
+}
+
+func (g guardedBooks) Delete(ctx context.Context, id string, version *int) error {
+	if !g.modes.Writable() {
+		return errReadOnly
+	}
+	return g.bookRepository.Delete(ctx, id, version)
+}
+
+type modeSettings struct {
+	ReadOnly    *bool `json:"read_only"`
+	Maintenance *bool `json:"maintenance"`
+}
+
+// Handles GET /api/admin/mode.
+func getServiceMode(m *serviceModes) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, map[string]bool{
+			"read_only":   m.readOnly.Load(),
+			"maintenance": m.maintenance.Load(),
+		})
+	}
+}
+
+// Handles PUT /api/admin/mode with a body like {"read_only": true}. Modes
+// left out of the body stay as they are.
+func setServiceMode(m *serviceModes) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var settings modeSettings
+		if err := c.Bind(&settings); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+		}
+		if settings.ReadOnly != nil {
+			m.readOnly.Store(*settings.ReadOnly)
+		}
+		if settings.Maintenance != nil {
+			m.maintenance.Store(*settings.Maintenance)
+		}
+		return getServiceMode(m)(c)
+	}
+}
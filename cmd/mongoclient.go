@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// The client is set up from MONGODB_URI and the MONGODB_* variables, which
+// cover what replica sets and Atlas clusters need: pool sizes, timeouts,
+// where reads go, and how many nodes acknowledge a write. Options written
+// into the URI itself, like "?maxPoolSize=50", take precedence over them.
+
+// Builds the options of the Mongo client from the configuration.
+func mongoClientOptions(cfg Config) (*options.ClientOptions, error) {
+	opts := options.Client().
+		SetAppName(cfg.ServiceName).
+		SetMaxPoolSize(uint64(cfg.MongoMaxPoolSize)).
+		SetMinPoolSize(uint64(cfg.MongoMinPoolSize)).
+		SetMaxConnIdleTime(cfg.MongoMaxConnIdleTime).
+		SetConnectTimeout(cfg.MongoConnectTimeout).
+		SetServerSelectionTimeout(cfg.MongoServerSelectionTimeout)
+	if cfg.MongoSocketTimeout > 0 {
+		opts.SetSocketTimeout(cfg.MongoSocketTimeout)
+	}
+	if cfg.MongoReplicaSet != "" {
+		opts.SetReplicaSet(cfg.MongoReplicaSet)
+	}
+
+	mode, err := readpref.ModeFromString(cfg.MongoReadPreference)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MONGODB_READ_PREFERENCE: %w", err)
+	}
+	pref, err := readpref.New(mode)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MONGODB_READ_PREFERENCE: %w", err)
+	}
+	opts.SetReadPreference(pref)
+
+	if cfg.MongoWriteConcern != "" {
+		opts.SetWriteConcern(parseWriteConcern(cfg.MongoWriteConcern))
+	}
+
+	opts.ApplyURI(cfg.MongoURI)
+	if err := opts.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid MongoDB options: %w", err)
+	}
+	return opts, nil
+}
+
+// Reads a write concern like "majority", "1", or the name of a tag set.
+func parseWriteConcern(raw string) *writeconcern.WriteConcern {
+	if raw == "majority" {
+		return writeconcern.Majority()
+	}
+	if n, err := strconv.Atoi(raw); err == nil {
+		return &writeconcern.WriteConcern{W: n}
+	}
+	return writeconcern.Custom(raw)
+}
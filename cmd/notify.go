@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// With SMTP_ADDR set, the server sends emails when
+//
+//   - book-created: books were added to the catalog, to NOTIFY_EMAILS. The
+//     books added within a minute share one email, so an import of
+//     thousands of rows does not send thousands of them.
+//   - loan-due: a loan is due within LOAN_REMINDER_BEFORE, to the borrower
+//     if the borrower is an email address, to NOTIFY_EMAILS otherwise. Each
+//     loan gets one reminder.
+//   - import-finished: an import job is done or failed, to NOTIFY_EMAILS.
+//
+// NOTIFY_EVENTS picks which of them are sent. The bodies are the email-*
+// blocks of views/emails.html, rendered like the pages; the subjects are
+// short summaries.
+
+const (
+	notifyBookCreated    = "book-created"
+	notifyLoanDue        = "loan-due"
+	notifyImportFinished = "import-finished"
+)
+
+var notifyEvents = []string{notifyBookCreated, notifyLoanDue, notifyImportFinished}
+
+// Sends an email with an HTML body.
+type notifier interface {
+	Notify(ctx context.Context, to []string, subject, body string) error
+}
+
+type smtpNotifier struct {
+	addr string
+	from *mail.Address
+	auth smtp.Auth
+}
+
+// Sending an email takes at most this long, so a mail server that hangs
+// does not hold up the imports and tasks waiting for it.
+const smtpTimeout = 30 * time.Second
+
+func (n smtpNotifier) Notify(ctx context.Context, to []string, subject, body string) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	// Encoded words also keep line breaks in titles out of the headers.
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/html; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n"))
+	return n.send(ctx, to, msg.Bytes())
+}
+
+// Does what smtp.SendMail does, within smtpTimeout and until ctx ends.
+func (n smtpNotifier) send(ctx context.Context, to []string, msg []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, smtpTimeout)
+	defer cancel()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", n.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	// The deadline covers the time; this covers ctx ending before it.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	host, _, _ := net.SplitHostPort(n.addr)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if n.auth != nil {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			return errors.New("the SMTP server does not support AUTH")
+		}
+		if err := client.Auth(n.auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(n.from.Address); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := client.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+type notifications struct {
+	// Nil when SMTP is not configured.
+	sender   notifier
+	renderer echo.Renderer
+	events   []string
+	// The addresses of NOTIFY_EMAILS.
+	staff []string
+}
+
+func newNotifications(cfg Config, renderer echo.Renderer) (*notifications, error) {
+	n := &notifications{renderer: renderer}
+	if cfg.SMTPAddr == "" {
+		return n, nil
+	}
+	for _, event := range cfg.NotifyEvents {
+		if !slices.Contains(notifyEvents, event) {
+			return nil, fmt.Errorf("invalid NOTIFY_EVENTS %q, want book-created, loan-due, or import-finished", event)
+		}
+	}
+	from, err := mail.ParseAddress(cfg.SMTPFrom)
+	if err != nil {
+		return nil, fmt.Errorf("SMTP_ADDR needs SMTP_FROM, an email address: %w", err)
+	}
+	for _, raw := range cfg.NotifyEmails {
+		addr, err := mail.ParseAddress(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q in NOTIFY_EMAILS: %w", raw, err)
+		}
+		n.staff = append(n.staff, addr.Address)
+	}
+	if len(n.staff) == 0 {
+		log.Printf("NOTIFY_EMAILS is not set; only borrowers with email addresses get emails")
+	}
+
+	sender := smtpNotifier{addr: cfg.SMTPAddr, from: from}
+	if cfg.SMTPUsername != "" {
+		host, _, err := net.SplitHostPort(cfg.SMTPAddr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SMTP_ADDR %q, want host:port: %w", cfg.SMTPAddr, err)
+		}
+		sender.auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, host)
+	}
+	n.sender = sender
+	n.events = cfg.NotifyEvents
+	return n, nil
+}
+
+// Whether emails about the event are sent.
+func (n *notifications) Wants(event string) bool {
+	return n.sender != nil && slices.Contains(n.events, event)
+}
+
+// Renders the email-<event> block with data and sends it.
+func (n *notifications) send(ctx context.Context, event string, to []string, subject string, data interface{}) error {
+	if len(to) == 0 {
+		return nil
+	}
+	var body bytes.Buffer
+	if err := n.renderer.Render(&body, "email-"+event, data, nil); err != nil {
+		return err
+	}
+	return n.sender.Notify(ctx, to, subject, body.String())
+}
+
+// How long added books are gathered before an email about them goes out.
+const newBooksDelay = time.Minute
+
+// Emails list this many books or failed rows at most.
+const emailListLimit = 50
+
+// The data of the email-book-created block.
+type newBooksEmail struct {
+	Books []bookItem
+	// The number of books added but not listed.
+	More int
+}
+
+func (e newBooksEmail) Total() int {
+	return len(e.Books) + e.More
+}
+
+// Mails the books added to the catalog until ctx is done.
+func (n *notifications) Follow(ctx context.Context, events *bookEvents) {
+	if !n.Wants(notifyBookCreated) {
+		return
+	}
+	changes, stop := events.Subscribe()
+	go func() {
+		defer stop()
+		ticker := time.NewTicker(newBooksDelay)
+		defer ticker.Stop()
+		n.mailNewBooks(ctx, changes, ticker.C)
+	}()
+}
+
+// Gathers the books created on changes and mails them on every tick.
+func (n *notifications) mailNewBooks(ctx context.Context, changes <-chan bookEvent, tick <-chan time.Time) {
+	var added newBooksEmail
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-changes:
+			switch {
+			case event.Type != bookCreated:
+			case len(added.Books) < emailListLimit:
+				added.Books = append(added.Books, bookToMap(event.Book))
+			default:
+				added.More++
+			}
+		case <-tick:
+			if len(added.Books) == 0 {
+				continue
+			}
+			subject := fmt.Sprintf("%d new books", added.Total())
+			if added.Total() == 1 {
+				subject = fmt.Sprintf("New book: %s", added.Books[0]["title"])
+			}
+			// Sending must not hold up the events.
+			go func(added newBooksEmail) {
+				if err := n.send(ctx, notifyBookCreated, n.staff, subject, added); err != nil {
+					log.Printf("Error sending the email about new books: %v", err)
+				}
+			}(added)
+			added = newBooksEmail{}
+		}
+	}
+}
+
+// The data of the email-loan-due block.
+type loanDueEmail struct {
+	Loan Loan
+	Book bookItem
+}
+
+// Reminds borrowers of the loans due within before, once per loan. A
+// reminder that cannot be sent, e.g. to an address the mail server does
+// not know, is logged and tried again on the next run; it does not keep
+// the other loans from being reminded.
+func remindLoansTask(coll, loans *mongo.Collection, n *notifications, before time.Duration) taskFunc {
+	return func(ctx context.Context) (string, error) {
+		filter := bson.M{
+			"returnedat": bson.M{"$exists": false},
+			"remindedat": bson.M{"$exists": false},
+			"dueat":      bson.M{"$gt": now(), "$lte": now().Add(before)},
+		}
+		cursor, err := loans.Find(ctx, filter)
+		if err != nil {
+			return "", err
+		}
+		var due []Loan
+		if err := cursor.All(ctx, &due); err != nil {
+			return "", err
+		}
+
+		sent, failed := 0, 0
+		for _, loan := range due {
+			book, err := findBook(ctx, coll, loan.BookID)
+			if err != nil && err != mongo.ErrNoDocuments {
+				return "", err
+			}
+			item := bookToMap(book)
+			if err == mongo.ErrNoDocuments {
+				item = bookItem{"id": loan.BookID, "title": loan.BookID}
+			}
+			subject := fmt.Sprintf("%s is due on %s", item["title"], loan.DueAt.Format("January 2"))
+			if err := n.send(ctx, notifyLoanDue, n.borrower(loan.Borrower), subject, loanDueEmail{Loan: loan, Book: item}); err != nil {
+				log.Printf("Error reminding %s of book %s: %v", loan.Borrower, loan.BookID, err)
+				failed++
+				continue
+			}
+			if _, err := loans.UpdateByID(ctx, loan.MongoID, bson.M{"$set": bson.M{"remindedat": now()}}); err != nil {
+				return "", err
+			}
+			sent++
+		}
+		summary := ""
+		if sent > 0 {
+			summary = fmt.Sprintf("Sent %s", pluralize(sent, "loan reminder"))
+		}
+		if failed > 0 {
+			return summary, fmt.Errorf("%s could not be sent and will be tried again", pluralize(failed, "loan reminder"))
+		}
+		return summary, nil
+	}
+}
+
+// Where reminders for a borrower go: to the borrower if it is an email
+// address, else to the staff.
+func (n *notifications) borrower(borrower string) []string {
+	if addr, err := mail.ParseAddress(borrower); err == nil {
+		return []string{addr.Address}
+	}
+	return n.staff
+}
+
+// The data of the email-import-finished block.
+type importFinishedEmail struct {
+	Job importJob
+	// The first of the rows that failed, and the number of the others.
+	Errors []importResult
+	More   int
+}
+
+// Mails the outcome of an import job.
+func (n *notifications) ImportFinished(ctx context.Context, job importJob) {
+	if !n.Wants(notifyImportFinished) {
+		return
+	}
+	subject := fmt.Sprintf("Import of %s failed", job.FileName)
+	if job.Status == jobDone {
+		subject = fmt.Sprintf("Import of %s done: %s added, %d failed", job.FileName, pluralize(job.Created, "book"), job.Failed)
+	}
+	data := importFinishedEmail{Job: job, Errors: job.Errors}
+	if len(data.Errors) > emailListLimit {
+		data.Errors, data.More = data.Errors[:emailListLimit], len(data.Errors)-emailListLimit
+	}
+	if err := n.send(ctx, notifyImportFinished, n.staff, subject, data); err != nil {
+		log.Printf("Error sending the email about import job %s: %v", job.MongoID.Hex(), err)
+	}
+}
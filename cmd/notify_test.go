@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	exercises "github.com/CAPS-Cloud/exercises"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type sentEmail struct {
+	to            []string
+	subject, body string
+}
+
+// A notifier that hands the emails to the test instead of a mail server.
+type recordingNotifier chan sentEmail
+
+func (r recordingNotifier) Notify(_ context.Context, to []string, subject, body string) error {
+	r <- sentEmail{to: to, subject: subject, body: body}
+	return nil
+}
+
+func (r recordingNotifier) next(t *testing.T) sentEmail {
+	t.Helper()
+	select {
+	case email := <-r:
+		return email
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email sent")
+		return sentEmail{}
+	}
+}
+
+// Notifications for all events, rendered with the built-in templates.
+func newTestNotifications() (*notifications, recordingNotifier) {
+	sent := make(recordingNotifier, 10)
+	return &notifications{
+		sender:   sent,
+		renderer: loadTemplates(exercises.Assets, false),
+		events:   notifyEvents,
+		staff:    []string{"staff@example.com"},
+	}, sent
+}
+
+// Checks that the email went to the addresses and has the subject, and
+// that its body contains every one of the snippets.
+func checkEmail(t *testing.T, email sentEmail, to, subject string, snippets ...string) {
+	t.Helper()
+	if fmt.Sprint(email.to) != to || email.subject != subject {
+		t.Errorf("sent %q to %v, want %q to %s", email.subject, email.to, subject, to)
+	}
+	for _, snippet := range snippets {
+		if !strings.Contains(email.body, snippet) {
+			t.Errorf("body of %q lacks %q:\n%s", email.subject, snippet, email.body)
+		}
+	}
+}
+
+func TestNotificationEmails(t *testing.T) {
+	n, sent := newTestNotifications()
+	ctx := context.Background()
+
+	price := bookPrice{Amount: 1299, Currency: "EUR"}
+	book := bookToMap(BookStore{ID: "dracula", BookName: "Dracula <1st>", BookAuthor: "Bram Stoker", BookYear: 1897, Price: &price})
+	if err := n.send(ctx, notifyBookCreated, n.staff, "New book", newBooksEmail{Books: []bookItem{book}, More: 2}); err != nil {
+		t.Fatal(err)
+	}
+	checkEmail(t, sent.next(t), "[staff@example.com]", "New book",
+		"3 books added", "<strong>Dracula &lt;1st&gt;</strong> by Bram Stoker, 1897, 12.99 EUR", "And 2 more books.")
+
+	loan := Loan{BookID: "dracula", Borrower: "mina@example.com", CheckedOutAt: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), DueAt: time.Date(2024, 5, 15, 0, 0, 0, 0, time.UTC)}
+	if err := n.send(ctx, notifyLoanDue, n.borrower(loan.Borrower), "Due", loanDueEmail{Loan: loan, Book: book}); err != nil {
+		t.Fatal(err)
+	}
+	checkEmail(t, sent.next(t), "[mina@example.com]", "Due",
+		"borrowed by mina@example.com on 2024-05-01, is due back on 2024-05-15")
+
+	job := importJob{MongoID: primitive.NewObjectID(), Status: jobDone, FileName: "books.csv", TotalRows: 60, Created: 5}
+	for row := 1; row <= 55; row++ {
+		job.Errors = append(job.Errors, importResult{Row: row, Error: "title is required"})
+	}
+	job.Failed = len(job.Errors)
+	n.ImportFinished(ctx, job)
+	email := sent.next(t)
+	checkEmail(t, email, "[staff@example.com]", "Import of books.csv done: 5 books added, 55 failed",
+		"5 books added, 55 of 60 rows failed", "Row 50: title is required", "And 5 more failed rows.")
+	if strings.Contains(email.body, "Row 51:") {
+		t.Errorf("body lists more than %d failed rows", emailListLimit)
+	}
+
+	n.ImportFinished(ctx, importJob{MongoID: primitive.NewObjectID(), Status: jobFailed, FileName: "books.csv", Error: "no title column"})
+	checkEmail(t, sent.next(t), "[staff@example.com]", "Import of books.csv failed", "failed: no title column")
+}
+
+// Reminders go to borrowers with an email address, else to the staff.
+func TestNotificationBorrower(t *testing.T) {
+	n, _ := newTestNotifications()
+	for borrower, want := range map[string]string{
+		"mina@example.com":               "[mina@example.com]",
+		"Mina Harker <mina@example.com>": "[mina@example.com]",
+		"Mina Harker":                    "[staff@example.com]",
+		"":                               "[staff@example.com]",
+	} {
+		if got := fmt.Sprint(n.borrower(borrower)); got != want {
+			t.Errorf("reminders for %q go to %s, want %s", borrower, got, want)
+		}
+	}
+}
+
+// Books created between two ticks share one email; other events and
+// quiet ticks send none.
+func TestNotificationNewBooks(t *testing.T) {
+	n, sent := newTestNotifications()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Unbuffered, so every event is taken before the next tick is.
+	changes, tick := make(chan bookEvent), make(chan time.Time)
+	go n.mailNewBooks(ctx, changes, tick)
+
+	changes <- bookEvent{Type: bookCreated, Book: BookStore{ID: "dracula", BookName: "Dracula"}}
+	changes <- bookEvent{Type: bookUpdated, Book: BookStore{ID: "dracula", BookName: "Dracula"}}
+	tick <- time.Now()
+	checkEmail(t, sent.next(t), "[staff@example.com]", "New book: Dracula", "1 book added", "Dracula")
+
+	tick <- time.Now()
+	for i := 1; i <= emailListLimit+3; i++ {
+		changes <- bookEvent{Type: bookCreated, Book: BookStore{ID: fmt.Sprint("book-", i), BookName: fmt.Sprint("Book ", i)}}
+	}
+	tick <- time.Now()
+	email := sent.next(t)
+	checkEmail(t, email, "[staff@example.com]", "53 new books", "53 books added", "Book 50<", "And 3 more books.")
+	if strings.Contains(email.body, "Book 51<") {
+		t.Errorf("body lists more than %d books", emailListLimit)
+	}
+	select {
+	case email := <-sent:
+		t.Errorf("sent %q as well", email.subject)
+	default:
+	}
+}
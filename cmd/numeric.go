@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// Pages and years used to be strings, which made sorting and range queries
+// impossible ("1000" < "280"). They are integers now, stored as such in
+// Mongo. Old clients keep sending "280" instead of 280, so flexInt accepts
+// both when decoding. Zero means "unknown" and is written as null.
+type flexInt int
+
+func (n flexInt) MarshalJSON() ([]byte, error) {
+	if n == 0 {
+		return []byte("null"), nil
+	}
+	return []byte(strconv.Itoa(int(n))), nil
+}
+
+func (n *flexInt) UnmarshalJSON(data []byte) error {
+	raw := strings.TrimSpace(string(data))
+	if raw == "null" {
+		*n = 0
+		return nil
+	}
+	if unquoted, err := strconv.Unquote(raw); err == nil {
+		raw = strings.TrimSpace(unquoted)
+	}
+	parsed, err := parseFlexInt(raw)
+	if err != nil {
+		// Returning this error type lets encoding/json tell us which field
+		// was wrong, see bindFailed.
+		return &json.UnmarshalTypeError{Value: "string " + raw, Type: reflect.TypeOf(n).Elem()}
+	}
+	*n = parsed
+	return nil
+}
+
+// Also accepts the strings of documents that were not migrated yet, so a
+// forgotten document does not break a whole listing.
+func (n *flexInt) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	value := bsoncore.Value{Type: t, Data: data}
+	switch t {
+	case bsontype.Int32:
+		*n = flexInt(value.Int32())
+	case bsontype.Int64:
+		*n = flexInt(value.Int64())
+	case bsontype.Double:
+		*n = flexInt(value.Double())
+	case bsontype.String:
+		parsed, _ := parseFlexInt(value.StringValue())
+		*n = parsed
+	case bsontype.Null, bsontype.Undefined:
+		*n = 0
+	default:
+		return fmt.Errorf("cannot decode %s into a number", t)
+	}
+	return nil
+}
+
+// Shows nothing for unknown values, e.g., in templates and CSV exports.
+func (n flexInt) String() string {
+	if n == 0 {
+		return ""
+	}
+	return strconv.Itoa(int(n))
+}
+
+// Parses a number given as text; the empty string stands for "unknown".
+func parseFlexInt(s string) (flexInt, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	return flexInt(n), err
+}
+
+// Reads a number from a decoded JSON payload, where it may arrive as a
+// number or a string. GraphQL arguments arrive as ints.
+func payloadInt(v interface{}) (flexInt, bool) {
+	switch value := v.(type) {
+	case int:
+		return flexInt(value), true
+	case float64:
+		return flexInt(value), value == float64(int(value))
+	case string:
+		n, err := parseFlexInt(value)
+		return n, err == nil
+	case nil:
+		return 0, true
+	}
+	return 0, false
+}
+
+// Converts pages and years stored as strings into integers. It only touches
+// documents that still hold strings, so running it on every start is cheap
+// and harmless. Values that are not numbers become 0 (unknown).
+func migrateNumericFields(ctx context.Context, coll, history *mongo.Collection) error {
+	for _, target := range []struct {
+		coll   *mongo.Collection
+		prefix string
+	}{{coll, ""}, {history, "book."}} {
+		for _, field := range []string{"bookpages", "bookyear"} {
+			path := target.prefix + field
+			filter := bson.M{path: bson.M{"$type": "string"}}
+			pipeline := mongo.Pipeline{{{Key: "$set", Value: bson.M{
+				path: bson.M{"$convert": bson.M{
+					"input":   bson.M{"$trim": bson.M{"input": "$" + path}},
+					"to":      "int",
+					"onError": 0,
+					"onNull":  0,
+				}},
+			}}}}
+			if _, err := target.coll.UpdateMany(ctx, filter, pipeline); err != nil {
+				return fmt.Errorf("migrating %s: %w", path, err)
+			}
+		}
+	}
+	return nil
+}
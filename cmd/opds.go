@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/xml"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// An OPDS 1.2 catalog (https://specs.opds.io/opds-1.2) lets e-reader apps
+// browse the library. It is a set of Atom feeds: navigation feeds link to
+// other feeds, acquisition feeds list books. The root at /opds links to all
+// books, the newest books, and the books of each author; every feed is paged
+// and the catalog can be searched through an OpenSearch description.
+
+const (
+	opdsNavigation  = "application/atom+xml;profile=opds-catalog;kind=navigation"
+	opdsAcquisition = "application/atom+xml;profile=opds-catalog;kind=acquisition"
+	opdsPageSize    = 25
+)
+
+type atomFeed struct {
+	XMLName    xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	DC         string      `xml:"xmlns:dc,attr,omitempty"`
+	OpenSearch string      `xml:"xmlns:opensearch,attr,omitempty"`
+	ID         string      `xml:"id"`
+	Title      string      `xml:"title"`
+	Updated    time.Time   `xml:"updated"`
+	Author     *atomPerson `xml:"author,omitempty"`
+	Links      []atomLink  `xml:"link"`
+	Total      int         `xml:"opensearch:totalResults,omitempty"`
+	PerPage    int         `xml:"opensearch:itemsPerPage,omitempty"`
+	Entries    []atomEntry `xml:"entry"`
+}
+
+type atomEntry struct {
+	ID         string       `xml:"id"`
+	Title      string       `xml:"title"`
+	Updated    time.Time    `xml:"updated"`
+	Published  *time.Time   `xml:"published,omitempty"`
+	Authors    []atomPerson `xml:"author"`
+	Issued     string       `xml:"dc:issued,omitempty"`
+	Identifier string       `xml:"dc:identifier,omitempty"`
+	Content    *atomContent `xml:"content,omitempty"`
+	Links      []atomLink   `xml:"link"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+type atomLink struct {
+	Rel   string `xml:"rel,attr,omitempty"`
+	Href  string `xml:"href,attr"`
+	Type  string `xml:"type,attr,omitempty"`
+	Title string `xml:"title,attr,omitempty"`
+}
+
+// Writes a feed as XML with the given content type.
+func writeFeed(c echo.Context, contentType string, feed atomFeed) error {
+	body, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return err
+	}
+	return c.Blob(http.StatusOK, contentType, append([]byte(xml.Header), body...))
+}
+
+// Turns a path into an absolute URL on this server.
+func absoluteURL(c echo.Context, path string) string {
+	return c.Scheme() + "://" + c.Request().Host + path
+}
+
+// Builds the Atom entry of a book, linking to its API resource, cover, and
+// the checkout endpoint to borrow it.
+func bookEntry(c echo.Context, book BookStore) atomEntry {
+	entry := atomEntry{
+		ID:      "urn:book:" + url.PathEscape(book.ID),
+		Title:   book.BookName,
+		Updated: book.UpdatedAt,
+		Authors: []atomPerson{{Name: book.BookAuthor}},
+		Issued:  book.BookYear.String(),
+		Links: []atomLink{
+			{Rel: "alternate", Href: absoluteURL(c, "/api/books/"+url.PathEscape(book.ID)), Type: "application/json"},
+			{Rel: "http://opds-spec.org/acquisition/borrow", Href: absoluteURL(c, "/api/books/"+url.PathEscape(book.ID)+"/checkout"), Type: "application/json"},
+		},
+	}
+	if entry.Updated.IsZero() {
+		entry.Updated = time.Unix(0, 0).UTC()
+	}
+	if !book.CreatedAt.IsZero() {
+		entry.Published = &book.CreatedAt
+	}
+	if looksLikeISBN(book.BookEdition) {
+		entry.Identifier = "urn:isbn:" + book.BookEdition
+	}
+	if book.AuthorID != "" {
+		entry.Authors[0].URI = absoluteURL(c, "/opds/authors/"+url.PathEscape(book.AuthorID))
+	}
+	if book.BookPages != 0 {
+		entry.Content = &atomContent{Type: "text", Text: book.BookPages.String() + " pages"}
+	}
+	if book.Cover != nil {
+		entry.Links = append(entry.Links,
+			atomLink{Rel: "http://opds-spec.org/image", Href: absoluteURL(c, coverURL(book.ID, "")), Type: book.Cover.ContentType},
+			atomLink{Rel: "http://opds-spec.org/image/thumbnail", Href: absoluteURL(c, coverURL(book.ID, "thumb")), Type: book.Cover.ThumbType},
+		)
+	}
+	return entry
+}
+
+// The links every feed carries: the catalog root, the search description,
+// and the feed itself.
+func feedLinks(c echo.Context, self, kind string) []atomLink {
+	return []atomLink{
+		{Rel: "self", Href: absoluteURL(c, self), Type: kind},
+		{Rel: "start", Href: absoluteURL(c, "/opds"), Type: opdsNavigation},
+		{Rel: "search", Href: absoluteURL(c, "/opds/opensearch.xml"), Type: "application/opensearchdescription+xml"},
+	}
+}
+
+// Handles GET /opds, the navigation feed at the root of the catalog.
+func opdsRoot(c echo.Context) error {
+	nav := func(id, title, href, rel, kind, summary string) atomEntry {
+		return atomEntry{
+			ID:      "urn:opds:" + id,
+			Title:   title,
+			Updated: now(),
+			Content: &atomContent{Type: "text", Text: summary},
+			Links:   []atomLink{{Rel: rel, Href: absoluteURL(c, href), Type: kind}},
+		}
+	}
+	return writeFeed(c, opdsNavigation, atomFeed{
+		ID:      "urn:opds:root",
+		Title:   "Book catalog",
+		Updated: now(),
+		Links:   feedLinks(c, "/opds", opdsNavigation),
+		Entries: []atomEntry{
+			nav("books", "All books", "/opds/books", "subsection", opdsAcquisition, "Every book, by title"),
+			nav("new", "Recently added", "/opds/new", "http://opds-spec.org/sort/new", opdsAcquisition, "The newest books first"),
+			nav("authors", "Authors", "/opds/authors", "subsection", opdsNavigation, "Books by author"),
+		},
+	})
+}
+
+// Serves one page of books as an acquisition feed. The page is taken from
+// ?page=, starting at 1, and the feed links to the pages before and after.
+func opdsBooks(coll *mongo.Collection, id, title string, filter func(c echo.Context) bson.M, sort bson.D) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		page, err := strconv.Atoi(c.QueryParam("page"))
+		if err != nil || page < 1 {
+			page = 1
+		}
+		query := notDeleted(filter(c))
+		total, err := coll.CountDocuments(ctx, query)
+		if err != nil {
+			log.Printf("Error counting books for %s: %v", id, err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		opts := options.Find().SetSort(sort).SetSkip(int64((page - 1) * opdsPageSize)).SetLimit(opdsPageSize)
+		var books []BookStore
+		cursor, err := coll.Find(ctx, query, opts)
+		if err == nil {
+			err = cursor.All(ctx, &books)
+		}
+		if err != nil {
+			log.Printf("Error listing books for %s: %v", id, err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+
+		pageURL := func(n int) string {
+			params, _ := url.ParseQuery(c.Request().URL.RawQuery)
+			params.Set("page", strconv.Itoa(n))
+			return c.Request().URL.Path + "?" + params.Encode()
+		}
+		feed := atomFeed{
+			DC:         "http://purl.org/dc/terms/",
+			OpenSearch: "http://a9.com/-/spec/opensearch/1.1/",
+			ID:         "urn:opds:" + id,
+			Title:      title,
+			Updated:    now(),
+			Links:      feedLinks(c, pageURL(page), opdsAcquisition),
+			Total:      int(total),
+			PerPage:    opdsPageSize,
+		}
+		if page > 1 {
+			feed.Links = append(feed.Links, atomLink{Rel: "previous", Href: absoluteURL(c, pageURL(page-1)), Type: opdsAcquisition})
+		}
+		if int64(page*opdsPageSize) < total {
+			feed.Links = append(feed.Links, atomLink{Rel: "next", Href: absoluteURL(c, pageURL(page+1)), Type: opdsAcquisition})
+		}
+		for _, book := range books {
+			feed.Entries = append(feed.Entries, bookEntry(c, book))
+		}
+		return writeFeed(c, opdsAcquisition, feed)
+	}
+}
+
+// Handles GET /opds/authors, a navigation feed with one entry per author.
+func opdsAuthors(authors *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		var list []Author
+		cursor, err := authors.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+		if err == nil {
+			err = cursor.All(ctx, &list)
+		}
+		if err != nil {
+			log.Printf("Error listing authors: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		feed := atomFeed{
+			ID:      "urn:opds:authors",
+			Title:   "Authors",
+			Updated: now(),
+			Links:   feedLinks(c, "/opds/authors", opdsNavigation),
+		}
+		for _, author := range list {
+			entry := atomEntry{
+				ID:      "urn:author:" + url.PathEscape(author.ID),
+				Title:   author.Name,
+				Updated: author.UpdatedAt,
+				Links:   []atomLink{{Rel: "subsection", Href: absoluteURL(c, "/opds/authors/"+url.PathEscape(author.ID)), Type: opdsAcquisition}},
+			}
+			if author.Bio != "" {
+				entry.Content = &atomContent{Type: "text", Text: author.Bio}
+			}
+			feed.Entries = append(feed.Entries, entry)
+		}
+		return writeFeed(c, opdsNavigation, feed)
+	}
+}
+
+// Handles GET /opds/opensearch.xml, which tells clients how to search.
+func opdsSearchDescription(c echo.Context) error {
+	type urlTemplate struct {
+		Type     string `xml:"type,attr"`
+		Template string `xml:"template,attr"`
+	}
+	description := struct {
+		XMLName     xml.Name    `xml:"http://a9.com/-/spec/opensearch/1.1/ OpenSearchDescription"`
+		ShortName   string      `xml:"ShortName"`
+		Description string      `xml:"Description"`
+		URL         urlTemplate `xml:"Url"`
+	}{
+		ShortName:   "Books",
+		Description: "Search the book catalog by title or author",
+		URL:         urlTemplate{Type: opdsAcquisition, Template: absoluteURL(c, "/opds/search?q={searchTerms}")},
+	}
+	body, err := xml.MarshalIndent(description, "", "  ")
+	if err != nil {
+		return err
+	}
+	return c.Blob(http.StatusOK, "application/opensearchdescription+xml", append([]byte(xml.Header), body...))
+}
+
+// Matches books whose title or author contains the ?q= parameter.
+func opdsSearchFilter(c echo.Context) bson.M {
+	pattern := primitive.Regex{Pattern: regexp.QuoteMeta(c.QueryParam("q")), Options: "i"}
+	return bson.M{"$or": bson.A{bson.M{"bookname": pattern}, bson.M{"bookauthor": pattern}}}
+}
+
+// Registers the catalog routes.
+func registerOPDS(e *echo.Echo, coll, authors *mongo.Collection) {
+	byTitle := bson.D{{Key: "bookname", Value: 1}}
+	all := func(echo.Context) bson.M { return bson.M{} }
+	byAuthor := func(c echo.Context) bson.M { return bson.M{"authorid": c.Param("id")} }
+
+	e.GET("/opds", opdsRoot)
+	e.GET("/opds/opensearch.xml", opdsSearchDescription)
+	e.GET("/opds/books", opdsBooks(coll, "books", "All books", all, byTitle))
+	e.GET("/opds/new", opdsBooks(coll, "new", "Recently added", all, bson.D{{Key: "createdat", Value: -1}}))
+	e.GET("/opds/authors", opdsAuthors(authors))
+	e.GET("/opds/authors/:id", opdsBooks(coll, "author", "Books by author", byAuthor, byTitle))
+	e.GET("/opds/search", opdsBooks(coll, "search", "Search results", opdsSearchFilter, byTitle))
+}
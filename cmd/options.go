@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Answers OPTIONS on every API route with the methods it offers, e.g.
+// "Allow: DELETE, GET, HEAD, OPTIONS, PUT" for /api/books/:id. The methods
+// are read from the routes, so this must run after all of them are
+// registered. The handlers belong to the echo instance rather than the
+// /api group, so asking needs no token. Preflight requests of browsers
+// never get here; the CORS middleware answers those.
+func registerOptions(e *echo.Echo) {
+	methods := map[string][]string{}
+	for _, route := range e.Routes() {
+		if !isAPIPath(route.Path) || strings.Contains(route.Path, "*") || route.Method == echo.RouteNotFound {
+			continue
+		}
+		if !slices.Contains(methods[route.Path], route.Method) {
+			methods[route.Path] = append(methods[route.Path], route.Method)
+		}
+	}
+	for path, allowed := range methods {
+		allowed = append(allowed, http.MethodOptions)
+		slices.Sort(allowed)
+		allow := strings.Join(allowed, ", ")
+		e.OPTIONS(path, func(c echo.Context) error {
+			c.Response().Header().Set(echo.HeaderAllow, allow)
+			return c.NoContent(http.StatusNoContent)
+		})
+	}
+}
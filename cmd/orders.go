@@ -0,0 +1,229 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Placing an order turns the cart of the session into a document of the
+// orders collection and empties the cart; see cart.go. Every line keeps
+// the title, author, edition, and price the book had then, so later
+// changes to the catalog leave past orders alone. An order moves from
+// pending to paid to shipped, one step at a time, and remembers when it
+// took each step.
+type Order struct {
+	MongoID  primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Customer string             `json:"customer,omitempty"`
+	Items    []orderItem        `json:"items"`
+	Status   string             `json:"status"`
+	// Every status the order reached, the current one last.
+	History   []orderStatusChange `json:"history"`
+	CreatedAt time.Time           `json:"created_at"`
+	UpdatedAt time.Time           `json:"updated_at"`
+}
+
+type orderItem struct {
+	BookID   string `bson:"bookid" json:"book_id"`
+	Title    string `json:"title"`
+	Author   string `json:"author"`
+	Edition  string `json:"edition,omitempty"`
+	Quantity int    `json:"quantity"`
+	// Of a single copy, if the book had a price.
+	Price *bookPrice `json:"price,omitempty"`
+}
+
+type orderStatusChange struct {
+	Status string    `json:"status"`
+	At     time.Time `json:"at"`
+}
+
+const (
+	orderPending = "pending"
+	orderPaid    = "paid"
+	orderShipped = "shipped"
+)
+
+var orderStatuses = []string{orderPending, orderPaid, orderShipped}
+
+// The status each status leads to.
+var nextOrderStatus = map[string]string{
+	orderPending: orderPaid,
+	orderPaid:    orderShipped,
+}
+
+// The body of PUT /api/orders/:id/status.
+var orderStatusSchema = mustSchema(`{
+	"type": "object",
+	"properties": {
+		"status": {"enum": ["paid", "shipped"]}
+	},
+	"required": ["status"],
+	"additionalProperties": false
+}`)
+
+// Handles POST /api/orders, which orders the books in the cart. Books
+// deleted since they were put into the cart fail the order with 409.
+func placeOrder(books bookRepository, orders *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		s := currentSession(c)
+		if len(s.Cart) == 0 {
+			return validationFailed(c, validationErrors{"cart": "is empty"})
+		}
+
+		order := Order{
+			MongoID:   primitive.NewObjectID(),
+			Customer:  callerSubject(c),
+			Status:    orderPending,
+			CreatedAt: now(),
+		}
+		order.UpdatedAt = order.CreatedAt
+		order.History = []orderStatusChange{{Status: orderPending, At: order.CreatedAt}}
+		for _, item := range s.Cart {
+			book, err := books.Get(ctx, item.BookID)
+			if err == errBookNotFound {
+				return c.JSON(http.StatusConflict, map[string]string{"error": "Book with ID " + item.BookID + " is no longer available, remove it from the cart"})
+			} else if err != nil {
+				log.Printf("Error fetching book with ID %s: %v", item.BookID, err)
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to place the order"})
+			}
+			order.Items = append(order.Items, orderItem{
+				BookID:   book.ID,
+				Title:    book.BookName,
+				Author:   book.BookAuthor,
+				Edition:  book.BookEdition,
+				Quantity: item.Quantity,
+				Price:    book.Price,
+			})
+		}
+		if _, err := orders.InsertOne(ctx, order); err != nil {
+			log.Printf("Error inserting order: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to place the order"})
+		}
+		s.Cart = nil
+		s.Changed()
+		return c.JSON(http.StatusCreated, order)
+	}
+}
+
+// Admins see every order, everybody else only their own. Without
+// authentication, everybody may see everything, like the rest of the API.
+func visibleOrders(c echo.Context, access accessControl) bson.M {
+	if access.Allows(c, RoleAdmin) {
+		return bson.M{}
+	}
+	return bson.M{"customer": callerSubject(c)}
+}
+
+// Handles GET /api/orders, newest first. ?status= narrows them down, and
+// admins may ask for the orders of one ?customer=.
+func listOrders(orders *mongo.Collection, access accessControl) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		filter := visibleOrders(c, access)
+		if status := c.QueryParam("status"); status != "" {
+			if !slices.Contains(orderStatuses, status) {
+				return validationFailed(c, validationErrors{"status": "must be one of pending, paid, shipped"})
+			}
+			filter["status"] = status
+		}
+		if customer := c.QueryParam("customer"); customer != "" && access.Allows(c, RoleAdmin) {
+			filter["customer"] = customer
+		}
+
+		opts := options.Find().SetSort(bson.D{{Key: "createdat", Value: -1}})
+		cursor, err := orders.Find(ctx, filter, opts)
+		if err != nil {
+			log.Printf("Error listing orders: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to list orders"})
+		}
+		ret := []Order{}
+		if err := cursor.All(ctx, &ret); err != nil {
+			log.Printf("Error listing orders: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to list orders"})
+		}
+		return c.JSON(http.StatusOK, ret)
+	}
+}
+
+// Handles GET /api/orders/:id. Orders of others answer 404, as if they did
+// not exist.
+func getOrder(orders *mongo.Collection, access accessControl) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		notFound := func() error {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Order not found with ID " + c.Param("id")})
+		}
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return notFound()
+		}
+		filter := visibleOrders(c, access)
+		filter["_id"] = id
+		var order Order
+		if err := orders.FindOne(ctx, filter).Decode(&order); err == mongo.ErrNoDocuments {
+			return notFound()
+		} else if err != nil {
+			log.Printf("Error fetching order %s: %v", c.Param("id"), err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch order"})
+		}
+		return c.JSON(http.StatusOK, order)
+	}
+}
+
+// Handles PUT /api/orders/:id/status with a body like {"status": "paid"}.
+// The order must be in the status before, or the change answers 409; the
+// check and the change are one conditional update, so two admins cannot
+// both ship an order.
+func setOrderStatus(orders *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		var payload struct {
+			Status string `json:"status"`
+		}
+		if err := c.Bind(&payload); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+		}
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Order not found with ID " + c.Param("id")})
+		}
+		var previous string
+		for from, to := range nextOrderStatus {
+			if to == payload.Status {
+				previous = from
+			}
+		}
+
+		changed := now()
+		update := bson.M{
+			"$set":  bson.M{"status": payload.Status, "updatedat": changed},
+			"$push": bson.M{"history": orderStatusChange{Status: payload.Status, At: changed}},
+		}
+		var order Order
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+		err = orders.FindOneAndUpdate(ctx, bson.M{"_id": id, "status": previous}, update, opts).Decode(&order)
+		if err == mongo.ErrNoDocuments {
+			// Either there is no such order, or it is in another status.
+			if err := orders.FindOne(ctx, bson.M{"_id": id}).Decode(&order); err == mongo.ErrNoDocuments {
+				return c.JSON(http.StatusNotFound, map[string]string{"error": "Order not found with ID " + c.Param("id")})
+			} else if err != nil {
+				log.Printf("Error fetching order %s: %v", c.Param("id"), err)
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update order"})
+			}
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Order " + c.Param("id") + " is " + order.Status + " and cannot become " + payload.Status})
+		} else if err != nil {
+			log.Printf("Error updating order %s: %v", c.Param("id"), err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update order"})
+		}
+		return c.JSON(http.StatusOK, order)
+	}
+}
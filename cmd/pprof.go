@@ -0,0 +1,32 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Mounts the profiles of net/http/pprof under /debug/pprof, for admins
+// only, e.g.
+//
+//	curl -H "Authorization: Bearer $TOKEN" -o cpu.pprof \
+//	    "http://localhost:3030/debug/pprof/profile?seconds=30"
+//	go tool pprof cpu.pprof
+//
+// Profiles reveal a lot about the server, so they stay off without
+// JWT_SECRET, when there would be no admins to restrict them to.
+func registerPprof(e *echo.Echo, access accessControl) {
+	if !access.enabled() {
+		log.Printf("PPROF is set, but profiles need JWT_SECRET to restrict them to admins; not serving them")
+		return
+	}
+	debug := e.Group("/debug/pprof", access.Authenticate(), access.Require(RoleAdmin))
+	debug.GET("/cmdline", echo.WrapHandler(http.HandlerFunc(pprof.Cmdline)))
+	debug.GET("/profile", echo.WrapHandler(http.HandlerFunc(pprof.Profile)))
+	debug.Match([]string{http.MethodGet, http.MethodPost}, "/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+	debug.GET("/trace", echo.WrapHandler(http.HandlerFunc(pprof.Trace)))
+	// The index page, and the named profiles like /debug/pprof/heap.
+	debug.GET("/*", echo.WrapHandler(http.HandlerFunc(pprof.Index)))
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/text/currency"
+)
+
+// Books may carry a price, sent and answered like
+// {"amount": 12.99, "currency": "EUR"}, with the amount as a number or, for
+// clients wary of floating point, as a string. It is stored as a whole
+// number of the minor unit of the currency, 1299 cents here, so amounts
+// stay exact. Currencies without minor units, like JPY, or with three of
+// them, like BHD, work the same. Currency codes must be ISO 4217 ones.
+//
+// ?currency=USD on GET /api/books and /api/books/:id adds a display_price
+// to every book with a price, converted with the rates of an exchangeRates
+// provider. The price itself stays in its own currency. Books whose
+// currency the provider has no rate for get no display_price.
+
+type bookPrice struct {
+	// In the minor unit of the currency, e.g. cents.
+	Amount   int64  `bson:"amount"`
+	Currency string `bson:"currency"`
+}
+
+// The number of decimals of a currency, e.g. 2 for EUR and 0 for JPY.
+func currencyScale(code string) int {
+	unit, err := currency.ParseISO(code)
+	if err != nil {
+		return 0
+	}
+	scale, _ := currency.Standard.Rounding(unit)
+	return scale
+}
+
+// Checks a currency code and spells it in capitals, e.g. usd becomes USD.
+func parseCurrency(code string) (string, error) {
+	unit, err := currency.ParseISO(strings.TrimSpace(code))
+	if err != nil {
+		return "", err
+	}
+	return unit.String(), nil
+}
+
+var errInvalidAmount = errors.New("invalid amount")
+
+// Reads an amount like "12.99" in the given currency. It must not be
+// negative or have more decimals than the currency.
+func parsePrice(amount, code string) (bookPrice, error) {
+	code, err := parseCurrency(code)
+	if err != nil {
+		return bookPrice{}, err
+	}
+	scale := currencyScale(code)
+	whole, fraction, _ := strings.Cut(strings.TrimSpace(amount), ".")
+	fraction = strings.TrimRight(fraction, "0")
+	if whole == "" || len(whole) > 15 || len(fraction) > scale || strings.Trim(whole+fraction, "0123456789") != "" {
+		return bookPrice{}, errInvalidAmount
+	}
+	minor, err := strconv.ParseInt(whole+fraction+strings.Repeat("0", scale-len(fraction)), 10, 64)
+	if err != nil {
+		return bookPrice{}, errInvalidAmount
+	}
+	return bookPrice{Amount: minor, Currency: code}, nil
+}
+
+// The amount in the major unit, e.g. "12.99".
+func (p bookPrice) decimal() string {
+	scale := currencyScale(p.Currency)
+	digits := strconv.FormatInt(p.Amount, 10)
+	if scale == 0 {
+		return digits
+	}
+	if len(digits) <= scale {
+		digits = strings.Repeat("0", scale-len(digits)+1) + digits
+	}
+	return digits[:len(digits)-scale] + "." + digits[len(digits)-scale:]
+}
+
+// Shows the price in templates and CSV exports, e.g. "12.99 EUR".
+func (p bookPrice) String() string {
+	return p.decimal() + " " + p.Currency
+}
+
+// Reads a price the way String writes it, for CSV imports.
+func parsePriceText(text string) (bookPrice, error) {
+	amount, code, _ := strings.Cut(strings.TrimSpace(text), " ")
+	return parsePrice(amount, code)
+}
+
+type priceJSON struct {
+	Amount   json.Number `json:"amount"`
+	Currency string      `json:"currency"`
+}
+
+func (p bookPrice) MarshalJSON() ([]byte, error) {
+	return json.Marshal(priceJSON{Amount: json.Number(p.decimal()), Currency: p.Currency})
+}
+
+func (p *bookPrice) UnmarshalJSON(data []byte) error {
+	var raw priceJSON
+	err := json.Unmarshal(data, &raw)
+	if err == nil {
+		*p, err = parsePrice(raw.Amount.String(), raw.Currency)
+	}
+	if err != nil {
+		// Like flexInt, so the field shows up in the validation errors.
+		return &json.UnmarshalTypeError{Value: "price " + string(data), Type: reflect.TypeOf(p).Elem()}
+	}
+	return nil
+}
+
+// Converts amounts between currencies, for display only.
+type exchangeRates interface {
+	// How much one unit of from is worth in to, or errNoExchangeRate.
+	Rate(ctx context.Context, from, to string) (float64, error)
+}
+
+var errNoExchangeRate = errors.New("no exchange rate")
+
+// Rates from a fixed table of what one unit of a base currency is worth in
+// others, set with EXCHANGE_BASE and EXCHANGE_RATES, e.g. USD=1.08.
+type fixedRates map[string]float64
+
+func newFixedRates(base string, rates []string) (fixedRates, error) {
+	code, err := parseCurrency(base)
+	if err != nil {
+		return nil, fmt.Errorf("invalid EXCHANGE_BASE %q, want an ISO 4217 currency code", base)
+	}
+	table := fixedRates{code: 1}
+	for _, entry := range rates {
+		code, value, _ := strings.Cut(entry, "=")
+		parsed, err := parseCurrency(code)
+		if err != nil {
+			return nil, fmt.Errorf("invalid currency %q in EXCHANGE_RATES", code)
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("invalid rate %q for %s in EXCHANGE_RATES, want a positive number", value, parsed)
+		}
+		table[parsed] = rate
+	}
+	return table, nil
+}
+
+func (r fixedRates) Rate(_ context.Context, from, to string) (float64, error) {
+	fromRate, ok := r[from]
+	if !ok {
+		return 0, errNoExchangeRate
+	}
+	toRate, ok := r[to]
+	if !ok {
+		return 0, errNoExchangeRate
+	}
+	return toRate / fromRate, nil
+}
+
+// The price in another currency, rounded to its minor unit.
+func (p bookPrice) convert(ctx context.Context, rates exchangeRates, to string) (bookPrice, error) {
+	if p.Currency == to {
+		return p, nil
+	}
+	rate, err := rates.Rate(ctx, p.Currency, to)
+	if err != nil {
+		return bookPrice{}, err
+	}
+	major := float64(p.Amount) / math.Pow10(currencyScale(p.Currency)) * rate
+	return bookPrice{Amount: int64(math.Round(major * math.Pow10(currencyScale(to)))), Currency: to}, nil
+}
+
+// The currency of ?currency=, or "" without one, and a message when it is
+// no ISO 4217 code.
+func displayCurrency(c echo.Context) (string, string) {
+	raw := c.QueryParam("currency")
+	if raw == "" {
+		return "", ""
+	}
+	code, err := parseCurrency(raw)
+	if err != nil {
+		return "", "must be an ISO 4217 currency code like EUR"
+	}
+	return code, ""
+}
+
+// Adds the price of the book in the display currency to its answer.
+func addDisplayPrice(ctx context.Context, rates exchangeRates, item bookItem, book BookStore, to string) error {
+	if to == "" || book.Price == nil {
+		return nil
+	}
+	converted, err := book.Price.convert(ctx, rates, to)
+	if err == errNoExchangeRate {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	item["display_price"] = converted
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"golang.org/x/time/rate"
+)
+
+// Builds a per-IP token bucket limiter. Every client IP gets its own bucket
+// that refills at cfg.RateLimit tokens per second and holds up to
+// cfg.RateBurst tokens. Once a bucket is empty, the client receives a 429
+// together with a Retry-After header telling it when the next token arrives.
+func rateLimiter(cfg Config) echo.MiddlewareFunc {
+	if cfg.RateLimit <= 0 {
+		return passThrough
+	}
+
+	store := middleware.NewRateLimiterMemoryStoreWithConfig(middleware.RateLimiterMemoryStoreConfig{
+		Rate:  rate.Limit(cfg.RateLimit),
+		Burst: cfg.RateBurst,
+	})
+	retryAfter := strconv.Itoa(int(math.Ceil(1 / cfg.RateLimit)))
+
+	return middleware.RateLimiterWithConfig(middleware.RateLimiterConfig{
+		Store: store,
+		IdentifierExtractor: func(c echo.Context) (string, error) {
+			return c.RealIP(), nil
+		},
+		DenyHandler: func(c echo.Context, identifier string, err error) error {
+			c.Response().Header().Set("Retry-After", retryAfter)
+			return c.JSON(http.StatusTooManyRequests, map[string]string{"error": "Too many requests"})
+		},
+	})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Keys and the channel of the Redis cache. Answers live under
+// "books:cache:<generation>:<key>"; purging moves on to a new generation,
+// and the answers of the old one expire on their own.
+const (
+	redisCachePrefix     = "books:cache:"
+	redisGenerationKey   = redisCachePrefix + "generation"
+	redisPurgeChannel    = redisCachePrefix + "purge"
+	redisStartupDeadline = 5 * time.Second
+)
+
+// Keeps the cached answers in Redis, shared by every instance of the
+// server. Each instance remembers the current generation, so reading an
+// answer takes a single round trip; a purge is announced on a channel,
+// and the other instances switch to the new generation right away.
+type redisCache struct {
+	client     *redis.Client
+	ttl        time.Duration
+	generation atomic.Uint64
+}
+
+// Connects to the Redis at url, e.g. "redis://localhost:6379/0". When
+// Redis cannot be reached, every request is a cache miss until it can.
+func newRedisCache(url string, ttl time.Duration) *redisCache {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		log.Fatalf("Error parsing REDIS_URL: %v", err)
+	}
+	rc := &redisCache{client: redis.NewClient(opts), ttl: ttl}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisStartupDeadline)
+	defer cancel()
+	generation, err := rc.client.Get(ctx, redisGenerationKey).Uint64()
+	if err != nil && err != redis.Nil {
+		log.Printf("Error reading the cache generation from Redis: %v", err)
+	}
+	rc.advance(generation)
+	go rc.follow(context.Background())
+	return rc
+}
+
+// Moves on to a newer generation; older ones are ignored, since purges of
+// several instances may arrive in any order.
+func (rc *redisCache) advance(generation uint64) {
+	for {
+		current := rc.generation.Load()
+		if generation <= current || rc.generation.CompareAndSwap(current, generation) {
+			return
+		}
+	}
+}
+
+// Listens for the purges of the other instances. The subscription
+// reconnects by itself when the connection drops.
+func (rc *redisCache) follow(ctx context.Context) {
+	sub := rc.client.Subscribe(ctx, redisPurgeChannel)
+	defer sub.Close()
+	for msg := range sub.Channel() {
+		generation, err := strconv.ParseUint(msg.Payload, 10, 64)
+		if err != nil {
+			log.Printf("Ignoring cache purge %q: not a generation", msg.Payload)
+			continue
+		}
+		rc.advance(generation)
+	}
+}
+
+func (rc *redisCache) key(generation uint64, key string) string {
+	return redisCachePrefix + strconv.FormatUint(generation, 10) + ":" + key
+}
+
+func (rc *redisCache) get(ctx context.Context, key string) (*cachedResponse, uint64) {
+	generation := rc.generation.Load()
+	raw, err := rc.client.Get(ctx, rc.key(generation, key)).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			log.Printf("Error reading from the Redis cache: %v", err)
+		}
+		return nil, generation
+	}
+	entry := new(cachedResponse)
+	if err := json.Unmarshal(raw, entry); err != nil {
+		log.Printf("Error decoding cached answer %s: %v", key, err)
+		return nil, generation
+	}
+	return entry, generation
+}
+
+func (rc *redisCache) put(ctx context.Context, entry *cachedResponse, generation uint64) {
+	if generation != rc.generation.Load() {
+		return
+	}
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Error encoding cached answer %s: %v", entry.Key, err)
+		return
+	}
+	if err := rc.client.Set(ctx, rc.key(generation, entry.Key), raw, rc.ttl).Err(); err != nil {
+		log.Printf("Error writing to the Redis cache: %v", err)
+	}
+}
+
+func (rc *redisCache) purge(ctx context.Context) {
+	generation, err := rc.client.Incr(ctx, redisGenerationKey).Uint64()
+	if err != nil {
+		log.Printf("Error purging the Redis cache: %v", err)
+		return
+	}
+	rc.advance(generation)
+	if err := rc.client.Publish(ctx, redisPurgeChannel, generation).Err(); err != nil {
+		log.Printf("Error announcing the cache purge: %v", err)
+	}
+}
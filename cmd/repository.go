@@ -0,0 +1,527 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The repository holds the rules for reading and writing books: which
+// fields the server maintains, how authors get linked, how versions are
+// checked, and that deleting only moves a book to the recycle bin. The REST
+// handlers and GraphQL both go through it, so they cannot drift apart.
+type bookRepository interface {
+	List(ctx context.Context, q bookQuery) ([]BookStore, error)
+	Get(ctx context.Context, id string) (BookStore, error)
+	Create(ctx context.Context, book *BookStore) error
+	Update(ctx context.Context, id string, changes bookChanges, version *int) (BookStore, error)
+	Delete(ctx context.Context, id string, version *int) error
+	// Counts the books matching the query, ignoring its offset and limit.
+	Count(ctx context.Context, q bookQuery) (int64, error)
+}
+
+var (
+	errBookNotFound = errors.New("book not found")
+	errBookExists   = errors.New("book already exists")
+	// The book exists, but not in the version the caller expected.
+	errStaleVersion = errors.New("book was modified by someone else")
+)
+
+// Selects the books to list. Nil bounds and an empty author or tag list
+// match every book; a Limit of 0 means no limit. Sort names a field of
+// sortFields, prefixed with "-" for descending order.
+type bookQuery struct {
+	YearFrom *int
+	YearTo   *int
+	MinPages *int
+	MaxPages *int
+	Tags     []string
+	AuthorID string
+	// Matched regardless of case. A language also matches its regional
+	// variants, e.g. en matches en-GB.
+	Publisher string
+	Language  string
+	Offset    int64
+	Limit     int64
+	Sort      string
+	// Only books added after this one, for cursor pagination; see
+	// bookCursor.
+	After *primitive.ObjectID
+	// The JSON fields to return, all of them when empty; see
+	// projectionFields.
+	Fields []string
+	// The currency of display_price, if any; see price.go.
+	Currency string
+}
+
+// The fields books can be sorted by, from their JSON name to the stored one.
+var sortFields = map[string]string{
+	"id":         "id",
+	"title":      "bookname",
+	"author":     "bookauthor",
+	"edition":    "bookedition",
+	"pages":      "bookpages",
+	"year":       "bookyear",
+	"created_at": "createdat",
+	"updated_at": "updatedat",
+}
+
+// The Mongo sort order of the query. The _id comes last, so books with
+// equal values keep a stable order across pages.
+func (q bookQuery) sort() bson.D {
+	order := bson.D{}
+	field, desc := strings.CutPrefix(q.Sort, "-")
+	if stored, ok := sortFields[field]; ok {
+		direction := 1
+		if desc {
+			direction = -1
+		}
+		order = append(order, bson.E{Key: stored, Value: direction})
+	}
+	return append(order, bson.E{Key: "_id", Value: 1})
+}
+
+// The stored fields behind each JSON field of a book, for ?fields=. Some
+// JSON fields are derived from the same stored one, e.g. available and
+// due_at from the checkout.
+var projectionFields = map[string][]string{
+	"id":            {"id"},
+	"title":         {"bookname"},
+	"author":        {"bookauthor"},
+	"author_id":     {"authorid"},
+	"edition":       {"bookedition"},
+	"pages":         {"bookpages"},
+	"year":          {"bookyear"},
+	"version":       {"version"},
+	"tags":          {"tags"},
+	"available":     {"checkout"},
+	"due_at":        {"checkout"},
+	"cover_url":     {"cover"},
+	"thumbnail_url": {"cover"},
+	"rating":        {"rating"},
+	"copies":        {"copies"},
+	"series":        {"series"},
+	"series_index":  {"seriesindex"},
+	"publisher":     {"publisher"},
+	"language":      {"language"},
+	"description":   {"description"},
+	"price":         {"price"},
+	"display_price": {"price"},
+	"created_at":    {"createdat"},
+	"updated_at":    {"updatedat"},
+}
+
+// The Mongo projection of the query, or nil for whole books. The update
+// time is always read, since it drives Last-Modified.
+func (q bookQuery) projection() bson.M {
+	if len(q.Fields) == 0 {
+		return nil
+	}
+	projection := bson.M{"updatedat": 1}
+	for _, field := range q.Fields {
+		for _, stored := range projectionFields[field] {
+			projection[stored] = 1
+		}
+	}
+	return projection
+}
+
+// Drops the fields of a book the query did not ask for.
+func (q bookQuery) project(book map[string]interface{}) map[string]interface{} {
+	if len(q.Fields) == 0 {
+		return book
+	}
+	projected := make(map[string]interface{}, len(q.Fields))
+	for _, field := range q.Fields {
+		if value, ok := book[field]; ok {
+			projected[field] = value
+		}
+	}
+	return projected
+}
+
+// The Mongo filter for the query, e.g. a YearFrom of 1800 becomes
+// {"bookyear": {"$gte": 1800}}.
+func (q bookQuery) filter() bson.M {
+	filter := bson.M{}
+	bound := func(field, op string, value *int) {
+		if value == nil {
+			return
+		}
+		cond, ok := filter[field].(bson.M)
+		if !ok {
+			cond = bson.M{}
+			filter[field] = cond
+		}
+		cond[op] = *value
+	}
+	bound("bookyear", "$gte", q.YearFrom)
+	bound("bookyear", "$lte", q.YearTo)
+	bound("bookpages", "$gte", q.MinPages)
+	bound("bookpages", "$lte", q.MaxPages)
+	if len(q.Tags) > 0 {
+		filter["tags"] = bson.M{"$all": q.Tags}
+	}
+	if q.AuthorID != "" {
+		filter["authorid"] = q.AuthorID
+	}
+	if q.Publisher != "" {
+		filter["publisher"] = primitive.Regex{Pattern: "^" + regexp.QuoteMeta(q.Publisher) + "$", Options: "i"}
+	}
+	if q.Language != "" {
+		filter["language"] = primitive.Regex{Pattern: "^" + regexp.QuoteMeta(q.Language) + "(-|$)", Options: "i"}
+	}
+	if q.After != nil {
+		filter["_id"] = bson.M{"$gt": *q.After}
+	}
+	return filter
+}
+
+// A partial update of a book. Only the fields that are set change.
+type bookChanges struct {
+	Title       *string
+	Author      *string
+	AuthorID    *string
+	Edition     *string
+	Pages       *flexInt
+	Year        *flexInt
+	Tags        *[]string
+	Series      *string
+	SeriesIndex *flexInt
+	Publisher   *string
+	Language    *string
+	Description *string
+	// A price without a currency removes the price.
+	Price *bookPrice
+}
+
+func (ch bookChanges) empty() bool {
+	return ch == bookChanges{}
+}
+
+// Collects the changes from the JSON body of PATCH /api/books/:id. The
+// payload must have passed validateUpdate.
+func changesFromPayload(payload map[string]interface{}) bookChanges {
+	var ch bookChanges
+	text := func(name string) *string {
+		if value, ok := payload[name].(string); ok {
+			return &value
+		}
+		return nil
+	}
+	number := func(name string) *flexInt {
+		// Numbers may still arrive as strings from older clients.
+		if value, ok := payloadInt(payload[name]); ok && payload[name] != nil {
+			return &value
+		}
+		return nil
+	}
+	ch.Title = text("title")
+	ch.Author = text("author")
+	if authorID := text("author_id"); authorID != nil && *authorID != "" {
+		ch.AuthorID = authorID
+	}
+	ch.Edition = text("edition")
+	ch.Series = text("series")
+	ch.Publisher = text("publisher")
+	ch.Language = text("language")
+	ch.Description = text("description")
+	if _, ok := payload["price"]; ok {
+		decoded, _ := decodeFields(payload)
+		ch.Price = decoded.Price
+		if ch.Price == nil {
+			ch.Price = &bookPrice{}
+		}
+	}
+	ch.Pages = number("pages")
+	ch.Year = number("year")
+	ch.SeriesIndex = number("series_index")
+	if _, ok := payload["tags"]; ok {
+		decoded, _ := decodeFields(payload)
+		ch.Tags = &decoded.Tags
+	}
+	return ch
+}
+
+// The changes that turn a book into the given one, every field included,
+// for PUT /api/books/:id. The author is taken by ID when one is given.
+func replacementChanges(book BookStore) bookChanges {
+	tags := book.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	ch := bookChanges{
+		Title:       &book.BookName,
+		Edition:     &book.BookEdition,
+		Pages:       &book.BookPages,
+		Year:        &book.BookYear,
+		Tags:        &tags,
+		Series:      &book.Series,
+		SeriesIndex: &book.SeriesIndex,
+		Publisher:   &book.Publisher,
+		Language:    &book.Language,
+		Description: &book.Description,
+		Price:       book.Price,
+	}
+	if ch.Price == nil {
+		ch.Price = &bookPrice{}
+	}
+	if book.AuthorID != "" {
+		ch.AuthorID = &book.AuthorID
+	} else {
+		ch.Author = &book.BookAuthor
+	}
+	return ch
+}
+
+// The repository backed by the Mongo collections of books, their history,
+// and authors.
+type mongoBooks struct {
+	coll    *mongo.Collection
+	history *mongo.Collection
+	authors *mongo.Collection
+}
+
+func newMongoBooks(coll, history, authors *mongo.Collection) *mongoBooks {
+	return &mongoBooks{coll: coll, history: history, authors: authors}
+}
+
+func (r *mongoBooks) List(ctx context.Context, q bookQuery) ([]BookStore, error) {
+	opts := options.Find()
+	if q.Sort != "" || q.Offset > 0 || q.Limit > 0 {
+		// Pages are only stable in a fixed order.
+		opts.SetSort(q.sort()).SetSkip(q.Offset).SetLimit(q.Limit)
+	}
+	if projection := q.projection(); projection != nil {
+		opts.SetProjection(projection)
+	}
+	cursor, err := r.coll.Find(ctx, notDeleted(q.filter()), opts)
+	if err != nil {
+		return nil, err
+	}
+	var books []BookStore
+	err = cursor.All(ctx, &books)
+	return books, err
+}
+
+func (r *mongoBooks) Count(ctx context.Context, q bookQuery) (int64, error) {
+	return r.coll.CountDocuments(ctx, notDeleted(q.filter()))
+}
+
+func (r *mongoBooks) Get(ctx context.Context, id string) (BookStore, error) {
+	book, err := findBook(ctx, r.coll, id)
+	if err == mongo.ErrNoDocuments {
+		return book, errBookNotFound
+	}
+	return book, err
+}
+
+// Stores a new book. Rating, copies, checkout, and cover are maintained by
+// the server and cannot be set here. Invalid books are refused with
+// validationErrors.
+func (r *mongoBooks) Create(ctx context.Context, book *BookStore) error {
+	book.MongoID = primitive.NewObjectID()
+	book.CreatedAt = now()
+	book.UpdatedAt = book.CreatedAt
+	book.Version = 1
+	book.Rating = nil
+	book.Copies = nil
+	book.Checkout = nil
+	book.Cover = nil
+
+	// The author may be given by ID instead of by name.
+	if err := fillAuthorName(ctx, r.authors, book); err != nil {
+		return err
+	}
+	// The ID, title, and author are required; pages and year have to be
+	// numbers and the edition a valid ISBN (or a label like "1st
+	// Edition"). See validation.go for the rules.
+	if errs := validateStruct(book); len(errs) > 0 {
+		return errs
+	}
+	book.BookEdition = normalizeEdition(book.BookEdition)
+	book.Language = normalizeLanguage(book.Language)
+	book.Tags = normalizeTags(book.Tags)
+	book.setSearchKeys()
+
+	// The book and a new author it brings along are written in one
+	// transaction where Mongo offers them; see transactions.go.
+	authorID := book.AuthorID
+	return inTransaction(ctx, r.coll.Database().Client(), func(ctx context.Context) error {
+		// A transaction tried again starts over with the author.
+		book.AuthorID = authorID
+		count, err := r.coll.CountDocuments(ctx, notDeleted(bson.M{"id": book.ID}))
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return errBookExists
+		}
+		// A deleted book with the same ID may still sit in the recycle
+		// bin. The new book replaces it for good.
+		if err := purgeDeleted(ctx, r.coll, []string{book.ID}); err != nil {
+			return err
+		}
+		if err := linkAuthor(ctx, r.authors, book); err != nil {
+			return err
+		}
+		_, err = r.coll.InsertOne(ctx, book)
+		if mongo.IsDuplicateKeyError(err) {
+			// Another request created the book in the meantime.
+			return errBookExists
+		}
+		return err
+	})
+}
+
+// Applies the changes and returns the updated book. With a version, the
+// update only happens if the book still is in that version.
+func (r *mongoBooks) Update(ctx context.Context, id string, changes bookChanges, version *int) (BookStore, error) {
+	set, err := changeSet(ctx, r.authors, changes)
+	if err != nil {
+		return BookStore{}, err
+	}
+
+	// Books in the recycle bin have to be restored before editing.
+	filter := notDeleted(bson.M{"id": id})
+	if version != nil {
+		filter = withVersion(filter, *version)
+	}
+	// The previous state of the book is kept in the history collection.
+	if _, err := updateWithHistory(ctx, r.coll, r.history, filter, set); err != nil {
+		return BookStore{}, r.missing(ctx, id, version, err)
+	}
+	var book BookStore
+	if err := r.coll.FindOne(ctx, bson.M{"id": id}).Decode(&book); err != nil {
+		// Trying the call again would apply the changes twice.
+		return book, writeAppliedError{err}
+	}
+	return book, nil
+}
+
+// The stored fields to $set for the changes. A new author is looked up, or
+// created, in the authors collection.
+func changeSet(ctx context.Context, authors *mongo.Collection, changes bookChanges) (bson.M, error) {
+	set := bson.M{}
+	if changes.Title != nil {
+		set["bookname"] = *changes.Title
+	}
+	// The author can be changed by ID or by name. Either way, the book ends
+	// up linked to an author and carries its name.
+	if changes.AuthorID != nil {
+		book := BookStore{AuthorID: *changes.AuthorID}
+		if err := fillAuthorName(ctx, authors, &book); err != nil {
+			return nil, err
+		}
+		set["authorid"] = book.AuthorID
+		set["bookauthor"] = book.BookAuthor
+	} else if changes.Author != nil {
+		book := BookStore{BookAuthor: *changes.Author}
+		if err := linkAuthor(ctx, authors, &book); err != nil {
+			return nil, err
+		}
+		set["authorid"] = book.AuthorID
+		set["bookauthor"] = book.BookAuthor
+	}
+	if changes.Edition != nil {
+		set["bookedition"] = normalizeEdition(*changes.Edition)
+	}
+	if changes.Tags != nil {
+		set["tags"] = normalizeTags(*changes.Tags)
+	}
+	if changes.Series != nil {
+		set["series"] = *changes.Series
+	}
+	if changes.SeriesIndex != nil {
+		set["seriesindex"] = *changes.SeriesIndex
+	}
+	if changes.Publisher != nil {
+		set["publisher"] = *changes.Publisher
+	}
+	if changes.Language != nil {
+		set["language"] = normalizeLanguage(*changes.Language)
+	}
+	if changes.Description != nil {
+		set["description"] = *changes.Description
+	}
+	if changes.Price != nil {
+		set["price"] = nil
+		if changes.Price.Currency != "" {
+			set["price"] = *changes.Price
+		}
+	}
+	if changes.Pages != nil {
+		set["bookpages"] = *changes.Pages
+	}
+	if changes.Year != nil {
+		set["bookyear"] = *changes.Year
+	}
+	return set, nil
+}
+
+// Moves the book to the recycle bin; see trash.go.
+func (r *mongoBooks) Delete(ctx context.Context, id string, version *int) error {
+	filter := notDeleted(bson.M{"id": id})
+	if version != nil {
+		filter = withVersion(filter, *version)
+	}
+	deletedAt := now()
+	update := bson.M{
+		"$set": bson.M{"deletedat": deletedAt, "updatedat": deletedAt},
+		"$inc": bson.M{"version": 1},
+	}
+	result, err := r.coll.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return r.missing(ctx, id, version, mongo.ErrNoDocuments)
+	}
+	return nil
+}
+
+// Explains why a write matched no book: either there is no such book, or,
+// when a version was expected, somebody else changed it first.
+func (r *mongoBooks) missing(ctx context.Context, id string, version *int, err error) error {
+	if err != mongo.ErrNoDocuments {
+		return err
+	}
+	if version != nil {
+		if _, err := findBook(ctx, r.coll, id); err == nil {
+			return errStaleVersion
+		}
+	}
+	return errBookNotFound
+}
+
+// Answers a failed repository call with the matching status code. action
+// completes the error message, e.g. "Failed to update book".
+func bookFailed(c echo.Context, err error, id, action string) error {
+	var errs validationErrors
+	switch {
+	case errors.As(err, &errs):
+		return validationFailed(c, errs)
+	case err == errBookNotFound:
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Book not found with ID " + id})
+	case err == errBookExists:
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Book with ID " + id + " already exists"})
+	case err == errStaleVersion:
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Book with ID " + id + " was modified by someone else"})
+	case err == errReadOnly:
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "The service is read-only at the moment, try again later"})
+	case err == errCircuitOpen:
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "The database is unavailable at the moment, try again later"})
+	}
+	log.Printf("Error trying to %s book %s: %v", action, id, err)
+	reportError(c, err)
+	return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to " + action + " book"})
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Most collections need the same REST plumbing: bind the body, validate
+// it, find the document named in the path, and answer errors with the
+// right status and message. A Resource does this once for a document type
+// T; a collection only brings a resourceStore and the hooks for what is
+// special about it. Authors and webhooks are served this way, see
+// authorResource and webhookResource. Books have a repository of their own,
+// with versions and a recycle bin; see repository.go.
+//
+// A Resource is a flat collection under /:id, so the rest does without:
+// reviews live under the book they are about, with a store that would
+// differ per request and a rating to refresh on every change; tags are a
+// field of the books, not documents; and loans are made and ended by
+// checking books out and returning them, never created or replaced.
+
+var (
+	errResourceNotFound = errors.New("resource not found")
+	errResourceExists   = errors.New("resource already exists")
+)
+
+// A request that cannot be done to the document in its current state,
+// answered with 409 and the message, e.g. "Author with ID x still has
+// books".
+type resourceConflict string
+
+func (e resourceConflict) Error() string { return string(e) }
+
+// Reads and writes the documents of a resource.
+type resourceStore[T any] interface {
+	List(ctx context.Context) ([]T, error)
+	Get(ctx context.Context, id string) (T, error)
+	Create(ctx context.Context, doc *T) error
+	// Replaces the fields clients may change, and updates doc to the
+	// stored document.
+	Replace(ctx context.Context, id string, doc *T) error
+	Delete(ctx context.Context, id string) error
+}
+
+// Serves the documents of a store. Name and Store are required, ID is
+// needed for Replace, and the hooks are optional.
+type Resource[T any] struct {
+	// The name of one document in messages, e.g. "author" in "Failed to
+	// create author". Plural defaults to Name + "s".
+	Name   string
+	Plural string
+	Store  resourceStore[T]
+	// The ID field of a document. PUT fills it with the ID in the path.
+	ID func(doc *T) *string
+
+	// Runs on a bound and validated document before it is created, to
+	// check what tags cannot and fill in what the server derives.
+	BeforeCreate func(ctx context.Context, doc *T) error
+	// Runs on a bound and validated replacement before it is stored.
+	BeforeReplace func(ctx context.Context, id string, doc *T) error
+	// Runs once a document was replaced, e.g. to copy a changed name to
+	// the documents referring to it.
+	AfterReplace func(ctx context.Context, doc T) error
+	// Runs before a document is deleted, e.g. to refuse with a
+	// resourceConflict while others still refer to it.
+	BeforeDelete func(ctx context.Context, id string) error
+	// Turns a stored document into its answer, e.g. to hide a secret.
+	// Documents are answered as they are without it, and so is a new
+	// document to the client that created it.
+	Present func(doc T) interface{}
+	// Turns a document into a JSON:API resource object, for clients asking
+	// for application/vnd.api+json. Without it, they get plain JSON.
+	JSONAPI func(doc T) jsonAPIResource
+}
+
+func (r Resource[T]) plural() string {
+	if r.Plural != "" {
+		return r.Plural
+	}
+	return r.Name + "s"
+}
+
+func (r Resource[T]) present(doc T) interface{} {
+	if r.Present != nil {
+		return r.Present(doc)
+	}
+	return doc
+}
+
+// A document as a JSON:API resource, limited to the sparse fieldset of its
+// type, e.g. ?fields[authors]=name.
+func (r Resource[T]) jsonAPI(c echo.Context, doc T) jsonAPIResource {
+	res := r.JSONAPI(doc)
+	return res.sparse(c.QueryParam("fields[" + res.Type + "]"))
+}
+
+// Answers an error of the store or a hook, like bookFailed does for books.
+func (r Resource[T]) failed(c echo.Context, err error, id, action string) error {
+	var errs validationErrors
+	var conflict resourceConflict
+	title := strings.ToUpper(r.Name[:1]) + r.Name[1:]
+	switch {
+	case errors.As(err, &errs):
+		return validationFailed(c, errs)
+	case errors.As(err, &conflict):
+		return c.JSON(http.StatusConflict, map[string]string{"error": string(conflict)})
+	case errors.Is(err, errResourceNotFound):
+		return c.JSON(http.StatusNotFound, map[string]string{"error": title + " not found with ID " + id})
+	case errors.Is(err, errResourceExists):
+		return c.JSON(http.StatusConflict, map[string]string{"error": title + " with ID " + id + " already exists"})
+	}
+	name := r.Name
+	if action == "list" {
+		name = r.plural()
+	}
+	log.Printf("Error trying to %s: %v", strings.TrimSpace(action+" "+name+" "+id), err)
+	reportError(c, err)
+	return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to " + action + " " + name})
+}
+
+// Binds and validates the body of a POST or PUT.
+func (r Resource[T]) bind(c echo.Context) (*T, error) {
+	doc := new(T)
+	if err := c.Bind(doc); err != nil {
+		return nil, c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+	}
+	if err := c.Validate(doc); err != nil {
+		return nil, validationFailed(c, err)
+	}
+	return doc, nil
+}
+
+// Handles GET on the collection, listing all documents.
+func (r Resource[T]) List() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		docs, err := r.Store.List(c.Request().Context())
+		if err != nil {
+			return r.failed(c, err, "", "list")
+		}
+		if r.JSONAPI != nil && prefersJSONAPI(c) {
+			data := make([]jsonAPIResource, len(docs))
+			for i, doc := range docs {
+				data[i] = r.jsonAPI(c, doc)
+			}
+			return respond(c, http.StatusOK, newJSONAPIDocument(data))
+		}
+		ret := make([]interface{}, len(docs))
+		for i, doc := range docs {
+			ret[i] = r.present(doc)
+		}
+		return c.JSON(http.StatusOK, ret)
+	}
+}
+
+// Handles GET on /:id.
+func (r Resource[T]) Get() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		idParam := c.Param("id")
+		doc, err := r.Store.Get(c.Request().Context(), idParam)
+		if err != nil {
+			return r.failed(c, err, idParam, "fetch")
+		}
+		if r.JSONAPI != nil && prefersJSONAPI(c) {
+			return respond(c, http.StatusOK, newJSONAPIDocument(r.jsonAPI(c, doc)))
+		}
+		return c.JSON(http.StatusOK, r.present(doc))
+	}
+}
+
+// Handles POST on the collection, answering with 201 and the new document.
+func (r Resource[T]) Create() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		doc, err := r.bind(c)
+		if doc == nil {
+			return err
+		}
+		ctx := c.Request().Context()
+		if r.BeforeCreate != nil {
+			err = r.BeforeCreate(ctx, doc)
+		}
+		if err == nil {
+			err = r.Store.Create(ctx, doc)
+		}
+		if err != nil {
+			id := ""
+			if r.ID != nil {
+				id = *r.ID(doc)
+			}
+			return r.failed(c, err, id, "create")
+		}
+		return c.JSON(http.StatusCreated, doc)
+	}
+}
+
+// Handles PUT on /:id. The ID in the body may be left out, but must not
+// differ from the one in the path.
+func (r Resource[T]) Replace() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		idParam := c.Param("id")
+		doc, err := r.bind(c)
+		if doc == nil {
+			return err
+		}
+		id := r.ID(doc)
+		if *id != "" && *id != idParam {
+			return validationFailed(c, validationErrors{"id": "must match the ID in the path"})
+		}
+		*id = idParam
+		ctx := c.Request().Context()
+		if r.BeforeReplace != nil {
+			if err := r.BeforeReplace(ctx, idParam, doc); err != nil {
+				return r.failed(c, err, idParam, "update")
+			}
+		}
+		if err := r.Store.Replace(ctx, idParam, doc); err != nil {
+			return r.failed(c, err, idParam, "update")
+		}
+		if r.AfterReplace != nil {
+			if err := r.AfterReplace(ctx, *doc); err != nil {
+				return r.failed(c, err, idParam, "update")
+			}
+		}
+		return c.JSON(http.StatusOK, r.present(*doc))
+	}
+}
+
+// Handles DELETE on /:id.
+func (r Resource[T]) Delete() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		idParam := c.Param("id")
+		ctx := c.Request().Context()
+		if r.BeforeDelete != nil {
+			if err := r.BeforeDelete(ctx, idParam); err != nil {
+				return r.failed(c, err, idParam, "delete")
+			}
+		}
+		if err := r.Store.Delete(ctx, idParam); err != nil {
+			return r.failed(c, err, idParam, "delete")
+		}
+		return c.NoContent(http.StatusOK)
+	}
+}
+
+// A resourceStore on a Mongo collection.
+type mongoStore[T any] struct {
+	coll *mongo.Collection
+	// The filter selecting the document with an ID, and false if the ID
+	// cannot name a document, e.g. because it is no ObjectID.
+	filter func(id string) (bson.M, bool)
+	// The order of List.
+	sort bson.D
+	// The stored fields a replacement sets.
+	replace func(doc T) bson.M
+}
+
+// A store of documents found by their "id" field.
+func newMongoStore[T any](coll *mongo.Collection, sort bson.D, replace func(doc T) bson.M) mongoStore[T] {
+	return mongoStore[T]{
+		coll:    coll,
+		filter:  func(id string) (bson.M, bool) { return bson.M{"id": id}, true },
+		sort:    sort,
+		replace: replace,
+	}
+}
+
+func (s mongoStore[T]) List(ctx context.Context) ([]T, error) {
+	cursor, err := s.coll.Find(ctx, bson.M{}, options.Find().SetSort(s.sort))
+	if err != nil {
+		return nil, err
+	}
+	ret := []T{}
+	err = cursor.All(ctx, &ret)
+	return ret, err
+}
+
+func (s mongoStore[T]) Get(ctx context.Context, id string) (T, error) {
+	var doc T
+	filter, ok := s.filter(id)
+	if !ok {
+		return doc, errResourceNotFound
+	}
+	err := s.coll.FindOne(ctx, filter).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return doc, errResourceNotFound
+	}
+	return doc, err
+}
+
+func (s mongoStore[T]) Create(ctx context.Context, doc *T) error {
+	_, err := s.coll.InsertOne(ctx, doc)
+	if mongo.IsDuplicateKeyError(err) {
+		return errResourceExists
+	}
+	return err
+}
+
+func (s mongoStore[T]) Replace(ctx context.Context, id string, doc *T) error {
+	filter, ok := s.filter(id)
+	if !ok {
+		return errResourceNotFound
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := s.coll.FindOneAndUpdate(ctx, filter, bson.M{"$set": s.replace(*doc)}, opts).Decode(doc)
+	if err == mongo.ErrNoDocuments {
+		return errResourceNotFound
+	}
+	return err
+}
+
+func (s mongoStore[T]) Delete(ctx context.Context, id string) error {
+	filter, ok := s.filter(id)
+	if !ok {
+		return errResourceNotFound
+	}
+	result, err := s.coll.DeleteOne(ctx, filter)
+	if err == nil && result.DeletedCount == 0 {
+		return errResourceNotFound
+	}
+	return err
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The handlers of Resource on a store in memory, with a document type of
+// its own.
+
+type shelf struct {
+	ID       string `json:"id"`
+	Name     string `json:"name" validate:"required"`
+	Capacity int    `json:"capacity"`
+	Secret   string `json:"secret,omitempty"`
+}
+
+type memoryStore[T any] struct {
+	mu   sync.Mutex
+	docs []T
+	id   func(doc *T) *string
+}
+
+func (s *memoryStore[T]) find(id string) int {
+	return slices.IndexFunc(s.docs, func(doc T) bool { return *s.id(&doc) == id })
+}
+
+func (s *memoryStore[T]) List(ctx context.Context) ([]T, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.docs), nil
+}
+
+func (s *memoryStore[T]) Get(ctx context.Context, id string) (T, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i := s.find(id); i >= 0 {
+		return s.docs[i], nil
+	}
+	var zero T
+	return zero, errResourceNotFound
+}
+
+func (s *memoryStore[T]) Create(ctx context.Context, doc *T) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.find(*s.id(doc)) >= 0 {
+		return errResourceExists
+	}
+	s.docs = append(s.docs, *doc)
+	return nil
+}
+
+func (s *memoryStore[T]) Replace(ctx context.Context, id string, doc *T) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.find(id)
+	if i < 0 {
+		return errResourceNotFound
+	}
+	s.docs[i] = *doc
+	return nil
+}
+
+func (s *memoryStore[T]) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.find(id)
+	if i < 0 {
+		return errResourceNotFound
+	}
+	s.docs = slices.Delete(s.docs, i, i+1)
+	return nil
+}
+
+func TestResource(t *testing.T) {
+	id := func(s *shelf) *string { return &s.ID }
+	shelves := Resource[shelf]{
+		Name:  "shelf",
+		Store: &memoryStore[shelf]{id: id},
+		ID:    id,
+		BeforeCreate: func(ctx context.Context, s *shelf) error {
+			if strings.ContainsRune(s.ID, ' ') {
+				return validationErrors{"id": "must not contain spaces"}
+			}
+			return nil
+		},
+		BeforeDelete: func(ctx context.Context, id string) error {
+			if id == "fixed" {
+				return resourceConflict("Shelf with ID fixed is bolted to the wall")
+			}
+			return nil
+		},
+		Present: func(s shelf) interface{} {
+			s.Secret = ""
+			return s
+		},
+		JSONAPI: func(s shelf) jsonAPIResource {
+			return jsonAPIResource{Type: "shelves", ID: s.ID, Attributes: map[string]interface{}{"name": s.Name, "capacity": s.Capacity}}
+		},
+	}
+	e := echo.New()
+	e.Validator = bookValidator{}
+	e.GET("/shelves", shelves.List())
+	e.GET("/shelves/:id", shelves.Get())
+	e.POST("/shelves", shelves.Create())
+	e.PUT("/shelves/:id", shelves.Replace())
+	e.DELETE("/shelves/:id", shelves.Delete())
+
+	tests := []struct {
+		method, path, body string
+		status             int
+		answer             string
+		accept             string
+	}{
+		{http.MethodPost, "/shelves", `{"id":"a","name":"Attic","capacity":20,"secret":"s3"}`, http.StatusCreated, `"secret":"s3"`, ""},
+		{http.MethodPost, "/shelves", `{"id":"fixed","name":"Hall","capacity":5}`, http.StatusCreated, `"id":"fixed"`, ""},
+		{http.MethodPost, "/shelves", `{"id":"a","name":"Attic","capacity":20}`, http.StatusConflict, "Shelf with ID a already exists", ""},
+		{http.MethodPost, "/shelves", `{"id":"b","capacity":3}`, http.StatusUnprocessableEntity, `"name":"is required"`, ""},
+		{http.MethodPost, "/shelves", `{"id":"b c","name":"Basement","capacity":3}`, http.StatusUnprocessableEntity, "must not contain spaces", ""},
+		{http.MethodPost, "/shelves", `{"id":`, http.StatusBadRequest, "Invalid request payload", ""},
+		{http.MethodGet, "/shelves/a", "", http.StatusOK, `"name":"Attic"`, ""},
+		{http.MethodGet, "/shelves", "", http.StatusOK, `"id":"fixed"`, ""},
+		{http.MethodGet, "/shelves/z", "", http.StatusNotFound, "Shelf not found with ID z", ""},
+		{http.MethodGet, "/shelves/a", "", http.StatusOK, `"data":{"type":"shelves","id":"a","attributes":{"capacity":20,"name":"Attic"}}`, jsonAPIMediaType},
+		{http.MethodGet, "/shelves?fields[shelves]=name", "", http.StatusOK, `{"type":"shelves","id":"a","attributes":{"name":"Attic"}}`, jsonAPIMediaType},
+		{http.MethodPut, "/shelves/a", `{"name":"Loft","capacity":30}`, http.StatusOK, `"id":"a","name":"Loft"`, ""},
+		{http.MethodPut, "/shelves/a", `{"id":"b","name":"Loft","capacity":30}`, http.StatusUnprocessableEntity, "must match the ID in the path", ""},
+		{http.MethodPut, "/shelves/z", `{"name":"Loft","capacity":30}`, http.StatusNotFound, "Shelf not found with ID z", ""},
+		{http.MethodDelete, "/shelves/fixed", "", http.StatusConflict, "bolted to the wall", ""},
+		{http.MethodDelete, "/shelves/a", "", http.StatusOK, "", ""},
+		{http.MethodDelete, "/shelves/a", "", http.StatusNotFound, "Shelf not found with ID a", ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(echo.HeaderAccept, tt.accept)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != tt.status || !strings.Contains(rec.Body.String(), tt.answer) {
+			t.Errorf("%s %s %s answered %d %s, want %d with %s", tt.method, tt.path, tt.body, rec.Code, rec.Body, tt.status, tt.answer)
+		}
+		if tt.method == http.MethodGet && strings.Contains(rec.Body.String(), "secret") {
+			t.Errorf("GET %s shows the secret: %s", tt.path, rec.Body)
+		}
+	}
+}
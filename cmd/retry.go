@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"math/rand/v2"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+// Mongo has hiccups that go away by themselves: a replica set electing a
+// new primary, a connection dropped by a proxy. Reads of the repository
+// are tried again on such errors, up to RETRY_ATTEMPTS times in all,
+// waiting a random time of up to RETRY_BACKOFF, doubled for each attempt
+// and at most two seconds, in between. Writes are only tried again with
+// RETRY_WRITES, and only when the error proves they did not happen, as
+// trying a write that went through again would fail, e.g. with a conflict.
+// Calls that read after their write wrap the errors of those reads in
+// writeAppliedError, so they are not tried again either. Every retry is
+// counted in GET /metrics as mongo_retries, per operation.
+
+var mongoRetries = expvar.NewMap("mongo_retries")
+
+const maxRetryBackoff = 2 * time.Second
+
+// Server error codes of a primary stepping down or a node shutting down or
+// being unreachable, all of which a later attempt may not run into.
+var transientCodes = []int{
+	6,     // HostUnreachable
+	7,     // HostNotFound
+	89,    // NetworkTimeout
+	91,    // ShutdownInProgress
+	189,   // PrimarySteppedDown
+	9001,  // SocketException
+	10107, // NotWritablePrimary
+	11600, // InterruptedAtShutdown
+	11602, // InterruptedDueToReplStateChange
+	13435, // NotPrimaryNoSecondaryOk
+	13436, // NotPrimaryOrSecondary
+}
+
+// Whether a read that failed with err is worth another try.
+func isTransientError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if mongo.IsNetworkError(err) || isUnsentError(err) {
+		return true
+	}
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) {
+		if serverErr.HasErrorLabel("RetryableWriteError") || serverErr.HasErrorLabel("TransientTransactionError") {
+			return true
+		}
+		for _, code := range transientCodes {
+			if serverErr.HasErrorCode(code) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The error of a step after the write of a repository call went through.
+// It hides the error it wraps from errors.As, so even an unsent command
+// does not make the call look like it never happened.
+type writeAppliedError struct {
+	err error
+}
+
+func (e writeAppliedError) Error() string {
+	return e.err.Error()
+}
+
+// Whether err means the command never reached a server, because none was
+// available, so a write failing with it certainly did not happen.
+func isUnsentError(err error) bool {
+	var selection topology.ServerSelectionError
+	return errors.As(err, &selection)
+}
+
+type retryPolicy struct {
+	attempts int
+	backoff  time.Duration
+	writes   bool
+}
+
+// Runs op until it succeeds, fails with an error retryable tells apart as
+// transient, runs out of attempts, or the context ends.
+func (p retryPolicy) do(ctx context.Context, name string, retryable func(error) bool, op func() error) error {
+	wait := p.backoff
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= p.attempts || !retryable(err) {
+			return err
+		}
+		// Full jitter keeps the instances of the server from retrying
+		// in lockstep.
+		var delay time.Duration
+		if wait > 0 {
+			delay = rand.N(wait)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		mongoRetries.Add(name, 1)
+		wait = min(2*wait, maxRetryBackoff)
+	}
+}
+
+func (p retryPolicy) read(ctx context.Context, name string, op func() error) error {
+	return p.do(ctx, name, isTransientError, op)
+}
+
+func (p retryPolicy) write(ctx context.Context, name string, op func() error) error {
+	if !p.writes {
+		return op()
+	}
+	return p.do(ctx, name, isUnsentError, op)
+}
+
+// Wraps a repository so its calls are tried again on transient errors.
+type retryingBooks struct {
+	bookRepository
+	policy retryPolicy
+}
+
+func (r retryingBooks) List(ctx context.Context, q bookQuery) (books []BookStore, err error) {
+	err = r.policy.read(ctx, "list", func() error {
+		books, err = r.bookRepository.List(ctx, q)
+		return err
+	})
+	return books, err
+}
+
+func (r retryingBooks) Get(ctx context.Context, id string) (book BookStore, err error) {
+	err = r.policy.read(ctx, "get", func() error {
+		book, err = r.bookRepository.Get(ctx, id)
+		return err
+	})
+	return book, err
+}
+
+func (r retryingBooks) Count(ctx context.Context, q bookQuery) (n int64, err error) {
+	err = r.policy.read(ctx, "count", func() error {
+		n, err = r.bookRepository.Count(ctx, q)
+		return err
+	})
+	return n, err
+}
+
+func (r retryingBooks) Create(ctx context.Context, book *BookStore) error {
+	return r.policy.write(ctx, "create", func() error {
+		return r.bookRepository.Create(ctx, book)
+	})
+}
+
+func (r retryingBooks) Update(ctx context.Context, id string, changes bookChanges, version *int) (book BookStore, err error) {
+	err = r.policy.write(ctx, "update", func() error {
+		book, err = r.bookRepository.Update(ctx, id, changes, version)
+		return err
+	})
+	return book, err
+}
+
+func (r retryingBooks) Delete(ctx context.Context, id string, version *int) error {
+	return r.policy.write(ctx, "delete", func() error {
+		return r.bookRepository.Delete(ctx, id, version)
+	})
+}
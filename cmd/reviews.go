@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Reviews are kept in their own collection. Each book carries a summary of
+// its reviews (average rating and count), which is recomputed whenever a
+// review is added or removed. That way listings show ratings without
+// touching the reviews at all.
+type Review struct {
+	MongoID   primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	BookID    string             `bson:"bookid" json:"book_id"`
+	Rating    int                `json:"rating" validate:"required,min=1,max=5"`
+	Text      string             `json:"text"`
+	Reviewer  string             `json:"reviewer"`
+	CreatedAt time.Time          `json:"created_at"`
+}
+
+// The review summary stored with every reviewed book.
+type bookRating struct {
+	Average float64 `json:"average"`
+	Count   int     `json:"count"`
+}
+
+// Renders the average as five stars, rounded to the nearest whole star.
+func (r bookRating) Stars() string {
+	full := int(math.Round(r.Average))
+	return strings.Repeat("★", full) + strings.Repeat("☆", 5-full)
+}
+
+// Recomputes the rating summary of a book from its reviews.
+func refreshRating(ctx context.Context, coll, reviews *mongo.Collection, bookID string) error {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"bookid": bookID}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":     nil,
+			"average": bson.M{"$avg": "$rating"},
+			"count":   bson.M{"$sum": 1},
+		}}},
+	}
+	cursor, err := reviews.Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	var summary []bookRating
+	if err := cursor.All(ctx, &summary); err != nil {
+		return err
+	}
+
+	update := bson.M{"$unset": bson.M{"rating": ""}}
+	if len(summary) > 0 {
+		rating := summary[0]
+		rating.Average = math.Round(rating.Average*10) / 10
+		update = bson.M{"$set": bson.M{"rating": rating}}
+	}
+	_, err = coll.UpdateOne(ctx, bson.M{"id": bookID}, update)
+	return err
+}
+
+// Handles GET /api/books/:id/reviews, newest first.
+func listReviews(reviews *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		opts := options.Find().SetSort(bson.D{{Key: "createdat", Value: -1}})
+		cursor, err := reviews.Find(ctx, bson.M{"bookid": c.Param("id")}, opts)
+		if err != nil {
+			log.Printf("Error listing reviews of book %s: %v", c.Param("id"), err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to list reviews"})
+		}
+		ret := []Review{}
+		if err := cursor.All(ctx, &ret); err != nil {
+			log.Printf("Error listing reviews of book %s: %v", c.Param("id"), err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to list reviews"})
+		}
+		return c.JSON(http.StatusOK, ret)
+	}
+}
+
+// Handles POST /api/books/:id/reviews. The rating must be between 1 and 5.
+func createReview(coll, reviews *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		idParam := c.Param("id")
+		review := new(Review)
+		if err := c.Bind(review); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+		}
+		if err := c.Validate(review); err != nil {
+			return validationFailed(c, err)
+		}
+
+		if _, err := findBook(ctx, coll, idParam); err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Book not found with ID " + idParam})
+		} else if err != nil {
+			log.Printf("Error fetching book with ID %s: %v", idParam, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create review"})
+		}
+
+		review.MongoID = primitive.NewObjectID()
+		review.BookID = idParam
+		review.CreatedAt = now()
+		if _, err := reviews.InsertOne(ctx, review); err != nil {
+			log.Printf("Error inserting review: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create review"})
+		}
+		if err := refreshRating(ctx, coll, reviews, idParam); err != nil {
+			// The review is stored; the summary catches up with the next one.
+			log.Printf("Error refreshing the rating of book %s: %v", idParam, err)
+		}
+		return c.JSON(http.StatusCreated, review)
+	}
+}
+
+// Handles DELETE /api/books/:id/reviews/:review.
+func deleteReview(coll, reviews *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		idParam := c.Param("id")
+		reviewID, err := primitive.ObjectIDFromHex(c.Param("review"))
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Review not found with ID " + c.Param("review")})
+		}
+
+		result, err := reviews.DeleteOne(ctx, bson.M{"_id": reviewID, "bookid": idParam})
+		if err != nil {
+			log.Printf("Error deleting review %s: %v", c.Param("review"), err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete review"})
+		}
+		if result.DeletedCount == 0 {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Review not found with ID " + c.Param("review")})
+		}
+		if err := refreshRating(ctx, coll, reviews, idParam); err != nil {
+			log.Printf("Error refreshing the rating of book %s: %v", idParam, err)
+		}
+		return c.NoContent(http.StatusOK)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// A small in-process scheduler for maintenance, such as purging the recycle
+// bin. Each task runs every interval in its own goroutine, never twice at
+// the same time, and remembers how its last run went so admins can check
+// on it at GET /api/admin/tasks.
+type scheduler struct {
+	mu    sync.Mutex
+	tasks []*scheduledTask
+	// The context passed to Start, which manual runs use as well.
+	ctx context.Context
+}
+
+// A task reports what it did as a short summary, e.g. "Purged 3 books".
+type taskFunc func(ctx context.Context) (string, error)
+
+type scheduledTask struct {
+	name     string
+	interval time.Duration
+	run      taskFunc
+
+	// Guarded by the scheduler's mutex.
+	running bool
+	status  taskStatus
+}
+
+// What GET /api/admin/tasks shows about a task.
+type taskStatus struct {
+	Name         string     `json:"name"`
+	Interval     string     `json:"interval"`
+	Running      bool       `json:"running"`
+	LastRun      *time.Time `json:"last_run,omitempty"`
+	LastDuration string     `json:"last_duration,omitempty"`
+	LastResult   string     `json:"last_result,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+	NextRun      *time.Time `json:"next_run,omitempty"`
+}
+
+var (
+	errTaskNotFound = errors.New("no such task")
+	errTaskRunning  = errors.New("task is already running")
+)
+
+func newScheduler() *scheduler {
+	return &scheduler{ctx: context.Background()}
+}
+
+// Adds a task. Tasks with an interval of 0 or less are disabled and not
+// registered at all.
+func (s *scheduler) Register(name string, interval time.Duration, run taskFunc) {
+	if interval <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tasks = append(s.tasks, &scheduledTask{
+		name:     name,
+		interval: interval,
+		run:      run,
+		status:   taskStatus{Name: name, Interval: interval.String()},
+	})
+}
+
+// Runs every task once per interval until ctx is done. The first run of
+// each task happens one interval after the start.
+func (s *scheduler) Start(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ctx = ctx
+	for _, task := range s.tasks {
+		next := now().Add(task.interval)
+		task.status.NextRun = &next
+		go s.loop(ctx, task)
+	}
+}
+
+func (s *scheduler) loop(ctx context.Context, task *scheduledTask) {
+	ticker := time.NewTicker(task.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.execute(ctx, task); err == errTaskRunning {
+				log.Printf("Skipping task %s: the previous run is still going", task.name)
+			}
+		}
+	}
+}
+
+// Runs the task right away, unless it is running already.
+func (s *scheduler) execute(ctx context.Context, task *scheduledTask) error {
+	s.mu.Lock()
+	if task.running {
+		s.mu.Unlock()
+		return errTaskRunning
+	}
+	task.running = true
+	task.status.Running = true
+	s.mu.Unlock()
+
+	started := now()
+	result, err := task.run(ctx)
+	if err != nil {
+		log.Printf("Error running task %s: %v", task.name, err)
+	} else if result != "" {
+		log.Printf("Task %s: %s", task.name, result)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next := now().Add(task.interval)
+	task.running = false
+	task.status.Running = false
+	task.status.LastRun = &started
+	task.status.LastDuration = now().Sub(started).String()
+	task.status.LastResult = result
+	task.status.LastError = ""
+	if err != nil {
+		task.status.LastError = err.Error()
+	}
+	task.status.NextRun = &next
+	return nil
+}
+
+// Starts the named task in the background, outside its schedule.
+func (s *scheduler) Trigger(name string) error {
+	s.mu.Lock()
+	ctx := s.ctx
+	var found *scheduledTask
+	for _, task := range s.tasks {
+		if task.name == name {
+			found = task
+		}
+	}
+	running := found != nil && found.running
+	s.mu.Unlock()
+	if found == nil {
+		return errTaskNotFound
+	}
+	if running {
+		return errTaskRunning
+	}
+	go s.execute(ctx, found)
+	return nil
+}
+
+func (s *scheduler) Status() []taskStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := []taskStatus{}
+	for _, task := range s.tasks {
+		ret = append(ret, task.status)
+	}
+	return ret
+}
+
+// Handles GET /api/admin/tasks.
+func listTasks(s *scheduler) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, s.Status())
+	}
+}
+
+// Handles POST /api/admin/tasks/:name/run, which answers 202 and runs the
+// task in the background. GET /api/admin/tasks shows when it is done.
+func runTask(s *scheduler) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		name := c.Param("name")
+		switch err := s.Trigger(name); err {
+		case errTaskNotFound:
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Task not found with name " + name})
+		case errTaskRunning:
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Task " + name + " is already running"})
+		}
+		return c.NoContent(http.StatusAccepted)
+	}
+}
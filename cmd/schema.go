@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Binding a body into a struct quietly drops fields it does not know, so a
+// misspelled "titel" ends up as an empty title, and the client learns that
+// the title is required instead of what it did wrong. Routes that take a
+// JSON document therefore check it against a JSON Schema first, with
+// validateBody, and answer 422 with a message per field: unknown fields,
+// values of the wrong type, and missing required fields. The rules that go
+// beyond the shape of the document, like ISBN check digits, stay in the
+// validate tags; see validation.go.
+//
+// The schemas use a subset of JSON Schema (draft 2020-12): type,
+// properties, required, additionalProperties (true or false), items, enum,
+// anyOf, pattern, minLength, maxLength, minimum, and maximum.
+
+type jsonSchema struct {
+	// A type name or a list of them.
+	Type                 interface{}            `json:"type,omitempty"`
+	Properties           map[string]*jsonSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	AdditionalProperties *bool                  `json:"additionalProperties,omitempty"`
+	Items                *jsonSchema            `json:"items,omitempty"`
+	Enum                 []interface{}          `json:"enum,omitempty"`
+	AnyOf                []*jsonSchema          `json:"anyOf,omitempty"`
+	Pattern              string                 `json:"pattern,omitempty"`
+	MinLength            *int                   `json:"minLength,omitempty"`
+	MaxLength            *int                   `json:"maxLength,omitempty"`
+	Minimum              *float64               `json:"minimum,omitempty"`
+	Maximum              *float64               `json:"maximum,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// Parses a schema written in the source, panicking on mistakes in it.
+func mustSchema(text string) *jsonSchema {
+	var s jsonSchema
+	if err := json.Unmarshal([]byte(text), &s); err != nil {
+		panic("invalid JSON schema: " + err.Error())
+	}
+	s.compile()
+	return &s
+}
+
+func (s *jsonSchema) compile() {
+	if s.Pattern != "" {
+		s.pattern = regexp.MustCompile(s.Pattern)
+	}
+	for _, prop := range s.Properties {
+		prop.compile()
+	}
+	if s.Items != nil {
+		s.Items.compile()
+	}
+	for _, alt := range s.AnyOf {
+		alt.compile()
+	}
+}
+
+// A copy of an object schema with other required properties.
+func (s *jsonSchema) requiring(fields ...string) *jsonSchema {
+	c := *s
+	c.Required = fields
+	return &c
+}
+
+// A copy of an object schema for a JSON merge patch (RFC 7396): nothing is
+// required, and null, which clears a field, is fine for every property.
+func (s *jsonSchema) mergePatch() *jsonSchema {
+	c := *s
+	c.Required = nil
+	c.AnyOf = nil
+	c.Properties = make(map[string]*jsonSchema, len(s.Properties))
+	null := &jsonSchema{Type: "null"}
+	for name, prop := range s.Properties {
+		c.Properties[name] = &jsonSchema{AnyOf: []*jsonSchema{prop, null}}
+	}
+	return &c
+}
+
+func (s *jsonSchema) types() []string {
+	switch t := s.Type.(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		var names []string
+		for _, name := range t {
+			names = append(names, name.(string))
+		}
+		return names
+	}
+	return nil
+}
+
+// The JSON Schema type of a value decoded with UseNumber.
+func jsonType(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if _, err := strconv.ParseInt(v.String(), 10, 64); err == nil {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
+
+var typeMessages = map[string]string{
+	"string":  "must be a string",
+	"integer": "must be a whole number",
+	"number":  "must be a number",
+	"boolean": "must be true or false",
+	"array":   "must be a list",
+	"object":  "must be an object",
+	"null":    "must be null",
+}
+
+// Checks a value, adding a message for each problem to errs, keyed by the
+// path of the value, e.g. "tags[1]". A value fails anyOf with the messages
+// of its first alternative, and is checked against the rest of the schema
+// as well.
+func (s *jsonSchema) check(v interface{}, path string, errs validationErrors) {
+	if len(s.AnyOf) > 0 && !slices.ContainsFunc(s.AnyOf, func(alt *jsonSchema) bool { return alt.valid(v) }) {
+		s.AnyOf[0].check(v, path, errs)
+	}
+	key := path
+	if key == "" {
+		key = "body"
+	}
+	if types := s.types(); len(types) > 0 {
+		t := jsonType(v)
+		if !slices.Contains(types, t) && !(t == "integer" && slices.Contains(types, "number")) {
+			errs[key] = typeMessages[types[0]]
+			return
+		}
+	}
+	if len(s.Enum) > 0 && !slices.ContainsFunc(s.Enum, func(e interface{}) bool { return jsonEqual(e, v) }) {
+		var allowed []string
+		for _, e := range s.Enum {
+			allowed = append(allowed, strings.Trim(string(mustJSON(e)), `"`))
+		}
+		errs[key] = "must be one of " + strings.Join(allowed, ", ")
+		return
+	}
+	switch v := v.(type) {
+	case string:
+		length := len([]rune(v))
+		switch {
+		case s.MinLength != nil && length < *s.MinLength:
+			errs[key] = "must be at least " + strconv.Itoa(*s.MinLength) + " characters long"
+		case s.MaxLength != nil && length > *s.MaxLength:
+			errs[key] = "must be at most " + strconv.Itoa(*s.MaxLength) + " characters long"
+		case s.pattern != nil && !s.pattern.MatchString(v):
+			errs[key] = "has the wrong format"
+		}
+	case json.Number:
+		n, _ := v.Float64()
+		switch {
+		case s.Minimum != nil && n < *s.Minimum:
+			errs[key] = "must be at least " + strconv.FormatFloat(*s.Minimum, 'f', -1, 64)
+		case s.Maximum != nil && n > *s.Maximum:
+			errs[key] = "must be at most " + strconv.FormatFloat(*s.Maximum, 'f', -1, 64)
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range v {
+				s.Items.check(item, path+"["+strconv.Itoa(i)+"]", errs)
+			}
+		}
+	case map[string]interface{}:
+		prefix := ""
+		if path != "" {
+			prefix = path + "."
+		}
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				errs[prefix+name] = "is required"
+			}
+		}
+		for name, value := range v {
+			prop, ok := s.Properties[name]
+			switch {
+			case ok:
+				prop.check(value, prefix+name, errs)
+			case s.AdditionalProperties != nil && !*s.AdditionalProperties:
+				errs[prefix+name] = "is not a known field"
+			}
+		}
+	}
+}
+
+func (s *jsonSchema) valid(v interface{}) bool {
+	errs := validationErrors{}
+	s.check(v, "", errs)
+	return len(errs) == 0
+}
+
+func mustJSON(v interface{}) []byte {
+	raw, _ := json.Marshal(v)
+	return raw
+}
+
+func jsonEqual(a, b interface{}) bool {
+	return bytes.Equal(mustJSON(a), mustJSON(b))
+}
+
+// Checks JSON bodies against the schema before the handler binds them.
+// Other bodies, like JSON Patch documents or uploads, and bodies that are
+// no JSON at all are left to the handler, which answers them as before.
+func validateBody(schema *jsonSchema) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			mediaType, _, _ := mime.ParseMediaType(req.Header.Get(echo.HeaderContentType))
+			if mediaType != echo.MIMEApplicationJSON && mediaType != mergePatchType && mediaType != "" {
+				return next(c)
+			}
+			body, err := io.ReadAll(req.Body)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+			}
+			req.Body = io.NopCloser(bytes.NewReader(body))
+			dec := json.NewDecoder(bytes.NewReader(body))
+			dec.UseNumber()
+			var doc interface{}
+			if dec.Decode(&doc) != nil {
+				return next(c)
+			}
+			errs := validationErrors{}
+			schema.check(doc, "", errs)
+			if len(errs) > 0 {
+				return validationFailed(c, errs)
+			}
+			return next(c)
+		}
+	}
+}
+
+// Pages, years, and the like are sent as numbers, or as strings of digits
+// by older clients; see flexInt.
+const wholeNumberSchema = `{"anyOf": [{"type": "integer"}, {"type": "string", "pattern": "^\\s*(-?[0-9]+)?\\s*$"}, {"type": "null"}]}`
+
+// An amount, as a number or a string of digits, in a currency; see
+// price.go.
+const priceSchema = `{
+	"type": ["object", "null"],
+	"properties": {
+		"amount": {"anyOf": [{"type": "number", "minimum": 0}, {"type": "string", "pattern": "^\\s*[0-9]+(\\.[0-9]+)?\\s*$"}]},
+		"currency": {"type": "string", "pattern": "^[A-Za-z]{3}$"}
+	},
+	"required": ["amount", "currency"],
+	"additionalProperties": false
+}`
+
+// A book as sent to POST and PUT /api/books. The fields the server
+// maintains are allowed, so a book read with GET can be sent back, but
+// they are ignored. Requests always name the fields in snake_case, so with
+// JSON_FIELD_NAMING=camelCase the answer has to be renamed first. The
+// author is given by name, or by author_id alone.
+var bookSchema = mustSchema(`{
+	"type": "object",
+	"properties": {
+		"id": {"type": "string"},
+		"title": {"type": "string"},
+		"author": {"type": "string"},
+		"author_id": {"type": "string"},
+		"edition": {"type": "string"},
+		"pages": ` + wholeNumberSchema + `,
+		"year": ` + wholeNumberSchema + `,
+		"tags": {"type": ["array", "null"], "items": {"type": "string"}},
+		"series": {"type": "string"},
+		"series_index": ` + wholeNumberSchema + `,
+		"publisher": {"type": "string"},
+		"language": {"type": "string"},
+		"description": {"type": "string"},
+		"price": ` + priceSchema + `,
+		"version": ` + wholeNumberSchema + `,
+		"available": {},
+		"due_at": {},
+		"checkout": {},
+		"rating": {},
+		"copies": {},
+		"display_price": {},
+		"cover_url": {},
+		"thumbnail_url": {},
+		"created_at": {},
+		"updated_at": {},
+		"deleted_at": {},
+		"merged_into": {}
+	},
+	"required": ["title"],
+	"anyOf": [{"required": ["author"]}, {"required": ["author_id"]}],
+	"additionalProperties": false
+}`)
+
+var (
+	newBookSchema   = bookSchema.requiring("id", "title")
+	bookPatchSchema = bookSchema.mergePatch()
+)
+
+// An author as sent to POST and PUT /api/authors.
+var authorSchema = mustSchema(`{
+	"type": "object",
+	"properties": {
+		"id": {"type": "string"},
+		"name": {"type": "string"},
+		"bio": {"type": "string"},
+		"birth_year": ` + wholeNumberSchema + `,
+		"created_at": {},
+		"updated_at": {}
+	},
+	"required": ["name"],
+	"additionalProperties": false
+}`)
+
+// A webhook as sent to POST /api/webhooks.
+var webhookSchema = mustSchema(`{
+	"type": "object",
+	"properties": {
+		"url": {"type": "string"},
+		"events": {"type": ["array", "null"], "items": {"enum": ["created", "updated", "deleted"]}},
+		"secret": {"type": "string"}
+	},
+	"required": ["url"],
+	"additionalProperties": false
+}`)
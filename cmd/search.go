@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Besides the lowercased title and author, every book keeps the edge
+// n-grams of the words in them, i.e. the beginnings of each word from
+// ngramRange.Min up to ngramRange.Max letters: "Dracula" gives "dr", "dra",
+// "drac", and so on. A search matches books by the grams of the words
+// searched for, so a misspelled "Dracla" still shares "dr", "dra", and
+// "drac" with "Dracula". The grams live in the indexed titlegrams and
+// authorgrams fields; gramsize remembers the range they were cut with.
+
+// The lengths of the grams cut from each word, set from the configuration
+// before any book is written.
+var ngramRange = struct{ Min, Max int }{2, 12}
+
+// The words of a text, lowercased, split at everything that is neither a
+// letter nor a digit.
+func searchWords(text string) []string {
+	return strings.FieldsFunc(searchKey(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// The edge n-grams of the words of a text, each once.
+func edgeGrams(text string) []string {
+	grams := []string{}
+	seen := map[string]bool{}
+	for _, word := range searchWords(text) {
+		runes := []rune(word)
+		for n := ngramRange.Min; n <= min(len(runes), ngramRange.Max); n++ {
+			if gram := string(runes[:n]); !seen[gram] {
+				seen[gram] = true
+				grams = append(grams, gram)
+			}
+		}
+	}
+	return grams
+}
+
+func gramSize() string {
+	return fmt.Sprintf("%d-%d", ngramRange.Min, ngramRange.Max)
+}
+
+// What titles and authors are compared by: lowercased, without surrounding
+// spaces.
+func searchKey(text string) string {
+	return strings.ToLower(strings.TrimSpace(text))
+}
+
+// Fills in the search fields of a book about to be inserted.
+func (b *BookStore) setSearchKeys() {
+	b.TitleKey = searchKey(b.BookName)
+	b.AuthorKey = searchKey(b.BookAuthor)
+	b.TitleGrams = edgeGrams(b.BookName)
+	b.AuthorGrams = edgeGrams(b.BookAuthor)
+	b.GramSize = gramSize()
+}
+
+// Adds the search fields to an update that changes the title or the author.
+func withSearchKeys(set bson.M) bson.M {
+	if title, ok := set["bookname"].(string); ok {
+		set["titlekey"] = searchKey(title)
+		set["titlegrams"] = edgeGrams(title)
+		set["gramsize"] = gramSize()
+	}
+	if author, ok := set["bookauthor"].(string); ok {
+		set["authorkey"] = searchKey(author)
+		set["authorgrams"] = edgeGrams(author)
+		set["gramsize"] = gramSize()
+	}
+	return set
+}
+
+// Indexes the search fields and fills them in for books stored before they
+// existed, or cut into grams of another size. Like the other migrations it
+// runs on every start, and only touches books that need it.
+func prepareSearchKeys(ctx context.Context, coll *mongo.Collection) error {
+	_, err := coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "titlekey", Value: 1}}},
+		{Keys: bson.D{{Key: "authorkey", Value: 1}}},
+		{Keys: bson.D{{Key: "titlegrams", Value: 1}}},
+		{Keys: bson.D{{Key: "authorgrams", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	stale := bson.M{"$or": bson.A{
+		bson.M{"titlekey": bson.M{"$exists": false}},
+		bson.M{"authorkey": bson.M{"$exists": false}},
+		bson.M{"gramsize": bson.M{"$ne": gramSize()}},
+	}}
+	cursor, err := coll.Find(ctx, stale, options.Find().SetProjection(bson.M{"bookname": 1, "bookauthor": 1}))
+	if err != nil {
+		return err
+	}
+	var books []BookStore
+	if err := cursor.All(ctx, &books); err != nil {
+		return err
+	}
+	var models []mongo.WriteModel
+	for _, book := range books {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": book.MongoID}).
+			SetUpdate(bson.M{"$set": withSearchKeys(bson.M{"bookname": book.BookName, "bookauthor": book.BookAuthor})}))
+	}
+	if len(models) > 0 {
+		_, err = coll.BulkWrite(ctx, models)
+	}
+	return err
+}
+
+// A search for books, as sent to GET /api/books/search.
+type searchQuery struct {
+	Text string
+	// Tolerate misspellings, and order by relevance instead of title.
+	Fuzzy bool
+	Limit int
+}
+
+// A book found by a search. The score is higher the better the book
+// matches; searches that are not ordered by relevance leave it at 0.
+type searchHit struct {
+	Book  BookStore
+	Score float64
+	// The title and author with the matching words marked, by JSON field,
+	// from backends that can tell.
+	Highlights map[string]string
+}
+
+// Where searches run. The backends agree on what matches in general, but
+// differ in the details, and in how they rank the books.
+type bookSearcher interface {
+	Search(ctx context.Context, q searchQuery) ([]searchHit, error)
+}
+
+// Picks the backend named by cfg.SearchBackend: "ngram" for the edge
+// n-grams, "text" for a text index, "atlas" for Atlas Search, which falls
+// back to the text index outside of Atlas, or "elasticsearch" for the
+// mirror in es. Fuzzy searches need the n-grams unless Atlas Search or
+// Elasticsearch runs them.
+func newBookSearcher(ctx context.Context, cfg Config, coll *mongo.Collection, es *elasticIndex) (bookSearcher, error) {
+	grams := gramSearch{coll}
+	switch cfg.SearchBackend {
+	case "elasticsearch":
+		if es == nil {
+			return nil, fmt.Errorf("SEARCH_BACKEND elasticsearch needs ELASTICSEARCH_URL")
+		}
+		return es, nil
+	case "text", "atlas":
+		if err := prepareTextIndex(ctx, coll); err != nil {
+			return nil, err
+		}
+		text := textSearch{coll: coll, fuzzy: grams}
+		if cfg.SearchBackend == "text" {
+			return text, nil
+		}
+		return &atlasSearch{coll: coll, index: cfg.AtlasSearchIndex, fallback: text}, nil
+	case "ngram":
+		return grams, nil
+	}
+	return nil, fmt.Errorf("unknown SEARCH_BACKEND %q", cfg.SearchBackend)
+}
+
+// Searches the edge n-grams in the books collection.
+type gramSearch struct {
+	coll *mongo.Collection
+}
+
+func (s gramSearch) Search(ctx context.Context, q searchQuery) ([]searchHit, error) {
+	if q.Fuzzy {
+		return s.fuzzy(ctx, q)
+	}
+	// Every word has to begin a word of the title or the author. Words
+	// longer than the longest gram are matched by their beginning.
+	and := bson.A{}
+	for _, word := range searchWords(q.Text) {
+		runes := []rune(word)
+		if len(runes) < ngramRange.Min {
+			continue
+		}
+		gram := string(runes[:min(len(runes), ngramRange.Max)])
+		and = append(and, bson.M{"$or": bson.A{bson.M{"titlegrams": gram}, bson.M{"authorgrams": gram}}})
+	}
+	hits := []searchHit{}
+	if len(and) == 0 {
+		return hits, nil
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "titlekey", Value: 1}, {Key: "_id", Value: 1}}).SetLimit(int64(q.Limit))
+	cursor, err := s.coll.Find(ctx, notDeleted(bson.M{"$and": and}), opts)
+	if err != nil {
+		return nil, err
+	}
+	var books []BookStore
+	if err := cursor.All(ctx, &books); err != nil {
+		return nil, err
+	}
+	for _, book := range books {
+		hits = append(hits, searchHit{Book: book})
+	}
+	return hits, nil
+}
+
+// Ranks the books by how many grams of the search they share. A book
+// needs at least half of them to count as a match, so "dracla" finds
+// "Dracula" (3 of 5), but not "Drama" (2 of 5).
+func (s gramSearch) fuzzy(ctx context.Context, q searchQuery) ([]searchHit, error) {
+	grams := edgeGrams(q.Text)
+	hits := []searchHit{}
+	if len(grams) == 0 {
+		return hits, nil
+	}
+	ofBook := bson.M{"$setUnion": bson.A{
+		bson.M{"$ifNull": bson.A{"$titlegrams", bson.A{}}},
+		bson.M{"$ifNull": bson.A{"$authorgrams", bson.A{}}},
+	}}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: notDeleted(bson.M{"$or": bson.A{
+			bson.M{"titlegrams": bson.M{"$in": grams}},
+			bson.M{"authorgrams": bson.M{"$in": grams}},
+		}})}},
+		{{Key: "$set", Value: bson.M{"score": bson.M{"$size": bson.M{"$setIntersection": bson.A{ofBook, grams}}}}}},
+		{{Key: "$match", Value: bson.M{"score": bson.M{"$gte": math.Ceil(float64(len(grams)) / 2)}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "score", Value: -1}, {Key: "titlekey", Value: 1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$limit", Value: q.Limit}},
+	}
+	cursor, err := s.coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var found []struct {
+		BookStore `bson:",inline"`
+		Score     int `bson:"score"`
+	}
+	if err := cursor.All(ctx, &found); err != nil {
+		return nil, err
+	}
+	for _, hit := range found {
+		// Scores are the share of the grams found, from 0.5 to 1.
+		hits = append(hits, searchHit{Book: hit.BookStore, Score: float64(hit.Score) / float64(len(grams))})
+	}
+	return hits, nil
+}
+
+// Handles GET /api/books/search?q=dracula. Books match when every word
+// searched for begins a word of their title or author; they are listed by
+// title, or by relevance with their score when the backend ranks them.
+// With &fuzzy=true, misspelled words match as well, and the best matches
+// come first. ?limit= caps the number of books. With &facets=true, backends
+// that count the matches by tag, author, and decade answer with
+// {"books": [...], "facets": {...}} instead of the list of books.
+func searchBooks(searcher bookSearcher) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		errs := validationErrors{}
+		q := searchQuery{Text: c.QueryParam("q"), Limit: defaultPageSize}
+		if strings.TrimSpace(q.Text) == "" {
+			errs["q"] = "is required"
+		}
+		if raw := c.QueryParam("fuzzy"); raw != "" {
+			fuzzy, err := strconv.ParseBool(raw)
+			if err != nil {
+				errs["fuzzy"] = "must be true or false"
+			}
+			q.Fuzzy = fuzzy
+		}
+		if raw := c.QueryParam("limit"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 1 || n > maxPageSize {
+				errs["limit"] = "must be a whole number from 1 to " + strconv.Itoa(maxPageSize)
+			}
+			q.Limit = n
+		}
+		var wantFacets bool
+		if raw := c.QueryParam("facets"); raw != "" {
+			var err error
+			if wantFacets, err = strconv.ParseBool(raw); err != nil {
+				errs["facets"] = "must be true or false"
+			}
+		}
+		faceted, canFacet := searcher.(facetSearcher)
+		if wantFacets && !canFacet {
+			errs["facets"] = "are only counted with SEARCH_BACKEND=elasticsearch"
+		}
+		if len(errs) > 0 {
+			return validationFailed(c, errs)
+		}
+
+		hits, err := searcher.Search(c.Request().Context(), q)
+		if err != nil {
+			log.Printf("Error searching for %q: %v", q.Text, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to search books"})
+		}
+		ret := []map[string]interface{}{}
+		for _, hit := range hits {
+			book := bookToMap(hit.Book)
+			if hit.Score != 0 {
+				book["score"] = math.Round(hit.Score*1000) / 1000
+			}
+			if len(hit.Highlights) > 0 {
+				book["highlights"] = hit.Highlights
+			}
+			ret = append(ret, book)
+		}
+		if !wantFacets {
+			return c.JSON(http.StatusOK, ret)
+		}
+		facets, err := faceted.Facets(c.Request().Context(), q)
+		if err != nil {
+			log.Printf("Error counting facets for %q: %v", q.Text, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to search books"})
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"books": ret, "facets": facets})
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/CAPS-Cloud/exercises"
+	"gopkg.in/yaml.v3"
+)
+
+// An empty database is seeded with a few books when the server starts, so
+// there is something to look at. They come from the file SEED_FILE names,
+// a JSON or YAML array of books written like the body of POST /api/books,
+// or from seeds/books.json, built into the binary. Books already in the
+// database are left alone. SEED_ON_START=false, or `serve --seed=false`,
+// skips seeding, and `go run ./cmd seed` seeds without starting the server.
+
+const defaultSeedFile = "seeds/books.json"
+
+// Reads the seed books from path, or the built-in ones when path is empty,
+// and checks them like POST /api/books would.
+func loadSeeds(path string) ([]BookStore, error) {
+	var raw []byte
+	var err error
+	if path == "" {
+		raw, err = fs.ReadFile(exercises.Seeds, defaultSeedFile)
+		path = defaultSeedFile
+	} else {
+		raw, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		// The books only know their JSON names, so the YAML goes through
+		// JSON on its way in.
+		var doc interface{}
+		if err := yaml.Unmarshal(raw, &doc); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+		if raw, err = json.Marshal(doc); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+	}
+	var books []BookStore
+	if err := json.Unmarshal(raw, &books); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	seen := map[string]bool{}
+	for i, book := range books {
+		if msg := validateBulkBook(book); msg != "" {
+			return nil, fmt.Errorf("book %d (%s) in %s: %s", i+1, book.ID, path, msg)
+		}
+		if seen[book.ID] {
+			return nil, fmt.Errorf("book %d in %s: the ID %s appears twice", i+1, path, book.ID)
+		}
+		seen[book.ID] = true
+	}
+	return books, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Books may belong to a series, like "The Lord of the Rings", in which
+// series_index gives their position. Series are not stored on their own;
+// they are grouped from the books whenever they are asked for.
+
+// A volume of a series, as listed by GET /api/series.
+type seriesVolume struct {
+	ID          string  `bson:"id" json:"id"`
+	Title       string  `bson:"bookname" json:"title"`
+	Author      string  `bson:"bookauthor" json:"author"`
+	SeriesIndex flexInt `bson:"seriesindex" json:"series_index"`
+}
+
+type bookSeries struct {
+	Name    string         `bson:"_id" json:"series"`
+	Count   int            `bson:"count" json:"count"`
+	Volumes []seriesVolume `bson:"volumes" json:"volumes"`
+}
+
+// Groups the books into their series. Volumes are ordered by their index,
+// those without one come last. The filter may narrow the books down, e.g.
+// to a single series.
+func findSeries(ctx context.Context, coll *mongo.Collection, filter bson.M) ([]bookSeries, error) {
+	match := notDeleted(filter)
+	if _, ok := match["series"]; !ok {
+		match["series"] = bson.M{"$nin": bson.A{nil, ""}}
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		// Missing indexes would sort before 1, so push them behind every
+		// real one.
+		{{Key: "$set", Value: bson.M{"sortindex": bson.M{"$cond": bson.A{
+			bson.M{"$gt": bson.A{"$seriesindex", 0}}, "$seriesindex", int64(1) << 53,
+		}}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "sortindex", Value: 1}, {Key: "bookname", Value: 1}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   "$series",
+			"count": bson.M{"$sum": 1},
+			"volumes": bson.M{"$push": bson.M{
+				"id":          "$id",
+				"bookname":    "$bookname",
+				"bookauthor":  "$bookauthor",
+				"seriesindex": "$seriesindex",
+			}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+	}
+	cursor, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	series := []bookSeries{}
+	err = cursor.All(ctx, &series)
+	return series, err
+}
+
+// Handles GET /api/series.
+func listSeries(coll *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		series, err := findSeries(c.Request().Context(), coll, bson.M{})
+		if err != nil {
+			log.Printf("Error listing series: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to list series"})
+		}
+		return c.JSON(http.StatusOK, series)
+	}
+}
+
+// Handles GET /series/:name, rendering the volumes of one series in order.
+func seriesPage(coll *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		name := c.Param("name")
+		// Echo leaves the name escaped when the path holds escapes Go
+		// would not have made itself, like %2F for a slash.
+		if c.Request().URL.RawPath != "" {
+			unescaped, err := url.PathUnescape(name)
+			if err != nil {
+				return c.NoContent(http.StatusNotFound)
+			}
+			name = unescaped
+		}
+		series, err := findSeries(c.Request().Context(), coll, bson.M{"series": name})
+		if err != nil {
+			log.Printf("Error loading series %q: %v", name, err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		if len(series) == 0 {
+			return c.NoContent(http.StatusNotFound)
+		}
+		return c.Render(http.StatusOK, "series-page", series[0])
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// The web pages keep a little state per browser: who is logged in, the
+// flash messages not shown yet, and preferences like the number of rows in
+// the book table. It lives in a cookie, encrypted and authenticated with
+// AES-GCM, so the browser can neither read nor change it.
+type session struct {
+	User         string    `json:"user,omitempty"`
+	Role         string    `json:"role,omitempty"`
+	LoginExpires time.Time `json:"login_expires,omitempty"`
+	Flashes      []flash   `json:"flashes,omitempty"`
+	PageSize     int       `json:"page_size,omitempty"`
+	// The storefront cart; see cart.go.
+	Cart []cartItem `json:"cart,omitempty"`
+
+	// Set by Changed, so the cookie is only written when needed.
+	changed bool
+}
+
+// Marks the session to be saved with the response.
+func (s *session) Changed() {
+	s.changed = true
+}
+
+const (
+	sessionCookie = "session"
+	// The cookie outlives the login, so preferences are kept for a while.
+	sessionLifetime = 30 * 24 * time.Hour
+)
+
+type sessionStore struct {
+	aead cipher.AEAD
+}
+
+// Derives the cookie key from the secret. Without a secret, a random key
+// is used, and sessions end when the server restarts.
+func newSessionStore(secret string) *sessionStore {
+	key := sha256.Sum256([]byte(secret))
+	if secret == "" {
+		log.Printf("SESSION_SECRET is not set; sessions will not survive a restart")
+		if _, err := rand.Read(key[:]); err != nil {
+			log.Fatalf("Error generating a session key: %v", err)
+		}
+	}
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		log.Fatalf("Error setting up sessions: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		log.Fatalf("Error setting up sessions: %v", err)
+	}
+	return &sessionStore{aead: aead}
+}
+
+func (st *sessionStore) encode(s *session) (string, error) {
+	plain, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, st.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(st.aead.Seal(nonce, nonce, plain, []byte(sessionCookie))), nil
+}
+
+func (st *sessionStore) decode(value string) (*session, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < st.aead.NonceSize() {
+		return nil, errors.New("session cookie too short")
+	}
+	nonce, sealed := sealed[:st.aead.NonceSize()], sealed[st.aead.NonceSize():]
+	plain, err := st.aead.Open(nil, nonce, sealed, []byte(sessionCookie))
+	if err != nil {
+		return nil, err
+	}
+	s := new(session)
+	return s, json.Unmarshal(plain, s)
+}
+
+// Loads the session of the request, and saves it with the response when a
+// handler changed it. Cookies that were tampered with, or sealed with
+// another key, start a new session.
+func (st *sessionStore) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			s := new(session)
+			if cookie, err := c.Cookie(sessionCookie); err == nil {
+				if decoded, err := st.decode(cookie.Value); err == nil {
+					s = decoded
+				}
+			}
+			if s.User != "" && now().After(s.LoginExpires) {
+				s.User, s.Role = "", ""
+				s.Changed()
+			}
+			c.Set("session", s)
+			c.Response().Before(func() {
+				if !s.changed {
+					return
+				}
+				value, err := st.encode(s)
+				if err != nil {
+					log.Printf("Error saving session: %v", err)
+					return
+				}
+				c.SetCookie(&http.Cookie{
+					Name:     sessionCookie,
+					Value:    value,
+					Path:     "/",
+					MaxAge:   int(sessionLifetime.Seconds()),
+					HttpOnly: true,
+					SameSite: http.SameSiteLaxMode,
+				})
+			})
+			return next(c)
+		}
+	}
+}
+
+// The session of the request. Outside the middleware, changes to it are
+// simply lost.
+func currentSession(c echo.Context) *session {
+	if s, ok := c.Get("session").(*session); ok {
+		return s
+	}
+	s := new(session)
+	c.Set("session", s)
+	return s
+}
+
+// Handles GET /login, the login form of the web pages.
+func loginPage(c echo.Context) error {
+	// The form carries the CSRF token itself, since the page may be
+	// opened on its own, without the script of the start page.
+	return c.Render(http.StatusOK, "login-page", map[string]interface{}{"CSRF": csrfToken(c)})
+}
+
+// Handles POST /login, sent by the login form. The user stays logged in to
+// the session for ttl and may then use the web pages with their role. Either
+// way, the browser is sent back to the start page, which tells how it went.
+func webLogin(users *mongo.Collection, access accessControl, ttl time.Duration) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !access.enabled() {
+			addFlash(c, flashError, "Logins are disabled because no JWT secret is configured.")
+			return c.Redirect(http.StatusSeeOther, "/")
+		}
+		user, err := checkLogin(c.Request().Context(), users, c.FormValue("username"), c.FormValue("password"))
+		if err == errWrongLogin {
+			addFlash(c, flashError, "Wrong username or password.")
+			return c.Redirect(http.StatusSeeOther, "/")
+		} else if err != nil {
+			log.Printf("Error fetching user %s: %v", c.FormValue("username"), err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		s := currentSession(c)
+		s.User, s.Role, s.LoginExpires = user.Username, user.Role, now().Add(ttl)
+		s.Changed()
+		addFlash(c, flashUpdated, "Logged in as "+user.Username+".")
+		return c.Redirect(http.StatusSeeOther, "/")
+	}
+}
+
+// Handles POST /logout.
+func webLogout(c echo.Context) error {
+	s := currentSession(c)
+	s.User, s.Role, s.LoginExpires = "", "", time.Time{}
+	s.Changed()
+	return c.Redirect(http.StatusSeeOther, "/")
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Books like a given one are those by the same author, with tags in
+// common, or written within yearSpan years of it. Each of these adds to
+// their score:
+//
+//   - 3 for the same author,
+//   - 1 for every tag in common,
+//   - up to 1 for the year, the closer the more.
+//
+// So another novel by Bram Stoker outranks an unrelated horror novel of
+// the same year.
+
+// How many similar books GET /api/books/:id/similar returns, unless told
+// otherwise with ?limit=.
+const (
+	defaultSimilar = 5
+	maxSimilar     = 50
+)
+
+// Books written further apart than this many years are not similar by
+// their year.
+const yearSpan = 10
+
+// A book like another one, and how much it is like it.
+type similarBook struct {
+	BookStore `bson:",inline"`
+	Score     float64 `bson:"score"`
+}
+
+// Finds up to limit books most like book, best first.
+func findSimilar(ctx context.Context, coll *mongo.Collection, book BookStore, limit int) ([]similarBook, error) {
+	key := searchKey(book.BookAuthor)
+	tags := book.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	or := bson.A{bson.M{"authorkey": key}}
+	if len(tags) > 0 {
+		or = append(or, bson.M{"tags": bson.M{"$in": tags}})
+	}
+	score := bson.A{
+		bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$authorkey", key}}, 3, 0}},
+		bson.M{"$size": bson.M{"$setIntersection": bson.A{bson.M{"$ifNull": bson.A{"$tags", bson.A{}}}, tags}}},
+	}
+	if book.BookYear != 0 {
+		year := int(book.BookYear)
+		or = append(or, bson.M{"bookyear": bson.M{"$gte": year - yearSpan, "$lte": year + yearSpan}})
+		// Books without a year get null here, which $max ignores.
+		distance := bson.M{"$abs": bson.M{"$subtract": bson.A{"$bookyear", year}}}
+		score = append(score, bson.M{"$max": bson.A{0, bson.M{"$subtract": bson.A{1, bson.M{"$divide": bson.A{distance, yearSpan}}}}}})
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: notDeleted(bson.M{"id": bson.M{"$ne": book.ID}, "$or": or})}},
+		{{Key: "$set", Value: bson.M{"score": bson.M{"$add": score}}}},
+		{{Key: "$match", Value: bson.M{"score": bson.M{"$gt": 0}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "score", Value: -1}, {Key: "titlekey", Value: 1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$limit", Value: limit}},
+	}
+	cursor, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	similar := []similarBook{}
+	err = cursor.All(ctx, &similar)
+	return similar, err
+}
+
+// Handles GET /api/books/:id/similar. Every book comes with its score.
+func similarBooks(coll *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		id := c.Param("id")
+		limit := defaultSimilar
+		if raw := c.QueryParam("limit"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 1 || n > maxSimilar {
+				return validationFailed(c, validationErrors{"limit": "must be a whole number from 1 to " + strconv.Itoa(maxSimilar)})
+			}
+			limit = n
+		}
+		book, err := findBook(ctx, coll, id)
+		if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Book not found with ID " + id})
+		}
+		var similar []similarBook
+		if err == nil {
+			similar, err = findSimilar(ctx, coll, book, limit)
+		}
+		if err != nil {
+			log.Printf("Error finding books similar to %s: %v", id, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to find similar books"})
+		}
+		ret := []map[string]interface{}{}
+		for _, found := range similar {
+			book := bookToMap(found.BookStore)
+			book["score"] = math.Round(found.Score*1000) / 1000
+			ret = append(ret, book)
+		}
+		return c.JSON(http.StatusOK, ret)
+	}
+}
+
+// Handles GET /books/:id/similar, rendering the recommendations on the page
+// of a book.
+func similarBooksFragment(coll *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		book, err := findBook(ctx, coll, c.Param("id"))
+		if err == mongo.ErrNoDocuments {
+			return c.NoContent(http.StatusNotFound)
+		}
+		var similar []similarBook
+		if err == nil {
+			similar, err = findSimilar(ctx, coll, book, defaultSimilar)
+		}
+		if err != nil {
+			log.Printf("Error finding books similar to %s: %v", c.Param("id"), err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		ret := []map[string]interface{}{}
+		for _, found := range similar {
+			ret = append(ret, bookToMap(found.BookStore))
+		}
+		return c.Render(http.StatusOK, "similar-books", ret)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Handles GET /api/books/events, the book events as Server-Sent Events for
+// clients that cannot use WebSockets. Each event carries its number as id,
+// its type ("created", "updated", or "deleted") as event, and the book as
+// JSON data; deleted books only with their ID. A client that reconnects
+// with Last-Event-ID first gets the events it missed, as long as they are
+// among the last few hundred.
+func bookEventStream(events *bookEvents) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		lastID := c.Request().Header.Get("Last-Event-ID")
+		if lastID == "" {
+			lastID = c.QueryParam("last_event_id")
+		}
+		var after uint64
+		if lastID != "" {
+			var err error
+			if after, err = strconv.ParseUint(lastID, 10, 64); err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Last-Event-ID must be a number"})
+			}
+		}
+		missed, changes, stop := events.SubscribeAfter(after)
+		defer stop()
+
+		res := c.Response()
+		withoutWriteTimeout(c)
+		res.Header().Set(echo.HeaderContentType, "text/event-stream")
+		res.Header().Set(echo.HeaderCacheControl, "no-cache")
+		res.Header().Set("X-Accel-Buffering", "no")
+		res.WriteHeader(http.StatusOK)
+		// Clients wait this long before reconnecting.
+		fmt.Fprint(res, "retry: 5000\n\n")
+		res.Flush()
+
+		send := func(event bookEvent) error {
+			data := bookToMap(event.Book)
+			if event.Type == bookDeleted {
+				data = map[string]interface{}{"id": event.Book.ID}
+			}
+			payload, err := json.Marshal(data)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(res, "id: %d\nevent: %s\ndata: %s\n\n", event.Seq, event.Type, payload); err != nil {
+				return err
+			}
+			res.Flush()
+			return nil
+		}
+		for _, event := range missed {
+			if err := send(event); err != nil {
+				return nil
+			}
+		}
+
+		// A comment now and then keeps proxies from closing an idle stream.
+		keepAlive := time.NewTicker(30 * time.Second)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case <-c.Request().Context().Done():
+				return nil
+			case <-keepAlive.C:
+				if _, err := fmt.Fprint(res, ": keep-alive\n\n"); err != nil {
+					return nil
+				}
+				res.Flush()
+			case event := <-changes:
+				if err := send(event); err != nil {
+					return nil
+				}
+			}
+		}
+	}
+}
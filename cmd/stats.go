@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Figures about the whole collection, shown by GET /api/stats and the
+// statistics dashboard.
+type bookStats struct {
+	TotalBooks      int           `bson:"total" json:"total_books"`
+	DistinctAuthors int           `bson:"authors" json:"distinct_authors"`
+	AveragePages    float64       `bson:"avgpages" json:"average_pages"`
+	OldestYear      flexInt       `bson:"oldest" json:"oldest_year"`
+	NewestYear      flexInt       `bson:"newest" json:"newest_year"`
+	PerDecade       []decadeCount `bson:"decades" json:"books_per_decade"`
+}
+
+type decadeCount struct {
+	Decade int `bson:"_id" json:"decade"`
+	Count  int `bson:"count" json:"count"`
+}
+
+// Computes the statistics in a single aggregation. A $facet stage runs the
+// totals and the decade histogram side by side over the same books. Pages
+// and years of 0 stand for "unknown" and are left out of the figures.
+func collectionStats(ctx context.Context, coll *mongo.Collection) (bookStats, error) {
+	known := func(field string) bson.M {
+		return bson.M{"$cond": bson.A{bson.M{"$ne": bson.A{field, 0}}, field, nil}}
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: notDeleted(bson.M{})}},
+		{{Key: "$facet", Value: bson.M{
+			"totals": bson.A{
+				bson.M{"$group": bson.M{
+					"_id":      nil,
+					"total":    bson.M{"$sum": 1},
+					"authors":  bson.M{"$addToSet": "$bookauthor"},
+					"avgpages": bson.M{"$avg": known("$bookpages")},
+					"oldest":   bson.M{"$min": known("$bookyear")},
+					"newest":   bson.M{"$max": known("$bookyear")},
+				}},
+				bson.M{"$set": bson.M{"authors": bson.M{"$size": "$authors"}}},
+			},
+			"decades": bson.A{
+				bson.M{"$match": bson.M{"bookyear": bson.M{"$nin": bson.A{nil, 0}}}},
+				bson.M{"$group": bson.M{
+					"_id":   bson.M{"$multiply": bson.A{bson.M{"$floor": bson.M{"$divide": bson.A{"$bookyear", 10}}}, 10}},
+					"count": bson.M{"$sum": 1},
+				}},
+				bson.M{"$sort": bson.M{"_id": 1}},
+			},
+		}}},
+	}
+
+	cursor, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return bookStats{}, err
+	}
+	var facets []struct {
+		Totals  []bookStats   `bson:"totals"`
+		Decades []decadeCount `bson:"decades"`
+	}
+	if err := cursor.All(ctx, &facets); err != nil {
+		return bookStats{}, err
+	}
+
+	var stats bookStats
+	if len(facets) > 0 {
+		if len(facets[0].Totals) > 0 {
+			stats = facets[0].Totals[0]
+		}
+		stats.PerDecade = facets[0].Decades
+	}
+	if stats.PerDecade == nil {
+		stats.PerDecade = []decadeCount{}
+	}
+	stats.AveragePages = math.Round(stats.AveragePages*10) / 10
+	return stats, nil
+}
+
+// Keeps the latest statistics when the scheduler refreshes them
+// periodically, so the aggregation does not run on every request. Until the
+// first refresh, or without one scheduled, they are computed on demand.
+type statsCache struct {
+	coll    *mongo.Collection
+	mu      sync.Mutex
+	current *bookStats
+}
+
+func newStatsCache(coll *mongo.Collection) *statsCache {
+	return &statsCache{coll: coll}
+}
+
+func (s *statsCache) get(ctx context.Context) (bookStats, error) {
+	s.mu.Lock()
+	current := s.current
+	s.mu.Unlock()
+	if current != nil {
+		return *current, nil
+	}
+	return collectionStats(ctx, s.coll)
+}
+
+// The scheduler task recomputing the cached statistics.
+func (s *statsCache) refresh(ctx context.Context) (string, error) {
+	stats, err := collectionStats(ctx, s.coll)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	s.current = &stats
+	s.mu.Unlock()
+	return "", nil
+}
+
+// Handles GET /api/stats.
+func getStats(cache *statsCache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		stats, err := cache.get(c.Request().Context())
+		if err != nil {
+			log.Printf("Error computing statistics: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to compute statistics"})
+		}
+		return c.JSON(http.StatusOK, stats)
+	}
+}
+
+// A row of the decade histogram on the dashboard. Width is the length of
+// the bar in percent of the busiest decade.
+type decadeBar struct {
+	Decade int
+	Count  int
+	Width  int
+}
+
+func (s bookStats) DecadeBars() []decadeBar {
+	most := 0
+	for _, d := range s.PerDecade {
+		most = max(most, d.Count)
+	}
+	var bars []decadeBar
+	for _, d := range s.PerDecade {
+		bars = append(bars, decadeBar{Decade: d.Decade, Count: d.Count, Width: d.Count * 100 / most})
+	}
+	return bars
+}
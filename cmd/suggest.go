@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Suggestions while typing into the search bar come from a lowercased copy
+// of the title and the author of every book, kept in titlekey and
+// authorkey; see search.go. Both are indexed, so a prefix search on them
+// stays fast no matter how many books there are.
+
+// How many titles and authors GET /api/suggest returns each, unless told
+// otherwise with ?limit=.
+const (
+	defaultSuggestions = 10
+	maxSuggestions     = 50
+)
+
+type suggestion struct {
+	// The book for a title, the author for an author, if it has one.
+	ID   string `bson:"id" json:"id,omitempty"`
+	Text string `bson:"text" json:"text"`
+}
+
+type suggestions struct {
+	Query   string       `json:"-"`
+	Titles  []suggestion `json:"titles"`
+	Authors []suggestion `json:"authors"`
+}
+
+// Finds up to limit titles and authors starting with what was typed so
+// far. Titles come in alphabetical order, as do authors, each of whom is
+// listed once.
+func findSuggestions(ctx context.Context, coll *mongo.Collection, typed string, limit int) (suggestions, error) {
+	found := suggestions{Query: typed, Titles: []suggestion{}, Authors: []suggestion{}}
+	key := searchKey(typed)
+	if key == "" {
+		return found, nil
+	}
+	prefix := primitive.Regex{Pattern: "^" + regexp.QuoteMeta(key)}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "titlekey", Value: 1}}).
+		SetLimit(int64(limit)).
+		SetProjection(bson.M{"id": 1, "text": "$bookname"})
+	cursor, err := coll.Find(ctx, notDeleted(bson.M{"titlekey": prefix}), opts)
+	if err != nil {
+		return found, err
+	}
+	if err := cursor.All(ctx, &found.Titles); err != nil {
+		return found, err
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: notDeleted(bson.M{"authorkey": prefix})}},
+		{{Key: "$group", Value: bson.M{
+			"_id":  "$authorkey",
+			"id":   bson.M{"$first": "$authorid"},
+			"text": bson.M{"$first": "$bookauthor"},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+		{{Key: "$limit", Value: limit}},
+	}
+	cursor, err = coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return found, err
+	}
+	err = cursor.All(ctx, &found.Authors)
+	return found, err
+}
+
+// Reads ?q and ?limit of a suggestion request.
+func suggestionQuery(c echo.Context) (string, int, validationErrors) {
+	limit := defaultSuggestions
+	if raw := c.QueryParam("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxSuggestions {
+			return "", 0, validationErrors{"limit": "must be a whole number from 1 to " + strconv.Itoa(maxSuggestions)}
+		}
+		limit = n
+	}
+	return c.QueryParam("q"), limit, nil
+}
+
+// Handles GET /api/suggest?q=dra, e.g. for a search field in another
+// client.
+func suggestBooks(coll *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		typed, limit, errs := suggestionQuery(c)
+		if len(errs) > 0 {
+			return validationFailed(c, errs)
+		}
+		found, err := findSuggestions(c.Request().Context(), coll, typed, limit)
+		if err != nil {
+			log.Printf("Error finding suggestions for %q: %v", typed, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to find suggestions"})
+		}
+		return c.JSON(http.StatusOK, found)
+	}
+}
+
+// Handles GET /suggest, rendering the dropdown under the search bar while
+// the user types.
+func suggestionDropdown(coll *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		typed, _, _ := suggestionQuery(c)
+		found, err := findSuggestions(c.Request().Context(), coll, typed, defaultSuggestions)
+		if err != nil {
+			log.Printf("Error finding suggestions for %q: %v", typed, err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		return c.Render(http.StatusOK, "suggestions", found)
+	}
+}
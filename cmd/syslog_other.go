@@ -0,0 +1,13 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// Go has no syslog on this platform.
+func openSyslog(tag string) (io.Writer, error) {
+	return nil, errors.New("ACCESS_LOG_OUTPUT=syslog is not supported on this platform")
+}
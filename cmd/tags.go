@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Books can carry any number of tags, such as genres ("horror", "gothic").
+// Tags are stored in lower case without surrounding spaces, so "Horror" and
+// " horror" end up as the same tag.
+func normalizeTags(tags []string) []string {
+	ret := []string{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag != "" && !slices.Contains(ret, tag) {
+			ret = append(ret, tag)
+		}
+	}
+	return ret
+}
+
+// The body of POST and DELETE /api/books/:id/tags.
+type tagsPayload struct {
+	Tags []string `json:"tags"`
+}
+
+// Reads the tags of a request, from the body or from ?tag= parameters.
+func requestTags(c echo.Context) ([]string, error) {
+	var payload tagsPayload
+	if c.Request().ContentLength != 0 {
+		if err := (&echo.DefaultBinder{}).BindBody(c, &payload); err != nil {
+			return nil, err
+		}
+	}
+	return normalizeTags(append(payload.Tags, c.QueryParams()["tag"]...)), nil
+}
+
+// Handles POST /api/books/:id/tags, adding tags to a book.
+func addTags(books bookRepository) echo.HandlerFunc {
+	return changeTags(books, func(current, tags []string) []string {
+		return normalizeTags(append(current, tags...))
+	})
+}
+
+// Handles DELETE /api/books/:id/tags, removing tags from a book.
+func removeTags(books bookRepository) echo.HandlerFunc {
+	return changeTags(books, func(current, tags []string) []string {
+		return slices.DeleteFunc(current, func(tag string) bool {
+			return slices.Contains(tags, tag)
+		})
+	})
+}
+
+// Computes the new tag list of the book and stores it through the
+// repository like any other update, so tag changes bump the version, show
+// up in the history, and are announced. The update is tied to the version
+// we read, and a concurrent change makes it fail with 409 instead of
+// losing tags.
+func changeTags(books bookRepository, apply func(current, tags []string) []string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		idParam := c.Param("id")
+		tags, err := requestTags(c)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+		}
+		if len(tags) == 0 {
+			return validationFailed(c, validationErrors{"tags": "is required"})
+		}
+
+		book, err := books.Get(ctx, idParam)
+		if err != nil {
+			return bookFailed(c, err, idParam, "fetch")
+		}
+		changed := apply(slices.Clone(book.Tags), tags)
+		book, err = books.Update(ctx, idParam, bookChanges{Tags: &changed}, &book.Version)
+		if err != nil {
+			return bookFailed(c, err, idParam, "update tags of")
+		}
+		return c.JSON(http.StatusOK, bookToMap(book))
+	}
+}
+
+// Counts how many books use each tag.
+type tagCount struct {
+	Tag   string `bson:"_id" json:"tag"`
+	Count int    `bson:"count" json:"count"`
+}
+
+// Lists all tags with the number of books carrying them, most used first.
+func findAllTags(ctx context.Context, coll *mongo.Collection) ([]tagCount, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: notDeleted(bson.M{})}},
+		{{Key: "$unwind", Value: "$tags"}},
+		{{Key: "$group", Value: bson.M{"_id": "$tags", "count": bson.M{"$sum": 1}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}}},
+	}
+	cursor, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	tags := []tagCount{}
+	err = cursor.All(ctx, &tags)
+	return tags, err
+}
+
+// Handles GET /api/tags.
+func listTags(coll *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		tags, err := findAllTags(c.Request().Context(), coll)
+		if err != nil {
+			log.Printf("Error listing tags: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to list tags"})
+		}
+		return c.JSON(http.StatusOK, tags)
+	}
+}
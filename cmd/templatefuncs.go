@@ -0,0 +1,140 @@
+package main
+
+import (
+	"html/template"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Functions available in the views, so formatting lives in one place
+// instead of being repeated in every table. For example:
+//
+//	{{ .title | truncate 60 }}         Long titles end in "…"
+//	{{ year .year }}                   "1999", or "unknown" for 0
+//	{{ pages .pages }}                 "1,024", or "unknown" for 0
+//	{{ pluralize .Count "book" }}      "1 book", "3 books"
+//	{{ .title | highlight $.Query }}   Marks the search term with <mark>
+//	{{ date .due_at }}                 "2024-05-31"
+//	{{ stars .Rating }}                "★★★★☆" for a rating of 4
+//	/series/{{ pathescape .Name }}     "/series/Tales%2FMore" in a link
+var templateFuncs = template.FuncMap{
+	"truncate":  truncateText,
+	"year":      formatYear,
+	"pages":     formatPages,
+	"pluralize": pluralize,
+	"highlight": highlightTerm,
+	"date":      formatDate,
+	"stars":     ratingStars,
+	// hx-get and the like are no URL attributes to html/template, so
+	// what goes into a path there has to be escaped by hand.
+	"pathescape": url.PathEscape,
+}
+
+// The numbers in the views come as int, flexInt, or int64, depending on
+// where they were read from.
+func templateInt(v interface{}) int {
+	switch n := v.(type) {
+	case int:
+		return n
+	case flexInt:
+		return int(n)
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	case float64:
+		return int(n)
+	}
+	return 0
+}
+
+// Shortens text to at most max characters, the last of which is "…".
+func truncateText(max int, text string) string {
+	if max <= 0 || utf8.RuneCountInString(text) <= max {
+		return text
+	}
+	runes := []rune(text)
+	return strings.TrimSpace(string(runes[:max-1])) + "…"
+}
+
+func formatYear(v interface{}) string {
+	if year := templateInt(v); year != 0 {
+		return strconv.Itoa(year)
+	}
+	return "unknown"
+}
+
+// Pages are grouped by thousands, e.g. "1,024".
+func formatPages(v interface{}) string {
+	pages := templateInt(v)
+	if pages == 0 {
+		return "unknown"
+	}
+	digits := strconv.Itoa(pages)
+	var b strings.Builder
+	for i, d := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(d)
+	}
+	return b.String()
+}
+
+// Puts the count in front of the word, adding an "s" unless the count is
+// 1. Irregular words pass their plural as well, e.g.
+// {{ pluralize .Count "series" "series" }}.
+func pluralize(count interface{}, singular string, plural ...string) string {
+	n := templateInt(count)
+	word := singular
+	if n != 1 {
+		word = singular + "s"
+		if len(plural) > 0 {
+			word = plural[0]
+		}
+	}
+	return strconv.Itoa(n) + " " + word
+}
+
+// Escapes text and wraps every occurrence of term, ignoring case, in
+// <mark>. Without a term, the text is only escaped.
+func highlightTerm(term, text string) template.HTML {
+	if term == "" {
+		return template.HTML(template.HTMLEscapeString(text))
+	}
+	lower, needle := strings.ToLower(text), strings.ToLower(term)
+	var b strings.Builder
+	for {
+		i := strings.Index(lower, needle)
+		// Lowercasing may change the length of some characters, in which
+		// case the positions no longer line up and we stop marking.
+		if i < 0 || len(lower) != len(text) {
+			b.WriteString(template.HTMLEscapeString(text))
+			break
+		}
+		end := i + len(needle)
+		b.WriteString(template.HTMLEscapeString(text[:i]))
+		b.WriteString("<mark>" + template.HTMLEscapeString(text[i:end]) + "</mark>")
+		text, lower = text[end:], lower[end:]
+	}
+	return template.HTML(b.String())
+}
+
+func formatDate(v interface{}) string {
+	switch t := v.(type) {
+	case time.Time:
+		return t.Format("2006-01-02")
+	case *time.Time:
+		if t != nil {
+			return t.Format("2006-01-02")
+		}
+	}
+	return ""
+}
+
+func ratingStars(v interface{}) string {
+	return bookRating{Average: float64(templateInt(v))}.Stars()
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// One deployment can host several libraries, the tenants listed in
+// TENANTS, each with books of its own. TENANT_SOURCES says how a request
+// names its tenant:
+//
+//   - subdomain: acme.books.example.com, with TENANT_DOMAIN=books.example.com
+//   - path: /t/acme/api/books instead of /api/books
+//   - token: the "tenant" claim of the bearer token, like an API key of the
+//     library; see the token command
+//
+// A token naming a tenant only opens that library, whatever the subdomain
+// or path say; without the token source, it opens none. Requests naming no
+// tenant use the default library, as before. Every tenant has collections
+// of its own, e.g. information_acme next to information, and tenantBooks
+// picks them by the tenant in the context, so no query of one library can
+// reach the books of another. So far only the book routes of the
+// repository, /api/books and /api/books/:id, are open to tenants; the
+// other API routes, GraphQL, gRPC, and the forms of the web pages answer
+// 404 (or NOT_FOUND) for them.
+
+type tenantKey struct{}
+
+func withTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// The tenant of a request, or "" for the default library.
+func tenantFrom(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+var (
+	tenantSources = []string{"subdomain", "path", "token"}
+	// Tenant names end up in collection names and host names.
+	tenantName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,39}$`)
+)
+
+type tenancy struct {
+	sources []string
+	domain  string
+	tenants []string
+}
+
+func newTenancy(cfg Config) (tenancy, error) {
+	for _, source := range cfg.TenantSources {
+		if !slices.Contains(tenantSources, source) {
+			return tenancy{}, fmt.Errorf("invalid TENANT_SOURCES %q, want subdomain, path, or token", source)
+		}
+	}
+	if slices.Contains(cfg.TenantSources, "subdomain") && cfg.TenantDomain == "" {
+		return tenancy{}, fmt.Errorf("TENANT_SOURCES=subdomain needs TENANT_DOMAIN")
+	}
+	for _, tenant := range cfg.Tenants {
+		if !tenantName.MatchString(tenant) {
+			return tenancy{}, fmt.Errorf("invalid tenant %q in TENANTS, want lowercase letters, digits, and hyphens", tenant)
+		}
+	}
+	return tenancy{sources: cfg.TenantSources, domain: strings.ToLower(cfg.TenantDomain), tenants: cfg.Tenants}, nil
+}
+
+func (t tenancy) from(source string) bool {
+	return slices.Contains(t.sources, source)
+}
+
+// The tenant named by the request, before the token is looked at.
+func (t tenancy) named(c echo.Context) string {
+	if t.from("path") && c.Param("tenant") != "" {
+		return c.Param("tenant")
+	}
+	if t.from("subdomain") {
+		host, _, err := net.SplitHostPort(c.Request().Host)
+		if err != nil {
+			host = c.Request().Host
+		}
+		if sub, ok := strings.CutSuffix(strings.ToLower(host), "."+t.domain); ok {
+			return sub
+		}
+	}
+	return ""
+}
+
+// The tenant in the "tenant" claim of the caller's token, if any.
+func tokenTenant(c echo.Context) string {
+	token, ok := c.Get("user").(*jwt.Token)
+	if !ok {
+		return ""
+	}
+	claims, ok := token.Claims.(*bookClaims)
+	if !ok {
+		return ""
+	}
+	return claims.Tenant
+}
+
+// Finds the tenant of the request and puts it into the request's context
+// for the repository. It must run after Authenticate. Tenants may only
+// reach the routes in open, keyed like "GET /api/books".
+func (t tenancy) Resolve(open map[string]bool) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			tenant := t.named(c)
+			if claimed := tokenTenant(c); claimed != "" {
+				if !t.from("token") || tenant != "" && tenant != claimed {
+					return c.JSON(http.StatusForbidden, map[string]string{"error": "The token belongs to another library"})
+				}
+				tenant = claimed
+			}
+			if tenant == "" {
+				return next(c)
+			}
+			if !slices.Contains(t.tenants, tenant) {
+				return c.JSON(http.StatusNotFound, map[string]string{"error": "Library " + tenant + " not found"})
+			}
+			if !open[c.Request().Method+" "+c.Path()] {
+				return c.JSON(http.StatusNotFound, map[string]string{"error": "Not available for the library " + tenant})
+			}
+			c.SetRequest(c.Request().WithContext(withTenant(c.Request().Context(), tenant)))
+			return next(c)
+		}
+	}
+}
+
+// Keeps tenants away from routes that only serve the default library, like
+// GraphQL and the forms of the web pages, which would otherwise read and
+// write its books for them. It must run after Authenticate, where the
+// route takes tokens.
+func (t tenancy) DefaultOnly() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			tenant := tokenTenant(c)
+			if tenant == "" {
+				tenant = t.named(c)
+			}
+			if tenant != "" {
+				return c.JSON(http.StatusNotFound, map[string]string{"error": "Not available for the library " + tenant})
+			}
+			return next(c)
+		}
+	}
+}
+
+// The keys of Resolve's open routes.
+func routeKeys(routes []*echo.Route) map[string]bool {
+	keys := map[string]bool{}
+	for _, route := range routes {
+		keys[route.Method+" "+route.Path] = true
+	}
+	return keys
+}
+
+// A bookRepository that hands every call to the repository of the tenant
+// in the context. The default library is the embedded repository; the
+// ones of the tenants are opened on first use.
+type tenantBooks struct {
+	bookRepository
+	open func(tenant string) bookRepository
+
+	mu      sync.Mutex
+	tenants map[string]bookRepository
+}
+
+func newTenantBooks(books bookRepository, open func(tenant string) bookRepository) *tenantBooks {
+	return &tenantBooks{bookRepository: books, open: open, tenants: map[string]bookRepository{}}
+}
+
+func (r *tenantBooks) of(ctx context.Context) bookRepository {
+	tenant := tenantFrom(ctx)
+	if tenant == "" {
+		return r.bookRepository
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	books, ok := r.tenants[tenant]
+	if !ok {
+		books = r.open(tenant)
+		r.tenants[tenant] = books
+	}
+	return books
+}
+
+func (r *tenantBooks) List(ctx context.Context, q bookQuery) ([]BookStore, error) {
+	return r.of(ctx).List(ctx, q)
+}
+
+func (r *tenantBooks) Get(ctx context.Context, id string) (BookStore, error) {
+	return r.of(ctx).Get(ctx, id)
+}
+
+func (r *tenantBooks) Create(ctx context.Context, book *BookStore) error {
+	return r.of(ctx).Create(ctx, book)
+}
+
+func (r *tenantBooks) Update(ctx context.Context, id string, changes bookChanges, version *int) (BookStore, error) {
+	return r.of(ctx).Update(ctx, id, changes, version)
+}
+
+func (r *tenantBooks) Delete(ctx context.Context, id string, version *int) error {
+	return r.of(ctx).Delete(ctx, id, version)
+}
+
+func (r *tenantBooks) Count(ctx context.Context, q bookQuery) (int64, error) {
+	return r.of(ctx).Count(ctx, q)
+}
+
+// The collections of a tenant, named after the ones of the default
+// library, with the indexes the migrations give those.
+func tenantCollections(db *mongo.Database, tenant string) (books, history, authors *mongo.Collection) {
+	books = db.Collection("information_" + tenant)
+	history = db.Collection("book_history_" + tenant)
+	ctx := context.Background()
+	unique := mongo.IndexModel{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)}
+	if _, err := books.Indexes().CreateOne(ctx, unique); err != nil {
+		log.Printf("Error indexing the books of tenant %s: %v", tenant, err)
+	}
+	if _, err := history.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "bookid", Value: 1}}}); err != nil {
+		log.Printf("Error indexing the book history of tenant %s: %v", tenant, err)
+	}
+	return books, history, db.Collection("authors_" + tenant)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Every request gets a deadline on its context: REQUEST_TIMEOUT, or
+// LONG_REQUEST_TIMEOUT for the routes below that work through the whole
+// collection. Mongo gives up on the commands of a request once its
+// deadline passes, and the request is answered with 504 Gateway Timeout,
+// whatever the handler makes of the failed command. The event stream and
+// /ws run for as long as the client stays, and CPU profiles and traces for
+// as long as their ?seconds= asks, so they get no deadline.
+
+// Routes that import, export, or rebuild many books at once.
+var longRoutes = []string{
+	"/api/books/import",
+	"/api/books/export",
+	"/api/books/stream",
+	"/api/books/batch",
+	"/api/books/merge",
+	"/api/admin/search/reindex",
+	"/api/admin/tasks/:name/run",
+	"/api/admin/indexes",
+}
+
+// Routes that stream until the client goes away, or record for as long as
+// the client asks.
+var endlessRoutes = []string{
+	"/api/books/events",
+	"/ws",
+	"/debug/pprof/profile",
+	"/debug/pprof/trace",
+}
+
+// The deadline of requests to a route, 0 for none.
+func routeTimeout(cfg Config, route string) time.Duration {
+	switch {
+	case slices.Contains(endlessRoutes, route):
+		return 0
+	case slices.Contains(longRoutes, route):
+		return cfg.LongRequestTimeout
+	}
+	return cfg.RequestTimeout
+}
+
+// Puts the deadline of the route on the request context, and answers with
+// 504 when the handler failed because of it. It comes after the compression,
+// so the 504 is compressed like any other answer.
+func requestTimeout(cfg Config) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+			budget := routeTimeout(cfg, c.Path())
+			if budget <= 0 {
+				return next(c)
+			}
+			req := c.Request()
+			ctx, cancel := context.WithTimeout(req.Context(), budget)
+			defer cancel()
+			c.SetRequest(req.WithContext(ctx))
+			timedOut := func() bool { return errors.Is(ctx.Err(), context.DeadlineExceeded) }
+
+			// A handler answering 5xx after the deadline failed because of
+			// it, so the status becomes 504 and the body is replaced.
+			res := c.Response()
+			writer := &timeoutWriter{ResponseWriter: res.Writer, budget: budget}
+			res.Writer = writer
+			res.Before(func() {
+				if res.Status >= 500 && timedOut() {
+					res.Status = http.StatusGatewayTimeout
+					writer.replace = true
+				}
+			})
+
+			// The helpers from the original exercise panic when a query
+			// fails.
+			defer func() {
+				if r := recover(); r != nil {
+					if !timedOut() {
+						panic(r)
+					}
+					err = nil
+					if !res.Committed {
+						err = gatewayTimeout(c, budget)
+					}
+				}
+			}()
+			err = next(c)
+			if err != nil && timedOut() && !res.Committed {
+				return gatewayTimeout(c, budget)
+			}
+			return err
+		}
+	}
+}
+
+func gatewayTimeout(c echo.Context, budget time.Duration) error {
+	return c.JSON(http.StatusGatewayTimeout, map[string]string{"error": timeoutMessage(budget)})
+}
+
+func timeoutMessage(budget time.Duration) string {
+	return fmt.Sprintf("The request took longer than %s", budget)
+}
+
+// Swaps the body of an answer for the 504 error once the middleware
+// decided to replace it.
+type timeoutWriter struct {
+	http.ResponseWriter
+	budget  time.Duration
+	replace bool
+}
+
+func (w *timeoutWriter) WriteHeader(code int) {
+	if !w.replace {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	header := w.Header()
+	header.Del(echo.HeaderContentLength)
+	header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	w.ResponseWriter.WriteHeader(code)
+	body, _ := json.Marshal(map[string]string{"error": timeoutMessage(w.budget)})
+	w.ResponseWriter.Write(append(body, '\n'))
+}
+
+func (w *timeoutWriter) Write(b []byte) (int, error) {
+	if w.replace {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *timeoutWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
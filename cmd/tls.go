@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// The server speaks plain HTTP on :3030 unless TLS is configured, in one of
+// two ways:
+//
+//   - TLS_CERT_FILE and TLS_KEY_FILE name a certificate and its key, in PEM
+//   - TLS_AUTOCERT_HOSTS lists the host names to get certificates for from
+//     Let's Encrypt. They are kept in TLS_AUTOCERT_CACHE and renewed before
+//     they expire. The hosts must point at this server, on ports 443 and 80.
+//
+// With TLS, the server listens on TLS_ADDR, and on TLS_REDIRECT_ADDR answers
+// plain HTTP with a redirect to HTTPS (and the HTTP challenges of Let's
+// Encrypt). Answers over HTTPS carry a Strict-Transport-Security header, so
+// browsers stick to HTTPS for HSTS_MAX_AGE.
+
+// Starts the server as configured and blocks until it stops.
+func serve(e *echo.Echo, cfg Config) error {
+	applyServerTimeouts(e, cfg)
+	autoTLS := len(cfg.TLSAutocertHosts) > 0
+	files := cfg.TLSCertFile != "" || cfg.TLSKeyFile != ""
+	switch {
+	case autoTLS && files:
+		return errors.New("set either TLS_CERT_FILE and TLS_KEY_FILE or TLS_AUTOCERT_HOSTS, not both")
+	case files && (cfg.TLSCertFile == "" || cfg.TLSKeyFile == ""):
+		return errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	case autoTLS:
+		e.AutoTLSManager.Prompt = autocert.AcceptTOS
+		e.AutoTLSManager.HostPolicy = autocert.HostWhitelist(cfg.TLSAutocertHosts...)
+		e.AutoTLSManager.Cache = autocert.DirCache(cfg.TLSAutocertCache)
+		e.AutoTLSManager.Email = cfg.TLSAutocertEmail
+		e.Use(hsts(cfg))
+		startRedirectServer(cfg, e.AutoTLSManager.HTTPHandler(httpsRedirect(cfg.TLSAddr)))
+		return e.StartAutoTLS(cfg.TLSAddr)
+	case files:
+		e.Use(hsts(cfg))
+		startRedirectServer(cfg, httpsRedirect(cfg.TLSAddr))
+		return e.StartTLS(cfg.TLSAddr, cfg.TLSCertFile, cfg.TLSKeyFile)
+	}
+	return e.Start(":3030")
+}
+
+// Answers plain HTTP on TLS_REDIRECT_ADDR, unless that is empty.
+func startRedirectServer(cfg Config, handler http.Handler) {
+	if cfg.TLSRedirectAddr == "" {
+		return
+	}
+	go func() {
+		log.Printf("Redirecting HTTP on %s to HTTPS", cfg.TLSRedirectAddr)
+		server := &http.Server{Addr: cfg.TLSRedirectAddr, Handler: handler}
+		setTimeouts(server, cfg)
+		if err := server.ListenAndServe(); err != nil {
+			log.Printf("Error serving the HTTPS redirect: %v", err)
+		}
+	}()
+}
+
+// Redirects every request to the same URL over HTTPS, on the port of
+// tlsAddr. 308 keeps the method and body, so a POST stays a POST.
+func httpsRedirect(tlsAddr string) http.Handler {
+	port := ""
+	if _, p, err := net.SplitHostPort(tlsAddr); err == nil && p != "443" && p != "" {
+		port = ":" + p
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		http.Redirect(w, r, "https://"+host+port+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// Sets Strict-Transport-Security on answers sent over TLS. A max age of 0
+// leaves the header out.
+func hsts(cfg Config) echo.MiddlewareFunc {
+	value := "max-age=" + strconv.Itoa(int(cfg.HSTSMaxAge.Seconds()))
+	if cfg.HSTSIncludeSubdomains {
+		value += "; includeSubDomains"
+	}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if cfg.HSTSMaxAge > 0 && c.IsTLS() {
+				c.Response().Header().Set("Strict-Transport-Security", value)
+			}
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/event"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// With OTEL_EXPORTER_OTLP_ENDPOINT set, every request is traced with
+// OpenTelemetry: a span for the request, and within it one for each
+// command sent to Mongo on its behalf. Requests carrying a W3C traceparent
+// header continue the caller's trace. Spans are exported over OTLP/HTTP,
+// e.g. to an OpenTelemetry Collector or Jaeger; the exporter reads the
+// other OTEL_EXPORTER_OTLP_* variables, like headers, itself.
+
+// The name of the tracer, which shows up as the instrumentation scope.
+const tracerName = "github.com/CAPS-Cloud/exercises/cmd"
+
+// Installs the tracer provider exporting to OTEL_EXPORTER_OTLP_ENDPOINT,
+// and the propagator reading and writing traceparent headers. The returned
+// function flushes the spans not yet exported; call it before exiting.
+func setupTracing(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(cfg.ServiceName)))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// Starts a server span for every request, as a child of the span in its
+// traceparent header, if any. The span is named after the route, like
+// "GET /api/books/:id", and handlers find it in the request context, so the
+// Mongo commands they send show up inside it.
+func tracing() echo.MiddlewareFunc {
+	tracer := otel.Tracer(tracerName)
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+			route := c.Path()
+			ctx, span := tracer.Start(ctx, req.Method+" "+route,
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					semconv.HTTPRequestMethodKey.String(req.Method),
+					semconv.HTTPRoute(route),
+					semconv.URLPath(req.URL.Path),
+				))
+			defer span.End()
+			c.SetRequest(req.WithContext(ctx))
+
+			err := next(c)
+			status := c.Response().Status
+			if err != nil {
+				// Echo answers the error after the middleware returns.
+				span.RecordError(err)
+				status = http.StatusInternalServerError
+				var httpErr *echo.HTTPError
+				if errors.As(err, &httpErr) {
+					status = httpErr.Code
+				}
+			}
+			span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+			if status >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(status))
+			}
+			return err
+		}
+	}
+}
+
+// Traces the commands sent to Mongo, each as a client span named like
+// "find information", within the span of the context the command runs
+// with. Only the command and collection are recorded, not the documents.
+func mongoTracing() *event.CommandMonitor {
+	tracer := otel.Tracer(tracerName)
+	var mu sync.Mutex
+	spans := map[int64]trace.Span{}
+	finish := func(requestID int64, failure string) {
+		mu.Lock()
+		span, ok := spans[requestID]
+		delete(spans, requestID)
+		mu.Unlock()
+		if !ok {
+			return
+		}
+		if failure != "" {
+			span.SetStatus(codes.Error, failure)
+		}
+		span.End()
+	}
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, evt *event.CommandStartedEvent) {
+			attrs := []attribute.KeyValue{
+				semconv.DBSystemMongoDB,
+				semconv.DBNamespace(evt.DatabaseName),
+				semconv.DBOperationName(evt.CommandName),
+			}
+			name := evt.CommandName
+			// Most commands name their collection as their value, like
+			// {"find": "information", ...}.
+			if collection, ok := evt.Command.Lookup(evt.CommandName).StringValueOK(); ok {
+				attrs = append(attrs, semconv.DBCollectionName(collection))
+				name += " " + collection
+			}
+			_, span := tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+			mu.Lock()
+			spans[evt.RequestID] = span
+			mu.Unlock()
+		},
+		Succeeded: func(ctx context.Context, evt *event.CommandSucceededEvent) {
+			finish(evt.RequestID, "")
+		},
+		Failed: func(ctx context.Context, evt *event.CommandFailedEvent) {
+			finish(evt.RequestID, evt.Failure)
+		},
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Some operations write several documents that belong together, like the
+// two books of a merge, or a new book and its author. On a replica set or
+// a sharded cluster they run in a transaction, so either all of their
+// writes happen or none. A standalone server has no transactions; there
+// they run as before, one write after the other, and undo what they can
+// themselves when a later write fails.
+
+// Whether the servers of each client support transactions, found out on
+// first use.
+var transactionSupport sync.Map
+
+// Whether client is connected to a replica set or a sharded cluster.
+func supportsTransactions(ctx context.Context, client *mongo.Client) bool {
+	if supported, ok := transactionSupport.Load(client); ok {
+		return supported.(bool)
+	}
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	if err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello); err != nil {
+		// Try again next time instead of settling on a guess.
+		log.Printf("Error asking MongoDB whether it supports transactions: %v", err)
+		return false
+	}
+	supported := hello.SetName != "" || hello.Msg == "isdbgrid"
+	transactionSupport.Store(client, supported)
+	return supported
+}
+
+// Runs fn in a transaction where the server supports them, and directly
+// otherwise. fn must do its reads and writes with the context it is given.
+// Inside a transaction it may run more than once, when the transaction
+// ran into a conflict and is tried again, and an error it returns aborts
+// the transaction and is returned as is.
+func inTransaction(ctx context.Context, client *mongo.Client, fn func(ctx context.Context) error) error {
+	if !supportsTransactions(ctx, client) {
+		return fn(ctx)
+	}
+	session, err := client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	})
+	return err
+}
+
+// Whether ctx carries a transaction, in which case a failed operation
+// does not need to undo its earlier writes itself.
+func inTransactionContext(ctx context.Context) bool {
+	session := mongo.SessionFromContext(ctx)
+	return session != nil
+}
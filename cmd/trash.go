@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DELETE /api/books/:id does not remove a book right away. It sets the
+// deletedat field instead, which moves the book into a recycle bin: it
+// disappears from every listing but can still be restored. A background
+// sweeper purges books that stayed in the bin longer than the retention.
+
+// Adds the condition "not in the recycle bin" to a filter. A null query
+// matches both a null value and a missing field.
+func notDeleted(filter bson.M) bson.M {
+	filter["deletedat"] = nil
+	return filter
+}
+
+// Matches books in the recycle bin.
+func onlyDeleted(filter bson.M) bson.M {
+	filter["deletedat"] = bson.M{"$ne": nil}
+	return filter
+}
+
+// Removes deleted books with the given IDs for good.
+func purgeDeleted(ctx context.Context, coll *mongo.Collection, ids []string) error {
+	_, err := coll.DeleteMany(ctx, onlyDeleted(bson.M{"id": bson.M{"$in": ids}}))
+	return err
+}
+
+// Handles GET /api/books/trash, listing deleted books, most recently
+// deleted first.
+func listTrash(coll *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		opts := options.Find().SetSort(bson.D{{Key: "deletedat", Value: -1}})
+		cursor, err := coll.Find(ctx, onlyDeleted(bson.M{}), opts)
+		if err != nil {
+			log.Printf("Error listing the recycle bin: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to list deleted books"})
+		}
+		var books []BookStore
+		if err := cursor.All(ctx, &books); err != nil {
+			log.Printf("Error listing the recycle bin: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to list deleted books"})
+		}
+
+		ret := []map[string]interface{}{}
+		for _, book := range books {
+			item := bookToMap(book)
+			item["deleted_at"] = book.DeletedAt
+			if book.MergedInto != "" {
+				item["merged_into"] = book.MergedInto
+			}
+			ret = append(ret, item)
+		}
+		return c.JSON(http.StatusOK, ret)
+	}
+}
+
+// Handles POST /api/books/:id/restore, taking a book out of the recycle bin.
+// If a new book with the same ID was created meanwhile, the restore fails
+// with 409 since IDs must stay unique.
+func restoreBook(coll *mongo.Collection, events directEvents) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		idParam := c.Param("id")
+
+		// Checking for another book with the ID and restoring happen in
+		// one transaction where Mongo offers them; see transactions.go.
+		var book BookStore
+		err := inTransaction(ctx, coll.Database().Client(), func(ctx context.Context) error {
+			if _, err := findBook(ctx, coll, idParam); err == nil {
+				return errBookExists
+			} else if err != mongo.ErrNoDocuments {
+				return err
+			}
+			update := bson.M{
+				"$unset": bson.M{"deletedat": ""},
+				"$set":   bson.M{"updatedat": now()},
+				"$inc":   bson.M{"version": 1},
+			}
+			opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+			return coll.FindOneAndUpdate(ctx, onlyDeleted(bson.M{"id": idParam}), update, opts).Decode(&book)
+		})
+		if err == errBookExists {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Another book with ID " + idParam + " exists"})
+		} else if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "No deleted book with ID " + idParam})
+		} else if err != nil {
+			log.Printf("Error restoring book with ID %s: %v", idParam, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to restore book"})
+		}
+		// Watchers saw the book go, so it comes back as a new one.
+		events.Publish(bookEvent{Type: bookCreated, Book: book})
+		return c.JSON(http.StatusOK, bookToMap(book))
+	}
+}
+
+// Purges books that have been in the recycle bin for longer than retention.
+func purgeExpiredTrash(ctx context.Context, coll *mongo.Collection, retention time.Duration) (int64, error) {
+	cutoff := now().Add(-retention)
+	res, err := coll.DeleteMany(ctx, bson.M{"deletedat": bson.M{"$lt": cutoff}})
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+// The scheduler task emptying the recycle bin of expired books.
+func purgeTrashTask(coll *mongo.Collection, retention time.Duration) taskFunc {
+	return func(ctx context.Context) (string, error) {
+		purged, err := purgeExpiredTrash(ctx, coll, retention)
+		if err != nil || purged == 0 {
+			return "", err
+		}
+		return fmt.Sprintf("Purged %d books from the recycle bin", purged), nil
+	}
+}
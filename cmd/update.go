@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+
+	"github.com/labstack/echo/v4"
+)
+
+// PUT and PATCH on /api/books/:id. PUT replaces the whole book, so fields
+// left out of the body are cleared. PATCH changes single fields, either
+// with a JSON Merge Patch (RFC 7386), the default, or with a JSON Patch
+// (RFC 6902) when sent as application/json-patch+json.
+
+// The media types PATCH understands, announced in Accept-Patch.
+const (
+	mergePatchType = "application/merge-patch+json"
+	jsonPatchType  = "application/json-patch+json"
+)
+
+// Handles PUT /api/books/:id. The body is a complete book, validated like
+// one sent to POST /api/books. The id in the body may be left out, but must
+// not differ from the one in the path. With ?upsert=true, a missing book is
+// created and answered with 201.
+func replaceBook(books bookRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		idParam := c.Param("id")
+		body, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+		}
+		c.Request().Body = io.NopCloser(bytes.NewReader(body))
+
+		var book BookStore
+		if err := bindBook(c, &book); err != nil {
+			return bindFailed(c, err)
+		}
+		if book.ID != "" && book.ID != idParam {
+			return validationFailed(c, validationErrors{"id": "must match the ID in the path"})
+		}
+		book.ID = idParam
+		errs := validateStruct(&book)
+		// The author's name is taken from the author with author_id.
+		if book.AuthorID != "" {
+			delete(errs, "author")
+		}
+		if len(errs) > 0 {
+			return validationFailed(c, errs)
+		}
+
+		var payload map[string]interface{}
+		_ = json.Unmarshal(body, &payload)
+		expected, err := expectedVersionOf(c, payload)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "The version field must be a number"})
+		}
+
+		ctx := c.Request().Context()
+		updated, err := books.Update(ctx, idParam, replacementChanges(book), expected)
+		// With ?upsert=true, a book that does not exist yet is created. If
+		// somebody else creates it first, theirs is replaced after all.
+		if err == errBookNotFound && expected == nil && c.QueryParam("upsert") == "true" {
+			if err = books.Create(ctx, &book); err == nil {
+				c.Response().Header().Set(echo.HeaderLocation, "/api/books/"+book.ID)
+				return c.JSON(http.StatusCreated, bookToMap(book))
+			} else if err == errBookExists {
+				updated, err = books.Update(ctx, idParam, replacementChanges(book), nil)
+			}
+		}
+		if err != nil {
+			return bookFailed(c, err, idParam, "update")
+		}
+		return c.JSON(http.StatusOK, bookToMap(updated))
+	}
+}
+
+// Handles PATCH /api/books/:id.
+func patchBook(books bookRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		idParam := c.Param("id")
+		mediaType, _, _ := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+
+		var payload map[string]interface{}
+		var expected *int
+		switch mediaType {
+		case mergePatchType, echo.MIMEApplicationJSON, "":
+			if err := json.NewDecoder(c.Request().Body).Decode(&payload); err != nil || payload == nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+			}
+			var err error
+			if expected, err = expectedVersionOf(c, payload); err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "The version field must be a number"})
+			}
+		case jsonPatchType:
+			var ops []jsonPatchOp
+			if err := json.NewDecoder(c.Request().Body).Decode(&ops); err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid JSON patch"})
+			}
+			book, err := books.Get(c.Request().Context(), idParam)
+			if err != nil {
+				return bookFailed(c, err, idParam, "fetch")
+			}
+			payload, err = jsonPatchChanges(book, ops)
+			switch {
+			case err == errBadPatch:
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid JSON patch"})
+			case err == errPatchConflict:
+				return c.JSON(http.StatusConflict, map[string]string{"error": "The JSON patch does not apply to the book"})
+			case err != nil:
+				return bindFailed(c, err)
+			}
+			// The patch was applied to this version; a change in between
+			// would be lost otherwise.
+			version := book.Version
+			if v, ok := c.Get(expectedVersionKey).(int); ok {
+				version = v
+			}
+			expected = &version
+		default:
+			c.Response().Header().Set("Accept-Patch", mergePatchType+", "+jsonPatchType)
+			return c.JSON(http.StatusUnsupportedMediaType, map[string]string{"error": "PATCH takes " + mergePatchType + " or " + jsonPatchType})
+		}
+
+		clearNulls(payload)
+		// Only the fields present in the patch are checked, so a missing
+		// title just means "keep the title", while an empty one is refused.
+		if errs := validateUpdate(payload); len(errs) > 0 {
+			return validationFailed(c, errs)
+		}
+		changes := changesFromPayload(payload)
+		if changes.empty() {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "No valid fields provided for update"})
+		}
+
+		book, err := books.Update(c.Request().Context(), idParam, changes, expected)
+		if err != nil {
+			return bookFailed(c, err, idParam, "update")
+		}
+		return c.JSON(http.StatusOK, bookToMap(book))
+	}
+}
+
+// The version the client edited, from the body or an If-Match header, or
+// nil when it named none.
+func expectedVersionOf(c echo.Context, payload map[string]interface{}) (*int, error) {
+	version, ok, err := expectedVersion(c, payload)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return &version, nil
+}
+
+// What null stands for in a merge patch: the field is cleared. Required
+// fields become empty and fail validation.
+var mergePatchZero = map[string]interface{}{
+	"title":        "",
+	"author":       "",
+	"author_id":    "",
+	"edition":      "",
+	"series":       "",
+	"publisher":    "",
+	"language":     "",
+	"description":  "",
+	"pages":        0.0,
+	"year":         0.0,
+	"series_index": 0.0,
+	"tags":         []interface{}{},
+}
+
+func clearNulls(payload map[string]interface{}) {
+	for field, value := range payload {
+		if zero, ok := mergePatchZero[field]; ok && value == nil {
+			payload[field] = zero
+		}
+	}
+}
+
+// The editable fields of a book as a JSON document for a JSON Patch.
+func editableFields(book BookStore) map[string]interface{} {
+	tags := book.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	raw, _ := json.Marshal(map[string]interface{}{
+		"title":        book.BookName,
+		"author":       book.BookAuthor,
+		"author_id":    book.AuthorID,
+		"edition":      book.BookEdition,
+		"pages":        book.BookPages,
+		"year":         book.BookYear,
+		"tags":         tags,
+		"series":       book.Series,
+		"series_index": book.SeriesIndex,
+		"publisher":    book.Publisher,
+		"language":     book.Language,
+		"description":  book.Description,
+		"price":        book.Price,
+	})
+	var doc map[string]interface{}
+	_ = json.Unmarshal(raw, &doc)
+	return doc
+}
+
+// Applies a JSON Patch to the editable fields of the book and returns the
+// fields that changed as a merge patch; removed fields become null. Other
+// fields, like id or version, cannot be patched.
+func jsonPatchChanges(book BookStore, ops []jsonPatchOp) (map[string]interface{}, error) {
+	original := editableFields(book)
+	patched, err := applyJSONPatch(deepCopy(original), ops)
+	if err != nil {
+		return nil, err
+	}
+	result, ok := patched.(map[string]interface{})
+	if !ok {
+		return nil, errPatchConflict
+	}
+	payload := map[string]interface{}{}
+	errs := validationErrors{}
+	for field, value := range result {
+		if _, editable := original[field]; !editable {
+			errs[field] = "cannot be changed"
+		} else if !reflect.DeepEqual(value, original[field]) {
+			payload[field] = value
+		}
+	}
+	for field := range original {
+		if _, ok := result[field]; !ok {
+			payload[field] = nil
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return payload, nil
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Users register with a name and a password and log in to get a JWT, which
+// carries their role just like tokens minted by hand. Each user keeps named
+// reading lists of book IDs inside their own document. The "favorites" list
+// always exists and cannot be deleted.
+type User struct {
+	MongoID      primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	Username     string             `json:"username"`
+	PasswordHash []byte             `bson:"passwordhash" json:"-"`
+	Role         string             `json:"role"`
+	Lists        []readingList      `bson:"lists" json:"-"`
+	CreatedAt    time.Time          `json:"created_at"`
+}
+
+type readingList struct {
+	Name  string   `json:"name"`
+	Books []string `json:"books"`
+}
+
+const favoritesList = "favorites"
+
+// The body of registrations and logins.
+type credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Returns the list of the given name, or nil.
+func (u *User) list(name string) *readingList {
+	for i := range u.Lists {
+		if u.Lists[i].Name == name {
+			return &u.Lists[i]
+		}
+	}
+	return nil
+}
+
+// Handles POST /api/users. New users are readers; an admin can promote
+// them with PUT /api/users/:username/role.
+func registerUser(users *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		var creds credentials
+		if err := c.Bind(&creds); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+		}
+		creds.Username = strings.TrimSpace(creds.Username)
+		errs := validationErrors{}
+		if creds.Username == "" {
+			errs["username"] = "is required"
+		}
+		if len(creds.Password) < 8 {
+			errs["password"] = "must be at least 8 characters long"
+		}
+		if len(errs) > 0 {
+			return validationFailed(c, errs)
+		}
+
+		if count, err := users.CountDocuments(ctx, bson.M{"username": creds.Username}); err != nil {
+			log.Printf("Error checking for existing user: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to register user"})
+		} else if count > 0 {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "User " + creds.Username + " already exists"})
+		}
+
+		hash, err := bcrypt.GenerateFromPassword([]byte(creds.Password), bcrypt.DefaultCost)
+		if err != nil {
+			// Passwords longer than 72 bytes end up here.
+			return validationFailed(c, validationErrors{"password": "must be at most 72 bytes long"})
+		}
+		user := User{
+			MongoID:      primitive.NewObjectID(),
+			Username:     creds.Username,
+			PasswordHash: hash,
+			Role:         RoleReader,
+			Lists:        []readingList{{Name: favoritesList, Books: []string{}}},
+			CreatedAt:    now(),
+		}
+		// The unique index catches sign-ups racing for the same name.
+		if _, err := users.InsertOne(ctx, user); mongo.IsDuplicateKeyError(err) {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "User " + creds.Username + " already exists"})
+		} else if err != nil {
+			log.Printf("Error inserting user: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to register user"})
+		}
+		return c.JSON(http.StatusCreated, user)
+	}
+}
+
+var errWrongLogin = errors.New("wrong username or password")
+
+// Looks up the user and checks the password. Unknown users and wrong
+// passwords both give errWrongLogin, so callers cannot tell them apart.
+func checkLogin(ctx context.Context, users *mongo.Collection, username, password string) (User, error) {
+	var user User
+	err := users.FindOne(ctx, bson.M{"username": strings.TrimSpace(username)}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return user, errWrongLogin
+	} else if err != nil {
+		return user, err
+	}
+	if bcrypt.CompareHashAndPassword(user.PasswordHash, []byte(password)) != nil {
+		return user, errWrongLogin
+	}
+	return user, nil
+}
+
+// Handles POST /api/login, answering with a token for the user. Tokens can
+// only be issued when a JWT secret is configured.
+func loginUser(users *mongo.Collection, access accessControl, ttl time.Duration) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !access.enabled() {
+			return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Logins are disabled because no JWT secret is configured"})
+		}
+		var creds credentials
+		if err := c.Bind(&creds); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+		}
+
+		user, err := checkLogin(c.Request().Context(), users, creds.Username, creds.Password)
+		if err == errWrongLogin {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Wrong username or password"})
+		} else if err != nil {
+			log.Printf("Error fetching user %s: %v", creds.Username, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to log in"})
+		}
+
+		token, expires, err := access.Issue(user.Username, user.Role, ttl)
+		if err != nil {
+			log.Printf("Error signing token for %s: %v", user.Username, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to log in"})
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"token": token, "expires_at": expires})
+	}
+}
+
+// Handles PUT /api/users/:username/role, taking a body like
+// {"role": "editor"}. The new role applies to tokens issued afterwards.
+func setUserRole(users *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var payload struct {
+			Role string `json:"role"`
+		}
+		if err := c.Bind(&payload); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+		}
+		if _, ok := roleRank[payload.Role]; !ok {
+			return validationFailed(c, validationErrors{"role": "must be reader, editor, or admin"})
+		}
+		username := c.Param("username")
+		result, err := users.UpdateOne(c.Request().Context(), bson.M{"username": username}, bson.M{"$set": bson.M{"role": payload.Role}})
+		if err != nil {
+			log.Printf("Error changing the role of %s: %v", username, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to change role"})
+		}
+		if result.MatchedCount == 0 {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "User " + username + " not found"})
+		}
+		return c.NoContent(http.StatusOK)
+	}
+}
+
+// Loads the user the request's token belongs to. Answers with 401 when the
+// caller is not logged in and with 404 when the user no longer exists; in
+// both cases the returned user is nil.
+func loadCaller(c echo.Context, users *mongo.Collection) (*User, error) {
+	username := callerSubject(c)
+	if username == "" {
+		return nil, c.JSON(http.StatusUnauthorized, map[string]string{"error": "Log in to use your reading lists"})
+	}
+	var user User
+	err := users.FindOne(c.Request().Context(), bson.M{"username": username}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return nil, c.JSON(http.StatusNotFound, map[string]string{"error": "User " + username + " not found"})
+	} else if err != nil {
+		log.Printf("Error fetching user %s: %v", username, err)
+		return nil, c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to load user"})
+	}
+	if user.list(favoritesList) == nil {
+		user.Lists = append([]readingList{{Name: favoritesList, Books: []string{}}}, user.Lists...)
+	}
+	return &user, nil
+}
+
+// Stores the lists of a user after they were changed.
+func saveLists(c echo.Context, users *mongo.Collection, user *User) error {
+	_, err := users.UpdateOne(c.Request().Context(), bson.M{"_id": user.MongoID}, bson.M{"$set": bson.M{"lists": user.Lists}})
+	if err != nil {
+		log.Printf("Error saving the lists of %s: %v", user.Username, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to save reading list"})
+	}
+	return nil
+}
+
+// Handles GET /api/me/lists.
+func myLists(users *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, err := loadCaller(c, users)
+		if user == nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, user.Lists)
+	}
+}
+
+// Handles GET /api/me/lists/:name, returning the list with its books.
+// Books that were deleted meanwhile are left out.
+func myList(coll, users *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, err := loadCaller(c, users)
+		if user == nil {
+			return err
+		}
+		list := user.list(c.Param("name"))
+		if list == nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Reading list " + c.Param("name") + " not found"})
+		}
+		books := booksInOrder(findBooks(c.Request().Context(), coll, bson.M{"id": bson.M{"$in": list.Books}}), list.Books)
+		return c.JSON(http.StatusOK, map[string]interface{}{"name": list.Name, "books": bookList(books)})
+	}
+}
+
+// Sorts books into the order of ids.
+func booksInOrder(books []map[string]interface{}, ids []string) []map[string]interface{} {
+	ret := []map[string]interface{}{}
+	for _, id := range ids {
+		idx := slices.IndexFunc(books, func(book map[string]interface{}) bool { return book["id"] == id })
+		if idx >= 0 {
+			ret = append(ret, books[idx])
+		}
+	}
+	return ret
+}
+
+// Handles POST /api/me/lists with a body like {"name": "to read"}.
+func createList(users *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var payload struct {
+			Name string `json:"name"`
+		}
+		if err := c.Bind(&payload); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+		}
+		payload.Name = strings.TrimSpace(payload.Name)
+		if payload.Name == "" {
+			return validationFailed(c, validationErrors{"name": "is required"})
+		}
+		user, err := loadCaller(c, users)
+		if user == nil {
+			return err
+		}
+		if user.list(payload.Name) != nil {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Reading list " + payload.Name + " already exists"})
+		}
+		list := readingList{Name: payload.Name, Books: []string{}}
+		user.Lists = append(user.Lists, list)
+		if err := saveLists(c, users, user); err != nil {
+			return err
+		}
+		return c.JSON(http.StatusCreated, list)
+	}
+}
+
+// Handles DELETE /api/me/lists/:name.
+func deleteList(users *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		name := c.Param("name")
+		if name == favoritesList {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "The favorites list cannot be deleted"})
+		}
+		user, err := loadCaller(c, users)
+		if user == nil {
+			return err
+		}
+		if user.list(name) == nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Reading list " + name + " not found"})
+		}
+		user.Lists = slices.DeleteFunc(user.Lists, func(list readingList) bool { return list.Name == name })
+		if err := saveLists(c, users, user); err != nil {
+			return err
+		}
+		return c.NoContent(http.StatusOK)
+	}
+}
+
+// Handles POST /api/me/lists/:name/books with a body like {"id": "example1"}.
+func addToList(coll, users *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var payload struct {
+			ID string `json:"id"`
+		}
+		if err := c.Bind(&payload); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+		}
+		if payload.ID == "" {
+			return validationFailed(c, validationErrors{"id": "is required"})
+		}
+		if _, err := findBook(c.Request().Context(), coll, payload.ID); err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Book not found with ID " + payload.ID})
+		} else if err != nil {
+			log.Printf("Error fetching book with ID %s: %v", payload.ID, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to save reading list"})
+		}
+
+		user, err := loadCaller(c, users)
+		if user == nil {
+			return err
+		}
+		list := user.list(c.Param("name"))
+		if list == nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Reading list " + c.Param("name") + " not found"})
+		}
+		if !slices.Contains(list.Books, payload.ID) {
+			list.Books = append(list.Books, payload.ID)
+		}
+		if err := saveLists(c, users, user); err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, list)
+	}
+}
+
+// Handles DELETE /api/me/lists/:name/books/:book.
+func removeFromList(users *mongo.Collection) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, err := loadCaller(c, users)
+		if user == nil {
+			return err
+		}
+		list := user.list(c.Param("name"))
+		if list == nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Reading list " + c.Param("name") + " not found"})
+		}
+		list.Books = slices.DeleteFunc(list.Books, func(id string) bool { return id == c.Param("book") })
+		if err := saveLists(c, users, user); err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, list)
+	}
+}
+
+// Handles GET /users/:username/lists, rendering the reading lists of a user
+// with their books. Only the user logged in to the session and admins see
+// them; everybody else gets 404, as if the user did not exist.
+func readingListsPage(coll, users *mongo.Collection, access accessControl) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !access.Allows(c, RoleAdmin) && callerSubject(c) != c.Param("username") {
+			return c.NoContent(http.StatusNotFound)
+		}
+		var user User
+		err := users.FindOne(c.Request().Context(), bson.M{"username": c.Param("username")}).Decode(&user)
+		if err == mongo.ErrNoDocuments {
+			return c.NoContent(http.StatusNotFound)
+		} else if err != nil {
+			log.Printf("Error fetching user %s: %v", c.Param("username"), err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+
+		var lists []map[string]interface{}
+		for _, list := range user.Lists {
+			books := booksInOrder(findBooks(c.Request().Context(), coll, bson.M{"id": bson.M{"$in": list.Books}}), list.Books)
+			lists = append(lists, map[string]interface{}{"Name": list.Name, "Books": books})
+		}
+		return c.Render(http.StatusOK, "reading-lists", map[string]interface{}{
+			"Username": user.Username,
+			"Lists":    lists,
+		})
+	}
+}
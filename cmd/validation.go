@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/isbn"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/text/language"
+)
+
+// Payload validation. Fields of a struct declare their rules in a
+// `validate` tag, e.g. `validate:"required,int,min=1"`, and bookValidator
+// checks them. It is registered as echo's Validator, so handlers simply call
+// c.Validate(&book) after binding.
+
+// Field level problems, keyed by the JSON name of the field.
+type validationErrors map[string]string
+
+func (v validationErrors) Error() string {
+	var parts []string
+	for field, msg := range v {
+		parts = append(parts, field+" "+msg)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
+
+// A rule looks at the (string) value of a field and returns a message when
+// the value is not acceptable. Rules other than "required" are only applied
+// to non-empty values, which keeps optional fields optional.
+type validationRule func(value, param string) string
+
+var validationRules = map[string]validationRule{
+	"int": func(value, _ string) string {
+		if _, err := strconv.Atoi(value); err != nil {
+			return "must be a whole number"
+		}
+		return ""
+	},
+	"min": func(value, param string) string {
+		n, err := strconv.Atoi(value)
+		limit, _ := strconv.Atoi(param)
+		if err == nil && n < limit {
+			return "must be at least " + param
+		}
+		return ""
+	},
+	"max": func(value, param string) string {
+		n, err := strconv.Atoi(value)
+		limit, _ := strconv.Atoi(param)
+		if err == nil && n > limit {
+			return "must be at most " + param
+		}
+		return ""
+	},
+	// Publication years may not lie more than a year in the future.
+	"notfuture": func(value, _ string) string {
+		n, err := strconv.Atoi(value)
+		if err == nil && n > time.Now().Year()+1 {
+			return "must not be in the future"
+		}
+		return ""
+	},
+	"bcp47": func(value, _ string) string {
+		if _, err := language.Parse(value); err != nil {
+			return "must be a BCP 47 language tag like en or pt-BR"
+		}
+		return ""
+	},
+	"isbn": func(value, _ string) string {
+		if !looksLikeISBN(value) {
+			return ""
+		}
+		switch isbn.Validate(value) {
+		case nil:
+			return ""
+		case isbn.ErrChecksum:
+			return "has a wrong ISBN check digit"
+		default:
+			return "must be an ISBN-10 or ISBN-13"
+		}
+	},
+}
+
+type bookValidator struct{}
+
+// Implements echo.Validator.
+func (bookValidator) Validate(i interface{}) error {
+	if errs := validateStruct(i); len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Checks every tagged string field of a struct (or pointer to one).
+func validateStruct(i interface{}) validationErrors {
+	v := reflect.Indirect(reflect.ValueOf(i))
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+	errs := validationErrors{}
+	t := v.Type()
+	for idx := 0; idx < t.NumField(); idx++ {
+		field := t.Field(idx)
+		tag := field.Tag.Get("validate")
+		if tag == "" {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" {
+			name = field.Name
+		}
+
+		// Rules work on text. Numbers are converted, with 0 standing for
+		// "not given" just like an empty string.
+		var value string
+		switch fv := v.Field(idx); fv.Kind() {
+		case reflect.String:
+			value = strings.TrimSpace(fv.String())
+		case reflect.Int, reflect.Int32, reflect.Int64:
+			if fv.Int() != 0 {
+				value = strconv.FormatInt(fv.Int(), 10)
+			}
+		default:
+			continue
+		}
+		if msg := checkRules(value, tag); msg != "" {
+			errs[name] = msg
+		}
+	}
+	return errs
+}
+
+func checkRules(value, tag string) string {
+	for _, rule := range strings.Split(tag, ",") {
+		name, param, _ := strings.Cut(rule, "=")
+		if name == "required" {
+			if value == "" {
+				return "is required"
+			}
+			continue
+		}
+		if value == "" {
+			continue
+		}
+		if check, ok := validationRules[name]; ok {
+			if msg := check(value, param); msg != "" {
+				return msg
+			}
+		}
+	}
+	return ""
+}
+
+// Validates the fields of a partial update. The payload uses the JSON names,
+// and only the fields it contains are checked.
+func validateUpdate(payload map[string]interface{}) validationErrors {
+	book, errs := decodeFields(payload)
+	for field, msg := range validateStruct(&book) {
+		if _, ok := payload[field]; ok && field != "id" && errs[field] == "" {
+			errs[field] = msg
+		}
+	}
+	return errs
+}
+
+// Copies the fields of a decoded JSON payload into a book one by one. Going
+// through JSON for each field applies the same conversions as binding a
+// full book does (e.g., "280" pages become 280), and tells us exactly which
+// fields have a value of the wrong type.
+func decodeFields(payload map[string]interface{}) (BookStore, validationErrors) {
+	errs := validationErrors{}
+	var req bookRequest
+	v := reflect.ValueOf(&req).Elem()
+	t := v.Type()
+	for idx := 0; idx < t.NumField(); idx++ {
+		name, _, _ := strings.Cut(t.Field(idx).Tag.Get("json"), ",")
+		value, ok := payload[name]
+		if !ok || name == "id" {
+			continue
+		}
+		raw, _ := json.Marshal(value)
+		if err := json.Unmarshal(raw, v.Field(idx).Addr().Interface()); err != nil {
+			errs[name] = typeMessage(t.Field(idx).Type)
+		}
+	}
+	return req.book(), errs
+}
+
+// Decodes the JSON body of a request, a bookRequest, into a book. When a
+// value has the wrong type, like "many" as pages, the body is decoded again
+// field by field to find out which ones are wrong, and a validationErrors
+// is returned.
+func bindBook(c echo.Context, book *BookStore) error {
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return err
+	}
+	var req bookRequest
+	if err := json.Unmarshal(body, &req); err == nil {
+		*book = req.book()
+		return nil
+	} else if _, ok := err.(*json.UnmarshalTypeError); !ok {
+		return err
+	}
+
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return err
+	}
+	_, errs := decodeFields(payload)
+	if len(errs) == 0 {
+		return errors.New("invalid payload")
+	}
+	return errs
+}
+
+// Answers a failed bind: wrong types are reported per field with 422, just
+// like failed validations, anything else is a malformed payload.
+func bindFailed(c echo.Context, err error) error {
+	if errs, ok := err.(validationErrors); ok {
+		return validationFailed(c, errs)
+	}
+	return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+}
+
+func typeMessage(t reflect.Type) string {
+	if t == reflect.TypeOf(&bookPrice{}) {
+		return "must have an ISO 4217 currency code like EUR and an amount with no more decimals than the currency has"
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return "must be a whole number"
+	case reflect.String:
+		return "must be a string"
+	}
+	return "has the wrong type"
+}
+
+// Answers a failed validation with 422 and the problems per field. Other
+// errors are passed on.
+func validationFailed(c echo.Context, err error) error {
+	var errs validationErrors
+	if !errors.As(err, &errs) {
+		return err
+	}
+	return c.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+		"error":  "Validation failed",
+		"fields": errs,
+	})
+}
+
+// The edition field holds either an ISBN or a free text label such as
+// "1st Edition". Only values made of digits, hyphens, spaces, and X are
+// treated as an attempt at an ISBN and have to pass the isbn package.
+func looksLikeISBN(value string) bool {
+	digits := 0
+	for _, r := range value {
+		switch {
+		case r >= '0' && r <= '9':
+			digits++
+		case r == '-' || r == ' ' || r == 'X' || r == 'x':
+		default:
+			return false
+		}
+	}
+	return digits > 0
+}
+
+// Brings ISBN editions into their compact form so the same book is not
+// stored under several spellings. Free text editions stay as they are.
+func normalizeEdition(edition string) string {
+	if !looksLikeISBN(edition) {
+		return edition
+	}
+	if normalized, err := isbn.Normalize(edition); err == nil {
+		return normalized
+	}
+	return edition
+}
+
+// Spells language tags the canonical way, e.g. en-us becomes en-US, so
+// ?language= finds every book in a language. Invalid tags stay as they are.
+func normalizeLanguage(tag string) string {
+	if parsed, err := language.Parse(tag); err == nil {
+		return parsed.String()
+	}
+	return tag
+}
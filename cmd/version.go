@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/labstack/echo/v4"
+)
+
+// What build of the server is running, so a deployment can be checked from
+// the outside with GET /api/version. The values are set when building:
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)" ./cmd
+//
+// Without them, the commit and date fall back to what the Go toolchain
+// records on its own when building in a git checkout.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	// Whether the checkout had uncommitted changes; only known from the
+	// toolchain.
+	Modified  bool   `json:"modified,omitempty"`
+	GoVersion string `json:"go_version"`
+	OS        string `json:"os"`
+	Arch      string `json:"arch"`
+	Compiler  string `json:"compiler"`
+}
+
+func readBuildInfo() buildInfo {
+	info := buildInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		Compiler:  runtime.Compiler,
+	}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range build.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = setting.Value
+				}
+			case "vcs.time":
+				if info.BuildDate == "" {
+					info.BuildDate = setting.Value
+				}
+			case "vcs.modified":
+				info.Modified = setting.Value == "true"
+			}
+		}
+	}
+	return info
+}
+
+// The line logged on start, like "bookstore 1.4.0 (commit 1a2b3c4, built
+// 2024-05-02T10:00:00Z, go1.22.3 linux/amd64)".
+func (info buildInfo) String() string {
+	commit := info.Commit
+	if len(commit) > 7 {
+		commit = commit[:7]
+	}
+	if commit == "" {
+		commit = "unknown"
+	}
+	if info.Modified {
+		commit += "+dirty"
+	}
+	built := info.BuildDate
+	if built == "" {
+		built = "unknown"
+	}
+	return fmt.Sprintf("%s (commit %s, built %s, %s %s/%s)", info.Version, commit, built, info.GoVersion, info.OS, info.Arch)
+}
+
+// Handles GET /api/version, which needs no token.
+func getVersion(info buildInfo) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, info)
+	}
+}
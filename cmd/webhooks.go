@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Webhooks let other systems hear about book changes. Admins register a
+// URL and the event types it wants ("created", "updated", "deleted"; none
+// means all), and every matching event is POSTed there as JSON. Each
+// request is signed with the secret of the webhook: the X-Webhook-Signature
+// header holds "sha256=" and the hex HMAC-SHA256 of the body.
+type Webhook struct {
+	MongoID   primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	URL       string             `json:"url" validate:"required"`
+	Events    []string           `json:"events"`
+	Secret    string             `json:"secret,omitempty"`
+	CreatedAt time.Time          `json:"created_at"`
+	// The outcome of the latest delivery, after all its retries.
+	LastDelivery *webhookResult `json:"last_delivery,omitempty"`
+}
+
+type webhookResult struct {
+	At     time.Time `json:"at"`
+	Event  string    `json:"event"`
+	Status int       `json:"status,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+func (w Webhook) wants(event string) bool {
+	return len(w.Events) == 0 || slices.Contains(w.Events, event)
+}
+
+const (
+	// Failed deliveries are tried this many times in total, waiting
+	// webhookBackoff before the second attempt and twice as long before
+	// each further one.
+	webhookAttempts = 5
+	webhookBackoff  = 2 * time.Second
+	// Deliveries are sent by this many workers in parallel.
+	webhookWorkers = 4
+)
+
+// Serves /api/webhooks. POST registers a webhook, e.g. {"url":
+// "https://example.com/hook", "events": ["created"]}; without a secret,
+// one is generated. Secrets are only shown when a webhook is created.
+func webhookResource(webhooks *mongo.Collection) Resource[Webhook] {
+	store := mongoStore[Webhook]{
+		coll: webhooks,
+		filter: func(id string) (bson.M, bool) {
+			oid, err := primitive.ObjectIDFromHex(id)
+			return bson.M{"_id": oid}, err == nil
+		},
+		sort: bson.D{{Key: "createdat", Value: 1}},
+	}
+	return Resource[Webhook]{
+		Name:  "webhook",
+		Store: store,
+		BeforeCreate: func(ctx context.Context, hook *Webhook) error {
+			errs := validationErrors{}
+			if target, err := url.Parse(hook.URL); err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+				errs["url"] = "must be an http or https URL"
+			}
+			for _, event := range hook.Events {
+				if event != bookCreated && event != bookUpdated && event != bookDeleted {
+					errs["events"] = "may only contain created, updated, and deleted"
+				}
+			}
+			if len(errs) > 0 {
+				return errs
+			}
+
+			if hook.Secret == "" {
+				secret := make([]byte, 32)
+				if _, err := rand.Read(secret); err != nil {
+					return fmt.Errorf("generating a secret: %w", err)
+				}
+				hook.Secret = hex.EncodeToString(secret)
+			}
+			hook.MongoID = primitive.NewObjectID()
+			hook.CreatedAt = now()
+			hook.LastDelivery = nil
+			return nil
+		},
+		Present: func(hook Webhook) interface{} {
+			hook.Secret = ""
+			return hook
+		},
+	}
+}
+
+// One event on its way to one webhook.
+type webhookDelivery struct {
+	hook    Webhook
+	id      string
+	event   string
+	body    []byte
+	attempt int
+}
+
+// Sends the book events to the registered webhooks in the background.
+type webhookDispatcher struct {
+	webhooks *mongo.Collection
+	client   *http.Client
+	queue    chan webhookDelivery
+}
+
+// Starts the dispatcher and its workers. They run until ctx is done.
+func startWebhooks(ctx context.Context, webhooks *mongo.Collection, events *bookEvents) {
+	d := &webhookDispatcher{
+		webhooks: webhooks,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan webhookDelivery, 1024),
+	}
+	for i := 0; i < webhookWorkers; i++ {
+		go d.work(ctx)
+	}
+	go d.dispatch(ctx, events)
+}
+
+// Turns every book event into a delivery for each webhook that wants it.
+func (d *webhookDispatcher) dispatch(ctx context.Context, events *bookEvents) {
+	changes, stop := events.Subscribe()
+	defer stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-changes:
+			var hooks []Webhook
+			cursor, err := d.webhooks.Find(ctx, bson.M{})
+			if err == nil {
+				err = cursor.All(ctx, &hooks)
+			}
+			if err != nil {
+				log.Printf("Error loading webhooks: %v", err)
+				continue
+			}
+			book := bookToMap(event.Book)
+			if event.Type == bookDeleted {
+				book = map[string]interface{}{"id": event.Book.ID}
+			}
+			body, err := json.Marshal(map[string]interface{}{
+				"event":       event.Type,
+				"book":        book,
+				"occurred_at": now(),
+			})
+			if err != nil {
+				log.Printf("Error encoding %s event of book %s: %v", event.Type, event.Book.ID, err)
+				continue
+			}
+			for _, hook := range hooks {
+				if hook.wants(event.Type) {
+					d.enqueue(webhookDelivery{hook: hook, id: primitive.NewObjectID().Hex(), event: event.Type, body: body, attempt: 1})
+				}
+			}
+		}
+	}
+}
+
+func (d *webhookDispatcher) enqueue(delivery webhookDelivery) {
+	select {
+	case d.queue <- delivery:
+	default:
+		log.Printf("Dropping %s delivery to %s: too many pending deliveries", delivery.event, delivery.hook.URL)
+	}
+}
+
+// Sends deliveries, scheduling failed ones for another attempt with
+// exponential backoff until they run out of attempts.
+func (d *webhookDispatcher) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case delivery := <-d.queue:
+			status, err := d.send(ctx, delivery)
+			if err != nil && delivery.attempt < webhookAttempts {
+				wait := webhookBackoff << (delivery.attempt - 1)
+				delivery.attempt++
+				time.AfterFunc(wait, func() { d.enqueue(delivery) })
+				continue
+			}
+			result := webhookResult{At: now(), Event: delivery.event, Status: status}
+			if err != nil {
+				result.Error = err.Error()
+				log.Printf("Giving up on %s delivery to %s after %d attempts: %v", delivery.event, delivery.hook.URL, delivery.attempt, err)
+			}
+			if _, err := d.webhooks.UpdateByID(ctx, delivery.hook.MongoID, bson.M{"$set": bson.M{"lastdelivery": result}}); err != nil {
+				log.Printf("Error recording delivery to %s: %v", delivery.hook.URL, err)
+			}
+		}
+	}
+}
+
+// POSTs the delivery and reports the status code. Anything but a 2xx
+// answer counts as a failure.
+func (d *webhookDispatcher) send(ctx context.Context, delivery webhookDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.hook.URL, bytes.NewReader(delivery.body))
+	if err != nil {
+		return 0, err
+	}
+	mac := hmac.New(sha256.New, []byte(delivery.hook.Secret))
+	mac.Write(delivery.body)
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set("X-Webhook-Event", delivery.event)
+	req.Header.Set("X-Webhook-Delivery", delivery.id)
+	req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,106 @@
+// Package isbn validates and normalizes International Standard Book
+// Numbers. Both the old ten digit form (ISBN-10) and the current thirteen
+// digit form (ISBN-13) are supported, including their check digits.
+package isbn
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	// ErrLength is returned when the number has neither 10 nor 13 digits.
+	ErrLength = errors.New("isbn: must have 10 or 13 digits")
+	// ErrCharacter is returned for characters other than digits, hyphens,
+	// spaces, and a trailing X in an ISBN-10.
+	ErrCharacter = errors.New("isbn: invalid character")
+	// ErrChecksum is returned when the check digit does not match.
+	ErrChecksum = errors.New("isbn: wrong check digit")
+)
+
+// Normalize validates s and returns it without hyphens or spaces, with an
+// uppercase X as ISBN-10 check digit. Publishers hyphenate the same number
+// in many ways ("978-3-16-148410-0", "978 3161484100", ...); the compact
+// form gives every ISBN exactly one spelling.
+func Normalize(s string) (string, error) {
+	compact := strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(strings.TrimSpace(s)))
+	switch len(compact) {
+	case 10:
+		return compact, check10(compact)
+	case 13:
+		return compact, check13(compact)
+	}
+	return "", ErrLength
+}
+
+// Validate reports why s is not a valid ISBN, or nil if it is one.
+func Validate(s string) error {
+	_, err := Normalize(s)
+	return err
+}
+
+// Valid reports whether s is a valid ISBN-10 or ISBN-13.
+func Valid(s string) bool {
+	return Validate(s) == nil
+}
+
+// To13 converts a valid ISBN-10 into its ISBN-13 equivalent by adding the
+// 978 prefix and recomputing the check digit. ISBN-13 input is returned
+// normalized.
+func To13(s string) (string, error) {
+	compact, err := Normalize(s)
+	if err != nil || len(compact) == 13 {
+		return compact, err
+	}
+	body := "978" + compact[:9]
+	return body + string(checkDigit13(body)), nil
+}
+
+// ISBN-10 weights the digits 10 down to 1; the sum must be divisible by 11.
+// A check digit of 10 is written as X.
+func check10(s string) error {
+	sum := 0
+	for i := 0; i < 10; i++ {
+		c := s[i]
+		var d int
+		switch {
+		case c >= '0' && c <= '9':
+			d = int(c - '0')
+		case c == 'X' && i == 9:
+			d = 10
+		default:
+			return ErrCharacter
+		}
+		sum += d * (10 - i)
+	}
+	if sum%11 != 0 {
+		return ErrChecksum
+	}
+	return nil
+}
+
+// ISBN-13 weights the digits alternately with 1 and 3; the sum must be
+// divisible by 10.
+func check13(s string) error {
+	for i := 0; i < 13; i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return ErrCharacter
+		}
+	}
+	if checkDigit13(s[:12]) != s[12] {
+		return ErrChecksum
+	}
+	return nil
+}
+
+func checkDigit13(body string) byte {
+	sum := 0
+	for i := 0; i < 12; i++ {
+		d := int(body[i] - '0')
+		if i%2 == 1 {
+			d *= 3
+		}
+		sum += d
+	}
+	return byte('0' + (10-sum%10)%10)
+}
@@ -0,0 +1,74 @@
+package isbn
+
+import "testing"
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+		err  error
+	}{
+		{"ISBN-13", "9783161484100", "9783161484100", nil},
+		{"ISBN-13 with hyphens", "978-3-16-148410-0", "9783161484100", nil},
+		{"ISBN-13 with spaces", " 978 3 16 148410 0 ", "9783161484100", nil},
+		{"ISBN-13 with a wrong check digit", "978-3-16-148410-1", "", ErrChecksum},
+		{"ISBN-13 with a letter", "978316148410A", "", ErrCharacter},
+		{"ISBN-13 with X", "978316148410X", "", ErrCharacter},
+		{"ISBN-10", "0306406152", "0306406152", nil},
+		{"ISBN-10 with hyphens", "0-306-40615-2", "0306406152", nil},
+		{"ISBN-10 with spaces", "0 306 40615 2", "0306406152", nil},
+		{"ISBN-10 with a wrong check digit", "0-306-40615-3", "", ErrChecksum},
+		{"ISBN-10 with X", "3-16-148410-X", "316148410X", nil},
+		{"ISBN-10 with lowercase x", "316148410x", "316148410X", nil},
+		{"ISBN-10 with X before the end", "31614841X0", "", ErrCharacter},
+		{"ISBN-10 with 0 for X", "3161484100", "", ErrChecksum},
+		{"too short", "978316148410", "", ErrLength},
+		{"too long", "97831614841000", "", ErrLength},
+		{"empty", "", "", ErrLength},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Normalize(tt.in)
+			if err != tt.err {
+				t.Fatalf("Normalize(%q) failed with %v, want %v", tt.in, err, tt.err)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("Normalize(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+			if valid := Valid(tt.in); valid != (tt.err == nil) {
+				t.Errorf("Valid(%q) = %t, want %t", tt.in, valid, !valid)
+			}
+		})
+	}
+}
+
+func TestTo13(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		err  error
+	}{
+		{"0-306-40615-2", "9780306406157", nil},
+		// The new check digit can be 0, where the old one was X.
+		{"3-16-148410-X", "9783161484100", nil},
+		{"316148410x", "9783161484100", nil},
+		{"9783161484100", "9783161484100", nil},
+		{"978-3-16-148410-0", "9783161484100", nil},
+		{"0-306-40615-3", "", ErrChecksum},
+		{"030640615", "", ErrLength},
+	}
+	for _, tt := range tests {
+		got, err := To13(tt.in)
+		if err != tt.err {
+			t.Errorf("To13(%q) failed with %v, want %v", tt.in, err, tt.err)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("To13(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+		if err == nil && Validate(got) != nil {
+			t.Errorf("To13(%q) = %q, which is no valid ISBN", tt.in, got)
+		}
+	}
+}
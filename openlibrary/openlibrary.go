@@ -0,0 +1,168 @@
+// Package openlibrary looks up book metadata by ISBN in the Open Library
+// (https://openlibrary.org). Requests time out, failed requests are retried,
+// and answers are cached, so a slow or flaky Open Library does not slow
+// down every lookup.
+package openlibrary
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned when the Open Library does not know the ISBN.
+var ErrNotFound = errors.New("openlibrary: book not found")
+
+// Book holds the metadata found for an ISBN. Numbers the Open Library does
+// not know are 0.
+type Book struct {
+	Title  string
+	Author string
+	Pages  int
+	Year   int
+}
+
+// Client queries the Open Library. The zero value is not usable; create one
+// with New.
+type Client struct {
+	// BaseURL of the Open Library, without a trailing slash.
+	BaseURL string
+	// HTTPClient sends the requests. Its timeout bounds every attempt.
+	HTTPClient *http.Client
+	// Retries is how often a failed request is repeated, waiting Backoff
+	// before the first retry and twice as long before each further one.
+	Retries int
+	Backoff time.Duration
+	// TTL is how long answers, including "not found", are cached.
+	TTL time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	book    Book
+	err     error
+	expires time.Time
+}
+
+// New returns a client for https://openlibrary.org with the given timeout
+// per request and cache TTL.
+func New(timeout, ttl time.Duration) *Client {
+	return &Client{
+		BaseURL:    "https://openlibrary.org",
+		HTTPClient: &http.Client{Timeout: timeout},
+		Retries:    2,
+		Backoff:    200 * time.Millisecond,
+		TTL:        ttl,
+		cache:      map[string]cacheEntry{},
+	}
+}
+
+// Lookup returns the metadata of the book with the given ISBN, which should
+// be in its compact form without hyphens.
+func (c *Client) Lookup(ctx context.Context, isbn string) (Book, error) {
+	c.mu.Lock()
+	entry, ok := c.cache[isbn]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.book, entry.err
+	}
+
+	book, err := c.fetchWithRetry(ctx, isbn)
+	if err == nil || errors.Is(err, ErrNotFound) {
+		c.mu.Lock()
+		c.cache[isbn] = cacheEntry{book: book, err: err, expires: time.Now().Add(c.TTL)}
+		c.mu.Unlock()
+	}
+	return book, err
+}
+
+// Errors worth another attempt: timeouts, dropped connections, and 5xx or
+// 429 answers.
+type retryableError struct{ err error }
+
+func (e retryableError) Error() string { return e.err.Error() }
+func (e retryableError) Unwrap() error { return e.err }
+
+func (c *Client) fetchWithRetry(ctx context.Context, isbn string) (Book, error) {
+	wait := c.Backoff
+	for attempt := 0; ; attempt++ {
+		book, err := c.fetch(ctx, isbn)
+		var retry retryableError
+		if err == nil || !errors.As(err, &retry) || attempt >= c.Retries {
+			return book, err
+		}
+		select {
+		case <-ctx.Done():
+			return Book{}, ctx.Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// The parts of the Open Library's books API answer we use, see
+// https://openlibrary.org/dev/docs/api/books.
+type apiBook struct {
+	Title   string `json:"title"`
+	Authors []struct {
+		Name string `json:"name"`
+	} `json:"authors"`
+	NumberOfPages int    `json:"number_of_pages"`
+	PublishDate   string `json:"publish_date"`
+}
+
+func (c *Client) fetch(ctx context.Context, isbn string) (Book, error) {
+	key := "ISBN:" + isbn
+	query := url.Values{"bibkeys": {key}, "format": {"json"}, "jscmd": {"data"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+"/api/books?"+query.Encode(), nil)
+	if err != nil {
+		return Book{}, err
+	}
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return Book{}, ctx.Err()
+		}
+		return Book{}, retryableError{err}
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests {
+		return Book{}, retryableError{fmt.Errorf("openlibrary: %s", res.Status)}
+	}
+	if res.StatusCode != http.StatusOK {
+		return Book{}, fmt.Errorf("openlibrary: %s", res.Status)
+	}
+
+	var answer map[string]apiBook
+	if err := json.NewDecoder(res.Body).Decode(&answer); err != nil {
+		return Book{}, fmt.Errorf("openlibrary: %w", err)
+	}
+	found, ok := answer[key]
+	if !ok {
+		return Book{}, ErrNotFound
+	}
+	book := Book{Title: found.Title, Pages: found.NumberOfPages, Year: parseYear(found.PublishDate)}
+	if len(found.Authors) > 0 {
+		book.Author = found.Authors[0].Name
+	}
+	return book, nil
+}
+
+var yearPattern = regexp.MustCompile(`\b\d{4}\b`)
+
+// Publish dates come in many shapes ("1818", "March 1, 2003", "2003-03");
+// the first four digit number in them is the year.
+func parseYear(date string) int {
+	year, _ := strconv.Atoi(yearPattern.FindString(date))
+	return year
+}